@@ -1,5 +1,10 @@
 module graid-tech-assignment
 
-go 1.23
+go 1.23.0
 
-require github.com/google/uuid v1.6.0
+require (
+	github.com/google/uuid v1.6.0
+	golang.org/x/crypto v0.40.0
+)
+
+require golang.org/x/sys v0.34.0 // indirect
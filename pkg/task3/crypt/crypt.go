@@ -0,0 +1,334 @@
+// Package crypt encrypts a RAID at rest. A Volume is a RAID whose data is
+// stored AES-XTS encrypted in fixed-size sectors on another RAID, so any level
+// can be encrypted transparently.
+//
+// The master key is random. It is kept in key slots in a header in front of
+// the data, each slot encrypted with a key derived from a passphrase or a key
+// file, so passphrases can be added and revoked without re-encrypting.
+//
+// Sectors whose ciphertext is all zeros read as zeros. That keeps unwritten
+// and discarded ranges reading as zeros, at the price of revealing which
+// sectors are unused, as discards do on other disk encryption systems.
+package crypt
+
+import (
+	"crypto/aes"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"graid-tech-assignment/pkg/task3/raid"
+	"io"
+	"os"
+	"sync"
+
+	"golang.org/x/crypto/xts"
+)
+
+// Options configure a new volume.
+type Options struct {
+	// SectorSize is the unit of encryption, 512 by default. It must be a
+	// multiple of 16 that divides HeaderSize.
+	SectorSize int
+	// KDF derives the key of the first key slot; DefaultKDF by default.
+	KDF *KDF
+}
+
+// Volume is the decrypted view of an encrypted RAID.
+type Volume struct {
+	mu         sync.Mutex
+	dev        raid.RAID
+	header     *header
+	masterKey  []byte
+	cipher     *xts.Cipher
+	sectorSize int
+}
+
+// Format writes a new header to dev and returns the volume, unlocked by key.
+// Whatever dev held before is lost.
+func Format(dev raid.RAID, key []byte, opts *Options) (*Volume, error) {
+	var o Options
+	if opts != nil {
+		o = *opts
+	}
+	if o.SectorSize == 0 {
+		o.SectorSize = 512
+	}
+	if o.SectorSize < 16 || o.SectorSize%16 != 0 || HeaderSize%o.SectorSize != 0 {
+		return nil, fmt.Errorf("crypt: invalid sector size %d", o.SectorSize)
+	}
+	kdf := DefaultKDF
+	if o.KDF != nil {
+		kdf = *o.KDF
+	}
+	if err := kdf.check(); err != nil {
+		return nil, err
+	}
+	size, err := deviceSize(dev)
+	if err != nil {
+		return nil, err
+	}
+	if size < HeaderSize {
+		return nil, fmt.Errorf("crypt: RAID of %d bytes is smaller than the header", size)
+	}
+	masterKey := make([]byte, masterKeySize)
+	if _, err := rand.Read(masterKey); err != nil {
+		return nil, err
+	}
+	h := newHeader(o.SectorSize)
+	if err := h.Slots[0].seal(masterKey, key, kdf); err != nil {
+		return nil, err
+	}
+	if err := writeHeader(dev, h); err != nil {
+		return nil, err
+	}
+	return newVolume(dev, h, masterKey)
+}
+
+// Open unlocks the volume on dev with a key that matches one of its slots.
+func Open(dev raid.RAID, key []byte) (*Volume, error) {
+	if _, err := deviceSize(dev); err != nil {
+		return nil, err
+	}
+	h, err := readHeader(dev)
+	if err != nil {
+		return nil, err
+	}
+	for i := range h.Slots {
+		if masterKey, ok := h.Slots[i].open(key); ok {
+			return newVolume(dev, h, masterKey)
+		}
+	}
+	return nil, ErrWrongKey
+}
+
+func newVolume(dev raid.RAID, h *header, masterKey []byte) (*Volume, error) {
+	c, err := xts.NewCipher(aes.NewCipher, masterKey)
+	if err != nil {
+		return nil, err
+	}
+	return &Volume{dev: dev, header: h, masterKey: masterKey, cipher: c, sectorSize: h.SectorSize}, nil
+}
+
+// ReadKeyFile reads a key file. Its whole contents are the key.
+func ReadKeyFile(path string) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	// Like LUKS, only the first 8 MiB count.
+	return io.ReadAll(io.LimitReader(f, 8<<20))
+}
+
+// AddKey seals the master key into a free slot with key and returns the
+// slot.
+func (v *Volume) AddKey(key []byte, kdf KDF) (int, error) {
+	if err := kdf.check(); err != nil {
+		return 0, err
+	}
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	for i := range v.header.Slots {
+		if v.header.Slots[i].Active {
+			continue
+		}
+		if err := v.header.Slots[i].seal(v.masterKey, key, kdf); err != nil {
+			return 0, err
+		}
+		if err := writeHeader(v.dev, v.header); err != nil {
+			v.header.Slots[i] = keySlot{}
+			return 0, err
+		}
+		return i, nil
+	}
+	return 0, ErrNoFreeSlot
+}
+
+// RemoveKey wipes a key slot. The last active slot cannot be removed, as
+// the data would become unreadable.
+func (v *Volume) RemoveKey(slot int) error {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if slot < 0 || slot >= len(v.header.Slots) || !v.header.Slots[slot].Active {
+		return fmt.Errorf("crypt: key slot %d is not in use", slot)
+	}
+	active := 0
+	for _, s := range v.header.Slots {
+		if s.Active {
+			active++
+		}
+	}
+	if active == 1 {
+		return errors.New("crypt: cannot remove the last key slot")
+	}
+	old := v.header.Slots[slot]
+	v.header.Slots[slot] = keySlot{}
+	if err := writeHeader(v.dev, v.header); err != nil {
+		v.header.Slots[slot] = old
+		return err
+	}
+	return nil
+}
+
+// Slots reports which key slots are in use.
+func (v *Volume) Slots() []bool {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	active := make([]bool, len(v.header.Slots))
+	for i, s := range v.header.Slots {
+		active[i] = s.Active
+	}
+	return active
+}
+
+// UUID identifies the volume.
+func (v *Volume) UUID() string {
+	return v.header.UUID
+}
+
+// Size is the usable size of the volume.
+func (v *Volume) Size() int64 {
+	size, _ := deviceSize(v.dev)
+	return max(size-HeaderSize, 0)
+}
+
+// deviceSize is the size of the RAID below. Format and Open refuse RAIDs
+// that do not know it, as the volume could not keep requests within itself.
+func deviceSize(dev raid.RAID) (int64, error) {
+	switch d := dev.(type) {
+	case raid.Array:
+		return d.Geometry().Size, nil
+	case interface{ Size() int64 }:
+		return d.Size(), nil
+	}
+	return 0, errors.New("crypt: the size of the RAID is unknown")
+}
+
+// checkRange rejects ranges outside the volume before they are shifted past
+// the header, where a negative position would land on the key slots.
+func (v *Volume) checkRange(pos, length int) error {
+	if pos < 0 || length < 0 {
+		return errNegativeRange
+	}
+	if size := v.Size(); int64(pos)+int64(length) > size {
+		return fmt.Errorf("crypt: %d bytes at %d exceed the volume of %d bytes", length, pos, size)
+	}
+	return nil
+}
+
+var errNegativeRange = errors.New("crypt: negative position or length")
+
+func (v *Volume) Read(length int, pos int) ([]byte, error) {
+	if err := v.checkRange(pos, length); err != nil {
+		return nil, err
+	}
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	first, buf, err := v.readSectors(pos, length)
+	if err != nil {
+		return nil, err
+	}
+	start := pos - first*v.sectorSize
+	return buf[start : start+length], nil
+}
+
+// Write encrypts whole sectors. Sectors that are only partly written are
+// read and decrypted first.
+func (v *Volume) Write(data []byte, pos int) error {
+	if err := v.checkRange(pos, len(data)); err != nil {
+		return err
+	}
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if len(data) == 0 {
+		return nil
+	}
+	var first int
+	var buf []byte
+	if pos%v.sectorSize == 0 && len(data)%v.sectorSize == 0 {
+		first, buf = pos/v.sectorSize, make([]byte, len(data))
+	} else {
+		var err error
+		if first, buf, err = v.readSectors(pos, len(data)); err != nil {
+			return err
+		}
+	}
+	copy(buf[pos-first*v.sectorSize:], data)
+	for s := 0; s*v.sectorSize < len(buf); s++ {
+		sector := buf[s*v.sectorSize : (s+1)*v.sectorSize]
+		v.cipher.Encrypt(sector, sector, uint64(first+s))
+	}
+	return v.dev.Write(buf, HeaderSize+first*v.sectorSize)
+}
+
+// Discard discards the whole sectors in the range on the RAID below, which
+// then read as zeros. The parts of sectors at either end are zeroed by a
+// write.
+func (v *Volume) Discard(pos, length int) error {
+	if err := v.checkRange(pos, length); err != nil {
+		return err
+	}
+	if length == 0 {
+		return nil
+	}
+	lo := (pos + v.sectorSize - 1) / v.sectorSize * v.sectorSize
+	hi := (pos + length) / v.sectorSize * v.sectorSize
+	if lo >= hi {
+		return v.Write(make([]byte, length), pos)
+	}
+	if lo > pos {
+		if err := v.Write(make([]byte, lo-pos), pos); err != nil {
+			return err
+		}
+	}
+	if pos+length > hi {
+		if err := v.Write(make([]byte, pos+length-hi), hi); err != nil {
+			return err
+		}
+	}
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	return v.dev.Discard(HeaderSize+lo, hi-lo)
+}
+
+func (v *Volume) ClearDisk(diskIndex int) {
+	v.dev.ClearDisk(diskIndex)
+}
+
+// Flush flushes the RAID below if it supports it.
+func (v *Volume) Flush() error {
+	if f, ok := v.dev.(interface{ Flush() error }); ok {
+		return f.Flush()
+	}
+	return nil
+}
+
+// readSectors reads and decrypts the sectors covering [pos, pos+length) and
+// returns the first of them and their contents.
+func (v *Volume) readSectors(pos, length int) (int, []byte, error) {
+	if pos < 0 || length < 0 {
+		return 0, nil, errNegativeRange
+	}
+	first := pos / v.sectorSize
+	last := (pos + length + v.sectorSize - 1) / v.sectorSize
+	buf, err := v.dev.Read((last-first)*v.sectorSize, HeaderSize+first*v.sectorSize)
+	if err != nil {
+		return 0, nil, err
+	}
+	for s := 0; s < last-first; s++ {
+		sector := buf[s*v.sectorSize : (s+1)*v.sectorSize]
+		if !allZero(sector) {
+			v.cipher.Decrypt(sector, sector, uint64(first+s))
+		}
+	}
+	return first, buf, nil
+}
+
+func allZero(b []byte) bool {
+	for _, c := range b {
+		if c != 0 {
+			return false
+		}
+	}
+	return true
+}
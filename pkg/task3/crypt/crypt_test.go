@@ -0,0 +1,178 @@
+package crypt
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"graid-tech-assignment/pkg/task3/raid"
+	"graid-tech-assignment/pkg/task3/raid/raidtest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// testKDF keeps the tests fast; it is far too weak for real passphrases.
+var testKDF = KDF{Time: 1, Memory: 64, Threads: 1}
+
+func newArray(t testing.TB) (raid.Array, []raid.Disk) {
+	t.Helper()
+	disks := make([]raid.Disk, 4)
+	for i := range disks {
+		disks[i] = raid.NewMemDisk(8192)
+	}
+	arr, err := raid.New(raid.Level5, disks, 512)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return arr, disks
+}
+
+func TestVolume(t *testing.T) {
+	arr, disks := newArray(t)
+	v, err := Format(arr, []byte("correct horse"), &Options{KDF: &testKDF})
+	if err != nil {
+		t.Fatalf("Format() error = %v", err)
+	}
+	if got, want := v.Size(), int64(3*8192-HeaderSize); got != want {
+		t.Errorf("Size() = %d, want %d", got, want)
+	}
+	secret := bytes.Repeat([]byte("top secret data "), 64)
+	if err := v.Write(secret, 1000); err != nil {
+		t.Fatal(err)
+	}
+	for i, d := range disks {
+		if bytes.Contains(d.(*raid.MemDisk).Bytes(), []byte("top secret")) {
+			t.Errorf("disk %d holds plaintext", i)
+		}
+	}
+
+	if _, err := Open(arr, []byte("wrong horse")); !errors.Is(err, ErrWrongKey) {
+		t.Errorf("Open() with a wrong key error = %v, want %v", err, ErrWrongKey)
+	}
+	v, err = Open(arr, []byte("correct horse"))
+	if err != nil {
+		t.Fatalf("Open() error = %v", err)
+	}
+	got, err := v.Read(len(secret)+20, 990)
+	if err != nil || !bytes.Equal(got[10:len(got)-10], secret) || !bytes.Equal(got[:10], make([]byte, 10)) {
+		t.Errorf("Read() after Open() = %v, contents match %v", err, bytes.Equal(got[10:len(got)-10], secret))
+	}
+
+	// A key file unlocks the volume in a second slot until it is removed.
+	keyFile := filepath.Join(t.TempDir(), "key")
+	if err := os.WriteFile(keyFile, []byte{0, 1, 2, 3, 255}, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	key, err := ReadKeyFile(keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	slot, err := v.AddKey(key, testKDF)
+	if err != nil || slot != 1 {
+		t.Fatalf("AddKey() = %d, %v", slot, err)
+	}
+	if _, err := Open(arr, key); err != nil {
+		t.Errorf("Open() with the key file error = %v", err)
+	}
+	if err := v.RemoveKey(0); err != nil {
+		t.Fatalf("RemoveKey(0) error = %v", err)
+	}
+	if _, err := Open(arr, []byte("correct horse")); !errors.Is(err, ErrWrongKey) {
+		t.Errorf("Open() with a removed key error = %v, want %v", err, ErrWrongKey)
+	}
+	if err := v.RemoveKey(1); err == nil {
+		t.Error("RemoveKey() of the last slot succeeded")
+	}
+
+	blank, _ := newArray(t)
+	if _, err := Open(blank, key); !errors.Is(err, ErrNoHeader) {
+		t.Errorf("Open() of an unformatted array error = %v, want %v", err, ErrNoHeader)
+	}
+}
+
+// TestOutOfRange checks that writes and discards outside the volume are
+// rejected instead of landing on the header.
+func TestOutOfRange(t *testing.T) {
+	arr, _ := newArray(t)
+	v, err := Format(arr, []byte("key"), &Options{KDF: &testKDF})
+	if err != nil {
+		t.Fatal(err)
+	}
+	size := int(v.Size())
+	for _, pos := range []int{-HeaderSize, -8192, -512, -1, size, size - 511} {
+		if err := v.Write(make([]byte, 512), pos); err == nil {
+			t.Errorf("Write(512 bytes, %d) succeeded", pos)
+		}
+		if err := v.Discard(pos, 512); err == nil {
+			t.Errorf("Discard(%d, 512) succeeded", pos)
+		}
+		if _, err := v.Read(512, pos); err == nil {
+			t.Errorf("Read(512, %d) succeeded", pos)
+		}
+	}
+	if _, err := Open(arr, []byte("key")); err != nil {
+		t.Errorf("Open() after writes out of range error = %v", err)
+	}
+}
+
+// TestKDFLimits checks that KDF parameters argon2 cannot run, or that would
+// make it allocate without bound, are refused, also from a header on disk.
+func TestKDFLimits(t *testing.T) {
+	bad := []KDF{{}, {Time: 1, Memory: 64}, {Memory: 64, Threads: 1}, {Time: 1, Memory: 1 << 30, Threads: 1}}
+	for _, kdf := range bad {
+		arr, _ := newArray(t)
+		if _, err := Format(arr, []byte("key"), &Options{KDF: &kdf}); err == nil {
+			t.Errorf("Format() with KDF %+v succeeded", kdf)
+		}
+	}
+
+	arr, _ := newArray(t)
+	v, err := Format(arr, []byte("key"), &Options{KDF: &testKDF})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, kdf := range bad {
+		if _, err := v.AddKey([]byte("other"), kdf); err == nil {
+			t.Errorf("AddKey() with KDF %+v succeeded", kdf)
+		}
+	}
+	v.header.Slots[0].KDF.Time = 0
+	if err := writeHeader(arr, v.header); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Open(arr, []byte("key")); !errors.Is(err, ErrNoHeader) {
+		t.Errorf("Open() of a header with a bad KDF error = %v, want %v", err, ErrNoHeader)
+	}
+}
+
+// TestUnsizedRAID checks that a RAID of unknown size is refused, as the
+// volume could not keep requests within it.
+func TestUnsizedRAID(t *testing.T) {
+	arr, _ := newArray(t)
+	unsized := struct{ raid.RAID }{arr}
+	if _, err := Format(unsized, []byte("key"), &Options{KDF: &testKDF}); err == nil {
+		t.Error("Format() of a RAID of unknown size succeeded")
+	}
+	if _, err := Format(arr, []byte("key"), &Options{KDF: &testKDF}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Open(unsized, []byte("key")); err == nil {
+		t.Error("Open() of a RAID of unknown size succeeded")
+	}
+}
+
+func TestConformance(t *testing.T) {
+	for _, sectorSize := range []int{512, 4096} {
+		t.Run(fmt.Sprint(sectorSize), func(t *testing.T) {
+			raidtest.Run(t, raidtest.Config{
+				New: func() (raid.RAID, error) {
+					arr, _ := newArray(t)
+					return Format(arr, []byte("key"), &Options{SectorSize: sectorSize, KDF: &testKDF})
+				},
+				Size:      3*8192 - HeaderSize,
+				NumDisks:  4,
+				Tolerance: 1,
+			})
+		})
+	}
+}
@@ -0,0 +1,196 @@
+package crypt
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"graid-tech-assignment/pkg/task3/raid"
+	"hash/crc32"
+
+	"github.com/google/uuid"
+	"golang.org/x/crypto/argon2"
+)
+
+// An encrypted volume starts with a header that describes the cipher and
+// holds up to NumKeySlots copies of the master key, each encrypted with a key
+// derived from a different passphrase. Encrypted data follows it.
+//
+// Layout: magic (8 bytes), payload length (uint32), CRC32 of the payload
+// (uint32), then the JSON encoded payload.
+const (
+	headerMagic = "GRAIDCR1"
+	headerHdr   = 16
+)
+
+// HeaderSize is how much of the array the header takes up.
+const HeaderSize = 8192
+
+const NumKeySlots = 8
+
+// masterKeySize is the size of an AES-256-XTS key: two AES-256 keys.
+const masterKeySize = 64
+
+var (
+	ErrNoHeader   = errors.New("no valid encryption header")
+	ErrWrongKey   = errors.New("no key slot matches the key")
+	ErrNoFreeSlot = errors.New("all key slots are in use")
+)
+
+// KDF are the Argon2id parameters used to derive a key slot's key from a
+// passphrase.
+type KDF struct {
+	Time    uint32 `json:"time"`
+	Memory  uint32 `json:"memory"` // KiB
+	Threads uint8  `json:"threads"`
+}
+
+// DefaultKDF follows the recommendation of RFC 9106 for memory-constrained
+// environments.
+var DefaultKDF = KDF{Time: 3, Memory: 64 * 1024, Threads: 4}
+
+// The most work a key slot may ask for. Headers are read before any key is
+// checked, so a corrupt or hostile one must not make Open allocate or spin
+// without bound.
+const (
+	maxKDFTime   = 100
+	maxKDFMemory = 4 << 20 // 4 GiB
+)
+
+func (k KDF) check() error {
+	switch {
+	case k.Time < 1 || k.Time > maxKDFTime:
+		return fmt.Errorf("crypt: KDF time %d is not between 1 and %d", k.Time, maxKDFTime)
+	case k.Threads < 1:
+		return errors.New("crypt: KDF needs at least one thread")
+	case k.Memory > maxKDFMemory:
+		return fmt.Errorf("crypt: KDF memory of %d KiB is above %d KiB", k.Memory, maxKDFMemory)
+	}
+	return nil
+}
+
+type header struct {
+	UUID       string    `json:"uuid"`
+	Cipher     string    `json:"cipher"`
+	SectorSize int       `json:"sector_size"`
+	Slots      []keySlot `json:"slots"`
+}
+
+// keySlot is the master key sealed with AES-GCM under a key derived from a
+// passphrase. An inactive slot is empty.
+type keySlot struct {
+	Active bool   `json:"active"`
+	KDF    KDF    `json:"kdf"`
+	Salt   []byte `json:"salt,omitempty"`
+	Nonce  []byte `json:"nonce,omitempty"`
+	Key    []byte `json:"key,omitempty"`
+}
+
+func slotCipher(passphrase []byte, salt []byte, kdf KDF) (cipher.AEAD, error) {
+	key := argon2.IDKey(passphrase, salt, kdf.Time, kdf.Memory, kdf.Threads, 32)
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// seal stores masterKey in the slot, protected by passphrase.
+func (s *keySlot) seal(masterKey, passphrase []byte, kdf KDF) error {
+	salt := make([]byte, 32)
+	if _, err := rand.Read(salt); err != nil {
+		return err
+	}
+	aead, err := slotCipher(passphrase, salt, kdf)
+	if err != nil {
+		return err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+	*s = keySlot{Active: true, KDF: kdf, Salt: salt, Nonce: nonce, Key: aead.Seal(nil, nonce, masterKey, nil)}
+	return nil
+}
+
+// open returns the master key if passphrase unlocks the slot.
+func (s *keySlot) open(passphrase []byte) ([]byte, bool) {
+	if !s.Active {
+		return nil, false
+	}
+	aead, err := slotCipher(passphrase, s.Salt, s.KDF)
+	if err != nil || len(s.Nonce) != aead.NonceSize() {
+		return nil, false
+	}
+	key, err := aead.Open(nil, s.Nonce, s.Key, nil)
+	return key, err == nil && len(key) == masterKeySize
+}
+
+func newHeader(sectorSize int) *header {
+	return &header{
+		UUID:       uuid.NewString(),
+		Cipher:     "aes-xts-plain64",
+		SectorSize: sectorSize,
+		Slots:      make([]keySlot, NumKeySlots),
+	}
+}
+
+func writeHeader(dev raid.RAID, h *header) error {
+	payload, err := json.Marshal(h)
+	if err != nil {
+		return err
+	}
+	if len(payload) > HeaderSize-headerHdr {
+		return fmt.Errorf("header of %d bytes does not fit", len(payload))
+	}
+	buf := make([]byte, HeaderSize)
+	copy(buf, headerMagic)
+	binary.LittleEndian.PutUint32(buf[8:], uint32(len(payload)))
+	binary.LittleEndian.PutUint32(buf[12:], crc32.ChecksumIEEE(payload))
+	copy(buf[headerHdr:], payload)
+	return dev.Write(buf, 0)
+}
+
+func readHeader(dev raid.RAID) (*header, error) {
+	buf, err := dev.Read(HeaderSize, 0)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(buf[:8], []byte(headerMagic)) {
+		return nil, ErrNoHeader
+	}
+	n := binary.LittleEndian.Uint32(buf[8:])
+	if n > HeaderSize-headerHdr {
+		return nil, fmt.Errorf("%w: bad length %d", ErrNoHeader, n)
+	}
+	payload := buf[headerHdr : headerHdr+n]
+	if crc32.ChecksumIEEE(payload) != binary.LittleEndian.Uint32(buf[12:]) {
+		return nil, fmt.Errorf("%w: checksum mismatch", ErrNoHeader)
+	}
+	var h header
+	if err := json.Unmarshal(payload, &h); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrNoHeader, err)
+	}
+	if h.Cipher != "aes-xts-plain64" {
+		return nil, fmt.Errorf("unsupported cipher %q", h.Cipher)
+	}
+	if h.SectorSize < 16 || h.SectorSize%16 != 0 || HeaderSize%h.SectorSize != 0 {
+		return nil, fmt.Errorf("%w: bad sector size %d", ErrNoHeader, h.SectorSize)
+	}
+	for i, s := range h.Slots {
+		if !s.Active {
+			continue
+		}
+		if err := s.KDF.check(); err != nil {
+			return nil, fmt.Errorf("%w: key slot %d: %v", ErrNoHeader, i, err)
+		}
+	}
+	for len(h.Slots) < NumKeySlots {
+		h.Slots = append(h.Slots, keySlot{})
+	}
+	return &h, nil
+}
@@ -0,0 +1,661 @@
+// Package httpapi exposes RAID arrays over HTTP/JSON:
+//
+//	GET    /arrays                              list arrays
+//	POST   /arrays                              create an array
+//	GET    /arrays/{name}                       array and member state, rebuild progress
+//	POST   /arrays/{name}/disks/{disk}/fail     fail a member
+//	POST   /arrays/{name}/disks/{disk}/replace  replace a failed member and rebuild it
+//	POST   /arrays/{name}/scrub[?repair=true]   check (and repair) the redundancy
+//	GET    /arrays/{name}/events[?since=N]      recent events, after sequence number N
+//	GET    /arrays/{name}/data                  read data, honouring a Range header
+//	PUT    /arrays/{name}/data[?offset=N]       write the request body
+package httpapi
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"graid-tech-assignment/pkg/task3/raid"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DiskFactory provides the disk for slot index of an array, both when the
+// array is created and when a member is replaced.
+type DiskFactory func(array string, index int, size int64) (raid.Disk, error)
+
+// MemDisks is a DiskFactory for arrays that live in memory.
+func MemDisks(array string, index int, size int64) (raid.Disk, error) {
+	return raid.NewMemDisk(size), nil
+}
+
+// maxBody bounds the size of a single PUT.
+const maxBody = 64 << 20
+
+// Limits bound the arrays that POST /arrays creates, so that a request cannot
+// take arbitrary memory or disk space.
+type Limits struct {
+	Disks      int
+	DiskSize   int64
+	StripeSize int
+	// Arrays bounds the number of arrays served, and TotalSize the members
+	// of the arrays created over HTTP taken together.
+	Arrays    int
+	TotalSize int64
+}
+
+// DefaultLimits are the limits NewServer sets.
+var DefaultLimits = Limits{Disks: 64, DiskSize: 1 << 30, StripeSize: 16 << 20, Arrays: 16, TotalSize: 4 << 30}
+
+type Server struct {
+	// Limits may be changed before the server is used.
+	Limits Limits
+
+	mu     sync.Mutex
+	arrays map[string]*entry
+	// creating holds the names of the arrays whose members are being made,
+	// with their size.
+	creating map[string]int64
+	newDisk  DiskFactory
+	mux      *http.ServeMux
+	// ctx is done once the server is closed, which stops background
+	// rebuilds.
+	ctx      context.Context
+	close    context.CancelFunc
+	rebuilds sync.WaitGroup
+}
+
+type entry struct {
+	arr raid.Array
+	// size is the size of the members, if the array was created over HTTP.
+	size int64
+	// rebuilding holds the members being replaced or rebuilt in the
+	// background.
+	rebuilding map[int]bool
+	// rebuildErr is the outcome of the last background rebuild.
+	rebuildErr error
+}
+
+func NewServer(newDisk DiskFactory) *Server {
+	s := &Server{
+		Limits:   DefaultLimits,
+		arrays:   make(map[string]*entry),
+		creating: make(map[string]int64),
+		newDisk:  newDisk,
+		mux:      http.NewServeMux(),
+	}
+	s.ctx, s.close = context.WithCancel(context.Background())
+	s.mux.HandleFunc("GET /arrays", s.list)
+	s.mux.HandleFunc("POST /arrays", s.create)
+	s.mux.HandleFunc("GET /arrays/{name}", s.get)
+	s.mux.HandleFunc("POST /arrays/{name}/disks/{disk}/fail", s.fail)
+	s.mux.HandleFunc("POST /arrays/{name}/disks/{disk}/replace", s.replace)
+	s.mux.HandleFunc("POST /arrays/{name}/scrub", s.scrub)
+	s.mux.HandleFunc("GET /arrays/{name}/events", s.events)
+	s.mux.HandleFunc("GET /arrays/{name}/data", s.read)
+	s.mux.HandleFunc("PUT /arrays/{name}/data", s.write)
+	return s
+}
+
+// Add serves an existing array under name.
+func (s *Server) Add(name string, arr raid.Array) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.taken(name); err != nil {
+		return err
+	}
+	s.arrays[name] = &entry{arr: arr}
+	return nil
+}
+
+// Close stops the background rebuilds and waits for them to return. The
+// members being rebuilt stay rebuilding with the progress they made.
+func (s *Server) Close() {
+	s.close()
+	s.rebuilds.Wait()
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mux.ServeHTTP(w, r)
+}
+
+type createRequest struct {
+	Name       string `json:"name"`
+	Level      string `json:"level"`
+	Disks      int    `json:"disks"`
+	StripeSize int    `json:"stripe_size"`
+	// DiskSize is the usable size of every member.
+	DiskSize int64 `json:"disk_size"`
+}
+
+type arrayJSON struct {
+	Name       string       `json:"name"`
+	UUID       string       `json:"uuid,omitempty"`
+	Level      string       `json:"level"`
+	StripeSize int          `json:"stripe_size,omitempty"`
+	Size       int64        `json:"size"`
+	State      string       `json:"state"`
+	RebuildErr string       `json:"rebuild_error,omitempty"`
+	Members    []memberJSON `json:"members,omitempty"`
+}
+
+type memberJSON struct {
+	Index     int     `json:"index"`
+	Name      string  `json:"name,omitempty"`
+	State     string  `json:"state"`
+	Size      int64   `json:"size"`
+	Recovered int64   `json:"recovered,omitempty"`
+	Progress  float64 `json:"progress,omitempty"`
+	BadBlocks int     `json:"bad_blocks,omitempty"`
+	Remapped  int     `json:"remapped,omitempty"`
+}
+
+type scrubJSON struct {
+	Checked    int64 `json:"checked"`
+	Mismatches int   `json:"mismatches"`
+	Repaired   int   `json:"repaired"`
+}
+
+type eventJSON struct {
+	Seq        uint64    `json:"seq"`
+	Time       time.Time `json:"time"`
+	Kind       string    `json:"kind"`
+	Disk       *int      `json:"disk,omitempty"`
+	Offset     int64     `json:"offset,omitempty"`
+	Done       int64     `json:"done,omitempty"`
+	Total      int64     `json:"total,omitempty"`
+	Mismatches int       `json:"mismatches,omitempty"`
+	Remapped   bool      `json:"remapped,omitempty"`
+	Error      string    `json:"error,omitempty"`
+}
+
+func toJSON(name string, e *entry, withMembers bool) arrayJSON {
+	st := e.arr.Status()
+	a := arrayJSON{
+		Name:       name,
+		UUID:       st.UUID,
+		Level:      st.Level.String(),
+		StripeSize: st.StripeSize,
+		Size:       st.Size,
+		State:      "clean",
+	}
+	if e.rebuildErr != nil {
+		a.RebuildErr = e.rebuildErr.Error()
+	}
+	for _, m := range st.Members {
+		switch {
+		case m.State == raid.DiskRebuilding:
+			a.State = "rebuilding"
+		case m.State != raid.DiskActive && a.State == "clean":
+			a.State = "degraded"
+		}
+		if !withMembers {
+			continue
+		}
+		mj := memberJSON{
+			Index: m.Index, Name: m.Name, State: m.State.String(), Size: m.Size,
+			BadBlocks: m.BadBlocks, Remapped: m.Remapped,
+		}
+		if m.State == raid.DiskRebuilding {
+			mj.Recovered = m.Recovered
+			if m.Size > 0 {
+				mj.Progress = float64(m.Recovered) / float64(m.Size)
+			}
+		}
+		a.Members = append(a.Members, mj)
+	}
+	return a
+}
+
+func (s *Server) list(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	names := make([]string, 0, len(s.arrays))
+	for name := range s.arrays {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	out := make([]arrayJSON, 0, len(names))
+	for _, name := range names {
+		out = append(out, toJSON(name, s.arrays[name], false))
+	}
+	s.mu.Unlock()
+	writeJSON(w, http.StatusOK, out)
+}
+
+func (s *Server) create(w http.ResponseWriter, r *http.Request) {
+	var req createRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if err := checkName(req.Name); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	level, err := raid.ParseLevel(req.Level)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if err := s.Limits.check(req); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	// The name and the space are reserved while the members are made, which
+	// may take a while, without holding the lock.
+	size := int64(req.Disks) * req.DiskSize
+	s.mu.Lock()
+	if err := s.taken(req.Name); err != nil {
+		s.mu.Unlock()
+		writeError(w, http.StatusConflict, err)
+		return
+	}
+	if err := s.reserve(size); err != nil {
+		s.mu.Unlock()
+		writeError(w, http.StatusInsufficientStorage, err)
+		return
+	}
+	s.creating[req.Name] = size
+	s.mu.Unlock()
+
+	arr, status, err := s.build(req, level)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.creating, req.Name)
+	if err != nil {
+		writeError(w, status, err)
+		return
+	}
+	e := &entry{arr: arr, size: size}
+	s.arrays[req.Name] = e
+	writeJSON(w, http.StatusCreated, toJSON(req.Name, e, true))
+}
+
+// build makes the members of a new array and creates it. If that fails, the
+// members made are released, and the status to answer with is returned.
+func (s *Server) build(req createRequest, level raid.Level) (raid.Array, int, error) {
+	var disks []raid.Disk
+	for i := range req.Disks {
+		d, err := s.newDisk(req.Name, i, raid.DiskSize(req.DiskSize))
+		if err != nil {
+			release(disks...)
+			return nil, http.StatusInternalServerError, err
+		}
+		disks = append(disks, d)
+	}
+	arr, err := raid.Create(level, disks, req.StripeSize)
+	if err != nil {
+		release(disks...)
+		return nil, http.StatusBadRequest, err
+	}
+	return arr, 0, nil
+}
+
+// release disposes of disks the factory made that no array holds: file disks
+// are removed, other disks closed if they can be.
+func release(disks ...raid.Disk) {
+	for _, d := range disks {
+		switch d := d.(type) {
+		case interface{ Remove() error }:
+			if err := d.Remove(); err != nil {
+				log.Printf("httpapi: %v", err)
+			}
+		case io.Closer:
+			d.Close()
+		}
+	}
+}
+
+// taken reports whether an array named name is served or being created.
+// s.mu must be held.
+func (s *Server) taken(name string) error {
+	if _, ok := s.arrays[name]; ok {
+		return fmt.Errorf("array %q already exists", name)
+	}
+	if _, ok := s.creating[name]; ok {
+		return fmt.Errorf("array %q already exists", name)
+	}
+	return nil
+}
+
+// reserve checks that another array of size bytes fits within the limits on
+// all arrays. s.mu must be held.
+func (s *Server) reserve(size int64) error {
+	if len(s.arrays)+len(s.creating) >= s.Limits.Arrays {
+		return fmt.Errorf("at most %d arrays can be served", s.Limits.Arrays)
+	}
+	total := size
+	for _, e := range s.arrays {
+		total += e.size
+	}
+	for _, n := range s.creating {
+		total += n
+	}
+	if total > s.Limits.TotalSize {
+		return fmt.Errorf("the arrays would take %d bytes, more than the limit of %d", total, s.Limits.TotalSize)
+	}
+	return nil
+}
+
+// checkName accepts the names LVM does, which are safe in paths and URLs.
+func checkName(name string) error {
+	if name == "" || len(name) > 128 || name == "." || name == ".." || name[0] == '-' {
+		return fmt.Errorf("invalid array name %q", name)
+	}
+	for _, c := range name {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case c == '_', c == '.', c == '+', c == '-':
+		default:
+			return fmt.Errorf("invalid array name %q", name)
+		}
+	}
+	return nil
+}
+
+// check rejects sizes that are not positive or above the limits.
+func (l Limits) check(req createRequest) error {
+	switch {
+	case req.Disks < 1 || req.Disks > l.Disks:
+		return fmt.Errorf("disks must be between 1 and %d", l.Disks)
+	case req.DiskSize < 1 || req.DiskSize > l.DiskSize:
+		return fmt.Errorf("disk_size must be between 1 and %d", l.DiskSize)
+	case req.StripeSize < 1 || req.StripeSize > l.StripeSize:
+		return fmt.Errorf("stripe_size must be between 1 and %d", l.StripeSize)
+	}
+	return nil
+}
+
+// lookup finds the array named in the path, or answers 404.
+func (s *Server) lookup(w http.ResponseWriter, r *http.Request) (string, *entry) {
+	name := r.PathValue("name")
+	s.mu.Lock()
+	e, ok := s.arrays[name]
+	s.mu.Unlock()
+	if !ok {
+		writeError(w, http.StatusNotFound, fmt.Errorf("array %q not found", name))
+		return name, nil
+	}
+	return name, e
+}
+
+func (s *Server) get(w http.ResponseWriter, r *http.Request) {
+	name, e := s.lookup(w, r)
+	if e == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	writeJSON(w, http.StatusOK, toJSON(name, e, true))
+}
+
+func (s *Server) fail(w http.ResponseWriter, r *http.Request) {
+	name, e := s.lookup(w, r)
+	if e == nil {
+		return
+	}
+	disk, err := strconv.Atoi(r.PathValue("disk"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if err := e.arr.Fail(disk); err != nil {
+		writeError(w, statusFor(err), err)
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	writeJSON(w, http.StatusOK, toJSON(name, e, true))
+}
+
+// replace swaps in a new disk and rebuilds it in the background; progress is
+// reported by GET /arrays/{name}.
+func (s *Server) replace(w http.ResponseWriter, r *http.Request) {
+	name, e := s.lookup(w, r)
+	if e == nil {
+		return
+	}
+	disk, err := strconv.Atoi(r.PathValue("disk"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	// The member is claimed under the lock, so that concurrent requests
+	// cannot both replace it and start two rebuilds.
+	s.mu.Lock()
+	st := e.arr.Status()
+	if disk < 0 || disk >= len(st.Members) {
+		s.mu.Unlock()
+		writeError(w, http.StatusBadRequest, fmt.Errorf("%w: %d", raid.ErrInvalidDisk, disk))
+		return
+	}
+	if st.Members[disk].State == raid.DiskRebuilding || e.rebuilding[disk] {
+		s.mu.Unlock()
+		writeError(w, http.StatusConflict, fmt.Errorf("disk %d is already rebuilding", disk))
+		return
+	}
+	if e.rebuilding == nil {
+		e.rebuilding = make(map[int]bool)
+	}
+	e.rebuilding[disk] = true
+	s.mu.Unlock()
+	unclaim := func() {
+		s.mu.Lock()
+		delete(e.rebuilding, disk)
+		s.mu.Unlock()
+	}
+
+	newDisk, err := s.newDisk(name, disk, raid.DiskSize(st.Members[disk].Size))
+	if err != nil {
+		unclaim()
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if err := e.arr.Replace(disk, newDisk); err != nil {
+		release(newDisk)
+		unclaim()
+		writeError(w, statusFor(err), err)
+		return
+	}
+
+	s.mu.Lock()
+	e.rebuildErr = nil
+	s.mu.Unlock()
+	s.rebuilds.Add(1)
+	go func() {
+		defer s.rebuilds.Done()
+		err := e.arr.RebuildContext(s.ctx, disk)
+		if err != nil {
+			log.Printf("httpapi: rebuild of %s disk %d: %v", name, disk, err)
+		}
+		s.mu.Lock()
+		delete(e.rebuilding, disk)
+		e.rebuildErr = err
+		s.mu.Unlock()
+	}()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	writeJSON(w, http.StatusAccepted, toJSON(name, e, true))
+}
+
+func (s *Server) scrub(w http.ResponseWriter, r *http.Request) {
+	_, e := s.lookup(w, r)
+	if e == nil {
+		return
+	}
+	repair := r.URL.Query().Get("repair") == "true"
+	report, err := e.arr.ScrubContext(r.Context(), repair)
+	if err != nil {
+		status := http.StatusConflict
+		var progress *raid.ProgressError
+		if errors.As(err, &progress) {
+			status = statusFor(err)
+		}
+		writeError(w, status, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, scrubJSON{report.Checked, report.Mismatches, report.Repaired})
+}
+
+// events answers the events the array remembers, oldest first. Clients poll
+// with since set to the last sequence number they saw.
+func (s *Server) events(w http.ResponseWriter, r *http.Request) {
+	_, e := s.lookup(w, r)
+	if e == nil {
+		return
+	}
+	var since uint64
+	if v := r.URL.Query().Get("since"); v != "" {
+		var err error
+		if since, err = strconv.ParseUint(v, 10, 64); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+	}
+	out := []eventJSON{}
+	for _, ev := range e.arr.Events().History() {
+		if ev.Seq <= since {
+			continue
+		}
+		ej := eventJSON{
+			Seq: ev.Seq, Time: ev.Time, Kind: ev.Kind.String(), Offset: ev.Offset,
+			Done: ev.Done, Total: ev.Total, Mismatches: ev.Mismatches, Remapped: ev.Remapped,
+		}
+		if ev.Disk >= 0 {
+			ej.Disk = &ev.Disk
+		}
+		if ev.Err != nil {
+			ej.Error = ev.Err.Error()
+		}
+		out = append(out, ej)
+	}
+	writeJSON(w, http.StatusOK, out)
+}
+
+func (s *Server) read(w http.ResponseWriter, r *http.Request) {
+	_, e := s.lookup(w, r)
+	if e == nil {
+		return
+	}
+	size := e.arr.Status().Size
+	start, end := int64(0), size
+	status := http.StatusOK
+	if rng := r.Header.Get("Range"); rng != "" {
+		var err error
+		if start, end, err = parseRange(rng, size); err != nil {
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", size))
+			writeError(w, http.StatusRequestedRangeNotSatisfiable, err)
+			return
+		}
+		status = http.StatusPartialContent
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end-1, size))
+	}
+	if end-start > maxBody {
+		writeError(w, http.StatusRequestEntityTooLarge, fmt.Errorf("read at most %d bytes at a time", maxBody))
+		return
+	}
+	data, err := raid.ReadContext(r.Context(), e.arr, int(end-start), int(start))
+	if err != nil {
+		writeError(w, statusFor(err), err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Accept-Ranges", "bytes")
+	w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	w.WriteHeader(status)
+	w.Write(data)
+}
+
+func (s *Server) write(w http.ResponseWriter, r *http.Request) {
+	_, e := s.lookup(w, r)
+	if e == nil {
+		return
+	}
+	offset := int64(0)
+	if v := r.URL.Query().Get("offset"); v != "" {
+		var err error
+		if offset, err = strconv.ParseInt(v, 10, 64); err != nil || offset < 0 {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid offset %q", v))
+			return
+		}
+	}
+	data, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxBody))
+	if err != nil {
+		writeError(w, http.StatusRequestEntityTooLarge, err)
+		return
+	}
+	if size := e.arr.Status().Size; offset+int64(len(data)) > size {
+		writeError(w, http.StatusRequestedRangeNotSatisfiable,
+			fmt.Errorf("write of %d bytes at %d exceeds the array size %d", len(data), offset, size))
+		return
+	}
+	if err := raid.WriteContext(r.Context(), e.arr, data, int(offset)); err != nil {
+		writeError(w, statusFor(err), err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// parseRange parses a single "bytes=a-b", "bytes=a-" or "bytes=-n" range into
+// the half-open interval [start, end).
+func parseRange(header string, size int64) (int64, int64, error) {
+	var first, last string
+	spec, ok := strings.CutPrefix(header, "bytes=")
+	if ok {
+		first, last, ok = strings.Cut(spec, "-")
+	}
+	if !ok {
+		return 0, 0, fmt.Errorf("unsupported range %q", header)
+	}
+	if first == "" {
+		n, err := strconv.ParseInt(last, 10, 64)
+		if err != nil || n <= 0 {
+			return 0, 0, fmt.Errorf("invalid range %q", header)
+		}
+		return max(size-n, 0), size, nil
+	}
+	start, err := strconv.ParseInt(first, 10, 64)
+	if err != nil || start >= size {
+		return 0, 0, fmt.Errorf("invalid range %q", header)
+	}
+	end := size
+	if last != "" {
+		l, err := strconv.ParseInt(last, 10, 64)
+		if err != nil || l < start {
+			return 0, 0, fmt.Errorf("invalid range %q", header)
+		}
+		end = min(l+1, size)
+	}
+	return start, end, nil
+}
+
+func statusFor(err error) int {
+	switch {
+	case errors.Is(err, raid.ErrInvalidDisk):
+		return http.StatusBadRequest
+	case errors.Is(err, raid.ErrDiskInSync):
+		return http.StatusConflict
+	case errors.Is(err, context.Canceled), errors.Is(err, context.DeadlineExceeded):
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusInternalServerError
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
@@ -0,0 +1,246 @@
+package httpapi
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"graid-tech-assignment/pkg/task3/raid"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func do(t *testing.T, method, url, body string, header http.Header) (*http.Response, []byte) {
+	t.Helper()
+	req, err := http.NewRequest(method, url, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	out, _ := io.ReadAll(resp.Body)
+	return resp, out
+}
+
+func TestServer(t *testing.T) {
+	ts := httptest.NewServer(NewServer(MemDisks))
+	defer ts.Close()
+
+	resp, body := do(t, "POST", ts.URL+"/arrays",
+		`{"name":"a","level":"raid5","disks":3,"stripe_size":16,"disk_size":4096}`, nil)
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("POST /arrays = %d %s", resp.StatusCode, body)
+	}
+	if resp, _ := do(t, "POST", ts.URL+"/arrays", `{"name":"a","level":"5","disks":3,"stripe_size":16,"disk_size":4096}`, nil); resp.StatusCode != http.StatusConflict {
+		t.Errorf("POST /arrays twice = %d, want %d", resp.StatusCode, http.StatusConflict)
+	}
+
+	data := strings.Repeat("0123456789abcdef", 8)
+	if resp, body := do(t, "PUT", ts.URL+"/arrays/a/data?offset=32", data, nil); resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("PUT data = %d %s", resp.StatusCode, body)
+	}
+	if resp, body := do(t, "POST", ts.URL+"/arrays/a/disks/1/fail", "", nil); resp.StatusCode != http.StatusOK {
+		t.Fatalf("fail = %d %s", resp.StatusCode, body)
+	}
+
+	tests := []struct {
+		name   string
+		rng    string
+		status int
+		want   string
+	}{
+		{name: "first bytes", rng: "bytes=32-47", status: http.StatusPartialContent, want: data[:16]},
+		{name: "open ended", rng: "bytes=150-", status: http.StatusPartialContent, want: data[118:] + strings.Repeat("\x00", 8192-160)},
+		{name: "suffix", rng: "bytes=-4", status: http.StatusPartialContent, want: "\x00\x00\x00\x00"},
+		{name: "past the end", rng: "bytes=9000-9001", status: http.StatusRequestedRangeNotSatisfiable},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, body := do(t, "GET", ts.URL+"/arrays/a/data", "", http.Header{"Range": {tt.rng}})
+			if resp.StatusCode != tt.status {
+				t.Fatalf("GET data %s = %d %s", tt.rng, resp.StatusCode, body)
+			}
+			if tt.want != "" && !bytes.Equal(body, []byte(tt.want)) {
+				t.Errorf("GET data %s = %q, want %q", tt.rng, body, tt.want)
+			}
+		})
+	}
+
+	if resp, body := do(t, "POST", ts.URL+"/arrays/a/disks/1/replace", "", nil); resp.StatusCode != http.StatusAccepted {
+		t.Fatalf("replace = %d %s", resp.StatusCode, body)
+	}
+	var st arrayJSON
+	for deadline := time.Now().Add(5 * time.Second); ; {
+		_, body := do(t, "GET", ts.URL+"/arrays/a", "", nil)
+		if err := json.Unmarshal(body, &st); err != nil {
+			t.Fatal(err)
+		}
+		if st.State == "clean" || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if st.State != "clean" || st.RebuildErr != "" {
+		t.Fatalf("array after rebuild = %+v", st)
+	}
+
+	resp, body = do(t, "POST", ts.URL+"/arrays/a/scrub", "", nil)
+	var report scrubJSON
+	if err := json.Unmarshal(body, &report); err != nil || resp.StatusCode != http.StatusOK || report.Mismatches != 0 {
+		t.Errorf("scrub = %d %s", resp.StatusCode, body)
+	}
+
+	var events []eventJSON
+	_, body = do(t, "GET", ts.URL+"/arrays/a/events", "", nil)
+	if err := json.Unmarshal(body, &events); err != nil {
+		t.Fatal(err)
+	}
+	var kinds []string
+	for _, ev := range events {
+		if ev.Kind != "rebuild-progress" {
+			kinds = append(kinds, ev.Kind)
+		}
+	}
+	if got, want := strings.Join(kinds, " "), "member-failed degraded member-replaced rebuild-started rebuild-finished clean scrub-finished"; got != want {
+		t.Errorf("GET events = %s, want kinds %s", got, want)
+	}
+	_, body = do(t, "GET", fmt.Sprintf("%s/arrays/a/events?since=%d", ts.URL, events[len(events)-2].Seq), "", nil)
+	if err := json.Unmarshal(body, &events); err != nil || len(events) != 1 || events[0].Kind != "scrub-finished" {
+		t.Errorf("GET events since the last but one = %s", body)
+	}
+
+	var list []arrayJSON
+	_, body = do(t, "GET", ts.URL+"/arrays", "", nil)
+	if err := json.Unmarshal(body, &list); err != nil || len(list) != 1 || list[0].Name != "a" {
+		t.Errorf("GET /arrays = %s", body)
+	}
+	if resp, _ := do(t, "GET", ts.URL+"/arrays/missing", "", nil); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("GET missing array = %d, want %d", resp.StatusCode, http.StatusNotFound)
+	}
+}
+
+func TestCreateLimits(t *testing.T) {
+	srv := NewServer(MemDisks)
+	srv.Limits = Limits{Disks: 8, DiskSize: 1 << 20, StripeSize: 4096, Arrays: 2, TotalSize: 12 << 20}
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+
+	for _, body := range []string{
+		`{"name":"a","level":"raid5","disks":-1,"stripe_size":16,"disk_size":4096}`,
+		`{"name":"a","level":"raid5","disks":0,"stripe_size":16,"disk_size":4096}`,
+		`{"name":"a","level":"raid5","disks":9,"stripe_size":16,"disk_size":4096}`,
+		`{"name":"a","level":"raid5","disks":3,"stripe_size":16,"disk_size":-4096}`,
+		`{"name":"a","level":"raid5","disks":3,"stripe_size":16,"disk_size":9223372036854775807}`,
+		`{"name":"a","level":"raid5","disks":3,"stripe_size":-16,"disk_size":4096}`,
+		`{"name":"a","level":"raid5","disks":3,"stripe_size":8192,"disk_size":4096}`,
+		`{"name":"","level":"raid5","disks":3,"stripe_size":16,"disk_size":4096}`,
+		`{"name":"../../x","level":"raid5","disks":3,"stripe_size":16,"disk_size":4096}`,
+		`{"name":"a/b","level":"raid5","disks":3,"stripe_size":16,"disk_size":4096}`,
+		`{"name":"-a","level":"raid5","disks":3,"stripe_size":16,"disk_size":4096}`,
+	} {
+		if resp, out := do(t, "POST", ts.URL+"/arrays", body, nil); resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("POST /arrays %s = %d %s, want %d", body, resp.StatusCode, out, http.StatusBadRequest)
+		}
+	}
+	if resp, out := do(t, "POST", ts.URL+"/arrays", `{"name":"a","level":"raid5","disks":8,"stripe_size":4096,"disk_size":1048576}`, nil); resp.StatusCode != http.StatusCreated {
+		t.Errorf("POST /arrays at the limits = %d %s", resp.StatusCode, out)
+	}
+	if resp, out := do(t, "POST", ts.URL+"/arrays", `{"name":"b","level":"raid5","disks":5,"stripe_size":4096,"disk_size":1048576}`, nil); resp.StatusCode != http.StatusInsufficientStorage {
+		t.Errorf("POST /arrays past the total size = %d %s, want %d", resp.StatusCode, out, http.StatusInsufficientStorage)
+	}
+	if resp, out := do(t, "POST", ts.URL+"/arrays", `{"name":"b","level":"raid5","disks":4,"stripe_size":4096,"disk_size":1048576}`, nil); resp.StatusCode != http.StatusCreated {
+		t.Errorf("POST /arrays up to the total size = %d %s", resp.StatusCode, out)
+	}
+	if resp, out := do(t, "POST", ts.URL+"/arrays", `{"name":"c","level":"raid1","disks":2,"stripe_size":16,"disk_size":4096}`, nil); resp.StatusCode != http.StatusInsufficientStorage {
+		t.Errorf("POST /arrays past the number of arrays = %d %s, want %d", resp.StatusCode, out, http.StatusInsufficientStorage)
+	}
+}
+
+// closeDisk is a disk that records being closed.
+type closeDisk struct {
+	*raid.MemDisk
+	closed *int
+}
+
+func (d closeDisk) Close() error {
+	*d.closed++
+	return nil
+}
+
+// TestCreateReleases checks that the members made for an array that cannot
+// be created are released.
+func TestCreateReleases(t *testing.T) {
+	var made, closed int
+	srv := NewServer(func(array string, index int, size int64) (raid.Disk, error) {
+		if index == 3 {
+			return nil, errors.New("out of disks")
+		}
+		made++
+		return closeDisk{raid.NewMemDisk(size), &closed}, nil
+	})
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+
+	if resp, out := do(t, "POST", ts.URL+"/arrays", `{"name":"a","level":"raid5","disks":4,"stripe_size":16,"disk_size":4096}`, nil); resp.StatusCode != http.StatusInternalServerError {
+		t.Errorf("POST /arrays with a failing factory = %d %s", resp.StatusCode, out)
+	}
+	if resp, out := do(t, "POST", ts.URL+"/arrays", `{"name":"a","level":"raid6","disks":2,"stripe_size":16,"disk_size":4096}`, nil); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("POST /arrays of too few disks = %d %s", resp.StatusCode, out)
+	}
+	if made != 5 || closed != made {
+		t.Errorf("made %d disks and closed %d, want 5 and 5", made, closed)
+	}
+	if resp, out := do(t, "POST", ts.URL+"/arrays", `{"name":"a","level":"raid1","disks":2,"stripe_size":16,"disk_size":4096}`, nil); resp.StatusCode != http.StatusCreated {
+		t.Errorf("POST /arrays after the failures = %d %s", resp.StatusCode, out)
+	}
+}
+
+// TestReplaceTwice checks that concurrent requests to replace a member do not
+// both replace it.
+func TestReplaceTwice(t *testing.T) {
+	var block chan struct{}
+	var replacing sync.WaitGroup
+	srv := NewServer(func(array string, index int, size int64) (raid.Disk, error) {
+		if block != nil {
+			replacing.Done()
+			<-block
+		}
+		return raid.NewMemDisk(size), nil
+	})
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+	defer srv.Close()
+
+	if resp, out := do(t, "POST", ts.URL+"/arrays", `{"name":"a","level":"raid1","disks":2,"stripe_size":16,"disk_size":4096}`, nil); resp.StatusCode != http.StatusCreated {
+		t.Fatalf("POST /arrays = %d %s", resp.StatusCode, out)
+	}
+	if resp, out := do(t, "POST", ts.URL+"/arrays/a/disks/1/fail", "", nil); resp.StatusCode != http.StatusOK {
+		t.Fatalf("fail = %d %s", resp.StatusCode, out)
+	}
+	block = make(chan struct{})
+	replacing.Add(1)
+	first := make(chan int)
+	go func() {
+		resp, _ := do(t, "POST", ts.URL+"/arrays/a/disks/1/replace", "", nil)
+		first <- resp.StatusCode
+	}()
+	replacing.Wait()
+	if resp, out := do(t, "POST", ts.URL+"/arrays/a/disks/1/replace", "", nil); resp.StatusCode != http.StatusConflict {
+		t.Errorf("second replace = %d %s, want %d", resp.StatusCode, out, http.StatusConflict)
+	}
+	close(block)
+	if status := <-first; status != http.StatusAccepted {
+		t.Errorf("first replace = %d, want %d", status, http.StatusAccepted)
+	}
+}
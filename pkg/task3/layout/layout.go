@@ -0,0 +1,203 @@
+// Package layout draws the stripe map of an array: which chunk of which
+// stripe lives on which member, where the parity goes and which members are
+// out of sync. It renders as an ASCII table, JSON or SVG.
+package layout
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"graid-tech-assignment/pkg/task3/raid"
+	"io"
+	"strings"
+)
+
+// raid1Block is the unit drawn as one row for RAID1, which has no stripes.
+const raid1Block = 4096
+
+type Layout struct {
+	Level      string   `json:"level"`
+	StripeSize int      `json:"stripe_size"`
+	Disks      []Disk   `json:"disks"`
+	Stripes    []Stripe `json:"stripes"`
+}
+
+type Disk struct {
+	Index int    `json:"index"`
+	State string `json:"state"`
+}
+
+// Stripe is one row of the map: the cell of every member at Offset.
+type Stripe struct {
+	Index  int    `json:"index"`
+	Offset int64  `json:"offset"`
+	Cells  []Cell `json:"cells"`
+}
+
+// Cell is what one member holds in a stripe. Chunk is the logical chunk
+// number of data and mirror cells, and -1 for parity.
+type Cell struct {
+	Role  string `json:"role"`
+	Chunk int    `json:"chunk"`
+}
+
+// Label is the short name of the cell used in the drawings: D3 for chunk 3,
+// M3 for a mirror of it and P1 or Q1 for the parity of stripe 1.
+func (c Cell) Label(stripe int) string {
+	switch c.Role {
+	case "data":
+		return fmt.Sprintf("D%d", c.Chunk)
+	case "mirror":
+		return fmt.Sprintf("M%d", c.Chunk)
+	case "":
+		return ""
+	}
+	return fmt.Sprintf("%s%d", c.Role, stripe)
+}
+
+// Build lays out the first stripes of arr. Linear arrays have no stripes to
+// lay out, and those of hybrid arrays differ from tier to tier.
+func Build(arr raid.Array, stripes int) (*Layout, error) {
+	g := arr.Geometry()
+	switch g.Level {
+	case raid.LevelLinear:
+		return nil, errors.New("layout: linear arrays have no stripes")
+	case raid.LevelHybrid:
+		return nil, errors.New("layout: hybrid arrays have no uniform stripes")
+	}
+	chunkSize, width := g.StripeSize, g.StripeWidth
+	if g.Level == raid.Level1 {
+		chunkSize, width = raid1Block, raid1Block
+	}
+	l := &Layout{Level: g.Level.String(), StripeSize: chunkSize}
+	for _, m := range arr.Status().Members {
+		l.Disks = append(l.Disks, Disk{m.Index, m.State.String()})
+	}
+	for s := 0; s < stripes; s++ {
+		extents, err := arr.Map(s*width, width)
+		if err != nil {
+			return nil, err
+		}
+		if len(extents) == 0 {
+			return nil, errors.New("layout: array maps nothing")
+		}
+		row := Stripe{Index: s, Offset: extents[0].Offset, Cells: make([]Cell, g.NumDisks)}
+		for _, e := range extents {
+			chunk := e.Pos / chunkSize
+			if e.Role == raid.RoleP || e.Role == raid.RoleQ {
+				chunk = -1
+			}
+			row.Cells[e.Member] = Cell{e.Role.String(), chunk}
+		}
+		l.Stripes = append(l.Stripes, row)
+	}
+	return l, nil
+}
+
+// Render writes the layout in format, which is ascii, json or svg.
+func (l *Layout) Render(w io.Writer, format string) error {
+	switch format {
+	case "ascii":
+		return l.ASCII(w)
+	case "json":
+		return l.JSON(w)
+	case "svg":
+		return l.SVG(w)
+	}
+	return fmt.Errorf("layout: unknown format %q", format)
+}
+
+// ASCII draws the layout as a table with a column per member and a row per
+// stripe. Cells of members that are out of sync are marked with a '!'.
+func (l *Layout) ASCII(w io.Writer) error {
+	var b strings.Builder
+	row := func(label, offset string, cells []string) {
+		line := fmt.Sprintf("%-10s%12s", label, offset)
+		for _, c := range cells {
+			line += fmt.Sprintf("  %-10s", c)
+		}
+		b.WriteString(strings.TrimRight(line, " ") + "\n")
+	}
+	fmt.Fprintf(&b, "%s, %d disks, %d bytes per chunk\n", l.Level, len(l.Disks), l.StripeSize)
+	names, states := make([]string, len(l.Disks)), make([]string, len(l.Disks))
+	for i, d := range l.Disks {
+		names[i], states[i] = fmt.Sprintf("disk%d", d.Index), d.State
+	}
+	row("", "offset", names)
+	row("", "", states)
+	for _, s := range l.Stripes {
+		cells := make([]string, len(s.Cells))
+		for i, c := range s.Cells {
+			cells[i] = c.Label(s.Index)
+			if l.Disks[i].State != raid.DiskActive.String() && cells[i] != "" {
+				cells[i] += "!"
+			}
+		}
+		row(fmt.Sprintf("stripe%d", s.Index), fmt.Sprint(s.Offset), cells)
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+func (l *Layout) JSON(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(l)
+}
+
+// Colours of the cells in the SVG drawing, by role.
+var svgFill = map[string]string{
+	"data":   "#9ecae1",
+	"mirror": "#c6dbef",
+	"P":      "#fdae6b",
+	"Q":      "#fb6a4a",
+	"":       "#ffffff",
+}
+
+const (
+	svgCellWidth  = 72
+	svgCellHeight = 28
+	svgLabelWidth = 72
+	svgHeader     = 48
+)
+
+// SVG draws the layout as a grid. Members that are out of sync are greyed
+// out and crossed.
+func (l *Layout) SVG(w io.Writer) error {
+	var b strings.Builder
+	width := svgLabelWidth + len(l.Disks)*svgCellWidth + 8
+	height := svgHeader + len(l.Stripes)*svgCellHeight + 8
+	fmt.Fprintf(&b, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" font-family="monospace" font-size="12">`+"\n", width, height)
+	fmt.Fprintf(&b, `<text x="4" y="14">%s, %d disks, %d bytes per chunk</text>`+"\n", l.Level, len(l.Disks), l.StripeSize)
+	for i, d := range l.Disks {
+		x := svgLabelWidth + i*svgCellWidth
+		fmt.Fprintf(&b, `<text x="%d" y="%d" text-anchor="middle">disk%d</text>`+"\n", x+svgCellWidth/2, svgHeader-20, d.Index)
+		fmt.Fprintf(&b, `<text x="%d" y="%d" text-anchor="middle" font-size="10">%s</text>`+"\n", x+svgCellWidth/2, svgHeader-6, d.State)
+	}
+	for r, s := range l.Stripes {
+		y := svgHeader + r*svgCellHeight
+		fmt.Fprintf(&b, `<text x="4" y="%d">stripe%d</text>`+"\n", y+svgCellHeight/2+4, s.Index)
+		for i, c := range s.Cells {
+			x := svgLabelWidth + i*svgCellWidth
+			opacity := "1"
+			if l.Disks[i].State != raid.DiskActive.String() {
+				opacity = "0.35"
+			}
+			fmt.Fprintf(&b, `<rect x="%d" y="%d" width="%d" height="%d" fill="%s" fill-opacity="%s" stroke="#333"/>`+"\n",
+				x, y, svgCellWidth, svgCellHeight, svgFill[c.Role], opacity)
+			fmt.Fprintf(&b, `<text x="%d" y="%d" text-anchor="middle">%s</text>`+"\n", x+svgCellWidth/2, y+svgCellHeight/2+4, c.Label(s.Index))
+		}
+	}
+	for i, d := range l.Disks {
+		if d.State == raid.DiskActive.String() || len(l.Stripes) == 0 {
+			continue
+		}
+		x1, x2 := svgLabelWidth+i*svgCellWidth, svgLabelWidth+(i+1)*svgCellWidth
+		y1, y2 := svgHeader, svgHeader+len(l.Stripes)*svgCellHeight
+		fmt.Fprintf(&b, `<line x1="%d" y1="%d" x2="%d" y2="%d" stroke="#c00" stroke-width="2"/>`+"\n", x1, y1, x2, y2)
+		fmt.Fprintf(&b, `<line x1="%d" y1="%d" x2="%d" y2="%d" stroke="#c00" stroke-width="2"/>`+"\n", x2, y1, x1, y2)
+	}
+	b.WriteString("</svg>\n")
+	_, err := io.WriteString(w, b.String())
+	return err
+}
@@ -0,0 +1,133 @@
+package layout
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"graid-tech-assignment/pkg/task3/raid"
+	"io"
+	"strings"
+	"testing"
+)
+
+func newArray(t *testing.T, level raid.Level, numDisks int, failed ...int) raid.Array {
+	t.Helper()
+	disks := make([]raid.Disk, numDisks)
+	for i := range disks {
+		disks[i] = raid.NewMemDisk(0)
+	}
+	arr, err := raid.New(level, disks, 4096)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, d := range failed {
+		arr.Fail(d)
+	}
+	return arr
+}
+
+func TestASCII(t *testing.T) {
+	tests := []struct {
+		name string
+		arr  raid.Array
+		want string
+	}{
+		{
+			name: "RAID5",
+			arr:  newArray(t, raid.Level5, 4, 1),
+			want: `RAID5, 4 disks, 4096 bytes per chunk
+                offset  disk0       disk1       disk2       disk3
+                        active      failed      active      active
+stripe0              0  P0          D0!         D1          D2
+stripe1           4096  D3          P1!         D4          D5
+stripe2           8192  D6          D7!         P2          D8
+stripe3          12288  D9          D10!        D11         P3
+`,
+		},
+		{
+			name: "RAID6",
+			arr:  newArray(t, raid.Level6, 4),
+			want: `RAID6, 4 disks, 4096 bytes per chunk
+                offset  disk0       disk1       disk2       disk3
+                        active      active      active      active
+stripe0              0  D0          D1          P0          Q0
+stripe1           4096  D2          D3          P1          Q1
+stripe2           8192  D4          D5          P2          Q2
+stripe3          12288  D6          D7          P3          Q3
+`,
+		},
+		{
+			name: "RAID10",
+			arr:  newArray(t, raid.Level10, 4, 2),
+			want: `RAID10, 4 disks, 4096 bytes per chunk
+                offset  disk0       disk1       disk2       disk3
+                        active      active      failed      active
+stripe0              0  D0          M0          D1!         M1
+stripe1           4096  D2          M2          D3!         M3
+stripe2           8192  D4          M4          D5!         M5
+stripe3          12288  D6          M6          D7!         M7
+`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l, err := Build(tt.arr, 4)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var b strings.Builder
+			if err := l.Render(&b, "ascii"); err != nil {
+				t.Fatal(err)
+			}
+			if b.String() != tt.want {
+				t.Errorf("ASCII() =\n%s\nwant\n%s", b.String(), tt.want)
+			}
+		})
+	}
+}
+
+func TestJSONAndSVG(t *testing.T) {
+	l, err := Build(newArray(t, raid.Level6, 5, 0), 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var b bytes.Buffer
+	if err := l.Render(&b, "json"); err != nil {
+		t.Fatal(err)
+	}
+	var decoded Layout
+	if err := json.Unmarshal(b.Bytes(), &decoded); err != nil {
+		t.Fatalf("JSON() is not valid JSON: %v", err)
+	}
+	if len(decoded.Stripes) != 5 || decoded.Disks[0].State != "failed" || decoded.Stripes[2].Cells[4] != (Cell{"Q", -1}) {
+		t.Errorf("JSON() = %s", b.Bytes())
+	}
+
+	b.Reset()
+	if err := l.Render(&b, "svg"); err != nil {
+		t.Fatal(err)
+	}
+	rects := 0
+	dec := xml.NewDecoder(&b)
+	for {
+		tok, err := dec.Token()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			t.Fatalf("SVG() is not valid XML: %v", err)
+		}
+		if el, ok := tok.(xml.StartElement); ok && el.Name.Local == "rect" {
+			rects++
+		}
+	}
+	if rects != 5*5 {
+		t.Errorf("SVG() has %d cells, want %d", rects, 5*5)
+	}
+
+	if err := l.Render(io.Discard, "png"); err == nil {
+		t.Error("Render() with an unknown format succeeded")
+	}
+}
@@ -0,0 +1,163 @@
+package nbd
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+)
+
+// Client is a minimal NBD client that issues one request at a time.
+type Client struct {
+	mu     sync.Mutex
+	nc     net.Conn
+	c      *conn
+	size   int64
+	flags  uint16
+	handle uint64
+}
+
+// Dial connects to an NBD server and selects an export with NBD_OPT_GO.
+func Dial(network, addr, export string) (*Client, error) {
+	nc, err := net.Dial(network, addr)
+	if err != nil {
+		return nil, err
+	}
+	cl := &Client{nc: nc, c: &conn{bufio.NewReader(nc), bufio.NewWriter(nc)}}
+	if err := cl.negotiate(export); err != nil {
+		nc.Close()
+		return nil, err
+	}
+	return cl, nil
+}
+
+func (cl *Client) negotiate(export string) error {
+	c := cl.c
+	var magic, opt uint64
+	var flags uint16
+	if err := c.read(&magic, &opt, &flags); err != nil {
+		return err
+	}
+	if magic != nbdMagic || opt != optMagic || flags&flagFixedNew == 0 {
+		return errors.New("nbd: server does not speak fixed newstyle")
+	}
+	data := binary.BigEndian.AppendUint32(nil, uint32(len(export)))
+	data = append(data, export...)
+	data = binary.BigEndian.AppendUint16(data, 0)
+	if err := c.write(uint32(clientFixedNew|clientNoZeroes), uint64(optMagic), uint32(optGo), uint32(len(data))); err != nil {
+		return err
+	}
+	if _, err := c.w.Write(data); err != nil {
+		return err
+	}
+	if err := c.w.Flush(); err != nil {
+		return err
+	}
+
+	for {
+		var magic uint64
+		var opt, typ, length uint32
+		if err := c.read(&magic, &opt, &typ, &length); err != nil {
+			return err
+		}
+		if magic != optReplyMagic || opt != optGo {
+			return fmt.Errorf("nbd: bad option reply %#x for option %d", magic, opt)
+		}
+		payload := make([]byte, length)
+		if _, err := io.ReadFull(c.r, payload); err != nil {
+			return err
+		}
+		switch {
+		case typ == repAck:
+			return nil
+		case typ == repInfo && len(payload) >= 12 && binary.BigEndian.Uint16(payload) == infoExport:
+			cl.size = int64(binary.BigEndian.Uint64(payload[2:]))
+			cl.flags = binary.BigEndian.Uint16(payload[10:])
+		case typ&(1<<31) != 0:
+			return fmt.Errorf("nbd: export %q refused with error %#x", export, typ)
+		}
+	}
+}
+
+func (cl *Client) Size() int64 {
+	return cl.size
+}
+
+func (cl *Client) ReadOnly() bool {
+	return cl.flags&transReadOnly != 0
+}
+
+// Error is an errno returned by the server.
+type Error uint32
+
+func (e Error) Error() string {
+	return fmt.Sprintf("nbd: server error %d", uint32(e))
+}
+
+func (cl *Client) ReadAt(p []byte, off int64) (int, error) {
+	if err := cl.do(cmdRead, off, len(p), p, nil); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (cl *Client) WriteAt(p []byte, off int64) (int, error) {
+	if err := cl.do(cmdWrite, off, len(p), nil, p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (cl *Client) Flush() error {
+	return cl.do(cmdFlush, 0, 0, nil, nil)
+}
+
+func (cl *Client) Trim(off, length int64) error {
+	return cl.do(cmdTrim, off, int(length), nil, nil)
+}
+
+// Close sends NBD_CMD_DISC and hangs up.
+func (cl *Client) Close() error {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	cl.c.write(uint32(requestMagic), uint16(0), uint16(cmdDisc), cl.handle, uint64(0), uint32(0))
+	cl.c.w.Flush()
+	return cl.nc.Close()
+}
+
+// do sends one request with the payload out and waits for its reply, whose
+// payload is read into in.
+func (cl *Client) do(typ uint16, off int64, length int, in, out []byte) error {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	cl.handle++
+	if err := cl.c.write(uint32(requestMagic), uint16(0), typ, cl.handle, uint64(off), uint32(length)); err != nil {
+		return err
+	}
+	if _, err := cl.c.w.Write(out); err != nil {
+		return err
+	}
+	if err := cl.c.w.Flush(); err != nil {
+		return err
+	}
+
+	var magic, errno uint32
+	var handle uint64
+	if err := cl.c.read(&magic, &errno, &handle); err != nil {
+		return err
+	}
+	if magic != replyMagic || handle != cl.handle {
+		return fmt.Errorf("nbd: bad reply %#x for handle %d", magic, handle)
+	}
+	if errno != 0 {
+		return Error(errno)
+	}
+	if typ == cmdRead {
+		_, err := io.ReadFull(cl.c.r, in)
+		return err
+	}
+	return nil
+}
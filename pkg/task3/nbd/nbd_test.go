@@ -0,0 +1,111 @@
+package nbd
+
+import (
+	"bytes"
+	"errors"
+	"graid-tech-assignment/pkg/task3/raid"
+	"net"
+	"path/filepath"
+	"testing"
+)
+
+func newArray(t *testing.T) raid.Array {
+	disks := make([]raid.Disk, 4)
+	for i := range disks {
+		disks[i] = raid.NewMemDisk(64 * 1024)
+	}
+	arr, err := raid.Create(raid.Level6, disks, 512)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return arr
+}
+
+func TestServer(t *testing.T) {
+	tests := []struct {
+		name    string
+		network string
+		addr    string
+	}{
+		{name: "tcp", network: "tcp", addr: "127.0.0.1:0"},
+		{name: "unix", network: "unix", addr: filepath.Join(t.TempDir(), "nbd.sock")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			arr := newArray(t)
+			size := arr.Status().Size
+			srv := NewServer(
+				&Export{Name: "array", Device: arr, Size: size},
+				&Export{Name: "ro", Device: arr, Size: size, ReadOnly: true},
+			)
+			l, err := net.Listen(tt.network, tt.addr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			go srv.Serve(l)
+			defer srv.Close()
+
+			cl, err := Dial(tt.network, l.Addr().String(), "array")
+			if err != nil {
+				t.Fatalf("Dial() error = %v", err)
+			}
+			defer cl.Close()
+			if cl.Size() != size {
+				t.Errorf("Size() = %d, want %d", cl.Size(), size)
+			}
+
+			data := bytes.Repeat([]byte("nbd!"), 1024)
+			if _, err := cl.WriteAt(data, 0); err != nil {
+				t.Fatalf("WriteAt() error = %v", err)
+			}
+			if err := cl.Flush(); err != nil {
+				t.Errorf("Flush() error = %v", err)
+			}
+			if err := cl.Trim(1000, 2000); err != nil {
+				t.Errorf("Trim() error = %v", err)
+			}
+			want := bytes.Clone(data)
+			clear(want[1000:3000])
+			arr.ClearDisk(0)
+			got := make([]byte, len(data))
+			if _, err := cl.ReadAt(got, 0); err != nil || !bytes.Equal(got, want) {
+				t.Errorf("ReadAt() = %v, data matches %v", err, bytes.Equal(got, want))
+			}
+			var nbdErr Error
+			if _, err := cl.ReadAt(got, size-1); !errors.As(err, &nbdErr) || nbdErr != errInval {
+				t.Errorf("ReadAt() past the end error = %v, want EINVAL", err)
+			}
+
+			// An offset of 1<<64 - 512 wraps around past the end of the
+			// export; it must not reach the array as a negative position.
+			const wrapped = -512
+			if _, err := cl.ReadAt(got[:1024], wrapped); !errors.As(err, &nbdErr) || nbdErr != errInval {
+				t.Errorf("ReadAt() at 1<<64 - 512 error = %v, want EINVAL", err)
+			}
+			if _, err := cl.WriteAt(data[:1024], wrapped); !errors.As(err, &nbdErr) || nbdErr != errNoSpc {
+				t.Errorf("WriteAt() at 1<<64 - 512 error = %v, want ENOSPC", err)
+			}
+			if err := cl.Trim(wrapped, 1024); !errors.As(err, &nbdErr) || nbdErr != errInval {
+				t.Errorf("Trim() at 1<<64 - 512 error = %v, want EINVAL", err)
+			}
+			if err := arr.Rebuild(0); err != nil {
+				t.Fatalf("Rebuild(0) error = %v", err)
+			}
+			if arr.Status().Degraded() {
+				t.Errorf("array degraded after requests at 1<<64 - 512: %+v", arr.Status().Members)
+			}
+
+			ro, err := Dial(tt.network, l.Addr().String(), "ro")
+			if err != nil {
+				t.Fatalf("Dial(ro) error = %v", err)
+			}
+			defer ro.Close()
+			if _, err := ro.WriteAt(data, 0); !errors.As(err, &nbdErr) || nbdErr != errPerm {
+				t.Errorf("WriteAt() on read-only export error = %v, want EPERM", err)
+			}
+			if _, err := Dial(tt.network, l.Addr().String(), "missing"); err == nil {
+				t.Errorf("Dial() to an unknown export succeeded")
+			}
+		})
+	}
+}
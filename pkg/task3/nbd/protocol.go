@@ -0,0 +1,57 @@
+// Package nbd serves RAID arrays over the Network Block Device protocol
+// (fixed newstyle negotiation, simple replies), and has a small client for it.
+//
+// See https://github.com/NetworkBlockDevice/nbd/blob/master/doc/proto.md
+package nbd
+
+// Negotiation
+const (
+	nbdMagic       = 0x4e42444d41474943 // "NBDMAGIC"
+	optMagic       = 0x49484156454f5054 // "IHAVEOPT"
+	optReplyMagic  = 0x0003e889045565a9
+	flagFixedNew   = 1 << 0
+	flagNoZeroes   = 1 << 1
+	clientFixedNew = 1 << 0
+	clientNoZeroes = 1 << 1
+
+	optExportName = 1
+	optAbort      = 2
+	optList       = 3
+	optInfo       = 6
+	optGo         = 7
+
+	repAck         = 1
+	repServer      = 2
+	repInfo        = 3
+	repErrUnsup    = 1<<31 + 1
+	repErrInvalid  = 1<<31 + 3
+	repErrUnknown  = 1<<31 + 6
+	infoExport     = 0
+	infoBlockSize  = 3
+	maxOptionBytes = 4096
+)
+
+// Transmission
+const (
+	requestMagic = 0x25609513
+	replyMagic   = 0x67446698
+
+	cmdRead  = 0
+	cmdWrite = 1
+	cmdDisc  = 2
+	cmdFlush = 3
+	cmdTrim  = 4
+
+	transHasFlags  = 1 << 0
+	transReadOnly  = 1 << 1
+	transSendFlush = 1 << 2
+	transSendTrim  = 1 << 5
+
+	errPerm  = 1
+	errIO    = 5
+	errInval = 22
+	errNoSpc = 28
+
+	// maxRequest bounds the payload of a single read or write.
+	maxRequest = 32 << 20
+)
@@ -0,0 +1,358 @@
+package nbd
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"graid-tech-assignment/pkg/task3/raid"
+	"io"
+	"log"
+	"net"
+	"sync"
+)
+
+// Export is a RAID offered to clients under a name.
+type Export struct {
+	Name     string
+	Device   raid.RAID
+	Size     int64
+	ReadOnly bool
+}
+
+// Devices may also implement this; the server falls back to a no-op, which
+// the protocol allows.
+type flusher interface {
+	Flush() error
+}
+
+type Server struct {
+	mu        sync.Mutex
+	exports   map[string]*Export
+	listeners map[net.Listener]struct{}
+	conns     map[net.Conn]struct{}
+	closed    bool
+}
+
+// NewServer serves the exports. The first one is also the default export
+// that clients get when asking for the empty name.
+func NewServer(exports ...*Export) *Server {
+	s := &Server{
+		exports:   make(map[string]*Export),
+		listeners: make(map[net.Listener]struct{}),
+		conns:     make(map[net.Conn]struct{}),
+	}
+	for i, e := range exports {
+		s.exports[e.Name] = e
+		if i == 0 {
+			s.exports[""] = e
+		}
+	}
+	return s
+}
+
+// ListenAndServe listens on a "tcp" or "unix" address and serves clients
+// until the server is closed.
+func (s *Server) ListenAndServe(network, addr string) error {
+	l, err := net.Listen(network, addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(l)
+}
+
+func (s *Server) Serve(l net.Listener) error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		l.Close()
+		return net.ErrClosed
+	}
+	s.listeners[l] = struct{}{}
+	s.mu.Unlock()
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			s.mu.Lock()
+			closed := s.closed
+			delete(s.listeners, l)
+			s.mu.Unlock()
+			if closed {
+				return nil
+			}
+			return err
+		}
+		s.mu.Lock()
+		s.conns[conn] = struct{}{}
+		s.mu.Unlock()
+		go func() {
+			if err := s.handle(conn); err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) {
+				log.Printf("nbd: %s: %v", conn.RemoteAddr(), err)
+			}
+			s.mu.Lock()
+			delete(s.conns, conn)
+			s.mu.Unlock()
+			conn.Close()
+		}()
+	}
+}
+
+// Close stops the listeners and drops every client.
+func (s *Server) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	for l := range s.listeners {
+		l.Close()
+	}
+	for c := range s.conns {
+		c.Close()
+	}
+	return nil
+}
+
+type conn struct {
+	r *bufio.Reader
+	w *bufio.Writer
+}
+
+func (c *conn) read(v ...any) error {
+	for _, x := range v {
+		if err := binary.Read(c.r, binary.BigEndian, x); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *conn) write(v ...any) error {
+	for _, x := range v {
+		if err := binary.Write(c.w, binary.BigEndian, x); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *Server) handle(nc net.Conn) error {
+	c := &conn{bufio.NewReader(nc), bufio.NewWriter(nc)}
+	export, err := s.negotiate(c)
+	if err != nil || export == nil {
+		return err
+	}
+	return s.transmit(c, export)
+}
+
+// negotiate runs the option haggling phase and returns the export the client
+// chose, or nil if it aborted.
+func (s *Server) negotiate(c *conn) (*Export, error) {
+	if err := c.write(uint64(nbdMagic), uint64(optMagic), uint16(flagFixedNew|flagNoZeroes)); err != nil {
+		return nil, err
+	}
+	if err := c.w.Flush(); err != nil {
+		return nil, err
+	}
+	var clientFlags uint32
+	if err := c.read(&clientFlags); err != nil {
+		return nil, err
+	}
+	if clientFlags&clientFixedNew == 0 {
+		return nil, errors.New("client does not support fixed newstyle negotiation")
+	}
+	noZeroes := clientFlags&clientNoZeroes != 0
+
+	for {
+		var magic uint64
+		var opt, length uint32
+		if err := c.read(&magic, &opt, &length); err != nil {
+			return nil, err
+		}
+		if magic != optMagic {
+			return nil, fmt.Errorf("bad option magic %#x", magic)
+		}
+		if length > maxOptionBytes {
+			return nil, fmt.Errorf("option %d of %d bytes is too long", opt, length)
+		}
+		data := make([]byte, length)
+		if _, err := io.ReadFull(c.r, data); err != nil {
+			return nil, err
+		}
+
+		var err error
+		switch opt {
+		case optExportName:
+			e, ok := s.exports[string(data)]
+			if !ok {
+				// There is no way to refuse this option but hanging up.
+				return nil, fmt.Errorf("unknown export %q", data)
+			}
+			err = c.write(uint64(e.Size), transmissionFlags(e))
+			if err == nil && !noZeroes {
+				_, err = c.w.Write(make([]byte, 124))
+			}
+			if err == nil {
+				err = c.w.Flush()
+			}
+			return e, err
+		case optAbort:
+			err = s.reply(c, opt, repAck, nil)
+			return nil, err
+		case optList:
+			for name, e := range s.exports {
+				if name != e.Name {
+					// The alias of the default export.
+					continue
+				}
+				payload := binary.BigEndian.AppendUint32(nil, uint32(len(name)))
+				if err = s.reply(c, opt, repServer, append(payload, name...)); err != nil {
+					return nil, err
+				}
+			}
+			err = s.reply(c, opt, repAck, nil)
+		case optInfo, optGo:
+			var e *Export
+			e, err = s.info(c, opt, data)
+			if err == nil && e != nil && opt == optGo {
+				return e, nil
+			}
+		default:
+			err = s.reply(c, opt, repErrUnsup, nil)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// info answers NBD_OPT_INFO and NBD_OPT_GO.
+func (s *Server) info(c *conn, opt uint32, data []byte) (*Export, error) {
+	if len(data) < 6 {
+		return nil, s.reply(c, opt, repErrInvalid, nil)
+	}
+	nameLen := binary.BigEndian.Uint32(data)
+	if uint32(len(data)) < 4+nameLen+2 {
+		return nil, s.reply(c, opt, repErrInvalid, nil)
+	}
+	e, ok := s.exports[string(data[4:4+nameLen])]
+	if !ok {
+		return nil, s.reply(c, opt, repErrUnknown, nil)
+	}
+
+	payload := binary.BigEndian.AppendUint16(nil, infoExport)
+	payload = binary.BigEndian.AppendUint64(payload, uint64(e.Size))
+	payload = binary.BigEndian.AppendUint16(payload, transmissionFlags(e))
+	if err := s.reply(c, opt, repInfo, payload); err != nil {
+		return nil, err
+	}
+	payload = binary.BigEndian.AppendUint16(nil, infoBlockSize)
+	payload = binary.BigEndian.AppendUint32(payload, 1)
+	payload = binary.BigEndian.AppendUint32(payload, 4096)
+	payload = binary.BigEndian.AppendUint32(payload, maxRequest)
+	if err := s.reply(c, opt, repInfo, payload); err != nil {
+		return nil, err
+	}
+	return e, s.reply(c, opt, repAck, nil)
+}
+
+func (s *Server) reply(c *conn, opt, typ uint32, data []byte) error {
+	if err := c.write(uint64(optReplyMagic), opt, typ, uint32(len(data))); err != nil {
+		return err
+	}
+	if _, err := c.w.Write(data); err != nil {
+		return err
+	}
+	return c.w.Flush()
+}
+
+func transmissionFlags(e *Export) uint16 {
+	flags := uint16(transHasFlags | transSendFlush | transSendTrim)
+	if e.ReadOnly {
+		flags |= transReadOnly
+	}
+	return flags
+}
+
+// transmit serves the requests of one client, in order.
+func (s *Server) transmit(c *conn, e *Export) error {
+	for {
+		var magic uint32
+		var flags, typ uint16
+		var handle, offset uint64
+		var length uint32
+		if err := c.read(&magic, &flags, &typ, &handle, &offset, &length); err != nil {
+			return err
+		}
+		if magic != requestMagic {
+			return fmt.Errorf("bad request magic %#x", magic)
+		}
+
+		var data []byte
+		if typ == cmdWrite {
+			if length > maxRequest {
+				return fmt.Errorf("write of %d bytes is too large", length)
+			}
+			data = make([]byte, length)
+			if _, err := io.ReadFull(c.r, data); err != nil {
+				return err
+			}
+		}
+
+		var errno uint32
+		var out []byte
+		inRange := offset <= uint64(e.Size) && uint64(length) <= uint64(e.Size)-offset
+		switch typ {
+		case cmdRead:
+			if !inRange || length > maxRequest {
+				errno = errInval
+				break
+			}
+			var err error
+			if out, err = e.Device.Read(int(length), int(offset)); err != nil {
+				log.Printf("nbd: read %d bytes at %d: %v", length, offset, err)
+				errno, out = errIO, nil
+			}
+		case cmdWrite:
+			if e.ReadOnly {
+				errno = errPerm
+			} else if !inRange {
+				errno = errNoSpc
+			} else if err := e.Device.Write(data, int(offset)); err != nil {
+				log.Printf("nbd: write %d bytes at %d: %v", length, offset, err)
+				errno = errIO
+			}
+		case cmdFlush:
+			if f, ok := e.Device.(flusher); ok {
+				if err := f.Flush(); err != nil {
+					log.Printf("nbd: flush: %v", err)
+					errno = errIO
+				}
+			}
+		case cmdTrim:
+			if e.ReadOnly {
+				errno = errPerm
+			} else if !inRange {
+				errno = errInval
+			} else if err := e.Device.Discard(int(offset), int(length)); err != nil {
+				log.Printf("nbd: trim %d bytes at %d: %v", length, offset, err)
+				errno = errIO
+			}
+		case cmdDisc:
+			return nil
+		default:
+			errno = errInval
+		}
+
+		if err := c.write(uint32(replyMagic), errno, handle); err != nil {
+			return err
+		}
+		if errno == 0 && typ == cmdRead {
+			if _, err := c.w.Write(out); err != nil {
+				return err
+			}
+		}
+		if err := c.w.Flush(); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,341 @@
+package raid
+
+import "slices"
+
+// A member that fails to read or write a range is not failed outright: the
+// blocks of the range are tried one by one, and those that fail again go on
+// the bad block list of the member. Reads of bad blocks are served by
+// reconstruction from the other members, and writes skip them. Arrays
+// created with Create keep a reserved area behind the data of every member;
+// bad blocks are rebuilt into it, after which the member serves them again.
+// The lists live in the superblocks, each member's in its own.
+const (
+	badBlockSize = 4096
+	// maxBadBlocks is how many bad blocks a member may have before it is
+	// failed. It bounds the size of the list in the superblock.
+	maxBadBlocks = 64
+)
+
+// reserveSlots is how many blocks Create reserves for remapping on members
+// of the given data size: one in 256, up to maxBadBlocks.
+func reserveSlots(dataSize int64) int {
+	return int(min(max(dataSize, 0)/badBlockSize/256, maxBadBlocks))
+}
+
+// splitReserve returns the largest data size whose reserved area fits into
+// space along with it.
+func splitReserve(space int64) int64 {
+	data := space - int64(reserveSlots(space))*badBlockSize
+	if r := reserveSlots(data); reserveSlots(space-int64(r)*badBlockSize) == r {
+		data = space - int64(r)*badBlockSize
+	}
+	return data
+}
+
+// DiskSize is the size of a disk that holds size bytes of member data behind
+// its superblock and reserved area: Create makes members of at least that
+// size from it, and Replace takes it for a member of that size.
+func DiskSize(size int64) int64 {
+	return SuperblockSize + size + int64(reserveSlots(size))*badBlockSize
+}
+
+// badBlock is a block of a member that failed. Slot is where it lives in the
+// reserved area, -1 while it is not remapped.
+type badBlock struct {
+	Block int64 `json:"block"`
+	Slot  int   `json:"slot"`
+}
+
+// badList is the bad block list of a member, sorted by block.
+type badList struct {
+	blocks []badBlock
+	slots  int // size of the reserved area, in blocks
+}
+
+func (l *badList) find(block int64) (int, bool) {
+	return slices.BinarySearchFunc(l.blocks, block, func(b badBlock, block int64) int {
+		return int(b.Block - block)
+	})
+}
+
+// unremapped reports whether [off, off+n) holds a bad block that is not
+// remapped.
+func (l *badList) unremapped(off int64, n int) bool {
+	if len(l.blocks) == 0 || n <= 0 {
+		return false
+	}
+	j, _ := l.find(off / badBlockSize)
+	for ; j < len(l.blocks) && l.blocks[j].Block*badBlockSize < off+int64(n); j++ {
+		if l.blocks[j].Slot < 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// holes returns the parts of [off, off+n) that fall on bad blocks that are
+// not remapped, as offsets relative to off.
+func (l *badList) holes(off int64, n int) [][2]int {
+	var parts [][2]int
+	j, _ := l.find(off / badBlockSize)
+	for ; j < len(l.blocks) && l.blocks[j].Block*badBlockSize < off+int64(n); j++ {
+		if l.blocks[j].Slot >= 0 {
+			continue
+		}
+		lo := max(l.blocks[j].Block*badBlockSize-off, 0)
+		hi := min((l.blocks[j].Block+1)*badBlockSize-off, int64(n))
+		if k := len(parts); k > 0 && parts[k-1][1] == int(lo) {
+			parts[k-1][1] = int(hi)
+			continue
+		}
+		parts = append(parts, [2]int{int(lo), int(hi)})
+	}
+	return parts
+}
+
+// cut returns the rest of [off, off+n), outside the holes.
+func (l *badList) cut(off int64, n int) [][2]int {
+	var parts [][2]int
+	lo := 0
+	for _, h := range l.holes(off, n) {
+		if h[0] > lo {
+			parts = append(parts, [2]int{lo, h[0]})
+		}
+		lo = h[1]
+	}
+	if lo < n {
+		parts = append(parts, [2]int{lo, n})
+	}
+	return parts
+}
+
+// add puts blocks on the list. A remapped block that fails again has lost
+// its slot. It reports false once the list is full.
+func (l *badList) add(blocks []int64) bool {
+	for _, b := range blocks {
+		j, ok := l.find(b)
+		if ok {
+			l.blocks[j].Slot = -1
+			continue
+		}
+		l.blocks = slices.Insert(l.blocks, j, badBlock{b, -1})
+	}
+	return len(l.blocks) <= maxBadBlocks
+}
+
+// clear drops the blocks that are not remapped and lie wholly in
+// [off, off+n), once it has been written successfully. The last block of a
+// member ends at its extent.
+func (l *badList) clear(off int64, n int, extent int64) bool {
+	before := len(l.blocks)
+	l.blocks = slices.DeleteFunc(l.blocks, func(b badBlock) bool {
+		return b.Slot < 0 && b.Block*badBlockSize >= off && min((b.Block+1)*badBlockSize, extent) <= off+int64(n)
+	})
+	return len(l.blocks) < before
+}
+
+// freeSlot returns a slot of the reserved area no block uses, or -1.
+func (l *badList) freeSlot() int {
+	for s := range l.slots {
+		if !slices.ContainsFunc(l.blocks, func(b badBlock) bool { return b.Slot == s }) {
+			return s
+		}
+	}
+	return -1
+}
+
+func (l *badList) remapped() int {
+	n := 0
+	for _, b := range l.blocks {
+		if b.Slot >= 0 {
+			n++
+		}
+	}
+	return n
+}
+
+// remapDisk is the data region of a member with the remapped blocks
+// redirected to their slots in the reserved area, which starts at base.
+type remapDisk struct {
+	Disk
+	bad  *badList
+	base int64
+}
+
+// each calls fn with the pieces of [off, off+n) and where they are on the
+// underlying disk.
+func (d *remapDisk) each(off int64, n int, fn func(lo, hi int, at int64) error) error {
+	for lo := 0; lo < n; {
+		pos := off + int64(lo)
+		block := pos / badBlockSize
+		j, ok := d.bad.find(block)
+		hi := n
+		at := pos
+		if ok && d.bad.blocks[j].Slot >= 0 {
+			hi = min(n, int((block+1)*badBlockSize-off))
+			at = d.base + int64(d.bad.blocks[j].Slot)*badBlockSize + pos%badBlockSize
+		} else {
+			// Up to the next remapped block.
+			for ; j < len(d.bad.blocks); j++ {
+				if b := d.bad.blocks[j]; b.Block > block && b.Slot >= 0 {
+					hi = min(n, int(b.Block*badBlockSize-off))
+					break
+				}
+			}
+		}
+		if err := fn(lo, hi, at); err != nil {
+			return err
+		}
+		lo = hi
+	}
+	return nil
+}
+
+func (d *remapDisk) ReadAt(p []byte, off int64) (int, error) {
+	err := d.each(off, len(p), func(lo, hi int, at int64) error {
+		_, err := d.Disk.ReadAt(p[lo:hi], at)
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (d *remapDisk) WriteAt(p []byte, off int64) (int, error) {
+	err := d.each(off, len(p), func(lo, hi int, at int64) error {
+		_, err := d.Disk.WriteAt(p[lo:hi], at)
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (d *remapDisk) Discard(off, n int64) error {
+	return d.each(off, int(n), func(lo, hi int, at int64) error {
+		return discard(d.Disk, at, int64(hi-lo))
+	})
+}
+
+// Size is that of the data, without the reserved area.
+func (d *remapDisk) Size() int64 {
+	return min(d.Disk.Size(), d.base)
+}
+
+// ioFailed handles a failed read or write of [off, off+len(p)) on member i.
+// The blocks that fail again on their own go on the bad block list and are
+// remapped where the reserved area allows. A member that does not respond at
+// all, or has more bad blocks than the list holds, is failed. A negative
+// offset is a mistake of the caller, which fails no member.
+func (m *members) ioFailed(i int, p []byte, off int64, write bool) {
+	if m.state[i] == DiskFailed || off < 0 {
+		return
+	}
+	var bad []int64
+	probed := 0
+	for lo := off; lo < off+int64(len(p)); probed++ {
+		block := lo / badBlockSize
+		hi := min((block+1)*badBlockSize, off+int64(len(p)))
+		q := p[lo-off : hi-off]
+		var err error
+		if write {
+			_, err = m.disks[i].WriteAt(q, lo)
+		} else {
+			_, err = m.disks[i].ReadAt(q, lo)
+		}
+		if err != nil {
+			bad = append(bad, block)
+		}
+		lo = hi
+	}
+	if len(bad) == 0 {
+		return
+	}
+	if len(bad) == probed && !m.responds(i, bad) || !m.bad[i].add(bad) {
+		m.failLocked(i)
+		return
+	}
+	for _, block := range bad {
+		remapped := m.remap(i, block)
+		m.events.publish(Event{Kind: EventBadBlock, Disk: i, Offset: block * badBlockSize, Remapped: remapped})
+	}
+	m.persist()
+}
+
+// responds reports whether member i reads anywhere outside the bad blocks.
+func (m *members) responds(i int, bad []int64) bool {
+	p := make([]byte, 1)
+	for _, off := range []int64{0, m.memberExtent(i) - 1} {
+		if off >= 0 && !slices.Contains(bad, off/badBlockSize) {
+			if _, err := m.disks[i].ReadAt(p, off); err == nil {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// remap rebuilds a bad block of member i into a free slot of the reserved
+// area. Without one, or while the block cannot be reconstructed, it stays
+// bad, and remap reports false.
+func (m *members) remap(i int, block int64) bool {
+	l := m.bad[i]
+	slot := l.freeSlot()
+	off := block * badBlockSize
+	n := int(min(badBlockSize, m.memberExtent(i)-off))
+	if slot < 0 || n <= 0 {
+		return false
+	}
+	rows, err := m.readRows(off, n)
+	if err != nil {
+		return false
+	}
+	j, _ := l.find(block)
+	l.blocks[j].Slot = slot
+	if _, err := m.disks[i].WriteAt(rows[i], off); err != nil {
+		l.blocks[j].Slot = -1
+		return false
+	}
+	return true
+}
+
+// skipBad drops the parts of the requests that fall on bad blocks that are
+// not remapped.
+func (m *members) skipBad(ios []memberIO) []memberIO {
+	var out []memberIO
+	for _, req := range ios {
+		l := m.bad[req.disk]
+		if !l.unremapped(req.off, len(req.p)) {
+			out = append(out, req)
+			continue
+		}
+		for _, part := range l.cut(req.off, len(req.p)) {
+			out = append(out, memberIO{req.disk, req.p[part[0]:part[1]], req.off + int64(part[0])})
+		}
+	}
+	return out
+}
+
+// heal writes the reconstructed rows at off over the bad blocks of every
+// member that are not remapped. Blocks that take the write come off the
+// list, as disks reallocate sectors that fail when they are written.
+func (m *members) heal(rows [][]byte, off int64) {
+	healed := false
+	for i, l := range m.bad {
+		p := m.clip(i, rows[i], off)
+		if m.state[i] != DiskActive {
+			continue
+		}
+		for _, h := range l.holes(off, len(p)) {
+			at := off + int64(h[0])
+			if _, err := m.disks[i].WriteAt(p[h[0]:h[1]], at); err == nil && l.clear(at, h[1]-h[0], m.memberExtent(i)) {
+				healed = true
+			}
+		}
+	}
+	if healed {
+		m.persist()
+	}
+}
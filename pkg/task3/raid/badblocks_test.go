@@ -0,0 +1,181 @@
+package raid
+
+import (
+	"bytes"
+	"errors"
+	"math/rand"
+	"testing"
+)
+
+var errBadSector = errors.New("bad sector")
+
+// faultyDisk fails every request that touches [bad, bad+n).
+type faultyDisk struct {
+	Disk
+	bad, n int64
+}
+
+func (d *faultyDisk) hits(p []byte, off int64) bool {
+	return d.n > 0 && off < d.bad+d.n && off+int64(len(p)) > d.bad
+}
+
+func (d *faultyDisk) ReadAt(p []byte, off int64) (int, error) {
+	if d.hits(p, off) {
+		return 0, errBadSector
+	}
+	return d.Disk.ReadAt(p, off)
+}
+
+func (d *faultyDisk) WriteAt(p []byte, off int64) (int, error) {
+	if d.hits(p, off) {
+		return 0, errBadSector
+	}
+	return d.Disk.WriteAt(p, off)
+}
+
+// TestBadBlockRemap checks that a bad sector is rebuilt into the reserved
+// area of its member, which stays in the array, and that the remapping
+// survives assembly.
+func TestBadBlockRemap(t *testing.T) {
+	disks := make([]Disk, 3)
+	for i := range disks {
+		disks[i] = NewMemDisk(SuperblockSize + 2<<20)
+	}
+	arr, err := Create(Level5, disks, 4096)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := make([]byte, arr.Size())
+	rand.New(rand.NewSource(1)).Read(data)
+	if err := arr.Write(data, 0); err != nil {
+		t.Fatal(err)
+	}
+	faulty := &faultyDisk{Disk: disks[1], bad: SuperblockSize + 96<<10 + 512, n: 512}
+	arr.(*RAID5).disks[1].(*remapDisk).Disk.(*sectionDisk).Disk = faulty
+	check := func(arr Array, when string) {
+		t.Helper()
+		got, err := arr.Read(len(data), 0)
+		if err != nil || !bytes.Equal(got, data) {
+			t.Errorf("Read() %s = %v, contents match %v", when, err, bytes.Equal(got, data))
+		}
+	}
+
+	check(arr, "over a bad sector")
+	if m := arr.Status().Members[1]; m.State != DiskActive || m.BadBlocks != 1 || m.Remapped != 1 {
+		t.Fatalf("member with a bad sector = %+v, want active with 1 remapped block", m)
+	}
+	rand.New(rand.NewSource(2)).Read(data[190<<10 : 210<<10])
+	if err := arr.Write(data[190<<10:210<<10], 190<<10); err != nil {
+		t.Fatalf("Write() over a remapped block error = %v", err)
+	}
+	arr.Fail(0)
+	check(arr, "relying on the remapped block")
+
+	arr, err = Assemble([]Disk{disks[0], faulty, disks[2]})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m := arr.Status().Members[1]; m.State != DiskActive || m.BadBlocks != 1 || m.Remapped != 1 {
+		t.Errorf("member with a bad sector after Assemble() = %+v", m)
+	}
+	check(arr, "after Assemble()")
+}
+
+// TestBadBlockNoReserve checks that without a reserved area, bad blocks are
+// reconstructed, and that a scrub rewrites them once the sector takes writes
+// again.
+func TestBadBlockNoReserve(t *testing.T) {
+	faulty := &faultyDisk{Disk: NewMemDisk(0), bad: 5000, n: 1}
+	arr, err := New(Level5, []Disk{NewMemDisk(0), NewMemDisk(0), faulty}, 512)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := make([]byte, 64<<10)
+	rand.New(rand.NewSource(1)).Read(data)
+	if err := arr.Write(data, 0); err != nil {
+		t.Fatal(err)
+	}
+	if m := arr.Status().Members[2]; m.State != DiskActive || m.BadBlocks != 1 || m.Remapped != 0 {
+		t.Fatalf("member with a bad sector = %+v, want active with 1 bad block", m)
+	}
+	got, err := arr.Read(len(data), 0)
+	if err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("Read() over a bad block = %v, contents match %v", err, bytes.Equal(got, data))
+	}
+
+	faulty.n = 0
+	if report, err := arr.Scrub(true); err != nil || report.Mismatches != 0 {
+		t.Errorf("Scrub() = %+v, %v", report, err)
+	}
+	if m := arr.Status().Members[2]; m.BadBlocks != 0 {
+		t.Errorf("member after Scrub() = %+v, want no bad blocks", m)
+	}
+	arr.Fail(0)
+	got, err = arr.Read(len(data), 0)
+	if err != nil || !bytes.Equal(got, data) {
+		t.Errorf("Read() relying on the healed block = %v, contents match %v", err, bytes.Equal(got, data))
+	}
+}
+
+// TestBadBlockDeadDisk checks that a member that fails everywhere is failed
+// rather than listed block by block.
+func TestBadBlockDeadDisk(t *testing.T) {
+	dead := &faultyDisk{Disk: NewMemDisk(0), n: 1 << 40}
+	arr, err := New(Level1, []Disk{NewMemDisk(0), dead}, 512)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := arr.Write(make([]byte, 8192), 0); err != nil {
+		t.Fatal(err)
+	}
+	if m := arr.Status().Members[1]; m.State != DiskFailed || m.BadBlocks != 0 {
+		t.Errorf("dead member = %+v, want failed", m)
+	}
+}
+
+func TestBadListCut(t *testing.T) {
+	l := &badList{blocks: []badBlock{{1, -1}, {2, -1}, {3, 0}, {5, -1}}}
+	if got, want := l.holes(1000, 5*badBlockSize), [][2]int{{3096, 11288}, {19480, 20480}}; !equalParts(got, want) {
+		t.Errorf("holes() = %v, want %v", got, want)
+	}
+	if got, want := l.cut(1000, 5*badBlockSize), [][2]int{{0, 3096}, {11288, 19480}}; !equalParts(got, want) {
+		t.Errorf("cut() = %v, want %v", got, want)
+	}
+	if l.clear(badBlockSize+100, badBlockSize, 1<<20) || len(l.blocks) != 4 {
+		t.Errorf("clear() of part of a block dropped it: %v", l.blocks)
+	}
+}
+
+func equalParts(a, b [][2]int) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// TestDiskSize checks that disks of DiskSize hold the member data asked for
+// and are taken as replacements.
+func TestDiskSize(t *testing.T) {
+	for _, size := range []int64{4096, 1 << 20, 1<<20 - 4096, 255 << 12 * 256, 64 << 20} {
+		disks := make([]Disk, 3)
+		for i := range disks {
+			disks[i] = NewMemDisk(DiskSize(size))
+		}
+		arr, err := Create(Level5, disks, 4096)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := arr.Status().Members[0].Size; got != size {
+			t.Errorf("member size on disks of DiskSize(%d) = %d", size, got)
+		}
+		arr.Fail(1)
+		if err := arr.Replace(1, NewMemDisk(DiskSize(size))); err != nil {
+			t.Errorf("Replace() with a disk of DiskSize(%d) error = %v", size, err)
+		}
+	}
+}
@@ -0,0 +1,160 @@
+package raid
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+var benchLevels = []struct {
+	level    Level
+	numDisks int
+}{
+	{Level0, 4},
+	{Level1, 2},
+	{Level10, 4},
+	{Level4, 4},
+	{Level5, 4},
+	{Level6, 6},
+	{LevelLinear, 4},
+	{LevelDeclustered, 7},
+	{LevelHybrid, 4},
+}
+
+var benchSizes = []int{4 << 10, 64 << 10, 1 << 20}
+
+const (
+	benchStripe = 64 << 10
+	benchSpan   = 16 << 20
+)
+
+// newBenchArray builds an array whose members hold benchSpan bytes each, as
+// linear and SHR arrays take their size from the members. The members of an
+// SHR array alternate between two sizes, so that it has two tiers.
+func newBenchArray(b *testing.B, level Level, numDisks int) Array {
+	disks := make([]Disk, numDisks)
+	for i := range disks {
+		size := int64(benchSpan)
+		if level == LevelHybrid && i%2 == 0 {
+			size *= 2
+		}
+		disks[i] = NewMemDisk(size)
+	}
+	arr, err := New(level, disks, benchStripe)
+	if err != nil {
+		b.Fatalf("New(%s) error = %v", level, err)
+	}
+	return arr
+}
+
+func BenchmarkWrite(b *testing.B) {
+	for _, l := range benchLevels {
+		for _, size := range benchSizes {
+			b.Run(fmt.Sprintf("%s/%dK", l.level, size>>10), func(b *testing.B) {
+				arr := newBenchArray(b, l.level, l.numDisks)
+				if err := arr.Write(make([]byte, benchSpan), 0); err != nil {
+					b.Fatal(err)
+				}
+				data := make([]byte, size)
+				b.SetBytes(int64(size))
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					if err := arr.Write(data, (i*size)%benchSpan); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		}
+	}
+}
+
+func BenchmarkRead(b *testing.B) {
+	for _, l := range benchLevels {
+		for _, size := range benchSizes {
+			b.Run(fmt.Sprintf("%s/%dK", l.level, size>>10), func(b *testing.B) {
+				arr := newBenchArray(b, l.level, l.numDisks)
+				if err := arr.Write(make([]byte, benchSpan), 0); err != nil {
+					b.Fatal(err)
+				}
+				b.SetBytes(int64(size))
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					if _, err := arr.Read(size, (i*size)%benchSpan); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		}
+	}
+}
+
+// slowDisk adds a fixed latency to every request, like a disk that has to
+// seek. Disks sharing a serial mutex take turns, which is what the array
+// would see if it issued member requests one after the other.
+type slowDisk struct {
+	Disk
+	latency time.Duration
+	serial  *sync.Mutex
+}
+
+func (d *slowDisk) wait() {
+	if d.serial != nil {
+		d.serial.Lock()
+		defer d.serial.Unlock()
+	}
+	time.Sleep(d.latency)
+}
+
+func (d *slowDisk) ReadAt(p []byte, off int64) (int, error) {
+	d.wait()
+	return d.Disk.ReadAt(p, off)
+}
+
+func (d *slowDisk) WriteAt(p []byte, off int64) (int, error) {
+	d.wait()
+	return d.Disk.WriteAt(p, off)
+}
+
+// BenchmarkSlowMembers writes full stripes to members with 1ms of latency,
+// once with member requests overlapping and once with them serialized.
+func BenchmarkSlowMembers(b *testing.B) {
+	levels := []struct {
+		level     Level
+		numDisks  int
+		dataDisks int
+	}{
+		{Level0, 4, 4},
+		{Level5, 5, 4},
+	}
+	for _, l := range levels {
+		for _, serial := range []bool{false, true} {
+			mode := "parallel"
+			if serial {
+				mode = "serial"
+			}
+			b.Run(fmt.Sprintf("%s/%s", l.level, mode), func(b *testing.B) {
+				var mu *sync.Mutex
+				if serial {
+					mu = new(sync.Mutex)
+				}
+				disks := make([]Disk, l.numDisks)
+				for i := range disks {
+					disks[i] = &slowDisk{NewMemDisk(0), time.Millisecond, mu}
+				}
+				arr, err := New(l.level, disks, benchStripe)
+				if err != nil {
+					b.Fatal(err)
+				}
+				data := make([]byte, l.dataDisks*benchStripe)
+				b.SetBytes(int64(len(data)))
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					if err := arr.Write(data, (i*len(data))%benchSpan); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		}
+	}
+}
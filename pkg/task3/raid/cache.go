@@ -0,0 +1,281 @@
+package raid
+
+import (
+	"container/list"
+	"errors"
+	"slices"
+	"sync"
+)
+
+type CacheMode int
+
+const (
+	// WriteBack keeps written data in the cache until the stripe is evicted
+	// or Flush is called. Writes are visible to reads right away, but a crash
+	// loses whatever was not flushed.
+	WriteBack CacheMode = iota
+	// WriteThrough passes every write on to the array before returning. The
+	// cache then only saves reads.
+	WriteThrough
+)
+
+func (m CacheMode) String() string {
+	switch m {
+	case WriteBack:
+		return "write-back"
+	case WriteThrough:
+		return "write-through"
+	default:
+		return "unknown"
+	}
+}
+
+// StripeCache is an Array that caches whole stripes of another one. Small
+// writes to the same stripe are gathered in the cache, and a stripe that was
+// written completely goes to the members as one full-stripe write, so parity
+// arrays do not have to read the old contents first.
+//
+// Management operations such as Fail or Rebuild are passed on unchanged;
+// call Flush first if they should see the cached writes.
+type StripeCache struct {
+	Array
+	mu       sync.Mutex
+	mode     CacheMode
+	lineSize int
+	maxLines int
+	lines    map[int]*list.Element
+	lru      *list.List // of *cacheLine, most recently used first
+}
+
+// cacheLine is one stripe in the cache. Only the bytes in valid hold the
+// stripe's contents; dirty ones have not reached the array yet.
+type cacheLine struct {
+	index int
+	data  []byte
+	valid extents
+	dirty extents
+}
+
+// NewStripeCache caches up to size stripes of arr.
+func NewStripeCache(arr Array, size int, mode CacheMode) (*StripeCache, error) {
+	if size <= 0 {
+		return nil, errors.New("stripe cache: size must be positive")
+	}
+	b, ok := arr.(interface{ base() *members })
+	if !ok {
+		return nil, errors.New("stripe cache: unsupported array")
+	}
+	c := b.base().codec
+	return &StripeCache{
+		Array:    arr,
+		mode:     mode,
+		lineSize: c.dataMembers() * c.rowSize(),
+		maxLines: size,
+		lines:    make(map[int]*list.Element),
+		lru:      list.New(),
+	}, nil
+}
+
+func (c *StripeCache) Mode() CacheMode {
+	return c.mode
+}
+
+// Read serves the stripes held by the cache from it. Stripes that are not
+// cached yet are read from the array, but only as far as requested.
+func (c *StripeCache) Read(length int, pos int) ([]byte, error) {
+	if err := checkRange(pos, length); err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	result := make([]byte, length)
+	for _, ch := range splitChunks(pos, length, c.lineSize) {
+		e, ok := c.lines[ch.index]
+		if !ok {
+			data, err := c.Array.Read(ch.n, pos+ch.pos)
+			if err != nil {
+				return nil, err
+			}
+			line := c.insert(ch.index)
+			copy(line.data[ch.within:], data)
+			line.valid.add(ch.within, ch.within+ch.n)
+			e = c.lines[ch.index]
+		}
+		c.lru.MoveToFront(e)
+		line := e.Value.(*cacheLine)
+		if !line.valid.covers(ch.within, ch.within+ch.n) {
+			if err := c.fill(line); err != nil {
+				return nil, err
+			}
+		}
+		copy(result[ch.pos:ch.pos+ch.n], line.data[ch.within:])
+	}
+	return result, c.evict()
+}
+
+// insert adds an empty line for stripe index.
+func (c *StripeCache) insert(index int) *cacheLine {
+	line := &cacheLine{index: index, data: make([]byte, c.lineSize)}
+	c.lines[index] = c.lru.PushFront(line)
+	return line
+}
+
+// Write stores data in the cache. In write-through mode it is also written
+// to the array before Write returns.
+func (c *StripeCache) Write(data []byte, pos int) error {
+	if err := checkRange(pos, len(data)); err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.mode == WriteThrough {
+		if err := c.Array.Write(data, pos); err != nil {
+			return err
+		}
+		for _, ch := range splitChunks(pos, len(data), c.lineSize) {
+			if e, ok := c.lines[ch.index]; ok {
+				line := e.Value.(*cacheLine)
+				copy(line.data[ch.within:], data[ch.pos:ch.pos+ch.n])
+				line.valid.add(ch.within, ch.within+ch.n)
+			}
+		}
+		return nil
+	}
+
+	for _, ch := range splitChunks(pos, len(data), c.lineSize) {
+		var line *cacheLine
+		if e, ok := c.lines[ch.index]; ok {
+			c.lru.MoveToFront(e)
+			line = e.Value.(*cacheLine)
+		} else {
+			line = c.insert(ch.index)
+		}
+		copy(line.data[ch.within:], data[ch.pos:ch.pos+ch.n])
+		line.valid.add(ch.within, ch.within+ch.n)
+		line.dirty.add(ch.within, ch.within+ch.n)
+	}
+	return c.evict()
+}
+
+// Discard writes back and drops the cached stripes in the range before
+// discarding it in the array.
+func (c *StripeCache) Discard(pos, length int) error {
+	if err := checkRange(pos, length); err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, ch := range splitChunks(pos, length, c.lineSize) {
+		if e, ok := c.lines[ch.index]; ok {
+			if err := c.writeBack(e.Value.(*cacheLine)); err != nil {
+				return err
+			}
+			c.lru.Remove(e)
+			delete(c.lines, ch.index)
+		}
+	}
+	return c.Array.Discard(pos, length)
+}
+
+// Flush writes every dirty stripe to the array and then flushes the array.
+// When Flush returns without error, all writes that completed before it was
+// called are durable on the members that can sync.
+func (c *StripeCache) Flush() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	lines := make([]*cacheLine, 0, c.lru.Len())
+	for e := c.lru.Front(); e != nil; e = e.Next() {
+		lines = append(lines, e.Value.(*cacheLine))
+	}
+	slices.SortFunc(lines, func(a, b *cacheLine) int { return a.index - b.index })
+	for _, line := range lines {
+		if err := c.writeBack(line); err != nil {
+			return err
+		}
+	}
+	return c.Array.Flush()
+}
+
+// evict writes back and drops the least recently used stripes until the
+// cache is within its size.
+func (c *StripeCache) evict() error {
+	for c.lru.Len() > c.maxLines {
+		e := c.lru.Back()
+		line := e.Value.(*cacheLine)
+		if err := c.writeBack(line); err != nil {
+			return err
+		}
+		c.lru.Remove(e)
+		delete(c.lines, line.index)
+	}
+	return nil
+}
+
+// writeBack writes the dirty parts of a line to the array. A line that holds
+// the whole stripe is written in one piece.
+func (c *StripeCache) writeBack(line *cacheLine) error {
+	if len(line.dirty) == 0 {
+		return nil
+	}
+	pos := line.index * c.lineSize
+	if line.valid.covers(0, c.lineSize) {
+		if err := c.Array.Write(line.data, pos); err != nil {
+			return err
+		}
+	} else {
+		for _, x := range line.dirty {
+			if err := c.Array.Write(line.data[x.lo:x.hi], pos+x.lo); err != nil {
+				return err
+			}
+		}
+	}
+	line.dirty = nil
+	return nil
+}
+
+// fill reads the parts of a line that are not valid from the array, as far
+// as they lie within it.
+func (c *StripeCache) fill(line *cacheLine) error {
+	pos := line.index * c.lineSize
+	n := int(max(min(int64(c.lineSize), c.Array.Status().Size-int64(pos)), 0))
+	data, err := c.Array.Read(n, pos)
+	if err != nil {
+		return err
+	}
+	for _, x := range line.valid {
+		copy(data[min(x.lo, n):min(x.hi, n)], line.data[x.lo:x.hi])
+	}
+	copy(line.data, data)
+	line.valid.add(0, n)
+	return nil
+}
+
+// extents is a sorted list of disjoint, non-adjacent byte ranges.
+type extents []extent
+
+type extent struct {
+	lo, hi int
+}
+
+func (xs *extents) add(lo, hi int) {
+	old := *xs
+	out := make(extents, 0, len(old)+1)
+	i := 0
+	for ; i < len(old) && old[i].hi < lo; i++ {
+		out = append(out, old[i])
+	}
+	for ; i < len(old) && old[i].lo <= hi; i++ {
+		lo, hi = min(lo, old[i].lo), max(hi, old[i].hi)
+	}
+	out = append(out, extent{lo, hi})
+	*xs = append(out, old[i:]...)
+}
+
+func (xs extents) covers(lo, hi int) bool {
+	for _, x := range xs {
+		if x.lo <= lo && hi <= x.hi {
+			return true
+		}
+	}
+	return lo >= hi
+}
@@ -0,0 +1,179 @@
+package raid
+
+import (
+	"bytes"
+	"errors"
+	"math/rand"
+	"sync/atomic"
+	"testing"
+)
+
+// countingDisk counts the requests that reach a disk.
+type countingDisk struct {
+	Disk
+	reads, writes atomic.Int64
+}
+
+func (d *countingDisk) ReadAt(p []byte, off int64) (int, error) {
+	d.reads.Add(1)
+	return d.Disk.ReadAt(p, off)
+}
+
+func (d *countingDisk) WriteAt(p []byte, off int64) (int, error) {
+	d.writes.Add(1)
+	return d.Disk.WriteAt(p, off)
+}
+
+func TestStripeCacheCoalesces(t *testing.T) {
+	counting := make([]*countingDisk, 4)
+	disks := make([]Disk, len(counting))
+	for i := range disks {
+		counting[i] = &countingDisk{Disk: NewMemDisk(0)}
+		disks[i] = counting[i]
+	}
+	arr, err := New(Level5, disks, 16)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cache, err := NewStripeCache(arr, 4, WriteBack)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Two whole stripes written in small pieces.
+	want := make([]byte, 2*3*16)
+	rand.New(rand.NewSource(1)).Read(want)
+	for pos := 0; pos < len(want); pos += 6 {
+		if err := cache.Write(want[pos:pos+6], pos); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i, d := range counting {
+		if n := d.writes.Load(); n != 0 {
+			t.Errorf("disk %d got %d writes before Flush()", i, n)
+		}
+	}
+	if err := cache.Flush(); err != nil {
+		t.Fatalf("Flush() error = %v", err)
+	}
+	for i, d := range counting {
+		if n := d.reads.Load(); n != 0 {
+			t.Errorf("disk %d got %d reads for full-stripe writes", i, n)
+		}
+		if n := d.writes.Load(); n != 2 {
+			t.Errorf("disk %d got %d writes, want one per stripe", i, n)
+		}
+	}
+	got, err := arr.Read(len(want), 0)
+	if err != nil || !bytes.Equal(got, want) {
+		t.Errorf("array Read() after Flush() = %v, contents match %v", err, bytes.Equal(got, want))
+	}
+}
+
+// TestStripeCache mixes reads, writes and discards through a cache that is
+// too small for the data, so that stripes are evicted all the time.
+func TestStripeCache(t *testing.T) {
+	tests := []struct {
+		level    Level
+		numDisks int
+		mode     CacheMode
+	}{
+		{Level1, 2, WriteBack},
+		{Level5, 4, WriteBack},
+		{Level6, 5, WriteBack},
+		{Level10, 4, WriteBack},
+		{Level5, 3, WriteThrough},
+		{Level6, 4, WriteThrough},
+	}
+	for _, tt := range tests {
+		t.Run(tt.level.String()+"/"+tt.mode.String(), func(t *testing.T) {
+			rng := rand.New(rand.NewSource(1))
+			arr := newTestArray(t, tt.level, tt.numDisks, 8)
+			want := make([]byte, 512)
+			arr.Write(want, 0)
+			cache, err := NewStripeCache(arr, 3, tt.mode)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i := 0; i < 300; i++ {
+				pos := rng.Intn(len(want))
+				n := rng.Intn(min(len(want)-pos, 64)) + 1
+				switch rng.Intn(6) {
+				case 0:
+					if err := cache.Discard(pos, n); err != nil {
+						t.Fatal(err)
+					}
+					clear(want[pos : pos+n])
+				case 1, 2:
+					got, err := cache.Read(n, pos)
+					if err != nil || !bytes.Equal(got, want[pos:pos+n]) {
+						t.Fatalf("Read(%d, %d) = %v, contents match %v", n, pos, err, bytes.Equal(got, want[pos:pos+n]))
+					}
+				default:
+					data := make([]byte, n)
+					rng.Read(data)
+					if err := cache.Write(data, pos); err != nil {
+						t.Fatal(err)
+					}
+					copy(want[pos:], data)
+					if tt.mode == WriteThrough {
+						if got, _ := arr.Read(n, pos); !bytes.Equal(got, data) {
+							t.Fatalf("write-through Write(%d bytes, %d) did not reach the array", n, pos)
+						}
+					}
+				}
+			}
+			if err := cache.Flush(); err != nil {
+				t.Fatalf("Flush() error = %v", err)
+			}
+			got, err := arr.Read(len(want), 0)
+			if err != nil || !bytes.Equal(got, want) {
+				t.Errorf("array Read() after Flush() = %v, contents match %v", err, bytes.Equal(got, want))
+			}
+			if report, err := arr.Scrub(false); err != nil || report.Mismatches != 0 {
+				t.Errorf("Scrub() = %+v, %v", report, err)
+			}
+		})
+	}
+}
+
+// syncDisk is a disk whose Sync returns err.
+type syncDisk struct {
+	Disk
+	err error
+}
+
+func (d *syncDisk) Sync() error {
+	return d.err
+}
+
+// TestFlushSyncError checks that a member that fails to sync fails Flush, so
+// that callers do not take the writes for durable.
+func TestFlushSyncError(t *testing.T) {
+	disks := make([]Disk, 4)
+	for i := range disks {
+		disks[i] = &syncDisk{Disk: NewMemDisk(0)}
+	}
+	errSync := errors.New("sync failed")
+	disks[2].(*syncDisk).err = errSync
+	arr, err := New(Level5, disks, 16)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cache, err := NewStripeCache(arr, 4, WriteBack)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cache.Write(make([]byte, 100), 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := cache.Flush(); !errors.Is(err, errSync) {
+		t.Errorf("Flush() error = %v, want %v", err, errSync)
+	}
+	if s := arr.Status(); s.Members[2].State != DiskFailed {
+		t.Errorf("disk 2 is %v after failing to sync", s.Members[2].State)
+	}
+	if err := cache.Flush(); err != nil {
+		t.Errorf("Flush() without the failed member error = %v", err)
+	}
+}
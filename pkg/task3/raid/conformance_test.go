@@ -0,0 +1,132 @@
+package raid_test
+
+import (
+	"fmt"
+	"graid-tech-assignment/pkg/task3/raid"
+	"graid-tech-assignment/pkg/task3/raid/raidtest"
+	"testing"
+)
+
+var levels = []struct {
+	name      string
+	level     raid.Level
+	numDisks  int
+	tolerance int
+}{
+	{"linear", raid.LevelLinear, 3, 0},
+	{"dRAID", raid.LevelDeclustered, 7, 1},
+	{"RAID0", raid.Level0, 3, 0},
+	{"RAID1", raid.Level1, 3, 2},
+	{"RAID10", raid.Level10, 4, 1},
+	{"RAID4", raid.Level4, 4, 1},
+	{"RAID5", raid.Level5, 4, 1},
+	{"RAID6", raid.Level6, 5, 2},
+}
+
+// memberSize is small enough for the suite to try every failure quickly and
+// large enough for many stripes.
+const memberSize = 4096
+
+func config(level raid.Level, numDisks, tolerance int, superblocks bool) raidtest.Config {
+	return raidtest.Config{
+		New: func() (raid.RAID, error) {
+			disks := make([]raid.Disk, numDisks)
+			for i := range disks {
+				if superblocks {
+					disks[i] = raid.NewMemDisk(raid.SuperblockSize + memberSize)
+				} else {
+					disks[i] = raid.NewMemDisk(memberSize)
+				}
+			}
+			if superblocks {
+				return raid.Create(level, disks, 64)
+			}
+			return raid.New(level, disks, 64)
+		},
+		NumDisks:  numDisks,
+		Tolerance: tolerance,
+		Seed:      1,
+	}
+}
+
+func TestConformance(t *testing.T) {
+	for _, l := range levels {
+		t.Run(l.name, func(t *testing.T) {
+			raidtest.Run(t, config(l.level, l.numDisks, l.tolerance, false))
+		})
+		t.Run(l.name+"/superblocks", func(t *testing.T) {
+			raidtest.Run(t, config(l.level, l.numDisks, l.tolerance, true))
+		})
+	}
+}
+
+// TestDeclusteredConformance covers declustered geometries other than the
+// default one: without spares, with double parity, and with mirrored pairs.
+func TestDeclusteredConformance(t *testing.T) {
+	for _, c := range []raid.DeclusteredConfig{{Data: 3, Parity: 1}, {Data: 2, Parity: 2, Spares: 1}, {Data: 1, Parity: 1, Spares: 3}} {
+		t.Run(fmt.Sprintf("%d+%d+%d", c.Data, c.Parity, c.Spares), func(t *testing.T) {
+			raidtest.Run(t, raidtest.Config{
+				New: func() (raid.RAID, error) {
+					disks := make([]raid.Disk, 8)
+					for i := range disks {
+						disks[i] = raid.NewMemDisk(raid.SuperblockSize + memberSize)
+					}
+					return raid.CreateDeclustered(disks, 64, c)
+				},
+				NumDisks:  8,
+				Tolerance: c.Parity,
+				Seed:      1,
+			})
+		})
+	}
+}
+
+// hybridConfig is an SHR array over members of five different sizes, so
+// that it has tiers of every width down to a mirror.
+func hybridConfig() raidtest.Config {
+	return raidtest.Config{
+		New: func() (raid.RAID, error) {
+			disks := make([]raid.Disk, 5)
+			for i, size := range []int{4, 2, 4, 1, 3} {
+				disks[i] = raid.NewMemDisk(raid.SuperblockSize + int64(size)*memberSize/4)
+			}
+			return raid.Create(raid.LevelHybrid, disks, 64)
+		},
+		NumDisks:  5,
+		Tolerance: 1,
+		Seed:      1,
+	}
+}
+
+func TestHybridConformance(t *testing.T) {
+	raidtest.Run(t, hybridConfig())
+}
+
+func TestStripeCacheConformance(t *testing.T) {
+	for _, mode := range []raid.CacheMode{raid.WriteBack, raid.WriteThrough} {
+		t.Run(mode.String(), func(t *testing.T) {
+			c := config(raid.Level6, 5, 2, false)
+			newArray := c.New
+			c.New = func() (raid.RAID, error) {
+				r, err := newArray()
+				if err != nil {
+					return nil, err
+				}
+				return raid.NewStripeCache(r.(raid.Array), 4, mode)
+			}
+			raidtest.Run(t, c)
+		})
+	}
+}
+
+func FuzzLinear(f *testing.F) { raidtest.Fuzz(f, config(raid.LevelLinear, 3, 0, false)) }
+func FuzzDeclustered(f *testing.F) {
+	raidtest.Fuzz(f, config(raid.LevelDeclustered, 7, 1, false))
+}
+func FuzzHybrid(f *testing.F) { raidtest.Fuzz(f, hybridConfig()) }
+func FuzzRAID0(f *testing.F)  { raidtest.Fuzz(f, config(raid.Level0, 3, 0, false)) }
+func FuzzRAID1(f *testing.F)  { raidtest.Fuzz(f, config(raid.Level1, 3, 2, false)) }
+func FuzzRAID10(f *testing.F) { raidtest.Fuzz(f, config(raid.Level10, 4, 1, false)) }
+func FuzzRAID4(f *testing.F)  { raidtest.Fuzz(f, config(raid.Level4, 4, 1, false)) }
+func FuzzRAID5(f *testing.F)  { raidtest.Fuzz(f, config(raid.Level5, 4, 1, false)) }
+func FuzzRAID6(f *testing.F)  { raidtest.Fuzz(f, config(raid.Level6, 5, 2, false)) }
@@ -0,0 +1,97 @@
+package raid
+
+import (
+	"context"
+	"fmt"
+)
+
+// contextChunk is how much ReadContext and WriteContext transfer between two
+// looks at their context.
+const contextChunk = 1 << 20
+
+// ProgressError is returned by an operation that stopped before it was done,
+// because its context was cancelled or timed out. Err is the error of the
+// context.
+type ProgressError struct {
+	Op string
+	// Done of Total bytes were handled. Rebuilds and scrubs count the bytes
+	// of every member, reads and writes those of the array.
+	Done, Total int64
+	Err         error
+}
+
+func (e *ProgressError) Error() string {
+	return fmt.Sprintf("%s stopped after %d of %d bytes: %v", e.Op, e.Done, e.Total, e.Err)
+}
+
+func (e *ProgressError) Unwrap() error {
+	return e.Err
+}
+
+// ReadContext reads like r.Read, in pieces so that a large read stops soon
+// after ctx is done. It then returns what was read so far along with a
+// *ProgressError.
+func ReadContext(ctx context.Context, r RAID, length, pos int) ([]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, &ProgressError{"read", 0, int64(length), err}
+	}
+	if length <= contextChunk {
+		return r.Read(length, pos)
+	}
+	result := make([]byte, 0, length)
+	err := pieces(ctx, r, pos, length, func(at, n int) error {
+		data, err := r.Read(n, pos+at)
+		result = append(result, data...)
+		return err
+	})
+	if err, ok := err.(*ProgressError); ok {
+		err.Op = "read"
+		return result, err
+	}
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// WriteContext writes like r.Write, in pieces so that a large write stops
+// soon after ctx is done. What the *ProgressError it then returns counts as
+// done has been written; the rest of data has not.
+func WriteContext(ctx context.Context, r RAID, data []byte, pos int) error {
+	if err := ctx.Err(); err != nil {
+		return &ProgressError{"write", 0, int64(len(data)), err}
+	}
+	if len(data) <= contextChunk {
+		return r.Write(data, pos)
+	}
+	err := pieces(ctx, r, pos, len(data), func(at, n int) error {
+		return r.Write(data[at:at+n], pos+at)
+	})
+	if err, ok := err.(*ProgressError); ok {
+		err.Op = "write"
+	}
+	return err
+}
+
+// pieces calls fn with the offset into [pos, pos+length) and the length of
+// every piece of it, checking ctx in between. Pieces end on whole stripes of
+// arrays, so that writes need not read their old contents.
+func pieces(ctx context.Context, r RAID, pos, length int, fn func(at, n int) error) error {
+	chunk := contextChunk
+	if arr, ok := r.(Array); ok {
+		if w := arr.Geometry().StripeWidth; w > 0 {
+			chunk = max(chunk/w, 1) * w
+		}
+	}
+	for at := 0; at < length; {
+		if err := ctx.Err(); err != nil {
+			return &ProgressError{Done: int64(at), Total: int64(length), Err: err}
+		}
+		n := min(chunk-(pos+at)%chunk, length-at)
+		if err := fn(at, n); err != nil {
+			return err
+		}
+		at += n
+	}
+	return nil
+}
@@ -0,0 +1,152 @@
+package raid
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"math/rand"
+	"sync/atomic"
+	"testing"
+)
+
+// cancelDisk cancels a context once it has seen a number of writes.
+type cancelDisk struct {
+	Disk
+	writes atomic.Int64
+	after  int64
+	cancel context.CancelFunc
+}
+
+func (d *cancelDisk) WriteAt(p []byte, off int64) (int, error) {
+	if d.writes.Add(1) == d.after {
+		d.cancel()
+	}
+	return d.Disk.WriteAt(p, off)
+}
+
+func TestReadWriteContext(t *testing.T) {
+	arr := newTestArray(t, Level5, 4, 4096)
+	data := make([]byte, 5*contextChunk+100)
+	rand.New(rand.NewSource(1)).Read(data)
+	if err := WriteContext(context.Background(), arr, data, 10); err != nil {
+		t.Fatalf("WriteContext() error = %v", err)
+	}
+	got, err := ReadContext(context.Background(), arr, len(data), 10)
+	if err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("ReadContext() = %v, contents match %v", err, bytes.Equal(got, data))
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	var progress *ProgressError
+	if _, err := ReadContext(ctx, arr, len(data), 0); !errors.As(err, &progress) || progress.Done != 0 || !errors.Is(err, context.Canceled) {
+		t.Errorf("ReadContext() with a cancelled context error = %v", err)
+	}
+
+	// Cancelled halfway through, a write reports the prefix it wrote.
+	ctx, cancel = context.WithCancel(context.Background())
+	disks := make([]Disk, 4)
+	for i := range disks {
+		disks[i] = NewMemDisk(0)
+	}
+	disks[0] = &cancelDisk{Disk: disks[0], after: 2, cancel: cancel}
+	arr, err = New(Level5, disks, 4096)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = WriteContext(ctx, arr, data, 0)
+	if !errors.As(err, &progress) || progress.Op != "write" || progress.Done == 0 || progress.Done >= int64(len(data)) {
+		t.Fatalf("WriteContext() cancelled halfway error = %v", err)
+	}
+	got, err = arr.Read(len(data), 0)
+	if err != nil || !bytes.Equal(got[:progress.Done], data[:progress.Done]) || got[progress.Done] != 0 {
+		t.Errorf("Read() after a cancelled write = %v, prefix matches %v", err, bytes.Equal(got[:progress.Done], data[:progress.Done]))
+	}
+}
+
+// TestRebuildContext cancels a rebuild and checks that the next one resumes
+// where it stopped.
+func TestRebuildContext(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	disks := newMemDisks(3)
+	arr, err := New(Level5, disks, 512)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := make([]byte, 8*rebuildChunk)
+	rand.New(rand.NewSource(1)).Read(data)
+	if err := arr.Write(data, 0); err != nil {
+		t.Fatal(err)
+	}
+	arr.Fail(1)
+	fresh := &cancelDisk{Disk: NewMemDisk(0), after: 2, cancel: cancel}
+	if err := arr.Replace(1, fresh); err != nil {
+		t.Fatal(err)
+	}
+
+	err = arr.RebuildContext(ctx, 1)
+	var progress *ProgressError
+	if !errors.As(err, &progress) || !errors.Is(err, context.Canceled) || progress.Done != 2*rebuildChunk || progress.Total != 4*rebuildChunk {
+		t.Fatalf("RebuildContext() error = %v, want 2 of 4 chunks done", err)
+	}
+	if m := arr.Status().Members[1]; m.State != DiskRebuilding || m.Recovered != 2*rebuildChunk {
+		t.Errorf("member after a cancelled rebuild = %+v", m)
+	}
+	if err := arr.Rebuild(1); err != nil {
+		t.Fatalf("Rebuild() error = %v", err)
+	}
+	if got := fresh.writes.Load(); got != 4 {
+		t.Errorf("rebuild wrote %d chunks in all, want 4", got)
+	}
+	arr.Fail(0)
+	got, err := arr.Read(len(data), 0)
+	if err != nil || !bytes.Equal(got, data) {
+		t.Errorf("Read() relying on the rebuilt member = %v, contents match %v", err, bytes.Equal(got, data))
+	}
+}
+
+func TestScrubContext(t *testing.T) {
+	arr := newTestArray(t, Level6, 5, 512)
+	arr.Write(make([]byte, 4*rebuildChunk), 0)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	report, err := arr.ScrubContext(ctx, true)
+	if !errors.Is(err, context.Canceled) || report.Checked != 0 {
+		t.Errorf("ScrubContext() with a cancelled context = %+v, %v", report, err)
+	}
+}
+
+// TestSpareContext cancels sparing a dRAID member and checks that the array
+// reads fine and can spare the member again.
+func TestSpareContext(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	disks := newMemDisks(7)
+	disks[3] = &cancelDisk{Disk: NewMemDisk(0), after: 3, cancel: cancel}
+	arr, err := newDeclustered(disks, 512, DeclusteredConfig{Data: 2, Parity: 1, Spares: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := make([]byte, 24*rebuildChunk)
+	rand.New(rand.NewSource(1)).Read(data)
+	arr.Write(data, 0)
+	disks[3].(*cancelDisk).writes.Store(0)
+	arr.ClearDisk(0)
+
+	var progress *ProgressError
+	if err := arr.SpareContext(ctx, 0); !errors.As(err, &progress) || progress.Op != "sparing of disk 0" {
+		t.Fatalf("SpareContext() error = %v", err)
+	}
+	if arr.isSpared(0) {
+		t.Error("member spared after a cancelled SpareContext()")
+	}
+	got, err := arr.Read(len(data), 0)
+	if err != nil || !bytes.Equal(got, data) {
+		t.Errorf("Read() after a cancelled spare = %v, contents match %v", err, bytes.Equal(got, data))
+	}
+	if err := arr.Rebuild(0); err != nil {
+		t.Fatalf("Rebuild() error = %v", err)
+	}
+	if report, err := arr.Scrub(false); err != nil || report.Mismatches != 0 {
+		t.Errorf("Scrub() = %+v, %v", report, err)
+	}
+}
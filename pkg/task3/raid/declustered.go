@@ -0,0 +1,546 @@
+package raid
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+)
+
+// ErrNoSpare is returned when the distributed spare space of a declustered
+// array is used up.
+var ErrNoSpare = errors.New("no distributed spare space left")
+
+// DeclusteredConfig is the geometry of a declustered array.
+type DeclusteredConfig struct {
+	// Data and Parity are the chunks of every stripe. Parity is 1 for XOR
+	// parity or 2 for P and Q, computed as RAID5 and RAID6 do.
+	Data   int `json:"data"`
+	Parity int `json:"parity"`
+	// Spares is how many failed members the distributed spare space can
+	// take in. Members left over once the stripes are laid out add to it.
+	Spares int `json:"spares"`
+}
+
+// defaultDeclustered is the geometry New and Create use for a declustered
+// array of n members: single parity and one spare, with the widest stripe of
+// up to 8 data chunks that divides the remaining members evenly.
+func defaultDeclustered(n int) DeclusteredConfig {
+	c := DeclusteredConfig{Data: n - 2, Parity: 1, Spares: 1}
+	for data := min(8, n-2); data >= 2; data-- {
+		if (n-1)%(data+1) == 0 {
+			c.Data = data
+			break
+		}
+	}
+	return c
+}
+
+// sparedDisk is a failed member whose chunks were rebuilt into spare column
+// Slot of every row. Excluded lists the members that were not active at the
+// time; rows whose spare chunk sits on one of them leave the chunk of the
+// failed member where it was. Neither depends on other spared members, so
+// members enter and leave the spare space without moving each other's
+// chunks.
+type sparedDisk struct {
+	Disk     int   `json:"disk"`
+	Slot     int   `json:"slot"`
+	Excluded []int `json:"excluded,omitempty"`
+}
+
+// Declustered is a declustered parity array in the style of ZFS dRAID.
+// Stripes have a fixed width of Data+Parity chunks, narrower than the pool of
+// members. A row of chunks, one on every member at the same offset, holds as
+// many stripes as fit and spare chunks for the rest. Every row shuffles the
+// members differently, so stripes and spare space are spread evenly over all
+// of them.
+//
+// Spare rebuilds a failed member into the spare chunks. Those sit on all the
+// other members, so the rebuild reads from and writes to all of them instead
+// of funnelling into one new disk, and redundancy comes back quickly. Rebuild
+// then copies the chunks back onto the member, once it has been replaced,
+// which frees the spare space again.
+type Declustered struct {
+	*members
+	numDisks   int
+	stripeSize int
+	config     DeclusteredConfig
+	width      int    // chunks per stripe
+	groups     int    // stripes per row
+	pq         *RAID6 // P and Q arithmetic of double parity stripes
+	stripes    *parityStripes
+
+	// spared lists the members whose chunks live in the spare space, in the
+	// order they were spared.
+	spared []sparedDisk
+	// While chunks move between members, rows below progress are laid out
+	// by next instead.
+	moving   bool
+	next     []sparedDisk
+	progress int
+	moveMu   sync.Mutex // one move at a time
+}
+
+// NewDeclustered builds a declustered array on memory disks.
+func NewDeclustered(numDisks, stripeSize int, c DeclusteredConfig) (*Declustered, error) {
+	return newDeclustered(newMemDisks(numDisks), stripeSize, c)
+}
+
+func newDeclustered(disks []Disk, stripeSize int, c DeclusteredConfig) (*Declustered, error) {
+	if c.Data < 1 {
+		return nil, errors.New("dRAID: stripes need at least one data chunk")
+	}
+	if c.Parity < 1 || c.Parity > 2 {
+		return nil, errors.New("dRAID: parity must be 1 or 2")
+	}
+	if c.Spares < 0 {
+		return nil, errors.New("dRAID: negative number of spares")
+	}
+	if c.Parity == 2 && c.Data > 255 {
+		return nil, errors.New("dRAID: at most 255 data chunks with double parity")
+	}
+	if need := c.Data + c.Parity + c.Spares; len(disks) < need {
+		return nil, fmt.Errorf("dRAID: %d disks given, need at least %d", len(disks), need)
+	}
+	if stripeSize <= 0 {
+		return nil, errors.New("dRAID: stripe size must be positive")
+	}
+	raid := &Declustered{
+		members:    newMembers(disks),
+		numDisks:   len(disks),
+		stripeSize: stripeSize,
+		config:     c,
+		width:      c.Data + c.Parity,
+		groups:     (len(disks) - c.Spares) / (c.Data + c.Parity),
+		pq:         &RAID6{dataDisks: c.Data, stripeSize: stripeSize},
+	}
+	raid.codec = raid
+	raid.stripes = &parityStripes{raid.members, raid, stripeSize, c.Data, raid.groups, 0}
+	return raid, nil
+}
+
+// Config returns the geometry of the array.
+func (r *Declustered) Config() DeclusteredConfig {
+	return r.config
+}
+
+func (r *Declustered) Read(length int, offset int) ([]byte, error) {
+	if err := checkRange(offset, length); err != nil {
+		return nil, err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.stripes.read(length, offset)
+}
+
+func (r *Declustered) Write(data []byte, offset int) error {
+	if err := checkRange(offset, len(data)); err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.stripes.write(data, offset)
+}
+
+func (r *Declustered) ReadV(vecs []IOVec) error {
+	if err := checkVecs(vecs); err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.stripes.readV(vecs)
+}
+
+func (r *Declustered) WriteV(vecs []IOVec) error {
+	if err := checkVecs(vecs); err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.stripes.writeV(coalesce(vecs))
+}
+
+func (r *Declustered) Discard(pos, length int) error {
+	if err := checkRange(pos, length); err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.stripes.discard(pos, length)
+}
+
+// permutation is the order of the members in a row: a Fisher-Yates shuffle
+// driven by splitmix64 seeded with the row number. It must never change, as
+// it decides where data lives.
+func (r *Declustered) permutation(row int) []int {
+	perm := make([]int, r.numDisks)
+	for i := range perm {
+		perm[i] = i
+	}
+	state := uint64(row)
+	for i := len(perm) - 1; i > 0; i-- {
+		state += 0x9e3779b97f4a7c15
+		z := state
+		z = (z ^ z>>30) * 0xbf58476d1ce4e5b9
+		z = (z ^ z>>27) * 0x94d049bb133111eb
+		z ^= z >> 31
+		j := int(z % uint64(i+1))
+		perm[i], perm[j] = perm[j], perm[i]
+	}
+	return perm
+}
+
+// columns returns the member holding every chunk of a row with the given
+// members spared: the chunks of stripe g are columns g*width to
+// (g+1)*width, and the spare chunks follow them. The chunks of a spared
+// member move to its spare column, including those it took in as a spare
+// itself. Where that is unusable, they stay and are reconstructed on every
+// access.
+func (r *Declustered) columns(row int, spared []sparedDisk) []int {
+	perm := r.permutation(row)
+	cols := slices.Clone(perm[:r.groups*r.width])
+	spares := perm[len(cols):]
+	for _, sp := range spared {
+		s := spares[sp.Slot]
+		if s == sp.Disk || slices.Contains(sp.Excluded, s) {
+			continue
+		}
+		for c, d := range cols {
+			if d == sp.Disk {
+				cols[c] = s
+			}
+		}
+	}
+	return cols
+}
+
+// layout is columns with the members spared that are in effect for row.
+func (r *Declustered) layout(row int) []int {
+	if r.moving && row < r.progress {
+		return r.columns(row, r.next)
+	}
+	return r.columns(row, r.spared)
+}
+
+func (r *Declustered) stripeDisks(s int) ([]int, []int) {
+	g := s % r.groups
+	cols := r.layout(s / r.groups)[g*r.width : (g+1)*r.width]
+	return cols[:r.config.Data:r.config.Data], cols[r.config.Data:]
+}
+
+func (r *Declustered) encode(data [][]byte, parity [][]byte) {
+	if r.config.Parity == 1 {
+		encodeXOR(data, parity)
+		return
+	}
+	r.pq.encode(data, parity)
+}
+
+func (r *Declustered) update(parity [][]byte, k int, delta []byte) {
+	if r.config.Parity == 1 {
+		xorInto(parity[0], delta)
+		return
+	}
+	r.pq.update(parity, k, delta)
+}
+
+// Geometry reports one stripe of Data chunks as the stripe width; a row of
+// chunks holds several of them.
+func (r *Declustered) Geometry() Geometry {
+	g := r.geometry(LevelDeclustered, r.stripeSize)
+	g.StripeWidth = r.config.Data * r.stripeSize
+	return g
+}
+
+func (r *Declustered) Map(pos, length int) ([]Extent, error) {
+	if pos < 0 || length < 0 {
+		return nil, errNegativeRange
+	}
+	return r.stripes.mapRange(pos, length), nil
+}
+
+func (r *Declustered) Level() Level {
+	return LevelDeclustered
+}
+
+func (r *Declustered) Status() Status {
+	return r.status(LevelDeclustered, r.stripeSize)
+}
+
+// eachStripe calls fn with the chunks of every stripe that rows, read from
+// all members at off, cover, and the members they came from.
+func (r *Declustered) eachStripe(rows [][]byte, off int64, fn func(chunks [][]byte, disks []int) error) error {
+	chunks := make([][]byte, r.width)
+	for start := 0; start < len(rows[0]); {
+		row := int((off + int64(start)) / int64(r.stripeSize))
+		end := min(len(rows[0]), int(int64(row+1)*int64(r.stripeSize)-off))
+		cols := r.layout(row)
+		for g := 0; g < r.groups; g++ {
+			disks := cols[g*r.width : (g+1)*r.width]
+			for j, d := range disks {
+				chunks[j] = rows[d][start:end]
+			}
+			if err := fn(chunks, disks); err != nil {
+				return err
+			}
+		}
+		start = end
+	}
+	return nil
+}
+
+// reconstruct rebuilds the chunks of the missing members stripe by stripe.
+// Rows of missing members that hold no chunk, such as unused spare space,
+// are left zero.
+func (r *Declustered) reconstruct(rows [][]byte, missing []int, off int64) error {
+	return r.eachStripe(rows, off, func(chunks [][]byte, disks []int) error {
+		var lost []int
+		for j, d := range disks {
+			if slices.Contains(missing, d) {
+				lost = append(lost, j)
+			}
+		}
+		switch {
+		case len(lost) == 0:
+			return nil
+		case len(lost) > r.config.Parity:
+			return fmt.Errorf("dRAID: %w", ErrDataLost)
+		case r.config.Parity == 1:
+			reconstructXOR(chunks, lost[0])
+			return nil
+		}
+		return r.pq.reconstruct(chunks, lost, off)
+	})
+}
+
+func (r *Declustered) verify(rows [][]byte, off int64, repair bool) int {
+	mismatches := 0
+	r.eachStripe(rows, off, func(chunks [][]byte, disks []int) error {
+		if r.config.Parity == 1 {
+			mismatches += verifyXOR(chunks, 0, len(chunks[0]), repair, func(int) int { return r.config.Data })
+		} else {
+			mismatches += r.pq.verify(chunks, 0, repair)
+		}
+		return nil
+	})
+	return mismatches
+}
+
+func (r *Declustered) dataMembers() int {
+	return r.groups * r.config.Data
+}
+
+func (r *Declustered) rowSize() int {
+	return r.stripeSize
+}
+
+// spareColumns is the number of spare chunks in every row.
+func (r *Declustered) spareColumns() int {
+	return r.numDisks - r.groups*r.width
+}
+
+func (r *Declustered) isSpared(diskIndex int) bool {
+	return slices.ContainsFunc(r.spared, func(sp sparedDisk) bool { return sp.Disk == diskIndex })
+}
+
+// Spare rebuilds the chunks of a failed member into the distributed spare
+// space, reading from and writing to all other members. The array is
+// redundant again afterwards, except in the rows whose spare chunk sits on
+// another member that is not active, and the member stays failed until
+// Rebuild copies its chunks back.
+func (r *Declustered) Spare(diskIndex int) error {
+	return r.SpareContext(context.Background(), diskIndex)
+}
+
+// SpareContext is Spare until ctx is done. The member is then not spared,
+// and the chunks already rebuilt into the spare space go unused.
+func (r *Declustered) SpareContext(ctx context.Context, diskIndex int) error {
+	r.moveMu.Lock()
+	defer r.moveMu.Unlock()
+	r.mu.Lock()
+	if err := r.checkIndex(diskIndex); err != nil {
+		r.mu.Unlock()
+		return err
+	}
+	if r.state[diskIndex] == DiskActive {
+		r.mu.Unlock()
+		return fmt.Errorf("%w: %d", ErrDiskInSync, diskIndex)
+	}
+	if r.isSpared(diskIndex) {
+		r.mu.Unlock()
+		return nil
+	}
+	if len(r.spared) >= r.spareColumns() {
+		r.mu.Unlock()
+		return fmt.Errorf("%w: %d members spared", ErrNoSpare, len(r.spared))
+	}
+	sp := sparedDisk{Disk: diskIndex}
+	for slices.ContainsFunc(r.spared, func(other sparedDisk) bool { return other.Slot == sp.Slot }) {
+		sp.Slot++
+	}
+	for i, s := range r.state {
+		if i != diskIndex && s != DiskActive {
+			sp.Excluded = append(sp.Excluded, i)
+		}
+	}
+	next := append(slices.Clone(r.spared), sp)
+	r.mu.Unlock()
+	return r.move(ctx, next, -1)
+}
+
+// Rebuild restores a member. A failed member is spared first, which makes
+// the array redundant again quickly; its chunks are then copied from the
+// spare space onto the member. Without spare space left, the member is
+// rebuilt from the parity directly.
+func (r *Declustered) Rebuild(diskIndex int) error {
+	return r.RebuildContext(context.Background(), diskIndex)
+}
+
+// RebuildContext is Rebuild until ctx is done. A copy back onto the member
+// that is cut short leaves it failed but spared no more, as the spare space
+// has missed the writes to the rows already copied.
+func (r *Declustered) RebuildContext(ctx context.Context, diskIndex int) error {
+	if err := r.SpareContext(ctx, diskIndex); err != nil && !errors.Is(err, ErrNoSpare) {
+		return err
+	}
+	r.moveMu.Lock()
+	defer r.moveMu.Unlock()
+	r.mu.Lock()
+	if r.state[diskIndex] == DiskActive {
+		r.mu.Unlock()
+		return fmt.Errorf("%w: %d", ErrDiskInSync, diskIndex)
+	}
+	next := slices.DeleteFunc(slices.Clone(r.spared), func(sp sparedDisk) bool { return sp.Disk == diskIndex })
+	r.state[diskIndex] = DiskRebuilding
+	r.recovered[diskIndex] = 0
+	// Until the copy completes, the superblocks say the member is not
+	// spared: its chunks are reconstructed from the parity if the copy is
+	// interrupted, as the spare space does not see writes to rows already
+	// copied.
+	r.save(next)
+	r.events.publish(Event{Kind: EventRebuildStarted, Disk: diskIndex, Total: r.extent()})
+	r.mu.Unlock()
+	return r.move(ctx, next, diskIndex)
+}
+
+// move changes which members are spared from r.spared to next, relocating
+// every chunk whose member changes one batch of rows at a time. A target
+// member is being rebuilt and recovered along with the rows.
+func (r *Declustered) move(ctx context.Context, next []sparedDisk, target int) error {
+	r.mu.Lock()
+	r.moving, r.next, r.progress = true, next, 0
+	rows := int((r.extent() + int64(r.stripeSize) - 1) / int64(r.stripeSize))
+	batch := r.chunkSize() / r.stripeSize
+	total := int64(rows) * int64(r.stripeSize)
+	t := r.newThrottle()
+	r.mu.Unlock()
+
+	// finished publishes the end of a rebuild; sparing only publishes its
+	// success.
+	finished := func(done int64, err error) error {
+		if target >= 0 {
+			return r.rebuildFinished(target, done, total, err)
+		}
+		return err
+	}
+	for row := 0; row < rows; row += batch {
+		n := min(batch, rows-row)
+		done := int64(row) * int64(r.stripeSize)
+		r.mu.Lock()
+		t.begin()
+		if err := ctx.Err(); err != nil {
+			op := fmt.Sprintf("sparing of disk %d", next[len(next)-1].Disk)
+			if target >= 0 {
+				op = fmt.Sprintf("rebuild of disk %d", target)
+			}
+			r.abortMove(target)
+			r.mu.Unlock()
+			return finished(done, &ProgressError{op, done, total, err})
+		}
+		if target >= 0 && r.state[target] != DiskRebuilding {
+			err := fmt.Errorf("rebuild of disk %d aborted: disk is %s", target, r.state[target])
+			r.abortMove(target)
+			r.mu.Unlock()
+			return finished(done, err)
+		}
+		ios, err := r.moveRows(row, n, next, target)
+		if err != nil {
+			r.abortMove(target)
+			r.mu.Unlock()
+			return finished(done, fmt.Errorf("moving row %d: %w", row, err))
+		}
+		r.progress = row + n
+		if target >= 0 {
+			r.recovered[target] = int64(row+n) * int64(r.stripeSize)
+			r.rebuildProgress(target, done, r.recovered[target], total)
+		}
+		if err := r.writeAll(ios); err != nil {
+			r.abortMove(target)
+			r.mu.Unlock()
+			return finished(done, fmt.Errorf("moving row %d: %w", row, err))
+		}
+		t.done(n * r.stripeSize)
+		r.mu.Unlock()
+		t.wait(ctx)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if target >= 0 && r.state[target] != DiskRebuilding {
+		r.abortMove(target)
+		return finished(total, fmt.Errorf("rebuild of disk %d aborted: disk is %s", target, r.state[target]))
+	}
+	r.spared, r.moving, r.next = next, false, nil
+	if target >= 0 {
+		r.state[target] = DiskActive
+		r.recovered[target] = 0
+		finished(total, nil)
+	} else {
+		r.events.publish(Event{Kind: EventSpareActivated, Disk: next[len(next)-1].Disk})
+	}
+	r.save(r.spared)
+	return nil
+}
+
+// moveRows reads the chunks of n rows that next places elsewhere, or on the
+// target, as they are laid out now, and returns the writes that put them
+// where next wants them.
+func (r *Declustered) moveRows(row, n int, next []sparedDisk, target int) ([]memberIO, error) {
+	var ios []memberIO
+	for ; n > 0; row, n = row+1, n-1 {
+		from, to := r.columns(row, r.spared), r.columns(row, next)
+		off := int64(row) * int64(r.stripeSize)
+		for c := range to {
+			if from[c] == to[c] && to[c] != target {
+				continue
+			}
+			p := make([]byte, r.stripeSize)
+			if err := r.readAt(from[c], p, off); err != nil {
+				return nil, err
+			}
+			ios = append(ios, memberIO{to[c], p, off})
+		}
+	}
+	return ios, nil
+}
+
+// abortMove gives up on a move. Rows already moved stay consistent when the
+// member being moved is treated as failed and not spared: it is stale, and
+// its chunks are reconstructed from the parity.
+func (r *Declustered) abortMove(target int) {
+	if target >= 0 {
+		r.spared = r.next
+		r.failLocked(target)
+	}
+	r.moving, r.next = false, nil
+}
+
+// save records the spared members in the superblocks along with the member
+// states.
+func (r *Declustered) save(spared []sparedDisk) {
+	if r.meta != nil {
+		r.meta.spared = slices.Clone(spared)
+	}
+	r.persist()
+}
@@ -0,0 +1,155 @@
+package raid
+
+import (
+	"bytes"
+	"errors"
+	"math/rand"
+	"testing"
+)
+
+// TestDeclusteredSpare spares a failed member and checks that the rebuild
+// writes to all other members, that the array is redundant again, and that
+// the chunks move back onto the member.
+func TestDeclusteredSpare(t *testing.T) {
+	disks := make([]Disk, 10)
+	counters := make([]*countingDisk, len(disks))
+	for i := range disks {
+		counters[i] = &countingDisk{Disk: NewMemDisk(0)}
+		disks[i] = counters[i]
+	}
+	arr, err := newDeclustered(disks, 16, DeclusteredConfig{Data: 2, Parity: 1, Spares: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := arr.Geometry(); got.DataMembers != 6 || got.StripeWidth != 32 {
+		t.Errorf("Geometry() = %+v, want 6 data members and a stripe width of 32", got)
+	}
+	data := make([]byte, 256*arr.Geometry().DataMembers*16)
+	rand.New(rand.NewSource(1)).Read(data)
+	if err := arr.Write(data, 0); err != nil {
+		t.Fatal(err)
+	}
+	check := func(when string) {
+		t.Helper()
+		got, err := arr.Read(len(data), 0)
+		if err != nil || !bytes.Equal(got, data) {
+			t.Errorf("Read() %s = %v, contents match %v", when, err, bytes.Equal(got, data))
+		}
+	}
+
+	arr.ClearDisk(0)
+	for _, c := range counters {
+		c.writes.Store(0)
+	}
+	if err := arr.Spare(0); err != nil {
+		t.Fatalf("Spare(0) error = %v", err)
+	}
+	for i, c := range counters {
+		if got := c.writes.Load(); (i == 0) != (got == 0) {
+			t.Errorf("disk %d got %d writes from sparing disk 0", i, got)
+		}
+	}
+	if err := arr.Spare(0); err != nil {
+		t.Errorf("Spare() of a spared member error = %v", err)
+	}
+
+	// Redundant again: another member may fail. There is no spare space
+	// left for it, so it is rebuilt in place.
+	arr.ClearDisk(5)
+	check("with two members lost")
+	if err := arr.Spare(5); !errors.Is(err, ErrNoSpare) {
+		t.Errorf("Spare() without spare space error = %v, want %v", err, ErrNoSpare)
+	}
+	for _, d := range []int{5, 0} {
+		if err := arr.Rebuild(d); err != nil {
+			t.Fatalf("Rebuild(%d) error = %v", d, err)
+		}
+	}
+	if arr.Status().Degraded() || len(arr.spared) != 0 {
+		t.Errorf("Status() after rebuilding = %+v, spared %v", arr.Status(), arr.spared)
+	}
+	if report, err := arr.Scrub(false); err != nil || report.Mismatches != 0 {
+		t.Errorf("Scrub() = %+v, %v", report, err)
+	}
+	check("after rebuilding")
+}
+
+// writeFailDisk fails every write once broken is set.
+type writeFailDisk struct {
+	Disk
+	broken bool
+}
+
+func (d *writeFailDisk) WriteAt(p []byte, off int64) (int, error) {
+	if d.broken {
+		return 0, errBadSector
+	}
+	return d.Disk.WriteAt(p, off)
+}
+
+// TestDeclusteredSpareWriteError checks that sparing fails, and leaves the
+// member unspared, when the writes into the spare space lose data: with two
+// members failing writes, some stripes lose both chunks.
+func TestDeclusteredSpareWriteError(t *testing.T) {
+	disks := newMemDisks(10)
+	var broken []*writeFailDisk
+	for _, i := range []int{3, 5} {
+		d := &writeFailDisk{Disk: disks[i]}
+		disks[i] = d
+		broken = append(broken, d)
+	}
+	arr, err := newDeclustered(disks, 16, DeclusteredConfig{Data: 2, Parity: 1, Spares: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := arr.Write(make([]byte, 256*arr.Geometry().DataMembers*16), 0); err != nil {
+		t.Fatal(err)
+	}
+	arr.ClearDisk(0)
+	for _, d := range broken {
+		d.broken = true
+	}
+	if err := arr.Spare(0); !errors.Is(err, ErrDataLost) {
+		t.Errorf("Spare() with members that fail writes = %v, want %v", err, ErrDataLost)
+	}
+	if len(arr.spared) != 0 {
+		t.Errorf("spared %v after a failed sparing", arr.spared)
+	}
+}
+
+// TestDeclusteredAssemble checks that spared members are remembered by the
+// superblocks.
+func TestDeclusteredAssemble(t *testing.T) {
+	disks := make([]Disk, 8)
+	for i := range disks {
+		disks[i] = NewMemDisk(SuperblockSize + 4096)
+	}
+	arr, err := CreateDeclustered(disks, 64, DeclusteredConfig{Data: 4, Parity: 2, Spares: 2})
+	if err != nil {
+		t.Fatalf("CreateDeclustered() error = %v", err)
+	}
+	data := make([]byte, arr.Status().Size)
+	rand.New(rand.NewSource(1)).Read(data)
+	if err := arr.Write(data, 0); err != nil {
+		t.Fatal(err)
+	}
+	arr.ClearDisk(2)
+	if err := arr.(*Declustered).Spare(2); err != nil {
+		t.Fatalf("Spare(2) error = %v", err)
+	}
+
+	arr, err = Assemble(disks)
+	if err != nil {
+		t.Fatalf("Assemble() error = %v", err)
+	}
+	if c := arr.(*Declustered).Config(); c != (DeclusteredConfig{4, 2, 2}) {
+		t.Errorf("Config() = %+v after assembly", c)
+	}
+	// Double parity on top of the spare: two more members may go.
+	arr.ClearDisk(0)
+	arr.ClearDisk(6)
+	got, err := arr.Read(len(data), 0)
+	if err != nil || !bytes.Equal(got, data) {
+		t.Errorf("Read() = %v, contents match %v", err, bytes.Equal(got, data))
+	}
+}
@@ -0,0 +1,202 @@
+package raid
+
+import (
+	"errors"
+	"io"
+	"os"
+	"sync"
+)
+
+// Disk is the storage behind one member of an array.
+// Regions that were never written read back as zeros, and writing past the
+// end of a disk grows it.
+type Disk interface {
+	io.ReaderAt
+	io.WriterAt
+	Size() int64
+}
+
+// MemDisk is a Disk held in memory.
+type MemDisk struct {
+	mu   sync.RWMutex
+	data []byte
+}
+
+func NewMemDisk(size int64) *MemDisk {
+	return &MemDisk{data: make([]byte, size)}
+}
+
+func (d *MemDisk) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New("MemDisk: negative offset")
+	}
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	n := 0
+	if off < int64(len(d.data)) {
+		n = copy(p, d.data[off:])
+	}
+	clear(p[n:])
+	return len(p), nil
+}
+
+func (d *MemDisk) WriteAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New("MemDisk: negative offset")
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if end := off + int64(len(p)); end > int64(len(d.data)) {
+		d.data = append(d.data, make([]byte, end-int64(len(d.data)))...)
+	}
+	return copy(d.data[off:], p), nil
+}
+
+func (d *MemDisk) Size() int64 {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return int64(len(d.data))
+}
+
+// Discard zeroes [off, off+n) without growing the disk.
+func (d *MemDisk) Discard(off, n int64) error {
+	if off < 0 || n < 0 {
+		return errors.New("MemDisk: negative offset")
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	size := int64(len(d.data))
+	clear(d.data[min(off, size):min(off+n, size)])
+	return nil
+}
+
+// Bytes returns the current contents of the disk.
+func (d *MemDisk) Bytes() []byte {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.data
+}
+
+// FileDisk is a Disk backed by an image file.
+type FileDisk struct {
+	f *os.File
+}
+
+// CreateFileDisk creates a sparse image file of the given size.
+func CreateFileDisk(path string, size int64) (*FileDisk, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	if err := f.Truncate(size); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &FileDisk{f}, nil
+}
+
+func OpenFileDisk(path string) (*FileDisk, error) {
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return nil, err
+	}
+	return &FileDisk{f}, nil
+}
+
+func (d *FileDisk) ReadAt(p []byte, off int64) (int, error) {
+	n, err := d.f.ReadAt(p, off)
+	if errors.Is(err, io.EOF) {
+		clear(p[n:])
+		return len(p), nil
+	}
+	return n, err
+}
+
+func (d *FileDisk) WriteAt(p []byte, off int64) (int, error) {
+	return d.f.WriteAt(p, off)
+}
+
+func (d *FileDisk) Size() int64 {
+	fi, err := d.f.Stat()
+	if err != nil {
+		return 0
+	}
+	return fi.Size()
+}
+
+// Discard punches a hole into the image file, so the range reads back as
+// zeros and no longer takes up space. Where holes are not supported, the
+// range is overwritten with zeros.
+func (d *FileDisk) Discard(off, n int64) error {
+	n = min(n, d.Size()-off)
+	if n <= 0 {
+		return nil
+	}
+	if err := punchHole(d.f, off, n); err == nil {
+		return nil
+	}
+	return writeZeros(d, off, n)
+}
+
+func (d *FileDisk) Name() string {
+	return d.f.Name()
+}
+
+func (d *FileDisk) Sync() error {
+	return d.f.Sync()
+}
+
+func (d *FileDisk) Close() error {
+	return d.f.Close()
+}
+
+// Remove closes the disk and deletes its image file.
+func (d *FileDisk) Remove() error {
+	d.f.Close()
+	return os.Remove(d.f.Name())
+}
+
+// sectionDisk exposes the part of a disk that starts at off, so that a
+// superblock can live in front of the member data.
+type sectionDisk struct {
+	Disk
+	off int64
+}
+
+func (d *sectionDisk) ReadAt(p []byte, off int64) (int, error) {
+	return d.Disk.ReadAt(p, d.off+off)
+}
+
+func (d *sectionDisk) WriteAt(p []byte, off int64) (int, error) {
+	return d.Disk.WriteAt(p, d.off+off)
+}
+
+func (d *sectionDisk) Discard(off, n int64) error {
+	return discard(d.Disk, d.off+off, n)
+}
+
+func (d *sectionDisk) Size() int64 {
+	return max(d.Disk.Size()-d.off, 0)
+}
+
+// discard drops [off, off+n) of a disk, so that it reads back as zeros. Disks
+// that cannot discard have the part of the range below their size zeroed.
+func discard(d Disk, off, n int64) error {
+	if dd, ok := d.(interface{ Discard(off, n int64) error }); ok {
+		return dd.Discard(off, n)
+	}
+	return writeZeros(d, off, min(n, d.Size()-off))
+}
+
+func writeZeros(d Disk, off, n int64) error {
+	if n <= 0 {
+		return nil
+	}
+	zero := make([]byte, min(n, rebuildChunk))
+	for done := int64(0); done < n; done += int64(len(zero)) {
+		if _, err := d.WriteAt(zero[:min(int64(len(zero)), n-done)], off+done); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,189 @@
+package raid
+
+import (
+	"slices"
+	"sync"
+	"time"
+)
+
+type EventKind int
+
+const (
+	// EventMemberFailed: member Disk was failed, by Fail or because it
+	// stopped responding.
+	EventMemberFailed EventKind = iota
+	// EventMemberReplaced: member Disk was swapped for a new disk.
+	EventMemberReplaced
+	// EventDegraded: a member went out of sync and the array lost
+	// redundancy. EventClean: all members are in sync again.
+	EventDegraded
+	EventClean
+	// EventRebuildStarted, EventRebuildProgress and EventRebuildFinished
+	// follow the rebuild of member Disk, Done of Total bytes. Err is set on
+	// a rebuild that did not complete.
+	EventRebuildStarted
+	EventRebuildProgress
+	EventRebuildFinished
+	// EventScrubMismatch: Mismatches inconsistent rows in the part of the
+	// members scrubbed at Offset. EventScrubFinished reports the whole
+	// scrub, Done of Total bytes.
+	EventScrubMismatch
+	EventScrubFinished
+	// EventPatrolFinished reports a patrol read, Done of Total bytes. The
+	// blocks it finds unreadable come as EventBadBlock.
+	EventPatrolFinished
+	// EventSpareActivated: the chunks of failed member Disk were rebuilt
+	// into the distributed spare space of a declustered array.
+	EventSpareActivated
+	// EventBadBlock: the block of member Disk at Offset failed. Remapped
+	// tells whether it was rebuilt into the reserved area.
+	EventBadBlock
+)
+
+func (k EventKind) String() string {
+	switch k {
+	case EventMemberFailed:
+		return "member-failed"
+	case EventMemberReplaced:
+		return "member-replaced"
+	case EventDegraded:
+		return "degraded"
+	case EventClean:
+		return "clean"
+	case EventRebuildStarted:
+		return "rebuild-started"
+	case EventRebuildProgress:
+		return "rebuild-progress"
+	case EventRebuildFinished:
+		return "rebuild-finished"
+	case EventScrubMismatch:
+		return "scrub-mismatch"
+	case EventScrubFinished:
+		return "scrub-finished"
+	case EventPatrolFinished:
+		return "patrol-finished"
+	case EventSpareActivated:
+		return "spare-activated"
+	case EventBadBlock:
+		return "bad-block"
+	default:
+		return "unknown"
+	}
+}
+
+// Event is something that happened to an array. Which fields are set
+// depends on the kind.
+type Event struct {
+	// Seq numbers the events of an array, so that subscribers can tell
+	// that they missed some.
+	Seq  uint64
+	Time time.Time
+	Kind EventKind
+	// Disk is the member the event is about, -1 for the array as a whole.
+	Disk       int
+	Offset     int64
+	Done       int64
+	Total      int64
+	Mismatches int
+	Remapped   bool
+	Err        error
+}
+
+// historySize is how many events an array remembers.
+const historySize = 256
+
+// EventBus delivers the events of an array to its subscribers and keeps the
+// most recent ones.
+type EventBus struct {
+	mu      sync.Mutex
+	seq     uint64
+	subs    map[chan Event]struct{}
+	history []Event // ring of up to historySize events, oldest at next
+	next    int
+}
+
+func newEventBus() *EventBus {
+	return &EventBus{subs: make(map[chan Event]struct{})}
+}
+
+// Subscribe returns a channel that receives the events published from now
+// on, and a function that unsubscribes it and closes the channel. Events
+// are published while the array is locked, so a subscriber whose channel
+// is full misses them rather than stall the array.
+func (b *EventBus) Subscribe(buffer int) (<-chan Event, func()) {
+	ch := make(chan Event, buffer)
+	b.mu.Lock()
+	b.subs[ch] = struct{}{}
+	b.mu.Unlock()
+	var once sync.Once
+	return ch, func() {
+		once.Do(func() {
+			b.mu.Lock()
+			delete(b.subs, ch)
+			b.mu.Unlock()
+			close(ch)
+		})
+	}
+}
+
+// History returns the most recent events, oldest first.
+func (b *EventBus) History() []Event {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return append(append([]Event(nil), b.history[b.next:]...), b.history[:b.next]...)
+}
+
+func (b *EventBus) publish(e Event) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.seq++
+	e.Seq, e.Time = b.seq, time.Now()
+	if len(b.history) < historySize {
+		b.history = append(b.history, e)
+	} else {
+		b.history[b.next] = e
+		b.next = (b.next + 1) % historySize
+	}
+	for ch := range b.subs {
+		select {
+		case ch <- e:
+		default:
+		}
+	}
+}
+
+// Events is the bus the array publishes its events on.
+func (m *members) Events() *EventBus {
+	return m.events
+}
+
+// rebuildProgress publishes the progress of a rebuild when it has advanced
+// by a whole percent.
+func (m *members) rebuildProgress(i int, before, done, total int64) {
+	if total > 0 && done*100/total > before*100/total {
+		m.events.publish(Event{Kind: EventRebuildProgress, Disk: i, Done: done, Total: total})
+	}
+}
+
+// rebuildFinished publishes the end of a rebuild and returns its error.
+func (m *members) rebuildFinished(i int, done, total int64, err error) error {
+	m.events.publish(Event{Kind: EventRebuildFinished, Disk: i, Done: done, Total: total, Err: err})
+	return err
+}
+
+// outOfSync reports whether a member is not active.
+func (m *members) outOfSync() bool {
+	return slices.ContainsFunc(m.state, func(s DiskState) bool { return s != DiskActive })
+}
+
+// checkDegraded publishes when the array loses or regains redundancy.
+func (m *members) checkDegraded() {
+	if degraded := m.outOfSync(); degraded != m.degraded {
+		m.degraded = degraded
+		kind := EventClean
+		if degraded {
+			kind = EventDegraded
+		}
+		m.events.publish(Event{Kind: kind, Disk: -1})
+	}
+}
@@ -0,0 +1,168 @@
+package raid
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+// kinds drains the events waiting on ch and returns their kinds, with runs
+// of rebuild progress left out.
+func kinds(ch <-chan Event) string {
+	var out []string
+	for {
+		select {
+		case ev := <-ch:
+			if ev.Kind != EventRebuildProgress {
+				out = append(out, ev.Kind.String())
+			}
+		default:
+			return strings.Join(out, " ")
+		}
+	}
+}
+
+// TestEvents follows an array through a member failure, its replacement and
+// rebuild, and a scrub that finds a mismatch.
+func TestEvents(t *testing.T) {
+	disks := newMemDisks(3)
+	arr, err := New(Level5, disks, 512)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := arr.Write(make([]byte, 512<<10), 0); err != nil {
+		t.Fatal(err)
+	}
+	ch, unsubscribe := arr.Events().Subscribe(1024)
+	defer unsubscribe()
+
+	arr.Fail(1)
+	arr.Replace(1, NewMemDisk(0))
+	if got, want := kinds(ch), "member-failed degraded member-replaced"; got != want {
+		t.Errorf("events of a failure = %q, want %q", got, want)
+	}
+	if err := arr.Rebuild(1); err != nil {
+		t.Fatal(err)
+	}
+	var progress []Event
+	for _, ev := range arr.Events().History() {
+		if ev.Kind == EventRebuildProgress {
+			progress = append(progress, ev)
+		}
+	}
+	if n := len(progress); n == 0 || progress[n-1].Done != progress[n-1].Total || progress[n-1].Disk != 1 {
+		t.Errorf("rebuild progress events = %+v", progress)
+	}
+	if got, want := kinds(ch), "rebuild-started rebuild-finished clean"; got != want {
+		t.Errorf("events of a rebuild = %q, want %q", got, want)
+	}
+
+	disks[0].WriteAt([]byte{1}, 200<<10)
+	if _, err := arr.Scrub(false); err != nil {
+		t.Fatal(err)
+	}
+	history := arr.Events().History()
+	if mismatch := history[len(history)-2]; mismatch.Kind != EventScrubMismatch || mismatch.Mismatches != 1 || mismatch.Offset != 192<<10 {
+		t.Errorf("scrub mismatch event = %+v", mismatch)
+	}
+	if got, want := kinds(ch), "scrub-mismatch scrub-finished"; got != want {
+		t.Errorf("events of a scrub = %q, want %q", got, want)
+	}
+}
+
+func TestEventsBadBlock(t *testing.T) {
+	faulty := &faultyDisk{Disk: NewMemDisk(0), bad: 5000, n: 1}
+	arr, err := New(Level5, []Disk{NewMemDisk(0), NewMemDisk(0), faulty}, 512)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := arr.Write(make([]byte, 64<<10), 0); err != nil {
+		t.Fatal(err)
+	}
+	history := arr.Events().History()
+	if len(history) != 1 || history[0].Kind != EventBadBlock || history[0].Disk != 2 || history[0].Offset != 4096 || history[0].Remapped {
+		t.Errorf("events of a bad sector = %+v", history)
+	}
+}
+
+func TestEventsSpare(t *testing.T) {
+	arr, err := NewDeclustered(7, 512, defaultDeclustered(7))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := arr.Write(make([]byte, 64<<10), 0); err != nil {
+		t.Fatal(err)
+	}
+	ch, unsubscribe := arr.Events().Subscribe(1024)
+	defer unsubscribe()
+	arr.Fail(3)
+	if err := arr.Spare(3); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := kinds(ch), "member-failed degraded spare-activated"; got != want {
+		t.Errorf("events of sparing = %q, want %q", got, want)
+	}
+	if err := arr.Rebuild(3); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := kinds(ch), "rebuild-started rebuild-finished clean"; got != want {
+		t.Errorf("events of a copy back = %q, want %q", got, want)
+	}
+}
+
+func TestEventBus(t *testing.T) {
+	b := newEventBus()
+	slow, unsubscribeSlow := b.Subscribe(1)
+	fast, unsubscribe := b.Subscribe(historySize + 11)
+	for i := range historySize + 10 {
+		b.publish(Event{Kind: EventRebuildProgress, Done: int64(i)})
+	}
+
+	history := b.History()
+	if len(history) != historySize || history[0].Seq != 11 || history[len(history)-1].Seq != historySize+10 {
+		t.Errorf("History() holds %d events, %d to %d", len(history), history[0].Seq, history[len(history)-1].Seq)
+	}
+	if ev := <-slow; ev.Seq != 1 || len(slow) != 0 {
+		t.Errorf("full subscriber got event %d and has %d waiting", ev.Seq, len(slow))
+	}
+	if len(fast) != historySize+10 {
+		t.Errorf("subscriber got %d events, want %d", len(fast), historySize+10)
+	}
+
+	unsubscribeSlow()
+	unsubscribeSlow()
+	if _, ok := <-slow; ok {
+		t.Error("channel still open after unsubscribing")
+	}
+	b.publish(Event{})
+	unsubscribe()
+	if n := len(fast); n != historySize+11 {
+		t.Errorf("subscriber got %d events after the other left, want %d", n, historySize+11)
+	}
+}
+
+// TestEventsScrubError checks that a scrub that stops on an error still
+// reports that it finished, with the error.
+func TestEventsScrubError(t *testing.T) {
+	disks := newMemDisks(3)
+	bad := []*faultyDisk{{Disk: disks[0]}, {Disk: disks[1]}}
+	disks[0], disks[1] = bad[0], bad[1]
+	arr, err := New(Level5, disks, 512)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := arr.Write(make([]byte, 512<<10), 0); err != nil {
+		t.Fatal(err)
+	}
+	for _, d := range bad {
+		d.bad, d.n = 64<<10, 512
+	}
+	report, err := arr.Scrub(false)
+	if err == nil {
+		t.Fatal("Scrub() over two bad members succeeded")
+	}
+	history := arr.Events().History()
+	if last := history[len(history)-1]; last.Kind != EventScrubFinished || !errors.Is(last.Err, err) || last.Done != report.Checked || last.Done >= last.Total {
+		t.Errorf("last event of a failed scrub = %+v", last)
+	}
+}
@@ -0,0 +1,92 @@
+package raid
+
+import (
+	"errors"
+)
+
+// Geometry describes how an array lays out its logical address space on its
+// members.
+type Geometry struct {
+	Level      Level
+	NumDisks   int
+	StripeSize int // bytes per member per stripe; 0 for RAID1 and linear arrays
+	// DataMembers is the number of members' worth of usable capacity.
+	DataMembers int
+	// StripeWidth is the number of logical bytes in one full stripe, the unit
+	// in which parity arrays write without reading first. It is 0 for
+	// hybrid arrays, whose tiers differ in width.
+	StripeWidth int
+	// DataOffset is where member data starts on every disk, after the
+	// superblock if there is one. Extent offsets are relative to it.
+	DataOffset int64
+	MemberSize int64
+	Size       int64
+}
+
+// Role is what a member holds in an extent.
+type Role int
+
+const (
+	RoleData Role = iota
+	RoleMirror
+	RoleP
+	RoleQ
+)
+
+func (r Role) String() string {
+	switch r {
+	case RoleData:
+		return "data"
+	case RoleMirror:
+		return "mirror"
+	case RoleP:
+		return "P"
+	case RoleQ:
+		return "Q"
+	default:
+		return "unknown"
+	}
+}
+
+// Extent is a range of a member that holds, or protects, the logical range
+// [Pos, Pos+Length).
+type Extent struct {
+	Pos    int
+	Length int
+	Member int
+	Offset int64
+	Role   Role
+}
+
+var errNegativeRange = errors.New("negative position or length")
+
+// checkRange rejects the ranges no level can map to its members.
+func checkRange(pos, length int) error {
+	if pos < 0 || length < 0 {
+		return errNegativeRange
+	}
+	return nil
+}
+
+// geometry fills in what every level has in common.
+func (m *members) geometry(level Level, stripeSize int) Geometry {
+	s := m.status(level, stripeSize)
+	g := Geometry{
+		Level:       level,
+		NumDisks:    len(m.disks),
+		StripeSize:  stripeSize,
+		DataMembers: m.codec.dataMembers(),
+		StripeWidth: m.codec.dataMembers() * m.codec.rowSize(),
+		Size:        s.Size,
+	}
+	if level == Level1 || level == LevelLinear {
+		g.StripeWidth = 0
+	}
+	if g.DataMembers > 0 {
+		g.MemberSize = s.Size / int64(g.DataMembers)
+	}
+	if m.meta != nil {
+		g.DataOffset = SuperblockSize
+	}
+	return g
+}
@@ -0,0 +1,90 @@
+package raid
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+)
+
+// TestMap checks the extents returned by Map against the contents of the
+// members: data and mirrors hold the logical bytes, P their XOR and Q their
+// Reed-Solomon syndrome.
+func TestMap(t *testing.T) {
+	tests := []struct {
+		level    Level
+		numDisks int
+	}{
+		{Level0, 3},
+		{Level1, 3},
+		{Level10, 6},
+		{Level4, 4},
+		{Level5, 4},
+		{Level6, 5},
+	}
+	for _, tt := range tests {
+		t.Run(tt.level.String(), func(t *testing.T) {
+			disks := newMemDisks(tt.numDisks)
+			arr, err := New(tt.level, disks, 8)
+			if err != nil {
+				t.Fatal(err)
+			}
+			data := make([]byte, 480)
+			rand.New(rand.NewSource(1)).Read(data)
+			arr.Write(data, 0)
+			member := func(e Extent) []byte {
+				return disks[e.Member].(*MemDisk).Bytes()[e.Offset : e.Offset+int64(e.Length)]
+			}
+
+			extents, err := arr.Map(0, len(data))
+			if err != nil {
+				t.Fatal(err)
+			}
+			covered := 0
+			for _, e := range extents {
+				logical := data[e.Pos : e.Pos+e.Length]
+				switch e.Role {
+				case RoleData:
+					if e.Pos != covered {
+						t.Fatalf("data extent %+v, want it at %d", e, covered)
+					}
+					covered += e.Length
+					if !bytes.Equal(member(e), logical) {
+						t.Errorf("data extent %+v does not hold the logical bytes", e)
+					}
+				case RoleMirror:
+					if !bytes.Equal(member(e), logical) {
+						t.Errorf("mirror extent %+v does not hold the logical bytes", e)
+					}
+				case RoleP, RoleQ:
+					// Recompute the parity from the data at the same member
+					// offset, taken from the mapping of the whole stripe.
+					p, q := make([]byte, e.Length), make([]byte, e.Length)
+					for _, d := range extents {
+						if d.Role == RoleData && d.Offset == e.Offset && d.Length == e.Length {
+							xorInto(p, member(d))
+							gfMulXor(q, member(d), byte(d.Member+1))
+						}
+					}
+					want := p
+					if e.Role == RoleQ {
+						want = q
+					}
+					if !bytes.Equal(member(e), want) {
+						t.Errorf("%s extent %+v does not match the data", e.Role, e)
+					}
+				}
+			}
+			if covered != len(data) {
+				t.Errorf("data extents cover %d bytes, want %d", covered, len(data))
+			}
+
+			g := arr.Geometry()
+			if g.Level != tt.level || g.NumDisks != tt.numDisks || g.Size != int64(g.DataMembers)*g.MemberSize {
+				t.Errorf("Geometry() = %+v", g)
+			}
+			if _, err := arr.Map(-1, 1); err == nil {
+				t.Error("Map() of a negative position succeeded")
+			}
+		})
+	}
+}
@@ -0,0 +1,51 @@
+package raid
+
+// Arithmetic in GF(2^8) with the polynomial x^8+x^4+x^3+x^2+1 (0x11D), using
+// log and exp tables of the generator 2.
+var (
+	gfExp [512]byte
+	gfLog [256]int
+)
+
+func init() {
+	x := 1
+	for i := 0; i < 255; i++ {
+		gfExp[i] = byte(x)
+		gfLog[x] = i
+		x <<= 1
+		if x&0x100 != 0 {
+			x ^= 0x11D
+		}
+	}
+	for i := 255; i < len(gfExp); i++ {
+		gfExp[i] = gfExp[i-255]
+	}
+}
+
+func gfMultiply(a, b byte) byte {
+	if a == 0 || b == 0 {
+		return 0
+	}
+	return gfExp[gfLog[a]+gfLog[b]]
+}
+
+func gfInverse(a byte) byte {
+	if a == 0 {
+		return 0
+	}
+	return gfExp[255-gfLog[a]]
+}
+
+// gfMulXor adds src multiplied by c to dst.
+func gfMulXor(dst, src []byte, c byte) {
+	if c == 0 {
+		return
+	}
+	var table [256]byte
+	for b := 1; b < 256; b++ {
+		table[b] = gfExp[gfLog[b]+gfLog[c]]
+	}
+	for i, b := range src {
+		dst[i] ^= table[b]
+	}
+}
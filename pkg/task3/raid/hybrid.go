@@ -0,0 +1,305 @@
+package raid
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+)
+
+// Hybrid is a single redundancy array for members of different sizes, in the
+// manner of Synology's SHR. The member space is cut into tiers at every
+// distinct member size. Each tier is a RAID5 of the members that reach
+// through it, or a mirror where only two do, and the tiers are concatenated.
+// The space of the largest member that no other member matches stays
+// unused. Any one member may fail, as it is in every tier at most once.
+type Hybrid struct {
+	*members
+	stripeSize int
+	sizes      []int64
+	tiers      []*hybridTier
+	size       int64
+}
+
+// hybridTier is the RAID5 of the members in disks over the member range
+// [start, end), which holds the logical range from pos on.
+type hybridTier struct {
+	start, end int64
+	pos, size  int64
+	disks      []int
+	stripes    *parityStripes
+}
+
+// NewHybrid builds a hybrid array on memory disks of the given sizes.
+func NewHybrid(stripeSize int, sizes ...int64) (*Hybrid, error) {
+	disks := make([]Disk, len(sizes))
+	for i, size := range sizes {
+		disks[i] = NewMemDisk(max(size, 0))
+	}
+	return newHybrid(disks, stripeSize, sizes)
+}
+
+// newHybrid lays tiers over disks. Without sizes, every disk is used up to
+// its current size. Sizes are cut down to whole stripes.
+func newHybrid(disks []Disk, stripeSize int, sizes []int64) (*Hybrid, error) {
+	if len(disks) < 2 {
+		return nil, errors.New("SHR: number of disks must be greater or equals than 2")
+	}
+	if stripeSize <= 0 {
+		return nil, errors.New("SHR: stripe size must be positive")
+	}
+	if sizes == nil {
+		for _, d := range disks {
+			sizes = append(sizes, d.Size())
+		}
+	}
+	if len(sizes) != len(disks) {
+		return nil, fmt.Errorf("SHR: %d sizes for %d disks", len(sizes), len(disks))
+	}
+	raid := &Hybrid{members: newMembers(disks), stripeSize: stripeSize}
+	for _, size := range sizes {
+		raid.sizes = append(raid.sizes, max(size-size%int64(stripeSize), 0))
+	}
+	bounds := slices.Compact(slices.Sorted(slices.Values(raid.sizes)))
+	var start int64
+	for _, end := range bounds {
+		var tier []int
+		for i, size := range raid.sizes {
+			if size >= end {
+				tier = append(tier, i)
+			}
+		}
+		if len(tier) < 2 || end == start {
+			continue
+		}
+		t := &hybridTier{
+			start: start, end: end,
+			pos:   raid.size,
+			size:  (end - start) * int64(len(tier)-1),
+			disks: tier,
+		}
+		t.stripes = &parityStripes{raid.members, t, stripeSize, len(tier) - 1, 1, start}
+		raid.tiers = append(raid.tiers, t)
+		raid.size += t.size
+		start = end
+	}
+	if raid.size == 0 {
+		return nil, errors.New("SHR: no two disks hold a stripe")
+	}
+	raid.codec = raid
+	return raid, nil
+}
+
+// Parity rotates over the members of a tier as it does in RAID5.
+func (t *hybridTier) stripeDisks(s int) ([]int, []int) {
+	parity := t.disks[s%len(t.disks)]
+	return slices.DeleteFunc(slices.Clone(t.disks), func(d int) bool { return d == parity }), []int{parity}
+}
+
+func (t *hybridTier) encode(data [][]byte, parity [][]byte) {
+	encodeXOR(data, parity)
+}
+
+func (t *hybridTier) update(parity [][]byte, k int, delta []byte) {
+	xorInto(parity[0], delta)
+}
+
+// split cuts the logical range at the boundaries between tiers and calls fn
+// with the tier-relative position of every piece and its offset in the
+// range.
+func (r *Hybrid) split(pos, length int, fn func(t *hybridTier, tierPos, n, at int) error) error {
+	if pos < 0 || length < 0 {
+		return errNegativeRange
+	}
+	if end := int64(pos) + int64(length); end > r.size {
+		return fmt.Errorf("SHR: %d bytes at %d exceed the array of %d bytes", length, pos, r.size)
+	}
+	for _, t := range r.tiers {
+		lo, hi := max(int64(pos), t.pos), min(int64(pos+length), t.pos+t.size)
+		if lo >= hi {
+			continue
+		}
+		if err := fn(t, int(lo-t.pos), int(hi-lo), int(lo)-pos); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *Hybrid) Read(length int, pos int) ([]byte, error) {
+	if err := checkRange(pos, length); err != nil {
+		return nil, err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	result := make([]byte, length)
+	err := r.split(pos, length, func(t *hybridTier, tierPos, n, at int) error {
+		data, err := t.stripes.read(n, tierPos)
+		copy(result[at:], data)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func (r *Hybrid) Write(data []byte, pos int) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.split(pos, len(data), func(t *hybridTier, tierPos, n, at int) error {
+		return t.stripes.write(data[at:at+n], tierPos)
+	})
+}
+
+// ReadV and WriteV batch the requests of every tier.
+func (r *Hybrid) ReadV(vecs []IOVec) error {
+	if err := checkVecs(vecs); err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.eachTierV(vecs, func(t *hybridTier, tierVecs []IOVec) error {
+		return t.stripes.readV(tierVecs)
+	})
+}
+
+func (r *Hybrid) WriteV(vecs []IOVec) error {
+	if err := checkVecs(vecs); err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.eachTierV(coalesce(vecs), func(t *hybridTier, tierVecs []IOVec) error {
+		return t.stripes.writeV(tierVecs)
+	})
+}
+
+// eachTierV splits the requests between the tiers and calls fn with the
+// tier-relative requests of every tier they reach.
+func (r *Hybrid) eachTierV(vecs []IOVec, fn func(t *hybridTier, tierVecs []IOVec) error) error {
+	perTier := make(map[*hybridTier][]IOVec)
+	for _, v := range vecs {
+		err := r.split(v.Pos, len(v.Data), func(t *hybridTier, tierPos, n, at int) error {
+			perTier[t] = append(perTier[t], IOVec{tierPos, v.Data[at : at+n]})
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	for _, t := range r.tiers {
+		if tierVecs := perTier[t]; len(tierVecs) > 0 {
+			if err := fn(t, tierVecs); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (r *Hybrid) Discard(pos, length int) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.split(pos, length, func(t *hybridTier, tierPos, n, at int) error {
+		return t.stripes.discard(tierPos, n)
+	})
+}
+
+// Geometry has no stripe width, as every tier has its own.
+func (r *Hybrid) Geometry() Geometry {
+	g := r.geometry(LevelHybrid, r.stripeSize)
+	g.StripeWidth = 0
+	g.MemberSize = slices.Max(r.sizes)
+	g.Size = r.size
+	return g
+}
+
+func (r *Hybrid) Map(pos, length int) ([]Extent, error) {
+	var extents []Extent
+	err := r.split(pos, length, func(t *hybridTier, tierPos, n, at int) error {
+		for _, e := range t.stripes.mapRange(tierPos, n) {
+			e.Pos += int(t.pos)
+			extents = append(extents, e)
+		}
+		return nil
+	})
+	return extents, err
+}
+
+func (r *Hybrid) Level() Level {
+	return LevelHybrid
+}
+
+func (r *Hybrid) Size() int64 {
+	return r.size
+}
+
+// Status reports how much of every member the tiers use.
+func (r *Hybrid) Status() Status {
+	s := r.status(LevelHybrid, r.stripeSize)
+	for i := range s.Members {
+		s.Members[i].Size = r.sizes[i]
+	}
+	s.Size = r.size
+	return s
+}
+
+// eachTier calls fn with the rows of the members of every tier that rows,
+// read from all members at off, cover, and the tier offset they start at.
+func (r *Hybrid) eachTier(rows [][]byte, off int64, fn func(t *hybridTier, tierRows [][]byte, tierOff int64) error) error {
+	for _, t := range r.tiers {
+		lo, hi := max(off, t.start), min(off+int64(len(rows[0])), t.end)
+		if lo >= hi {
+			continue
+		}
+		tierRows := make([][]byte, len(t.disks))
+		for j, d := range t.disks {
+			tierRows[j] = rows[d][lo-off : hi-off]
+		}
+		if err := fn(t, tierRows, lo-t.start); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *Hybrid) reconstruct(rows [][]byte, missing []int, off int64) error {
+	return r.eachTier(rows, off, func(t *hybridTier, tierRows [][]byte, tierOff int64) error {
+		var lost []int
+		for j, d := range t.disks {
+			if slices.Contains(missing, d) {
+				lost = append(lost, j)
+			}
+		}
+		switch len(lost) {
+		case 0:
+			return nil
+		case 1:
+			reconstructXOR(tierRows, lost[0])
+			return nil
+		}
+		return fmt.Errorf("SHR: %w", ErrDataLost)
+	})
+}
+
+func (r *Hybrid) verify(rows [][]byte, off int64, repair bool) int {
+	mismatches := 0
+	r.eachTier(rows, off, func(t *hybridTier, tierRows [][]byte, tierOff int64) error {
+		mismatches += verifyXOR(tierRows, tierOff, r.stripeSize, repair, func(s int) int { return s % len(t.disks) })
+		return nil
+	})
+	return mismatches
+}
+
+// dataMembers is that of the widest tier.
+func (r *Hybrid) dataMembers() int {
+	return len(r.tiers[0].disks) - 1
+}
+
+func (r *Hybrid) rowSize() int {
+	return r.stripeSize
+}
+
+func (r *Hybrid) memberSizes() []int64 {
+	return r.sizes
+}
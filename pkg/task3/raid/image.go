@@ -0,0 +1,298 @@
+package raid
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"slices"
+)
+
+// An image holds every member of an array in one portable file, together with
+// what it takes to put the array together again.
+//
+// Layout: magic (8 bytes), format version (uint32), header length (uint32),
+// CRC32 of the header (uint32), the JSON encoded header, then the contents of
+// every disk in turn as a series of records. A record is a kind byte followed
+// by:
+//
+//	'D': length (uint32), then that many bytes of data
+//	'Z': length (uint64) of a run of zeros
+//	'E': CRC32 of the contents of the disk, which ends here
+//
+// Integers are little endian.
+const (
+	imageMagic   = "GRAIDIMG"
+	imageVersion = 1
+	imageHdr     = 20
+	// imageBlock is the granularity at which runs of zeros are found.
+	imageBlock = 4096
+	// maxImageHeader bounds the header a corrupt length can make us read.
+	maxImageHeader = 1 << 20
+	// maxImageDisks and maxImageDiskSize bound the disks a header can make
+	// us allocate before any of their contents are read.
+	maxImageDisks    = 256
+	maxImageDiskSize = 1 << 50
+)
+
+var ErrBadImage = errors.New("not a valid array image")
+
+type imageHeader struct {
+	// Sizes is the size of every disk in the image.
+	Sizes []int64 `json:"sizes"`
+	// Arrays created with Create are assembled from the superblocks on their
+	// disks. The rest describes arrays without superblocks.
+	Superblocks bool               `json:"superblocks,omitempty"`
+	Level       Level              `json:"level"`
+	StripeSize  int                `json:"stripe_size,omitempty"`
+	States      []DiskState        `json:"states,omitempty"`
+	MemberSizes []int64            `json:"member_sizes,omitempty"`
+	Declustered *DeclusteredConfig `json:"declustered,omitempty"`
+	Spared      []sparedDisk       `json:"spared,omitempty"`
+}
+
+// Export writes an image of arr to w: every disk, including the superblocks
+// and the contents of failed members, so that Import gives back the same
+// array. Runs of zeros take no space. A write-back cache in front of arr has
+// to be flushed first.
+func Export(w io.Writer, arr Array) error {
+	b, ok := arr.(interface{ base() *members })
+	if !ok {
+		return fmt.Errorf("export: %T is not an array of this package", arr)
+	}
+	level, stripeSize := arr.Level(), arr.Geometry().StripeSize
+	m := b.base()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var h imageHeader
+	disks := m.disks
+	if m.meta != nil {
+		h.Superblocks = true
+		disks = m.meta.raw
+	} else {
+		h.Level, h.StripeSize, h.States = level, stripeSize, m.state
+		if sized, ok := m.codec.(interface{ memberSizes() []int64 }); ok {
+			h.MemberSizes = sized.memberSizes()
+		}
+		if r, ok := arr.(*Declustered); ok {
+			h.Declustered, h.Spared = &r.config, r.spared
+		}
+	}
+	for _, d := range disks {
+		h.Sizes = append(h.Sizes, d.Size())
+	}
+	payload, err := json.Marshal(h)
+	if err != nil {
+		return err
+	}
+
+	bw := bufio.NewWriter(w)
+	hdr := make([]byte, imageHdr)
+	copy(hdr, imageMagic)
+	binary.LittleEndian.PutUint32(hdr[8:], imageVersion)
+	binary.LittleEndian.PutUint32(hdr[12:], uint32(len(payload)))
+	binary.LittleEndian.PutUint32(hdr[16:], crc32.ChecksumIEEE(payload))
+	bw.Write(hdr)
+	bw.Write(payload)
+	for i, d := range disks {
+		if err := exportDisk(bw, d, h.Sizes[i]); err != nil {
+			return fmt.Errorf("export of disk %d: %w", i, err)
+		}
+	}
+	return bw.Flush()
+}
+
+func exportDisk(w *bufio.Writer, d Disk, size int64) error {
+	crc := crc32.NewIEEE()
+	var zeros uint64
+	record := make([]byte, 9)
+	buf := make([]byte, rebuildChunk)
+	for off := int64(0); off < size; off += int64(len(buf)) {
+		p := buf[:min(int64(len(buf)), size-off)]
+		if _, err := d.ReadAt(p, off); err != nil {
+			return err
+		}
+		crc.Write(p)
+		for start := 0; start < len(p); start += imageBlock {
+			block := p[start:min(start+imageBlock, len(p))]
+			if !slices.ContainsFunc(block, func(b byte) bool { return b != 0 }) {
+				zeros += uint64(len(block))
+				continue
+			}
+			if zeros > 0 {
+				record[0] = 'Z'
+				binary.LittleEndian.PutUint64(record[1:], zeros)
+				w.Write(record)
+				zeros = 0
+			}
+			record[0] = 'D'
+			binary.LittleEndian.PutUint32(record[1:], uint32(len(block)))
+			w.Write(record[:5])
+			w.Write(block)
+		}
+	}
+	if zeros > 0 {
+		record[0] = 'Z'
+		binary.LittleEndian.PutUint64(record[1:], zeros)
+		w.Write(record)
+	}
+	record[0] = 'E'
+	binary.LittleEndian.PutUint32(record[1:], crc.Sum32())
+	_, err := w.Write(record[:5])
+	return err
+}
+
+// Import reads an image written by Export and loads it into disks made by
+// newDisk, which gets the index and size of every disk. The disks it returns
+// must read as zeros: runs of zeros are not written.
+func Import(r io.Reader, newDisk func(i int, size int64) (Disk, error)) (Array, error) {
+	br := bufio.NewReader(r)
+	hdr := make([]byte, imageHdr)
+	if _, err := io.ReadFull(br, hdr); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrBadImage, err)
+	}
+	if !bytes.Equal(hdr[:8], []byte(imageMagic)) {
+		return nil, ErrBadImage
+	}
+	if v := binary.LittleEndian.Uint32(hdr[8:]); v != imageVersion {
+		return nil, fmt.Errorf("%w: format version %d, want %d", ErrBadImage, v, imageVersion)
+	}
+	n := binary.LittleEndian.Uint32(hdr[12:])
+	if n > maxImageHeader {
+		return nil, fmt.Errorf("%w: bad header length %d", ErrBadImage, n)
+	}
+	payload := make([]byte, n)
+	if _, err := io.ReadFull(br, payload); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrBadImage, err)
+	}
+	if crc32.ChecksumIEEE(payload) != binary.LittleEndian.Uint32(hdr[16:]) {
+		return nil, fmt.Errorf("%w: header checksum mismatch", ErrBadImage)
+	}
+	var h imageHeader
+	if err := json.Unmarshal(payload, &h); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrBadImage, err)
+	}
+	if err := h.check(); err != nil {
+		return nil, err
+	}
+
+	disks := make([]Disk, len(h.Sizes))
+	for i, size := range h.Sizes {
+		d, err := newDisk(i, size)
+		if err != nil {
+			return nil, err
+		}
+		if err := importDisk(br, d, size); err != nil {
+			return nil, fmt.Errorf("import of disk %d: %w", i, err)
+		}
+		disks[i] = d
+	}
+	if h.Superblocks {
+		return Assemble(disks)
+	}
+	arr, err := build(h.Level, disks, h.StripeSize, h.MemberSizes, h.Declustered, h.Spared)
+	if err != nil {
+		return nil, err
+	}
+	m := arr.(interface{ base() *members }).base()
+	for i, s := range h.States {
+		// An interrupted rebuild starts over.
+		if s == DiskRebuilding {
+			s = DiskFailed
+		}
+		m.state[i] = s
+	}
+	m.degraded = m.outOfSync()
+	return arr, nil
+}
+
+// check rejects headers that would make Import allocate disks of absurd
+// sizes or assemble an array no level describes.
+func (h *imageHeader) check() error {
+	if len(h.Sizes) == 0 || len(h.Sizes) > maxImageDisks {
+		return fmt.Errorf("%w: %d disks", ErrBadImage, len(h.Sizes))
+	}
+	for i, size := range h.Sizes {
+		if size <= 0 || size > maxImageDiskSize {
+			return fmt.Errorf("%w: disk %d of %d bytes", ErrBadImage, i, size)
+		}
+	}
+	if h.Superblocks {
+		return nil
+	}
+	if !h.Level.known() {
+		return fmt.Errorf("%w: %w: %d", ErrBadImage, ErrUnknownLevel, int(h.Level))
+	}
+	if len(h.States) != len(h.Sizes) {
+		return fmt.Errorf("%w: %d states for %d disks", ErrBadImage, len(h.States), len(h.Sizes))
+	}
+	for i, s := range h.States {
+		if s != DiskActive && s != DiskFailed && s != DiskRebuilding {
+			return fmt.Errorf("%w: disk %d in state %d", ErrBadImage, i, int(s))
+		}
+	}
+	return nil
+}
+
+func importDisk(r *bufio.Reader, d Disk, size int64) error {
+	crc := crc32.NewIEEE()
+	zero := make([]byte, imageBlock)
+	var buf []byte
+	var off int64
+	for {
+		kind, err := r.ReadByte()
+		if err != nil {
+			return fmt.Errorf("%w: %v", ErrBadImage, err)
+		}
+		switch kind {
+		case 'D':
+			var n uint32
+			if err := binary.Read(r, binary.LittleEndian, &n); err != nil {
+				return fmt.Errorf("%w: %v", ErrBadImage, err)
+			}
+			if int64(n) > size-off {
+				return fmt.Errorf("%w: data past the end of the disk", ErrBadImage)
+			}
+			buf = slices.Grow(buf[:0], int(n))[:n]
+			if _, err := io.ReadFull(r, buf); err != nil {
+				return fmt.Errorf("%w: %v", ErrBadImage, err)
+			}
+			if _, err := d.WriteAt(buf, off); err != nil {
+				return err
+			}
+			crc.Write(buf)
+			off += int64(n)
+		case 'Z':
+			var n uint64
+			if err := binary.Read(r, binary.LittleEndian, &n); err != nil {
+				return fmt.Errorf("%w: %v", ErrBadImage, err)
+			}
+			if n > uint64(size-off) {
+				return fmt.Errorf("%w: zeros past the end of the disk", ErrBadImage)
+			}
+			for left := n; left > 0; left -= min(left, imageBlock) {
+				crc.Write(zero[:min(left, imageBlock)])
+			}
+			off += int64(n)
+		case 'E':
+			var sum uint32
+			if err := binary.Read(r, binary.LittleEndian, &sum); err != nil {
+				return fmt.Errorf("%w: %v", ErrBadImage, err)
+			}
+			if off != size {
+				return fmt.Errorf("%w: %d of %d bytes", ErrBadImage, off, size)
+			}
+			if sum != crc.Sum32() {
+				return fmt.Errorf("%w: checksum mismatch", ErrBadImage)
+			}
+			return nil
+		default:
+			return fmt.Errorf("%w: unknown record %q", ErrBadImage, kind)
+		}
+	}
+}
@@ -0,0 +1,154 @@
+package raid
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"math/rand"
+	"reflect"
+	"testing"
+)
+
+func memDisk(i int, size int64) (Disk, error) {
+	return NewMemDisk(size), nil
+}
+
+func TestImage(t *testing.T) {
+	sized := func(level Level, n int) func() (Array, error) {
+		return func() (Array, error) {
+			disks := make([]Disk, n)
+			for i := range disks {
+				disks[i] = NewMemDisk(SuperblockSize + 64<<10)
+			}
+			return Create(level, disks, 512)
+		}
+	}
+	tests := []struct {
+		name   string
+		new    func() (Array, error)
+		failed int
+	}{
+		{"RAID5", func() (Array, error) { return New(Level5, newMemDisks(4), 512) }, 2},
+		{"RAID6 superblocks", sized(Level6, 5), 0},
+		{"SHR", func() (Array, error) { return NewHybrid(512, 64<<10, 32<<10, 64<<10) }, 1},
+		{"dRAID spared", func() (Array, error) {
+			arr, err := NewDeclustered(7, 512, DeclusteredConfig{Data: 2, Parity: 1, Spares: 1})
+			if err != nil {
+				return nil, err
+			}
+			if err := arr.Write(make([]byte, 64<<10), 0); err != nil {
+				return nil, err
+			}
+			arr.ClearDisk(4)
+			return arr, arr.Spare(4)
+		}, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			arr, err := tt.new()
+			if err != nil {
+				t.Fatal(err)
+			}
+			data := make([]byte, 40<<10)
+			rand.New(rand.NewSource(1)).Read(data[:100])
+			rand.New(rand.NewSource(2)).Read(data[30<<10:])
+			if err := arr.Write(data, 0); err != nil {
+				t.Fatal(err)
+			}
+			arr.Fail(tt.failed)
+
+			var image bytes.Buffer
+			if err := Export(&image, arr); err != nil {
+				t.Fatalf("Export() error = %v", err)
+			}
+			got, err := Import(bytes.NewReader(image.Bytes()), memDisk)
+			if err != nil {
+				t.Fatalf("Import() error = %v", err)
+			}
+			want := arr.Status()
+			if s := got.Status(); s.Level != want.Level || s.Size != want.Size || !reflect.DeepEqual(s.Members, want.Members) {
+				t.Errorf("Status() after Import() = %+v, want %+v", s, want)
+			}
+			read, err := got.Read(len(data), 0)
+			if err != nil || !bytes.Equal(read, data) {
+				t.Errorf("Read() after Import() = %v, contents match %v", err, bytes.Equal(read, data))
+			}
+		})
+	}
+}
+
+// TestImageZeros checks that the unused space of an array takes no room in
+// its image.
+func TestImageZeros(t *testing.T) {
+	disks := make([]Disk, 3)
+	for i := range disks {
+		disks[i] = NewMemDisk(SuperblockSize + 1<<20)
+	}
+	arr, err := Create(Level5, disks, 512)
+	if err != nil {
+		t.Fatal(err)
+	}
+	arr.Write([]byte("hello"), 700<<10)
+	var image bytes.Buffer
+	if err := Export(&image, arr); err != nil {
+		t.Fatal(err)
+	}
+	// The superblocks and two 4 KiB blocks of data and parity.
+	if image.Len() > 6*4096+1024 {
+		t.Errorf("image of 3 MiB of disks holding 5 bytes is %d bytes", image.Len())
+	}
+}
+
+func TestImageCorrupt(t *testing.T) {
+	arr := newTestArray(t, Level5, 3, 64)
+	arr.Write(bytes.Repeat([]byte("data"), 100), 0)
+	var image bytes.Buffer
+	if err := Export(&image, arr); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name    string
+		corrupt func(b []byte) []byte
+	}{
+		{"magic", func(b []byte) []byte { b[0] = 'X'; return b }},
+		{"version", func(b []byte) []byte { binary.LittleEndian.PutUint32(b[8:], 2); return b }},
+		{"header", func(b []byte) []byte { b[imageHdr+2]++; return b }},
+		{"data", func(b []byte) []byte { b[len(b)-20]++; return b }},
+		{"truncated", func(b []byte) []byte { return b[:len(b)-3] }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := tt.corrupt(bytes.Clone(image.Bytes()))
+			if _, err := Import(bytes.NewReader(b), memDisk); !errors.Is(err, ErrBadImage) {
+				t.Errorf("Import() error = %v, want %v", err, ErrBadImage)
+			}
+		})
+	}
+}
+
+// TestImageBadHeader checks that headers with a valid checksum but absurd
+// contents are refused before any disk is made.
+func TestImageBadHeader(t *testing.T) {
+	for _, header := range []string{
+		`{"sizes":[-1],"level":5,"states":[0]}`,
+		`{"sizes":[0],"superblocks":true}`,
+		`{"sizes":[1125899906842625],"superblocks":true}`,
+		`{"sizes":[],"superblocks":true}`,
+		`{"sizes":[4096,4096],"level":42,"states":[0,0]}`,
+		`{"sizes":[4096,4096],"level":1,"states":[0,7]}`,
+	} {
+		image := []byte(imageMagic)
+		image = binary.LittleEndian.AppendUint32(image, imageVersion)
+		image = binary.LittleEndian.AppendUint32(image, uint32(len(header)))
+		image = binary.LittleEndian.AppendUint32(image, crc32.ChecksumIEEE([]byte(header)))
+		image = append(image, header...)
+		_, err := Import(bytes.NewReader(image), func(i int, size int64) (Disk, error) {
+			t.Errorf("header %s: Import() made disk %d of %d bytes", header, i, size)
+			return NewMemDisk(0), nil
+		})
+		if !errors.Is(err, ErrBadImage) {
+			t.Errorf("Import() of header %s error = %v, want %v", header, err, ErrBadImage)
+		}
+	}
+}
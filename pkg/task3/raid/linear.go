@@ -0,0 +1,172 @@
+package raid
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+)
+
+// linearBlock is the unit in which the members of a linear array are
+// rebuilt and scrubbed. They do not relate to each other at all.
+const linearBlock = 4096
+
+// Linear concatenates its members (JBOD): the logical address space runs
+// through all of disk 0, then all of disk 1, and so on. Members may differ in
+// size, and the array is as large as all of them together. There is no
+// redundancy: a failed member loses the part of the array it held.
+type Linear struct {
+	*members
+	sizes  []int64
+	starts []int64 // logical offset at which every member begins
+	size   int64
+}
+
+// NewLinear builds a linear array on memory disks of the given sizes.
+func NewLinear(sizes ...int64) (*Linear, error) {
+	disks := make([]Disk, len(sizes))
+	for i, size := range sizes {
+		disks[i] = NewMemDisk(max(size, 0))
+	}
+	return newLinear(disks, sizes)
+}
+
+// newLinear concatenates disks. Without sizes, every disk is used up to its
+// current size.
+func newLinear(disks []Disk, sizes []int64) (*Linear, error) {
+	if len(disks) == 0 {
+		return nil, errors.New("linear: no disks")
+	}
+	if sizes == nil {
+		for _, d := range disks {
+			sizes = append(sizes, d.Size())
+		}
+	}
+	if len(sizes) != len(disks) {
+		return nil, fmt.Errorf("linear: %d sizes for %d disks", len(sizes), len(disks))
+	}
+	raid := &Linear{members: newMembers(disks), sizes: slices.Clone(sizes)}
+	for i, size := range sizes {
+		if size <= 0 {
+			return nil, fmt.Errorf("linear: disk %d is empty", i)
+		}
+		raid.starts = append(raid.starts, raid.size)
+		raid.size += size
+	}
+	raid.codec = raid
+	return raid, nil
+}
+
+// extents splits the logical range at the boundaries between members.
+func (r *Linear) extents(pos, length int) ([]Extent, error) {
+	if pos < 0 || length < 0 {
+		return nil, errNegativeRange
+	}
+	if end := int64(pos) + int64(length); end > r.size {
+		return nil, fmt.Errorf("linear: %d bytes at %d exceed the array of %d bytes", length, pos, r.size)
+	}
+	var extents []Extent
+	for i, start := range r.starts {
+		lo, hi := max(int64(pos), start), min(int64(pos+length), start+r.sizes[i])
+		if lo < hi {
+			extents = append(extents, Extent{int(lo), int(hi - lo), i, lo - start, RoleData})
+		}
+	}
+	return extents, nil
+}
+
+func (r *Linear) Read(length int, pos int) ([]byte, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	extents, err := r.extents(pos, length)
+	if err != nil {
+		return nil, err
+	}
+	result := make([]byte, length)
+	var ios []memberIO
+	for _, e := range extents {
+		ios = append(ios, memberIO{e.Member, result[e.Pos-pos : e.Pos-pos+e.Length], e.Offset})
+	}
+	if err := r.readAll(ios); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func (r *Linear) Write(data []byte, pos int) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	extents, err := r.extents(pos, len(data))
+	if err != nil {
+		return err
+	}
+	var ios []memberIO
+	for _, e := range extents {
+		ios = append(ios, memberIO{e.Member, data[e.Pos-pos : e.Pos-pos+e.Length], e.Offset})
+	}
+	return r.writeAll(ios)
+}
+
+func (r *Linear) Discard(pos, length int) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	extents, err := r.extents(pos, length)
+	if err != nil {
+		return err
+	}
+	for _, e := range extents {
+		if err := r.discardAt(e.Member, e.Offset, e.Length); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *Linear) Geometry() Geometry {
+	g := r.geometry(LevelLinear, 0)
+	g.MemberSize = slices.Max(r.sizes)
+	g.Size = r.size
+	return g
+}
+
+func (r *Linear) Map(pos, length int) ([]Extent, error) {
+	return r.extents(pos, length)
+}
+
+func (r *Linear) Size() int64 {
+	return r.size
+}
+
+func (r *Linear) Level() Level {
+	return LevelLinear
+}
+
+// Status reports the size of every member, which is what it adds to the
+// array.
+func (r *Linear) Status() Status {
+	s := r.status(LevelLinear, 0)
+	for i := range s.Members {
+		s.Members[i].Size = r.sizes[i]
+	}
+	s.Size = r.size
+	return s
+}
+
+func (r *Linear) reconstruct(rows [][]byte, missing []int, off int64) error {
+	return ErrDataLost
+}
+
+func (r *Linear) verify(rows [][]byte, off int64, repair bool) int {
+	return 0
+}
+
+func (r *Linear) dataMembers() int {
+	return len(r.sizes)
+}
+
+func (r *Linear) rowSize() int {
+	return linearBlock
+}
+
+func (r *Linear) memberSizes() []int64 {
+	return r.sizes
+}
@@ -0,0 +1,691 @@
+package raid
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+)
+
+type DiskState int
+
+const (
+	DiskActive DiskState = iota
+	DiskFailed
+	DiskRebuilding
+)
+
+func (s DiskState) String() string {
+	switch s {
+	case DiskActive:
+		return "active"
+	case DiskFailed:
+		return "failed"
+	case DiskRebuilding:
+		return "rebuilding"
+	default:
+		return "unknown"
+	}
+}
+
+// rebuildChunk is how much of each member is rebuilt or scrubbed while the
+// array lock is held, so that foreground I/O can interleave.
+const rebuildChunk = 64 * 1024
+
+// codec is implemented by every level. It knows how the contents of the
+// members at the same member offset relate to each other.
+type codec interface {
+	// reconstruct fills rows[i] for every i in missing from the other rows.
+	// Every row holds the contents of one member starting at off.
+	reconstruct(rows [][]byte, missing []int, off int64) error
+	// verify returns the number of inconsistent stripe rows. With repair set,
+	// the redundant rows are rewritten in place from the data rows.
+	verify(rows [][]byte, off int64, repair bool) int
+	// dataMembers is the number of members' worth of usable capacity.
+	dataMembers() int
+	// rowSize is the granularity at which members relate to each other.
+	rowSize() int
+}
+
+// members holds the disks of an array and their state. Every level embeds it
+// and gets failure handling, rebuild and scrub on top of its codec.
+type members struct {
+	mu        sync.Mutex
+	disks     []Disk
+	state     []DiskState
+	recovered []int64
+	bad       []*badList
+	codec     codec
+	meta      *metadata // nil unless the array was created with superblocks
+	events    *EventBus
+	degraded  bool // as last published
+	speed     SyncSpeed
+	// requests counts the member requests issued, which tells background
+	// work whether foreground I/O came in between its chunks.
+	requests int64
+}
+
+func newMembers(disks []Disk) *members {
+	m := &members{
+		disks:     disks,
+		state:     make([]DiskState, len(disks)),
+		recovered: make([]int64, len(disks)),
+		bad:       make([]*badList, len(disks)),
+		events:    newEventBus(),
+	}
+	for i := range m.bad {
+		m.bad[i] = &badList{}
+	}
+	return m
+}
+
+func (m *members) base() *members {
+	return m
+}
+
+func newMemDisks(numDisks int) []Disk {
+	disks := make([]Disk, numDisks)
+	for i := range disks {
+		disks[i] = NewMemDisk(0)
+	}
+	return disks
+}
+
+// inSync reports whether member i holds valid data for [off, off+n).
+func (m *members) inSync(i int, off int64, n int) bool {
+	switch m.state[i] {
+	case DiskActive:
+		return !m.bad[i].unremapped(off, n)
+	case DiskRebuilding:
+		return off+int64(n) <= m.recovered[i] && !m.bad[i].unremapped(off, n)
+	}
+	return false
+}
+
+// readAt reads member i, reconstructing its contents from the other members
+// when it is out of sync or fails to read.
+func (m *members) readAt(i int, p []byte, off int64) error {
+	if off < 0 {
+		return errNegativeRange
+	}
+	if m.inSync(i, off, len(p)) {
+		m.requests++
+		if _, err := m.disks[i].ReadAt(p, off); err == nil {
+			return nil
+		}
+		m.ioFailed(i, p, off, false)
+	}
+	rows, err := m.readRows(off, len(p))
+	if err != nil {
+		return err
+	}
+	copy(p, rows[i])
+	return nil
+}
+
+// readRows reads [off, off+n) of every member and reconstructs the rows of
+// the members that are out of sync.
+func (m *members) readRows(off int64, n int) ([][]byte, error) {
+	rows := make([][]byte, len(m.disks))
+	var missing []int
+	var ios []memberIO
+	for i := range m.disks {
+		rows[i] = make([]byte, n)
+		if !m.inSync(i, off, n) {
+			missing = append(missing, i)
+			continue
+		}
+		ios = append(ios, memberIO{i, rows[i], off})
+	}
+	for j, err := range m.issue(ios, false) {
+		if errors.Is(err, errNegativeRange) {
+			return nil, err
+		}
+		if err != nil {
+			m.ioFailed(ios[j].disk, ios[j].p, off, false)
+			missing = append(missing, ios[j].disk)
+		}
+	}
+	slices.Sort(missing)
+	if len(missing) > 0 {
+		if err := m.codec.reconstruct(rows, missing, off); err != nil {
+			return nil, err
+		}
+	}
+	return rows, nil
+}
+
+// writeAt writes member i. The blocks of a member that fail to write are
+// marked bad; the redundancy of the others keeps the array readable.
+func (m *members) writeAt(i int, p []byte, off int64) {
+	if off < 0 {
+		return
+	}
+	m.requests++
+	if _, err := m.disks[i].WriteAt(p, off); err != nil {
+		m.ioFailed(i, p, off, true)
+	}
+}
+
+// memberIO is one read or write of a single member.
+type memberIO struct {
+	disk int
+	p    []byte
+	off  int64
+}
+
+// issue runs ios against the disks concurrently, one goroutine per member.
+// The requests of one member are issued in order by its goroutine, so every
+// disk sees at most one request at a time. It returns the error of each
+// request and leaves the member states alone: callers hold the lock and
+// handle failures once all requests are done. Requests at negative offsets
+// fail with errNegativeRange without reaching the disks, as they are the
+// caller's mistake and not the disk's.
+func (m *members) issue(ios []memberIO, write bool) []error {
+	m.requests += int64(len(ios))
+	errs := make([]error, len(ios))
+	perDisk := make(map[int][]int)
+	for j, req := range ios {
+		perDisk[req.disk] = append(perDisk[req.disk], j)
+	}
+	run := func(queue []int) {
+		for _, j := range queue {
+			req := ios[j]
+			if req.off < 0 {
+				errs[j] = errNegativeRange
+				continue
+			}
+			if write {
+				_, errs[j] = m.disks[req.disk].WriteAt(req.p, req.off)
+			} else {
+				_, errs[j] = m.disks[req.disk].ReadAt(req.p, req.off)
+			}
+		}
+	}
+	if len(perDisk) <= 1 {
+		for _, queue := range perDisk {
+			run(queue)
+		}
+		return errs
+	}
+	var wg sync.WaitGroup
+	for _, queue := range perDisk {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			run(queue)
+		}()
+	}
+	wg.Wait()
+	return errs
+}
+
+// readAll is readAt for many requests at once. The members that are in sync
+// are read concurrently; the others are reconstructed afterwards.
+func (m *members) readAll(ios []memberIO) error {
+	var direct, fallback []memberIO
+	for _, req := range ios {
+		if m.inSync(req.disk, req.off, len(req.p)) {
+			direct = append(direct, req)
+		} else {
+			fallback = append(fallback, req)
+		}
+	}
+	for j, err := range m.issue(direct, false) {
+		if errors.Is(err, errNegativeRange) {
+			return err
+		}
+		if err != nil {
+			m.ioFailed(direct[j].disk, direct[j].p, direct[j].off, false)
+			fallback = append(fallback, direct[j])
+		}
+	}
+	for _, req := range fallback {
+		if err := m.readAt(req.disk, req.p, req.off); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// stale reports whether member i is not expected to hold valid data at off:
+// it is failed, or being rebuilt and not recovered up to off yet. Writes skip
+// stale members; their contents are reconstructed from the others.
+func (m *members) stale(i int, off int64) bool {
+	switch m.state[i] {
+	case DiskFailed:
+		return true
+	case DiskRebuilding:
+		return off >= m.recovered[i]
+	}
+	return false
+}
+
+// writeAll is writeAt for many requests at once, issued concurrently.
+// Requests for stale members and bad blocks are dropped. Their data lives on
+// in the redundancy of the other members; where there is none left, the
+// data is lost and writeAll returns ErrDataLost, though the requests for the
+// other members are written.
+func (m *members) writeAll(ios []memberIO) error {
+	var dropped []memberIO
+	kept := m.skipBad(slices.DeleteFunc(slices.Clone(ios), func(req memberIO) bool {
+		if m.stale(req.disk, req.off) {
+			dropped = append(dropped, req)
+			return true
+		}
+		if m.bad[req.disk].unremapped(req.off, len(req.p)) {
+			dropped = append(dropped, req)
+		}
+		return false
+	}))
+	for j, err := range m.issue(kept, true) {
+		if errors.Is(err, errNegativeRange) {
+			return err
+		}
+		if err != nil {
+			m.ioFailed(kept[j].disk, kept[j].p, kept[j].off, true)
+			dropped = append(dropped, kept[j])
+		}
+	}
+	return m.recoverable(dropped)
+}
+
+// recoverable checks that the ranges of requests that did not reach their
+// members can be reconstructed from the members in sync.
+func (m *members) recoverable(dropped []memberIO) error {
+	type span struct {
+		off int64
+		n   int
+	}
+	seen := make(map[span]bool)
+	for _, req := range dropped {
+		s := span{req.off, len(req.p)}
+		if seen[s] || m.inSync(req.disk, s.off, s.n) {
+			continue
+		}
+		seen[s] = true
+		var missing []int
+		rows := make([][]byte, len(m.disks))
+		for i := range rows {
+			rows[i] = make([]byte, s.n)
+			if !m.inSync(i, s.off, s.n) {
+				missing = append(missing, i)
+			}
+		}
+		if err := m.codec.reconstruct(rows, missing, s.off); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// discardAt drops [off, off+n) of member i. Stale members and bad blocks are
+// skipped like they are for writes, and a member that fails to discard is
+// failed. Like writeAll, it returns ErrDataLost when the range then has no
+// redundancy left.
+func (m *members) discardAt(i int, off int64, n int) error {
+	if off < 0 {
+		return errNegativeRange
+	}
+	req := memberIO{i, make([]byte, n), off}
+	if m.stale(i, off) {
+		return m.recoverable([]memberIO{req})
+	}
+	m.requests++
+	for _, part := range m.bad[i].cut(off, n) {
+		if err := discard(m.disks[i], off+int64(part[0]), int64(part[1]-part[0])); err != nil {
+			m.failLocked(i)
+			return m.recoverable([]memberIO{req})
+		}
+	}
+	return nil
+}
+
+func (m *members) failLocked(i int) {
+	if m.state[i] == DiskFailed {
+		return
+	}
+	m.state[i] = DiskFailed
+	m.recovered[i] = 0
+	m.events.publish(Event{Kind: EventMemberFailed, Disk: i})
+	m.persist()
+}
+
+func (m *members) checkIndex(diskIndex int) error {
+	if diskIndex < 0 || diskIndex >= len(m.disks) {
+		return fmt.Errorf("%w: %d", ErrInvalidDisk, diskIndex)
+	}
+	return nil
+}
+
+// extent is the number of bytes of each member that hold array data.
+func (m *members) extent() int64 {
+	if m.meta != nil {
+		return m.meta.dataSize
+	}
+	var size int64
+	for _, d := range m.disks {
+		size = max(size, d.Size())
+	}
+	return size
+}
+
+// memberExtent is extent for member i alone. The members of a hybrid array
+// differ in size, and have no data past their own.
+func (m *members) memberExtent(i int) int64 {
+	if sized, ok := m.codec.(interface{ memberSizes() []int64 }); ok {
+		return sized.memberSizes()[i]
+	}
+	return m.extent()
+}
+
+// clip cuts p, read from member i at off, down to the member's extent.
+func (m *members) clip(i int, p []byte, off int64) []byte {
+	return p[:max(min(int64(len(p)), m.memberExtent(i)-off), 0)]
+}
+
+// ClearDisk wipes a member, which then has to be rebuilt.
+func (m *members) ClearDisk(diskIndex int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.checkIndex(diskIndex) != nil {
+		return
+	}
+	zero := make([]byte, rebuildChunk)
+	size := m.disks[diskIndex].Size()
+	for off := int64(0); off < size; off += rebuildChunk {
+		n := min(int64(rebuildChunk), size-off)
+		m.disks[diskIndex].WriteAt(zero[:n], off)
+	}
+	m.failLocked(diskIndex)
+}
+
+func (m *members) Fail(diskIndex int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.checkIndex(diskIndex); err != nil {
+		return err
+	}
+	m.failLocked(diskIndex)
+	return nil
+}
+
+// Replace swaps a failed member for a new disk. The new disk is out of sync
+// until it is rebuilt.
+func (m *members) Replace(diskIndex int, disk Disk) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.checkIndex(diskIndex); err != nil {
+		return err
+	}
+	if m.state[diskIndex] == DiskActive {
+		return fmt.Errorf("%w: fail disk %d before replacing it", ErrDiskInSync, diskIndex)
+	}
+	bad := &badList{}
+	if m.meta != nil {
+		var err error
+		if disk, err = m.meta.attach(diskIndex, disk, bad); err != nil {
+			return err
+		}
+	}
+	m.disks[diskIndex] = disk
+	m.bad[diskIndex] = bad
+	m.state[diskIndex] = DiskFailed
+	m.recovered[diskIndex] = 0
+	m.events.publish(Event{Kind: EventMemberReplaced, Disk: diskIndex})
+	m.persist()
+	return nil
+}
+
+// Rebuild reconstructs a member from the others. The array stays usable
+// while the rebuild runs: the lock is only held for one chunk at a time.
+func (m *members) Rebuild(diskIndex int) error {
+	return m.RebuildContext(context.Background(), diskIndex)
+}
+
+// RebuildContext is Rebuild until ctx is done. The member is then left
+// rebuilding with what has been recovered so far, and a later rebuild picks
+// up from there.
+func (m *members) RebuildContext(ctx context.Context, diskIndex int) error {
+	m.mu.Lock()
+	if err := m.checkIndex(diskIndex); err != nil {
+		m.mu.Unlock()
+		return err
+	}
+	if m.state[diskIndex] == DiskActive {
+		m.mu.Unlock()
+		return fmt.Errorf("%w: %d", ErrDiskInSync, diskIndex)
+	}
+	if m.state[diskIndex] != DiskRebuilding {
+		m.state[diskIndex] = DiskRebuilding
+		m.recovered[diskIndex] = 0
+		m.persist()
+	}
+	total := m.extent()
+	chunk := m.chunkSize()
+	start := m.recovered[diskIndex] / int64(chunk) * int64(chunk)
+	m.events.publish(Event{Kind: EventRebuildStarted, Disk: diskIndex, Done: start, Total: total})
+	t := m.newThrottle()
+	m.mu.Unlock()
+
+	for off := start; off < total; off += int64(chunk) {
+		n := int(min(int64(chunk), total-off))
+		if err := ctx.Err(); err != nil {
+			return m.rebuildFinished(diskIndex, off, total, &ProgressError{fmt.Sprintf("rebuild of disk %d", diskIndex), off, total, err})
+		}
+		m.mu.Lock()
+		t.begin()
+		if m.state[diskIndex] != DiskRebuilding {
+			err := fmt.Errorf("rebuild of disk %d aborted: disk is %s", diskIndex, m.state[diskIndex])
+			m.mu.Unlock()
+			return m.rebuildFinished(diskIndex, off, total, err)
+		}
+		rows, err := m.readRows(off, n)
+		if err != nil {
+			m.mu.Unlock()
+			return m.rebuildFinished(diskIndex, off, total, fmt.Errorf("rebuild of disk %d at offset %d: %w", diskIndex, off, err))
+		}
+		p := m.clip(diskIndex, rows[diskIndex], off)
+		if _, err := m.disks[diskIndex].WriteAt(p, off); err != nil {
+			m.ioFailed(diskIndex, p, off, true)
+			if m.state[diskIndex] != DiskRebuilding {
+				m.mu.Unlock()
+				return m.rebuildFinished(diskIndex, off, total, fmt.Errorf("rebuild of disk %d at offset %d: %w", diskIndex, off, err))
+			}
+		} else if m.bad[diskIndex].clear(off, len(p), m.memberExtent(diskIndex)) {
+			// Blocks that take a write are good again.
+			m.persist()
+		}
+		m.recovered[diskIndex] = off + int64(n)
+		m.rebuildProgress(diskIndex, off, off+int64(n), total)
+		t.done(n)
+		m.mu.Unlock()
+		t.wait(ctx)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.state[diskIndex] != DiskRebuilding {
+		return m.rebuildFinished(diskIndex, total, total, fmt.Errorf("rebuild of disk %d aborted: disk is %s", diskIndex, m.state[diskIndex]))
+	}
+	m.state[diskIndex] = DiskActive
+	m.recovered[diskIndex] = 0
+	m.rebuildFinished(diskIndex, total, total, nil)
+	m.persist()
+	return nil
+}
+
+// Scrub reads every member and checks that the redundancy is consistent.
+// With repair set, inconsistent rows are rewritten from the data.
+func (m *members) Scrub(repair bool) (ScrubReport, error) {
+	return m.ScrubContext(context.Background(), repair)
+}
+
+// ScrubContext is Scrub until ctx is done. The report then covers the part
+// of the members that was checked.
+func (m *members) ScrubContext(ctx context.Context, repair bool) (report ScrubReport, err error) {
+	var total int64
+	defer func() {
+		m.events.publish(Event{Kind: EventScrubFinished, Disk: -1, Done: report.Checked, Total: total, Mismatches: report.Mismatches, Err: err})
+	}()
+	m.mu.Lock()
+	total = m.extent()
+	for i := range m.disks {
+		if m.state[i] != DiskActive {
+			err := fmt.Errorf("cannot scrub: disk %d is %s", i, m.state[i])
+			m.mu.Unlock()
+			return report, err
+		}
+	}
+	chunk := m.chunkSize()
+	t := m.newThrottle()
+	m.mu.Unlock()
+
+	for off := int64(0); off < total; off += int64(chunk) {
+		n := int(min(int64(chunk), total-off))
+		if err := ctx.Err(); err != nil {
+			return report, &ProgressError{"scrub", off, total, err}
+		}
+		m.mu.Lock()
+		t.begin()
+		rows, err := m.readRows(off, n)
+		if err != nil {
+			m.mu.Unlock()
+			return report, err
+		}
+		mismatches := m.codec.verify(rows, off, repair)
+		if mismatches > 0 {
+			m.events.publish(Event{Kind: EventScrubMismatch, Disk: -1, Offset: off, Mismatches: mismatches})
+		}
+		if repair && mismatches > 0 {
+			ios := make([]memberIO, len(m.disks))
+			for i := range m.disks {
+				ios[i] = memberIO{i, m.clip(i, rows[i], off), off}
+			}
+			if err := m.writeAll(ios); err != nil {
+				m.mu.Unlock()
+				return report, err
+			}
+			report.Repaired += mismatches
+		}
+		if repair {
+			m.heal(rows, off)
+		}
+		report.Mismatches += mismatches
+		report.Checked = off + int64(n)
+		t.done(n)
+		m.mu.Unlock()
+		t.wait(ctx)
+	}
+	return report, nil
+}
+
+// Flush makes completed writes durable on every member that can sync. A
+// member that fails to sync is failed, the others are still synced, and the
+// first error is returned: the writes may not be durable where the caller
+// was promised they are.
+func (m *members) Flush() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var first error
+	for i := range m.disks {
+		disk := m.disks[i]
+		if m.meta != nil {
+			disk = m.meta.raw[i]
+		}
+		if s, ok := disk.(interface{ Sync() error }); ok && m.state[i] != DiskFailed {
+			if err := s.Sync(); err != nil {
+				m.failLocked(i)
+				if first == nil {
+					first = fmt.Errorf("sync of disk %d: %w", i, err)
+				}
+			}
+		}
+	}
+	return first
+}
+
+func (m *members) chunkSize() int {
+	row := m.codec.rowSize()
+	return max(rebuildChunk/row, 1) * row
+}
+
+// Size is the usable capacity of the array: what the smallest member holds,
+// times the number of data members. Levels that use members of different
+// sizes to their full extent override it.
+func (m *members) Size() int64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.size()
+}
+
+func (m *members) size() int64 {
+	var smallest int64 = -1
+	for i := range m.disks {
+		if size := m.usable(i); smallest < 0 || size < smallest {
+			smallest = size
+		}
+	}
+	return max(smallest, 0) * int64(m.codec.dataMembers())
+}
+
+// usable is how much of member i the array can use.
+func (m *members) usable(i int) int64 {
+	if m.meta != nil {
+		return m.meta.dataSize
+	}
+	return m.disks[i].Size()
+}
+
+func (m *members) status(level Level, stripeSize int) Status {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s := Status{Level: level, StripeSize: stripeSize, Size: m.size()}
+	for i := range m.disks {
+		s.Members = append(s.Members, MemberStatus{
+			Index:     i,
+			Name:      m.diskName(i),
+			State:     m.state[i],
+			Size:      m.usable(i),
+			Recovered: m.recovered[i],
+			BadBlocks: len(m.bad[i].blocks),
+			Remapped:  m.bad[i].remapped(),
+		})
+	}
+	if m.meta != nil {
+		s.UUID = m.meta.uuid
+	}
+	return s
+}
+
+// diskName is the name of the disk behind member i, if it has one.
+func (m *members) diskName(i int) string {
+	disk := m.disks[i]
+	if m.meta != nil {
+		disk = m.meta.raw[i]
+	}
+	if named, ok := disk.(interface{ Name() string }); ok {
+		return named.Name()
+	}
+	return ""
+}
+
+// persist records the member states in the superblocks, if there are any,
+// and tells subscribers when the array loses or regains redundancy. Members
+// whose superblock cannot be written are failed, which records that on the
+// others.
+func (m *members) persist() {
+	m.checkDegraded()
+	if m.meta == nil {
+		return
+	}
+	for _, i := range m.meta.write(m) {
+		m.failLocked(i)
+	}
+}
+
+func xorInto(dst, src []byte) {
+	subtle.XORBytes(dst, dst, src)
+}
@@ -0,0 +1,67 @@
+package raid
+
+import "context"
+
+type PatrolReport struct {
+	// Checked is the number of bytes read on each member.
+	Checked int64
+	// BadBlocks is the number of blocks that were found unreadable. They
+	// are on the bad block lists of their members, remapped where the
+	// reserved area allows.
+	BadBlocks int
+}
+
+// Patrol reads every member that is in sync, to find unreadable blocks
+// before a rebuild has to rely on them. Unlike a scrub, it does not check
+// the redundancy, and it runs on degraded arrays too. Blocks already known
+// to be bad are skipped. It stops when ctx is done, with a *ProgressError
+// telling how far it got.
+func (m *members) Patrol(ctx context.Context) (PatrolReport, error) {
+	var report PatrolReport
+	m.mu.Lock()
+	total := m.extent()
+	chunk := m.chunkSize()
+	t := m.newThrottle()
+	m.mu.Unlock()
+
+	for off := int64(0); off < total; off += int64(chunk) {
+		n := int(min(int64(chunk), total-off))
+		if err := ctx.Err(); err != nil {
+			err = &ProgressError{"patrol read", off, total, err}
+			m.events.publish(Event{Kind: EventPatrolFinished, Disk: -1, Done: off, Total: total, Err: err})
+			return report, err
+		}
+		m.mu.Lock()
+		t.begin()
+		var ios []memberIO
+		for i := range m.disks {
+			p := m.clip(i, make([]byte, n), off)
+			if len(p) > 0 && (m.state[i] == DiskActive || m.state[i] == DiskRebuilding && off+int64(len(p)) <= m.recovered[i]) {
+				ios = append(ios, memberIO{i, p, off})
+			}
+		}
+		ios = m.skipBad(ios)
+		before := m.badBlocks()
+		for j, err := range m.issue(ios, false) {
+			if err != nil {
+				m.ioFailed(ios[j].disk, ios[j].p, ios[j].off, false)
+			}
+		}
+		report.BadBlocks += m.badBlocks() - before
+		report.Checked = off + int64(n)
+		t.done(n)
+		m.mu.Unlock()
+		t.wait(ctx)
+	}
+	m.events.publish(Event{Kind: EventPatrolFinished, Disk: -1, Done: total, Total: total})
+	return report, nil
+}
+
+// badBlocks is the number of bad blocks of all members.
+func (m *members) badBlocks() int {
+	n := 0
+	for _, l := range m.bad {
+		n += len(l.blocks)
+	}
+	return n
+}
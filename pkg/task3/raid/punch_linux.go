@@ -0,0 +1,26 @@
+package raid
+
+import (
+	"os"
+	"syscall"
+)
+
+// Flags of fallocate(2) from linux/falloc.h.
+const (
+	fallocKeepSize  = 0x01
+	fallocPunchHole = 0x02
+)
+
+func punchHole(f *os.File, off, n int64) error {
+	conn, err := f.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var punchErr error
+	if err := conn.Control(func(fd uintptr) {
+		punchErr = syscall.Fallocate(int(fd), fallocPunchHole|fallocKeepSize, off, n)
+	}); err != nil {
+		return err
+	}
+	return punchErr
+}
@@ -0,0 +1,12 @@
+//go:build !linux
+
+package raid
+
+import (
+	"errors"
+	"os"
+)
+
+func punchHole(f *os.File, off, n int64) error {
+	return errors.New("punching holes is not supported on this platform")
+}
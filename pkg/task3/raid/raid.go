@@ -1,7 +1,182 @@
 package raid
 
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+var (
+	ErrDataLost     = errors.New("data lost: too many members are not in sync")
+	ErrInvalidDisk  = errors.New("invalid disk index")
+	ErrDiskInSync   = errors.New("disk is in sync")
+	ErrUnknownLevel = errors.New("unknown RAID level")
+)
+
 type RAID interface {
 	Read(length int, pos int) ([]byte, error)
 	Write(data []byte, pos int) error
+	// Discard tells the array that [pos, pos+length) is no longer in use.
+	// The range reads back as zeros, and members backed by sparse files
+	// release its space.
+	Discard(pos, length int) error
 	ClearDisk(diskIndex int)
 }
+
+// Array is a RAID whose members can be inspected and managed: a member can be
+// failed, swapped for a new disk and rebuilt from the redundancy of the others.
+type Array interface {
+	RAID
+	Level() Level
+	// Size is the usable capacity. Striped levels use as much of every
+	// member as the smallest one holds.
+	Size() int64
+	Status() Status
+	Fail(diskIndex int) error
+	Replace(diskIndex int, disk Disk) error
+	Rebuild(diskIndex int) error
+	Scrub(repair bool) (ScrubReport, error)
+	// RebuildContext and ScrubContext stop when ctx is done and return a
+	// *ProgressError telling how far they got.
+	RebuildContext(ctx context.Context, diskIndex int) error
+	ScrubContext(ctx context.Context, repair bool) (ScrubReport, error)
+	// Patrol reads the members to find unreadable blocks early.
+	Patrol(ctx context.Context) (PatrolReport, error)
+	// SetSyncSpeed throttles rebuilds, scrubs and patrol reads.
+	SetSyncSpeed(SyncSpeed)
+	// Flush makes completed writes durable on the members.
+	Flush() error
+	// Events is where the array publishes member failures, rebuilds,
+	// scrubs and other changes to its state.
+	Events() *EventBus
+	Geometry() Geometry
+	// Map returns where the logical range [pos, pos+length) lives on the
+	// members, in logical order. Every piece of data comes with the extents
+	// that mirror it or hold its parity.
+	Map(pos, length int) ([]Extent, error)
+}
+
+type Level int
+
+const (
+	LevelHybrid      Level = -3
+	LevelDeclustered Level = -2
+	LevelLinear      Level = -1
+	Level0           Level = 0
+	Level1           Level = 1
+	Level4           Level = 4
+	Level5           Level = 5
+	Level6           Level = 6
+	Level10          Level = 10
+)
+
+func (l Level) String() string {
+	switch l {
+	case LevelLinear:
+		return "linear"
+	case LevelDeclustered:
+		return "dRAID"
+	case LevelHybrid:
+		return "SHR"
+	}
+	return fmt.Sprintf("RAID%d", int(l))
+}
+
+// known reports whether l is one of the levels of this package.
+func (l Level) known() bool {
+	switch l {
+	case Level0, Level1, Level4, Level5, Level6, Level10, LevelLinear, LevelDeclustered, LevelHybrid:
+		return true
+	}
+	return false
+}
+
+// ParseLevel accepts "5", "raid5" or "RAID5", "linear" or "jbod", "draid",
+// and "shr" or "hybrid".
+func ParseLevel(s string) (Level, error) {
+	s = strings.TrimPrefix(strings.ToLower(s), "raid")
+	switch s {
+	case "linear", "jbod":
+		return LevelLinear, nil
+	case "draid":
+		return LevelDeclustered, nil
+	case "shr", "hybrid":
+		return LevelHybrid, nil
+	}
+	for _, l := range []Level{Level0, Level1, Level4, Level5, Level6, Level10} {
+		if s == fmt.Sprint(int(l)) {
+			return l, nil
+		}
+	}
+	return 0, fmt.Errorf("%w: %q", ErrUnknownLevel, s)
+}
+
+// New builds an array of the given level on top of existing disks.
+// stripeSize is ignored by RAID1 and linear arrays. Declustered arrays get
+// the default geometry; see NewDeclustered for others. Linear and hybrid
+// arrays use every disk up to its current size.
+func New(level Level, disks []Disk, stripeSize int) (Array, error) {
+	switch level {
+	case LevelDeclustered:
+		return newDeclustered(disks, stripeSize, defaultDeclustered(len(disks)))
+	case LevelLinear:
+		return newLinear(disks, nil)
+	case LevelHybrid:
+		return newHybrid(disks, stripeSize, nil)
+	case Level0:
+		return newRAID0(disks, stripeSize)
+	case Level1:
+		return newRAID1(disks)
+	case Level4:
+		return newRAID4(disks, stripeSize)
+	case Level5:
+		return newRAID5(disks, stripeSize)
+	case Level6:
+		return newRAID6(disks, stripeSize)
+	case Level10:
+		return newRAID10(disks, stripeSize)
+	}
+	return nil, fmt.Errorf("%w: %d", ErrUnknownLevel, int(level))
+}
+
+// Status is a snapshot of an array and the state of its members.
+type Status struct {
+	Level      Level
+	UUID       string
+	StripeSize int
+	Size       int64
+	Members    []MemberStatus
+}
+
+type MemberStatus struct {
+	Index int
+	// Name identifies the disk, e.g. the path of its image file.
+	Name  string
+	State DiskState
+	Size  int64
+	// Recovered is how far a rebuild of this member has progressed.
+	Recovered int64
+	// BadBlocks is the number of blocks of the member that failed, of which
+	// Remapped live in its reserved area. The others are reconstructed from
+	// the other members.
+	BadBlocks, Remapped int
+}
+
+// Degraded reports whether any member is out of sync.
+func (s Status) Degraded() bool {
+	for _, m := range s.Members {
+		if m.State != DiskActive {
+			return true
+		}
+	}
+	return false
+}
+
+type ScrubReport struct {
+	// Checked is the number of bytes checked on each member.
+	Checked int64
+	// Mismatches is the number of stripe rows whose redundancy was inconsistent.
+	Mismatches int
+	Repaired   int
+}
@@ -5,21 +5,26 @@ import (
 )
 
 type RAID0 struct {
+	*members
 	numDisks   int
 	stripeSize int
-	disks      [][]byte
 }
 
 func NewRAID0(numDisks, stripeSize int) (*RAID0, error) {
-	if numDisks < 2 {
+	return newRAID0(newMemDisks(numDisks), stripeSize)
+}
+
+func newRAID0(disks []Disk, stripeSize int) (*RAID0, error) {
+	if len(disks) < 2 {
 		return nil, errors.New("RAID0: number of disks must be greater or equals than 2")
 	}
-	raid := &RAID0{
-		numDisks, stripeSize, make([][]byte, numDisks),
+	if stripeSize <= 0 {
+		return nil, errors.New("RAID0: stripe size must be positive")
 	}
-	for i := range raid.disks {
-		raid.disks[i] = make([]byte, 0)
+	raid := &RAID0{
+		newMembers(disks), len(disks), stripeSize,
 	}
+	raid.codec = raid
 	return raid, nil
 }
 
@@ -27,61 +32,107 @@ func NewRAID0(numDisks, stripeSize int) (*RAID0, error) {
 // and distribute them across the disks in order.
 // For example, if the stripeSize is 2, and the data is "abcdef",
 // then disk0 would get "ab", disk1 "cd", disk0 "ef", etc.
+// Every chunk is written to its disk in one piece, and the disks are written
+// concurrently.
 func (r *RAID0) Write(data []byte, pos int) error {
+	if err := checkRange(pos, len(data)); err != nil {
+		return err
+	}
 	if r.numDisks <= 0 {
 		return errors.New("RAID0: no disks available")
 	}
-	for i := 0; i < len(data); i++ {
-		logicalPos := pos + i
-		stripeNumber := logicalPos / r.stripeSize
-
-		diskIndex := stripeNumber % r.numDisks
-		offsetInStripe := logicalPos % r.stripeSize
-		stripeInDisk := stripeNumber / r.numDisks
-		diskOffset := stripeInDisk*r.stripeSize + offsetInStripe
-
-		if diskOffset >= len(r.disks[diskIndex]) {
-			needed := diskOffset - len(r.disks[diskIndex]) + 1
-			r.disks[diskIndex] = append(r.disks[diskIndex], make([]byte, needed)...)
-		}
-		r.disks[diskIndex][diskOffset] = data[i]
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var ios []memberIO
+	for _, c := range splitChunks(pos, len(data), r.stripeSize) {
+		diskIndex, diskOffset := r.locate(c)
+		ios = append(ios, memberIO{diskIndex, data[c.pos : c.pos+c.n], diskOffset})
 	}
-	return nil
+	return r.writeAll(ios)
 }
 
-// When reading, for each logical byte index, compute the disk and offset,
-// then read the byte from there. If the disk's slice is shorter than the offset, return zero.
+// When reading, every chunk of the request is read from its disk in one
+// piece. Regions that were never written read as zero.
 func (r *RAID0) Read(length int, pos int) ([]byte, error) {
+	if err := checkRange(pos, length); err != nil {
+		return nil, err
+	}
 	result := make([]byte, length)
 	if r.numDisks <= 0 {
 		return result, errors.New("RAID0: no disks available")
 	}
-	for i := 0; i < length; i++ {
-		logicalPos := pos + i
-		stripeNumber := logicalPos / r.stripeSize
-		diskIndex := stripeNumber % r.numDisks
-		if diskIndex >= len(r.disks) {
-			result[i] = 0
-			continue
-		}
-		offsetInStripe := logicalPos % r.stripeSize
-		stripeInDisk := stripeNumber / r.numDisks
-		diskOffset := stripeInDisk*r.stripeSize + offsetInStripe
-
-		disk := r.disks[diskIndex]
-		if diskOffset >= len(disk) {
-			result[i] = 0
-		} else {
-			result[i] = disk[diskOffset]
-		}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var ios []memberIO
+	for _, c := range splitChunks(pos, length, r.stripeSize) {
+		diskIndex, diskOffset := r.locate(c)
+		ios = append(ios, memberIO{diskIndex, result[c.pos : c.pos+c.n], diskOffset})
+	}
+	if err := r.readAll(ios); err != nil {
+		return nil, err
 	}
 	return result, nil
 }
 
-func (r *RAID0) ClearDisk(diskIndex int) {
-	if diskIndex >= 0 && diskIndex < len(r.disks) {
-		for i := range r.disks[diskIndex] {
-			r.disks[diskIndex][i] = 0
+func (r *RAID0) Discard(pos, length int) error {
+	if err := checkRange(pos, length); err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, c := range splitChunks(pos, length, r.stripeSize) {
+		diskIndex, diskOffset := r.locate(c)
+		if err := r.discardAt(diskIndex, diskOffset, c.n); err != nil {
+			return err
 		}
 	}
+	return nil
+}
+
+// locate returns the disk of a chunk and where the chunk starts on it.
+func (r *RAID0) locate(c chunk) (int, int64) {
+	stripeInDisk := c.index / r.numDisks
+	return c.index % r.numDisks, int64(stripeInDisk*r.stripeSize + c.within)
+}
+
+func (r *RAID0) Geometry() Geometry {
+	return r.geometry(Level0, r.stripeSize)
+}
+
+func (r *RAID0) Map(pos, length int) ([]Extent, error) {
+	if pos < 0 || length < 0 {
+		return nil, errNegativeRange
+	}
+	var extents []Extent
+	for _, c := range splitChunks(pos, length, r.stripeSize) {
+		diskIndex, diskOffset := r.locate(c)
+		extents = append(extents, Extent{pos + c.pos, c.n, diskIndex, diskOffset, RoleData})
+	}
+	return extents, nil
+}
+
+func (r *RAID0) Level() Level {
+	return Level0
+}
+
+func (r *RAID0) Status() Status {
+	return r.status(Level0, r.stripeSize)
+}
+
+// RAID0 has no redundancy: nothing can be reconstructed and there is nothing
+// to verify.
+func (r *RAID0) reconstruct(rows [][]byte, missing []int, off int64) error {
+	return ErrDataLost
+}
+
+func (r *RAID0) verify(rows [][]byte, off int64, repair bool) int {
+	return 0
+}
+
+func (r *RAID0) dataMembers() int {
+	return r.numDisks
+}
+
+func (r *RAID0) rowSize() int {
+	return r.stripeSize
 }
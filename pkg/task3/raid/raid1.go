@@ -1,77 +1,160 @@
 package raid
 
 import (
+	"bytes"
 	"errors"
+	"slices"
 )
 
+// raid1Row is the granularity at which mirrors are compared by a scrub.
+const raid1Row = 512
+
 type RAID1 struct {
+	*members
 	numDisks int
-	disks    [][]byte
 }
 
 func NewRAID1(numDisks int) (*RAID1, error) {
-	if numDisks < 2 {
+	return newRAID1(newMemDisks(numDisks))
+}
+
+func newRAID1(disks []Disk) (*RAID1, error) {
+	if len(disks) < 2 {
 		return nil, errors.New("RAID1: number of disks must be greater or equals than 2")
 	}
 	raid := &RAID1{
-		numDisks, make([][]byte, numDisks),
-	}
-	for i := range raid.disks {
-		raid.disks[i] = make([]byte, 0)
+		newMembers(disks), len(disks),
 	}
+	raid.codec = raid
 	return raid, nil
 }
 
 // Mirror data
 func (r *RAID1) Write(data []byte, pos int) error {
+	if err := checkRange(pos, len(data)); err != nil {
+		return err
+	}
 	if r.numDisks <= 0 {
 		return errors.New("RAID1: no disks available")
 	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	ios := make([]memberIO, r.numDisks)
+	for diskIndex := range ios {
+		ios[diskIndex] = memberIO{diskIndex, data, int64(pos)}
+	}
+	return r.writeAll(ios)
+}
+
+func (r *RAID1) Read(length int, pos int) ([]byte, error) {
+	if err := checkRange(pos, length); err != nil {
+		return nil, err
+	}
+	result := make([]byte, length)
+	if r.numDisks <= 0 {
+		return result, errors.New("RAID1: no disks available")
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if int64(pos+length) > r.extent() {
+		return nil, errors.New("raid1: logical position out of range")
+	}
+	if err := r.readAt(r.mirror(int64(pos), length), result, int64(pos)); err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
 
-	// Increase disk size if needed
-	diskOffset := pos + len(data)
+func (r *RAID1) Discard(pos, length int) error {
+	if err := checkRange(pos, length); err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
 	for diskIndex := range r.numDisks {
-		if diskOffset >= len(r.disks[diskIndex]) {
-			needed := diskOffset - len(r.disks[diskIndex]) + 1
-			r.disks[diskIndex] = append(r.disks[diskIndex], make([]byte, needed)...)
+		if err := r.discardAt(diskIndex, int64(pos), length); err != nil {
+			return err
 		}
 	}
+	return nil
+}
 
-	for i := 0; i < len(data); i++ {
-		logicalPos := pos + i
-		for diskIndex := range r.numDisks {
-			r.disks[diskIndex][logicalPos] = data[i]
+// mirror picks the first disk that holds valid data for the range, falling
+// back to disk 0 which is then reconstructed from the others.
+func (r *RAID1) mirror(off int64, n int) int {
+	for diskIndex := range r.numDisks {
+		if r.inSync(diskIndex, off, n) {
+			return diskIndex
 		}
 	}
-	return nil
+	return 0
 }
 
-func (r *RAID1) Read(length int, pos int) ([]byte, error) {
-	result := make([]byte, length)
-	if r.numDisks <= 0 {
-		return result, errors.New("RAID1: no disks available")
+func (r *RAID1) Geometry() Geometry {
+	return r.geometry(Level1, 0)
+}
+
+// Map places the range on disk 0 and mirrors it on all others.
+func (r *RAID1) Map(pos, length int) ([]Extent, error) {
+	if pos < 0 || length < 0 {
+		return nil, errNegativeRange
+	}
+	if length == 0 {
+		return nil, nil
+	}
+	extents := []Extent{{pos, length, 0, int64(pos), RoleData}}
+	for diskIndex := 1; diskIndex < r.numDisks; diskIndex++ {
+		extents = append(extents, Extent{pos, length, diskIndex, int64(pos), RoleMirror})
 	}
+	return extents, nil
+}
+
+func (r *RAID1) Level() Level {
+	return Level1
+}
 
-	for i := 0; i < length; i++ {
-		logicalPos := pos + i
-		if logicalPos >= len(r.disks[0]) {
-			return nil, errors.New("raid1: logical position out of range")
+func (r *RAID1) Status() Status {
+	return r.status(Level1, 0)
+}
+
+func (r *RAID1) reconstruct(rows [][]byte, missing []int, off int64) error {
+	for i := range rows {
+		if !slices.Contains(missing, i) {
+			for _, m := range missing {
+				copy(rows[m], rows[i])
+			}
+			return nil
 		}
-		for diskIndex := range r.numDisks {
-			if r.disks[diskIndex][logicalPos] != 0 {
-				result[i] = r.disks[diskIndex][logicalPos]
+	}
+	return ErrDataLost
+}
+
+// verify compares every mirror against the first one, which wins on repair.
+func (r *RAID1) verify(rows [][]byte, off int64, repair bool) int {
+	mismatches := 0
+	for start := 0; start < len(rows[0]); start += raid1Row {
+		end := min(start+raid1Row, len(rows[0]))
+		for _, row := range rows[1:] {
+			if !bytes.Equal(rows[0][start:end], row[start:end]) {
+				mismatches++
 				break
 			}
 		}
 	}
+	if repair && mismatches > 0 {
+		for _, row := range rows[1:] {
+			copy(row, rows[0])
+		}
+	}
+	return mismatches
+}
 
-	return result, nil
+func (r *RAID1) dataMembers() int {
+	return 1
 }
 
-func (r *RAID1) ClearDisk(diskIndex int) {
-	if diskIndex >= 0 && diskIndex < len(r.disks) {
-		for i := range r.disks[diskIndex] {
-			r.disks[diskIndex][i] = 0
-		}
-	}
+func (r *RAID1) rowSize() int {
+	return raid1Row
 }
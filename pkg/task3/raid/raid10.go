@@ -1,64 +1,64 @@
 package raid
 
-import "errors"
+import (
+	"bytes"
+	"errors"
+	"slices"
+)
 
 type RAID10 struct {
+	*members
 	numDisks   int
 	stripeSize int
-	disks      [][]byte
 }
 
 func NewRAID10(numDisks, stripeSize int) (*RAID10, error) {
+	return newRAID10(newMemDisks(numDisks), stripeSize)
+}
+
+func newRAID10(disks []Disk, stripeSize int) (*RAID10, error) {
+	numDisks := len(disks)
 	if numDisks < 4 {
 		return nil, errors.New("RAID10: number of disks must be greater or equals than 4")
 	}
 	if numDisks%2 != 0 {
 		return nil, errors.New("RAID10: number of disks must be even")
 	}
-	raid := &RAID10{
-		numDisks, stripeSize, make([][]byte, numDisks),
+	if stripeSize <= 0 {
+		return nil, errors.New("RAID10: stripe size must be positive")
 	}
-	for i := range raid.disks {
-		raid.disks[i] = make([]byte, 0)
+	raid := &RAID10{
+		newMembers(disks), numDisks, stripeSize,
 	}
+	raid.codec = raid
 	return raid, nil
 }
 
-// When reading, for each logical position, determine which pair and offset,
+// When reading, for each chunk, determine which pair and offset,
 // then read from either of the disks in the pair (since they are mirrored).
-// However, if one disk is cleared (zeroed),
+// However, if one disk is failed or cleared,
 // then the other disk in the pair should still have the data.
 func (r *RAID10) Read(length int, pos int) ([]byte, error) {
+	if err := checkRange(pos, length); err != nil {
+		return nil, err
+	}
 	result := make([]byte, length)
+	r.mu.Lock()
+	defer r.mu.Unlock()
 
-	numPairs := len(r.disks) / 2
-	for i := 0; i < length; i++ {
-		logicalPos := pos + i
-		stripeNumber := logicalPos / r.stripeSize
-		pairIndex := stripeNumber % numPairs
-		disk1 := pairIndex * 2
-		disk2 := pairIndex*2 + 1
-
-		offset := (stripeNumber/numPairs)*r.stripeSize + (logicalPos % r.stripeSize)
-		var value byte
-
-		// Check first disk in pair
-		if disk1 < len(r.disks) {
-			disk := r.disks[disk1]
-			if offset < len(disk) {
-				value = disk[offset]
-			}
-		}
+	var ios []memberIO
+	for _, c := range splitChunks(pos, length, r.stripeSize) {
+		disk1, disk2, offset := r.locate(c)
 
-		// If first disk's value is zero, check second disk
-		if value == 0 && disk2 < len(r.disks) {
-			disk := r.disks[disk2]
-			if offset < len(disk) {
-				value = disk[offset]
-			}
+		// Read from the first disk in the pair, unless only the second one is in sync
+		disk := disk1
+		if !r.inSync(disk1, offset, c.n) && r.inSync(disk2, offset, c.n) {
+			disk = disk2
 		}
-
-		result[i] = value
+		ios = append(ios, memberIO{disk, result[c.pos : c.pos+c.n], offset})
+	}
+	if err := r.readAll(ios); err != nil {
+		return nil, err
 	}
 
 	return result, nil
@@ -70,42 +70,103 @@ func (r *RAID10) Read(length int, pos int) ([]byte, error) {
 // The pairs are selected in a round-robin fashion.
 // So stripe 0 goes to pair 0 (disks 0 and 1), stripe 1 to pair 1 (disks 2 and 3), stripe 2 to pair 0 again, etc.
 func (r *RAID10) Write(data []byte, pos int) error {
-	numPairs := len(r.disks) / 2
-	for i := 0; i < len(data); i++ {
-		logicalPos := pos + i
-		stripeNumber := logicalPos / r.stripeSize
-		pairIndex := stripeNumber % numPairs
-		disk1 := pairIndex * 2
-		disk2 := pairIndex*2 + 1
-
-		offset := (stripeNumber/numPairs)*r.stripeSize + (logicalPos % r.stripeSize)
-
-		// Write to first disk in pair
-		if disk1 < len(r.disks) {
-			if offset >= len(r.disks[disk1]) {
-				needed := offset - len(r.disks[disk1]) + 1
-				r.disks[disk1] = append(r.disks[disk1], make([]byte, needed)...)
-			}
-			r.disks[disk1][offset] = data[i]
-		}
+	if err := checkRange(pos, len(data)); err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var ios []memberIO
+	for _, c := range splitChunks(pos, len(data), r.stripeSize) {
+		disk1, disk2, offset := r.locate(c)
+		ios = append(ios,
+			memberIO{disk1, data[c.pos : c.pos+c.n], offset},
+			memberIO{disk2, data[c.pos : c.pos+c.n], offset})
+	}
+	return r.writeAll(ios)
+}
 
-		// Write to second disk in pair
-		if disk2 < len(r.disks) {
-			if offset >= len(r.disks[disk2]) {
-				needed := offset - len(r.disks[disk2]) + 1
-				r.disks[disk2] = append(r.disks[disk2], make([]byte, needed)...)
+// Discard drops every chunk of the range from both disks of its pair.
+func (r *RAID10) Discard(pos, length int) error {
+	if err := checkRange(pos, length); err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, c := range splitChunks(pos, length, r.stripeSize) {
+		disk1, disk2, offset := r.locate(c)
+		for _, d := range []int{disk1, disk2} {
+			if err := r.discardAt(d, offset, c.n); err != nil {
+				return err
 			}
-			r.disks[disk2][offset] = data[i]
 		}
 	}
+	return nil
+}
 
+// locate returns the pair of disks holding a chunk and where it starts on them.
+func (r *RAID10) locate(c chunk) (int, int, int64) {
+	numPairs := r.numDisks / 2
+	pairIndex := c.index % numPairs
+	return pairIndex * 2, pairIndex*2 + 1, int64((c.index/numPairs)*r.stripeSize + c.within)
+}
+
+func (r *RAID10) Geometry() Geometry {
+	return r.geometry(Level10, r.stripeSize)
+}
+
+func (r *RAID10) Map(pos, length int) ([]Extent, error) {
+	if pos < 0 || length < 0 {
+		return nil, errNegativeRange
+	}
+	var extents []Extent
+	for _, c := range splitChunks(pos, length, r.stripeSize) {
+		disk1, disk2, offset := r.locate(c)
+		extents = append(extents,
+			Extent{pos + c.pos, c.n, disk1, offset, RoleData},
+			Extent{pos + c.pos, c.n, disk2, offset, RoleMirror})
+	}
+	return extents, nil
+}
+
+func (r *RAID10) Level() Level {
+	return Level10
+}
+
+func (r *RAID10) Status() Status {
+	return r.status(Level10, r.stripeSize)
+}
+
+// Disks 2k and 2k+1 mirror each other.
+func (r *RAID10) reconstruct(rows [][]byte, missing []int, off int64) error {
+	for _, m := range missing {
+		if slices.Contains(missing, m^1) {
+			return ErrDataLost
+		}
+		copy(rows[m], rows[m^1])
+	}
 	return nil
 }
 
-func (r *RAID10) ClearDisk(diskIndex int) {
-	if diskIndex >= 0 && diskIndex < len(r.disks) {
-		for i := range r.disks[diskIndex] {
-			r.disks[diskIndex][i] = 0
+func (r *RAID10) verify(rows [][]byte, off int64, repair bool) int {
+	mismatches := 0
+	for start := 0; start < len(rows[0]); start += r.stripeSize {
+		end := min(start+r.stripeSize, len(rows[0]))
+		for d := 0; d < r.numDisks; d += 2 {
+			if !bytes.Equal(rows[d][start:end], rows[d+1][start:end]) {
+				mismatches++
+				if repair {
+					copy(rows[d+1][start:end], rows[d][start:end])
+				}
+			}
 		}
 	}
+	return mismatches
+}
+
+func (r *RAID10) dataMembers() int {
+	return r.numDisks / 2
+}
+
+func (r *RAID10) rowSize() int {
+	return r.stripeSize
 }
@@ -0,0 +1,135 @@
+package raid
+
+import (
+	"errors"
+	"fmt"
+)
+
+// RAID4 is RAID5 with the parity of every stripe on the last disk instead of
+// rotating. Every write updates the parity disk, which makes it the
+// bottleneck of small writes.
+type RAID4 struct {
+	*members
+	numDisks   int
+	stripeSize int
+	stripes    *parityStripes
+}
+
+func NewRAID4(numDisks, stripeSize int) (*RAID4, error) {
+	return newRAID4(newMemDisks(numDisks), stripeSize)
+}
+
+func newRAID4(disks []Disk, stripeSize int) (*RAID4, error) {
+	if len(disks) < 3 {
+		return nil, errors.New("RAID4: number of disks must be greater or equals than 3")
+	}
+	if stripeSize <= 0 {
+		return nil, errors.New("RAID4: stripe size must be positive")
+	}
+	raid := &RAID4{
+		members: newMembers(disks), numDisks: len(disks), stripeSize: stripeSize,
+	}
+	raid.codec = raid
+	raid.stripes = &parityStripes{raid.members, raid, stripeSize, len(disks) - 1, 1, 0}
+	return raid, nil
+}
+
+func (r *RAID4) Read(length int, offset int) ([]byte, error) {
+	if err := checkRange(offset, length); err != nil {
+		return nil, err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.stripes.read(length, offset)
+}
+
+func (r *RAID4) Write(data []byte, offset int) error {
+	if err := checkRange(offset, len(data)); err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.stripes.write(data, offset)
+}
+
+func (r *RAID4) ReadV(vecs []IOVec) error {
+	if err := checkVecs(vecs); err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.stripes.readV(vecs)
+}
+
+func (r *RAID4) WriteV(vecs []IOVec) error {
+	if err := checkVecs(vecs); err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.stripes.writeV(coalesce(vecs))
+}
+
+func (r *RAID4) Discard(pos, length int) error {
+	if err := checkRange(pos, length); err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.stripes.discard(pos, length)
+}
+
+func (r *RAID4) stripeDisks(s int) ([]int, []int) {
+	dataDisks := make([]int, r.numDisks-1)
+	for k := range dataDisks {
+		dataDisks[k] = k
+	}
+	return dataDisks, []int{r.numDisks - 1}
+}
+
+func (r *RAID4) encode(data [][]byte, parity [][]byte) {
+	encodeXOR(data, parity)
+}
+
+func (r *RAID4) update(parity [][]byte, k int, delta []byte) {
+	xorInto(parity[0], delta)
+}
+
+func (r *RAID4) Geometry() Geometry {
+	return r.geometry(Level4, r.stripeSize)
+}
+
+func (r *RAID4) Map(pos, length int) ([]Extent, error) {
+	if pos < 0 || length < 0 {
+		return nil, errNegativeRange
+	}
+	return r.stripes.mapRange(pos, length), nil
+}
+
+func (r *RAID4) Level() Level {
+	return Level4
+}
+
+func (r *RAID4) Status() Status {
+	return r.status(Level4, r.stripeSize)
+}
+
+func (r *RAID4) reconstruct(rows [][]byte, missing []int, off int64) error {
+	if len(missing) > 1 {
+		return fmt.Errorf("RAID4: %w", ErrDataLost)
+	}
+	reconstructXOR(rows, missing[0])
+	return nil
+}
+
+func (r *RAID4) verify(rows [][]byte, off int64, repair bool) int {
+	return verifyXOR(rows, off, r.stripeSize, repair, func(int) int { return r.numDisks - 1 })
+}
+
+func (r *RAID4) dataMembers() int {
+	return r.numDisks - 1
+}
+
+func (r *RAID4) rowSize() int {
+	return r.stripeSize
+}
@@ -6,198 +6,188 @@ import (
 )
 
 type RAID5 struct {
+	*members
 	numDisks   int
 	stripeSize int
-	disks      [][]byte
+	stripes    *parityStripes
 }
 
 func NewRAID5(numDisks, stripeSize int) (*RAID5, error) {
-	if numDisks < 3 {
+	return newRAID5(newMemDisks(numDisks), stripeSize)
+}
+
+func newRAID5(disks []Disk, stripeSize int) (*RAID5, error) {
+	if len(disks) < 3 {
 		return nil, errors.New("RAID5: number of disks must be greater or equals than 3")
 	}
-	raid := &RAID5{
-		numDisks, stripeSize, make([][]byte, numDisks),
+	if stripeSize <= 0 {
+		return nil, errors.New("RAID5: stripe size must be positive")
 	}
-	for i := range raid.disks {
-		raid.disks[i] = make([]byte, 0)
+	raid := &RAID5{
+		members: newMembers(disks), numDisks: len(disks), stripeSize: stripeSize,
 	}
+	raid.codec = raid
+	raid.stripes = &parityStripes{raid.members, raid, stripeSize, len(disks) - 1, 1, 0}
 	return raid, nil
 }
 
+// Read maps the request onto the data chunks of the stripes it covers. A
+// chunk on a failed disk is reconstructed from the parity.
 func (r *RAID5) Read(length int, offset int) ([]byte, error) {
-	numDisks := r.numDisks
-	stripeDataSize := (numDisks - 1) * r.stripeSize
+	if err := checkRange(offset, length); err != nil {
+		return nil, err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.stripes.read(length, offset)
+}
 
-	startStripe := offset / stripeDataSize
-	endStripe := (offset + length + stripeDataSize - 1) / stripeDataSize
+// Write replaces whole stripes, computing their parity from the new data.
+// Partial stripes are read-modify-written.
+func (r *RAID5) Write(data []byte, offset int) error {
+	if err := checkRange(offset, len(data)); err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.stripes.write(data, offset)
+}
 
-	var data []byte
+func (r *RAID5) ReadV(vecs []IOVec) error {
+	if err := checkVecs(vecs); err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.stripes.readV(vecs)
+}
 
-	for s := startStripe; s < endStripe; s++ {
-		p := s % numDisks
-		dataDisks := make([]int, 0, numDisks-1)
-		for d := 0; d < numDisks; d++ {
-			if d != p {
-				dataDisks = append(dataDisks, d)
-			}
-		}
+// WriteV reads and writes the parity of every stripe the batch touches
+// once.
+func (r *RAID5) WriteV(vecs []IOVec) error {
+	if err := checkVecs(vecs); err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.stripes.writeV(coalesce(vecs))
+}
 
-		var blocks [][]byte
-		var missingDisk int = -1
-		for _, disk := range dataDisks {
-			if (s+1)*r.stripeSize > len(r.disks[disk]) {
-				if missingDisk == -1 {
-					missingDisk = disk
-				} else {
-					return nil, errors.New("RAID5: multiple disks failed")
-				}
-				blocks = append(blocks, nil)
-				continue
-			}
-			block := r.disks[disk][s*r.stripeSize : (s+1)*r.stripeSize]
-			isZero := true
-			for _, b := range block {
-				if b != 0 {
-					isZero = false
-					break
-				}
-			}
-			if isZero {
-				if missingDisk == -1 {
-					missingDisk = disk
-				} else {
-					return nil, errors.New("RAID5: multiple disks failed")
-				}
-				blocks = append(blocks, nil)
-			} else {
-				blocks = append(blocks, block)
-			}
+func (r *RAID5) Discard(pos, length int) error {
+	if err := checkRange(pos, length); err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.stripes.discard(pos, length)
+}
+
+// The parity of stripe s is on disk s % numDisks; the data chunks are on the
+// other disks in order.
+func (r *RAID5) stripeDisks(s int) ([]int, []int) {
+	parityDisk := s % r.numDisks
+	dataDisks := make([]int, 0, r.numDisks-1)
+	for d := 0; d < r.numDisks; d++ {
+		if d != parityDisk {
+			dataDisks = append(dataDisks, d)
 		}
+	}
+	return dataDisks, []int{parityDisk}
+}
 
-		if missingDisk != -1 {
-			parityBlock := r.disks[p][s*r.stripeSize : (s+1)*r.stripeSize]
-			missingIdx := -1
-			for i, d := range dataDisks {
-				if d == missingDisk {
-					missingIdx = i
-					break
-				}
-			}
-			if missingIdx == -1 {
-				return nil, errors.New("RAID5: missing disk not in dataDisks")
-			}
+func (r *RAID5) encode(data [][]byte, parity [][]byte) {
+	encodeXOR(data, parity)
+}
 
-			reconstructedBlock := make([]byte, r.stripeSize)
-			copy(reconstructedBlock, parityBlock)
-			for i, block := range blocks {
-				if i == missingIdx || block == nil {
-					continue
-				}
-				for j := 0; j < r.stripeSize; j++ {
-					reconstructedBlock[j] ^= block[j]
-				}
-			}
-			blocks[missingIdx] = reconstructedBlock
-		}
+func (r *RAID5) update(parity [][]byte, k int, delta []byte) {
+	xorInto(parity[0], delta)
+}
 
-		for _, block := range blocks {
-			data = append(data, block...)
-		}
-	}
+func (r *RAID5) Geometry() Geometry {
+	return r.geometry(Level5, r.stripeSize)
+}
 
-	startOffset := offset % stripeDataSize
-	endOffset := startOffset + length
-	if endOffset > len(data) {
-		endOffset = len(data)
-	}
-	return data[startOffset:endOffset], nil
-}
-
-func (r *RAID5) calculateParity(stripeIndex int) byte {
-	parity := byte(0)
-	numDataDisks := r.numDisks - 1
-	for diskIndex := 0; diskIndex < numDataDisks; diskIndex++ {
-		stripeOffset := stripeIndex * r.stripeSize
-		parity ^= r.disks[diskIndex][stripeOffset]
-		parity ^= r.disks[diskIndex][stripeOffset+1]
-		parity ^= r.disks[diskIndex][stripeOffset+2]
-		parity ^= r.disks[diskIndex][stripeOffset+3]
+func (r *RAID5) Map(pos, length int) ([]Extent, error) {
+	if pos < 0 || length < 0 {
+		return nil, errNegativeRange
 	}
-	return parity
+	return r.stripes.mapRange(pos, length), nil
 }
 
-func (r *RAID5) Write(data []byte, offset int) error {
-	stripeDataSize := (r.numDisks - 1) * r.stripeSize
+func (r *RAID5) Level() Level {
+	return Level5
+}
+
+func (r *RAID5) Status() Status {
+	return r.status(Level5, r.stripeSize)
+}
 
-	if offset%stripeDataSize != 0 {
-		return fmt.Errorf("RAID5: offset %d is not aligned to stripe data size %d", offset, stripeDataSize)
+func (r *RAID5) reconstruct(rows [][]byte, missing []int, off int64) error {
+	if len(missing) > 1 {
+		return fmt.Errorf("RAID5: %w", ErrDataLost)
 	}
+	reconstructXOR(rows, missing[0])
+	return nil
+}
 
-	startStripe := offset / stripeDataSize
-	numStripes := (len(data) + stripeDataSize - 1) / stripeDataSize
+func (r *RAID5) verify(rows [][]byte, off int64, repair bool) int {
+	return verifyXOR(rows, off, r.stripeSize, repair, func(s int) int { return s % r.numDisks })
+}
 
-	for s := 0; s < numStripes; s++ {
-		stripePos := startStripe + s
-		parityDisk := stripePos % r.numDisks
+func (r *RAID5) dataMembers() int {
+	return r.numDisks - 1
+}
 
-		start := s * stripeDataSize
-		end := start + stripeDataSize
-		if end > len(data) {
-			end = len(data)
-		}
-		stripeData := data[start:end]
-		if len(stripeData) < stripeDataSize {
-			padding := make([]byte, stripeDataSize-len(stripeData))
-			stripeData = append(stripeData, padding...)
-		}
+func (r *RAID5) rowSize() int {
+	return r.stripeSize
+}
 
-		blocks := make([][]byte, r.numDisks-1)
-		for i := 0; i < r.numDisks-1; i++ {
-			blockStart := i * r.stripeSize
-			blockEnd := blockStart + r.stripeSize
-			blocks[i] = stripeData[blockStart:blockEnd]
-		}
+// encodeXOR computes the parity of single parity levels.
+func encodeXOR(data [][]byte, parity [][]byte) {
+	clear(parity[0])
+	for _, block := range data {
+		xorInto(parity[0], block)
+	}
+}
 
-		parityBlock := make([]byte, r.stripeSize)
-		for i := 0; i < r.stripeSize; i++ {
-			for _, block := range blocks {
-				parityBlock[i] ^= block[i]
-			}
+// The blocks of a stripe XOR to zero wherever the parity sits, so a single
+// missing block is the XOR of all the others.
+func reconstructXOR(rows [][]byte, m int) {
+	clear(rows[m])
+	for i, row := range rows {
+		if i != m {
+			xorInto(rows[m], row)
 		}
+	}
+}
 
-		dataDisks := make([]int, 0, r.numDisks-1)
-		for d := 0; d < r.numDisks; d++ {
-			if d != parityDisk {
-				dataDisks = append(dataDisks, d)
-			}
+// verifyXOR checks that the rows of every stripe XOR to zero. A stripe that
+// does not has its parity, on member parityDisk(stripe), repaired.
+func verifyXOR(rows [][]byte, off int64, stripeSize int, repair bool, parityDisk func(stripe int) int) int {
+	mismatches := 0
+	sum := make([]byte, stripeSize)
+	for start := 0; start < len(rows[0]); start += stripeSize {
+		end := min(start+stripeSize, len(rows[0]))
+		sum := sum[:end-start]
+		clear(sum)
+		for _, row := range rows {
+			xorInto(sum, row[start:end])
 		}
-
-		for i, disk := range dataDisks {
-			requiredLen := (stripePos + 1) * r.stripeSize
-			if len(r.disks[disk]) < requiredLen {
-				newDisk := make([]byte, requiredLen)
-				copy(newDisk, r.disks[disk])
-				r.disks[disk] = newDisk
+		consistent := true
+		for _, b := range sum {
+			if b != 0 {
+				consistent = false
+				break
 			}
-			copy(r.disks[disk][stripePos*r.stripeSize:(stripePos+1)*r.stripeSize], blocks[i])
 		}
-
-		requiredLen := (stripePos + 1) * r.stripeSize
-		if len(r.disks[parityDisk]) < requiredLen {
-			newDisk := make([]byte, requiredLen)
-			copy(newDisk, r.disks[parityDisk])
-			r.disks[parityDisk] = newDisk
+		if consistent {
+			continue
 		}
-		copy(r.disks[parityDisk][stripePos*r.stripeSize:(stripePos+1)*r.stripeSize], parityBlock)
-	}
-
-	return nil
-}
-
-func (r *RAID5) ClearDisk(diskIndex int) {
-	if diskIndex >= 0 && diskIndex < len(r.disks) {
-		for i := range r.disks[diskIndex] {
-			r.disks[diskIndex][i] = 0
+		mismatches++
+		if repair {
+			p := parityDisk(int((off + int64(start)) / int64(stripeSize)))
+			xorInto(rows[p][start:end], sum)
 		}
 	}
+	return mismatches
 }
@@ -1,222 +1,230 @@
 package raid
 
-import "errors"
-
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"slices"
+)
+
+// RAID6 keeps the data on the first numDisks-2 disks, the XOR parity P on
+// the next one and the Reed-Solomon syndrome Q on the last one. Q is the sum
+// of every data byte multiplied by its coefficient j+1 in GF(2^8).
 type RAID6 struct {
+	*members
 	numDisks   int
 	stripeSize int
-	disks      [][]byte
 	dataDisks  int
+	stripes    *parityStripes
 }
 
 func NewRAID6(numDisks, stripeSize int) (*RAID6, error) {
+	return newRAID6(newMemDisks(numDisks), stripeSize)
+}
+
+func newRAID6(disks []Disk, stripeSize int) (*RAID6, error) {
+	numDisks := len(disks)
 	if numDisks < 4 {
 		return nil, errors.New("RAID6: number of disks must be greater or equals than 4")
 	}
-	raid := &RAID6{
-		numDisks, stripeSize, make([][]byte, numDisks), numDisks - 2,
+	if numDisks > 257 {
+		return nil, errors.New("RAID6: number of disks must be less or equals than 257")
+	}
+	if stripeSize <= 0 {
+		return nil, errors.New("RAID6: stripe size must be positive")
 	}
-	for i := range raid.disks {
-		raid.disks[i] = make([]byte, 0)
+	raid := &RAID6{
+		members: newMembers(disks), numDisks: numDisks, stripeSize: stripeSize, dataDisks: numDisks - 2,
 	}
+	raid.codec = raid
+	raid.stripes = &parityStripes{raid.members, raid, stripeSize, numDisks - 2, 1, 0}
 	return raid, nil
 }
 
-func gfMultiply(a, b byte) byte {
-	var product byte = 0
-	for i := 0; i < 8; i++ {
-		if (b & 1) != 0 {
-			product ^= a
-		}
-		highBit := a & 0x80
-		a <<= 1
-		if highBit != 0 {
-			a ^= 0x1D
-		}
-		b >>= 1
+// Read maps the request onto the data chunks of the stripes it covers. A
+// chunk on a failed disk is reconstructed from P, or from Q when P is failed
+// as well or a second data disk is missing.
+func (r *RAID6) Read(length int, offset int) ([]byte, error) {
+	if err := checkRange(offset, length); err != nil {
+		return nil, err
 	}
-	return product
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.stripes.read(length, offset)
 }
 
-func gfInverse(a byte) byte {
-	if a == 0 {
-		return 0
+// Write replaces whole stripes, computing P and Q from the new data. Partial
+// stripes are read-modify-written.
+func (r *RAID6) Write(data []byte, offset int) error {
+	if err := checkRange(offset, len(data)); err != nil {
+		return err
 	}
-	for b := byte(1); b != 0; b++ {
-		if gfMultiply(a, b) == 1 {
-			return b
-		}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.stripes.write(data, offset)
+}
+
+func (r *RAID6) ReadV(vecs []IOVec) error {
+	if err := checkVecs(vecs); err != nil {
+		return err
 	}
-	return 0
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.stripes.readV(vecs)
 }
 
-func (r *RAID6) Read(length int, offset int) ([]byte, error) {
-	result := make([]byte, length)
-	for i := 0; i < length; i++ {
-		logicalPos := offset + i
-		stripe := logicalPos / (r.stripeSize * r.dataDisks)
-		stripeByte := logicalPos % (r.stripeSize * r.dataDisks)
-		dataBlockIndex := stripeByte / r.stripeSize
-		byteInBlock := stripeByte % r.stripeSize
-
-		diskIdx := dataBlockIndex
-		stripeOffset := stripe * r.stripeSize
-		diskOffset := stripeOffset + byteInBlock
-
-		var dataByte byte
-		if diskIdx < 0 || diskIdx >= r.dataDisks {
-			dataByte = 0
-		} else {
-			if diskOffset < len(r.disks[diskIdx]) {
-				dataByte = r.disks[diskIdx][diskOffset]
-			}
-		}
+// WriteV reads and writes the parity of every stripe the batch touches
+// once.
+func (r *RAID6) WriteV(vecs []IOVec) error {
+	if err := checkVecs(vecs); err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.stripes.writeV(coalesce(vecs))
+}
 
-		if dataByte == 0 {
-			pDisk := r.dataDisks
-			qDisk := r.dataDisks + 1
-
-			var p, q byte
-			if diskOffset < len(r.disks[pDisk]) {
-				p = r.disks[pDisk][diskOffset]
-			}
-			if diskOffset < len(r.disks[qDisk]) {
-				q = r.disks[qDisk][diskOffset]
-			}
-
-			sumP := byte(0)
-			missingIndices := make([]int, 0)
-			for j := 0; j < r.dataDisks; j++ {
-				if j == diskIdx {
-					missingIndices = append(missingIndices, j)
-					continue
-				}
-				if stripeOffset+byteInBlock < len(r.disks[j]) {
-					sumP ^= r.disks[j][stripeOffset+byteInBlock]
-				}
-			}
-
-			if len(missingIndices) == 1 {
-				dataByte = sumP ^ p
-			} else if len(missingIndices) == 2 {
-				sumQ := byte(0)
-				for j := 0; j < r.dataDisks; j++ {
-					if j == missingIndices[0] || j == missingIndices[1] {
-						continue
-					}
-					if stripeOffset+byteInBlock < len(r.disks[j]) {
-						b := r.disks[j][stripeOffset+byteInBlock]
-						sumQ ^= gfMultiply(b, byte(j+1))
-					}
-				}
-				coeffA := byte(missingIndices[0] + 1)
-				coeffB := byte(missingIndices[1] + 1)
-				a := gfMultiply(0x01, coeffA) ^ gfMultiply(0x01, coeffB)
-				b := p ^ sumP
-				c := q ^ sumQ
-				dataByte = gfMultiply(c, gfInverse(a)) ^ b
-			}
-		}
+func (r *RAID6) Discard(pos, length int) error {
+	if err := checkRange(pos, length); err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.stripes.discard(pos, length)
+}
 
-		result[i] = dataByte
+func (r *RAID6) stripeDisks(s int) ([]int, []int) {
+	dataDisks := make([]int, r.dataDisks)
+	for k := range dataDisks {
+		dataDisks[k] = k
 	}
-	return result, nil
+	return dataDisks, []int{r.dataDisks, r.dataDisks + 1}
 }
 
-func (r *RAID6) Write(data []byte, offset int) error {
-	stripeDataSize := r.stripeSize * r.dataDisks
+func (r *RAID6) encode(data [][]byte, parity [][]byte) {
+	r.syndromes(data, parity[0], parity[1])
+}
 
-	// Calculate starting stripe and offset within the stripe
-	startStripe := offset / stripeDataSize
+func (r *RAID6) update(parity [][]byte, k int, delta []byte) {
+	xorInto(parity[0], delta)
+	gfMulXor(parity[1], delta, byte(k+1))
+}
 
-	// Process each byte in the data
-	for i := 0; i < len(data); i++ {
-		logicalPos := offset + i
-		stripe := logicalPos / stripeDataSize
-		byteInStripe := logicalPos % stripeDataSize
+func (r *RAID6) Geometry() Geometry {
+	return r.geometry(Level6, r.stripeSize)
+}
 
-		// Determine data block and byte position within the block
-		blockIndex := byteInStripe / r.stripeSize
-		byteInBlock := byteInStripe % r.stripeSize
+func (r *RAID6) Map(pos, length int) ([]Extent, error) {
+	if pos < 0 || length < 0 {
+		return nil, errNegativeRange
+	}
+	return r.stripes.mapRange(pos, length), nil
+}
 
-		// Calculate disk index (data disk for this block)
-		diskIndex := blockIndex
-		if diskIndex >= r.dataDisks {
-			return errors.New("RAID6: invalid disk index calculation")
-		}
+func (r *RAID6) Level() Level {
+	return Level6
+}
 
-		// Calculate stripe offset in disk (same for all disks in stripe)
-		stripeOffset := stripe * r.stripeSize
-		diskOffset := stripeOffset + byteInBlock
+func (r *RAID6) Status() Status {
+	return r.status(Level6, r.stripeSize)
+}
 
-		// Expand disk if needed
-		if diskOffset >= len(r.disks[diskIndex]) {
-			needed := diskOffset - len(r.disks[diskIndex]) + 1
-			r.disks[diskIndex] = append(r.disks[diskIndex], make([]byte, needed)...)
-		}
+// syndromes computes P and Q of the data rows.
+func (r *RAID6) syndromes(rows [][]byte, p, q []byte) {
+	clear(p)
+	clear(q)
+	for j := 0; j < r.dataDisks; j++ {
+		xorInto(p, rows[j])
+		gfMulXor(q, rows[j], byte(j+1))
+	}
+}
 
-		// Write data byte to data disk
-		r.disks[diskIndex][diskOffset] = data[i]
-	}
-
-	// Calculate parity for all affected stripes
-	for stripe := startStripe; stripe <= (offset+len(data)-1)/stripeDataSize; stripe++ {
-
-		// Prepare data blocks for parity calculation
-		dataBlocks := make([][]byte, r.dataDisks)
-		for i := 0; i < r.dataDisks; i++ {
-			start := stripe * r.stripeSize
-			end := start + r.stripeSize
-			if start >= len(r.disks[i]) {
-				dataBlocks[i] = make([]byte, r.stripeSize)
-				continue
-			}
-			if end > len(r.disks[i]) {
-				end = len(r.disks[i])
-			}
-			block := make([]byte, r.stripeSize)
-			copy(block, r.disks[i][start:end])
-			dataBlocks[i] = block
+func (r *RAID6) reconstruct(rows [][]byte, missing []int, off int64) error {
+	if len(missing) > 2 {
+		return fmt.Errorf("RAID6: %w", ErrDataLost)
+	}
+	pDisk, qDisk := r.dataDisks, r.dataDisks+1
+	var lost []int
+	for _, m := range missing {
+		if m < r.dataDisks {
+			lost = append(lost, m)
 		}
-
-		// Calculate P and Q parity
-		pParity := make([]byte, r.stripeSize)
-		qParity := make([]byte, r.stripeSize)
-		for i := 0; i < r.stripeSize; i++ {
-			var p, q byte
-			for j := 0; j < r.dataDisks; j++ {
-				p ^= dataBlocks[j][i]
-				q ^= gfMultiply(dataBlocks[j][i], byte(j+1))
-			}
-			pParity[i] = p
-			qParity[i] = q
+	}
+	pLost := slices.Contains(missing, pDisk)
+	qLost := slices.Contains(missing, qDisk)
+
+	// Partial syndromes of the data that survived.
+	n := len(rows[0])
+	pRest := make([]byte, n)
+	qRest := make([]byte, n)
+	for j := 0; j < r.dataDisks; j++ {
+		if slices.Contains(lost, j) {
+			continue
 		}
+		xorInto(pRest, rows[j])
+		gfMulXor(qRest, rows[j], byte(j+1))
+	}
 
-		// Write parity to disks
-		pDisk := r.dataDisks
-		qDisk := r.dataDisks + 1
-		stripeOffset := stripe * r.stripeSize
-
-		// Expand parity disks if needed
-		if stripeOffset+r.stripeSize > len(r.disks[pDisk]) {
-			needed := stripeOffset + r.stripeSize - len(r.disks[pDisk])
-			r.disks[pDisk] = append(r.disks[pDisk], make([]byte, needed)...)
+	switch {
+	case len(lost) == 1 && !pLost:
+		x := lost[0]
+		for k := range rows[x] {
+			rows[x][k] = rows[pDisk][k] ^ pRest[k]
 		}
-		copy(r.disks[pDisk][stripeOffset:], pParity)
-
-		if stripeOffset+r.stripeSize > len(r.disks[qDisk]) {
-			needed := stripeOffset + r.stripeSize - len(r.disks[qDisk])
-			r.disks[qDisk] = append(r.disks[qDisk], make([]byte, needed)...)
+	case len(lost) == 1:
+		x := lost[0]
+		inv := gfInverse(byte(x + 1))
+		for k := range rows[x] {
+			rows[x][k] = gfMultiply(rows[qDisk][k]^qRest[k], inv)
+		}
+	case len(lost) == 2:
+		x, y := lost[0], lost[1]
+		gy := byte(y + 1)
+		inv := gfInverse(byte(x+1) ^ gy)
+		for k := range rows[x] {
+			pxy := rows[pDisk][k] ^ pRest[k]
+			qxy := rows[qDisk][k] ^ qRest[k]
+			rows[x][k] = gfMultiply(qxy^gfMultiply(gy, pxy), inv)
+			rows[y][k] = pxy ^ rows[x][k]
+		}
+	}
+	if pLost || qLost {
+		p := make([]byte, n)
+		q := make([]byte, n)
+		r.syndromes(rows, p, q)
+		if pLost {
+			copy(rows[pDisk], p)
+		}
+		if qLost {
+			copy(rows[qDisk], q)
 		}
-		copy(r.disks[qDisk][stripeOffset:], qParity)
 	}
 	return nil
 }
 
-func (r *RAID6) ClearDisk(diskIndex int) {
-	if diskIndex >= 0 && diskIndex < len(r.disks) {
-		for i := range r.disks[diskIndex] {
-			r.disks[diskIndex][i] = 0
+func (r *RAID6) verify(rows [][]byte, off int64, repair bool) int {
+	pDisk, qDisk := r.dataDisks, r.dataDisks+1
+	p := make([]byte, len(rows[0]))
+	q := make([]byte, len(rows[0]))
+	r.syndromes(rows, p, q)
+	mismatches := 0
+	for start := 0; start < len(p); start += r.stripeSize {
+		end := min(start+r.stripeSize, len(p))
+		if !bytes.Equal(p[start:end], rows[pDisk][start:end]) || !bytes.Equal(q[start:end], rows[qDisk][start:end]) {
+			mismatches++
 		}
 	}
+	if repair && mismatches > 0 {
+		copy(rows[pDisk], p)
+		copy(rows[qDisk], q)
+	}
+	return mismatches
+}
+
+func (r *RAID6) dataMembers() int {
+	return r.dataDisks
+}
+
+func (r *RAID6) rowSize() int {
+	return r.stripeSize
 }
@@ -0,0 +1,437 @@
+package raid
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math/rand"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func newTestArray(t testing.TB, level Level, numDisks, stripeSize int) Array {
+	arr, err := New(level, newMemDisks(numDisks), stripeSize)
+	if err != nil {
+		t.Fatalf("New(%s) error = %v", level, err)
+	}
+	return arr
+}
+
+// TestUnalignedWrites writes at random offsets and lengths, crossing chunk and
+// stripe boundaries, and compares the array with a flat buffer.
+func TestUnalignedWrites(t *testing.T) {
+	tests := []struct {
+		level    Level
+		numDisks int
+	}{
+		{Level0, 3},
+		{Level1, 2},
+		{Level10, 4},
+		{Level4, 4},
+		{Level5, 4},
+		{Level6, 5},
+	}
+	for _, tt := range tests {
+		t.Run(tt.level.String(), func(t *testing.T) {
+			rng := rand.New(rand.NewSource(1))
+			arr := newTestArray(t, tt.level, tt.numDisks, 8)
+			want := make([]byte, 512)
+			arr.Write(want, 0)
+			for i := 0; i < 200; i++ {
+				pos := rng.Intn(len(want))
+				data := make([]byte, rng.Intn(len(want)-pos)+1)
+				rng.Read(data)
+				if err := arr.Write(data, pos); err != nil {
+					t.Fatalf("Write(%d bytes, %d) error = %v", len(data), pos, err)
+				}
+				copy(want[pos:], data)
+			}
+			got, err := arr.Read(len(want), 0)
+			if err != nil || !bytes.Equal(got, want) {
+				t.Fatalf("Read() = %v, contents match %v", err, bytes.Equal(got, want))
+			}
+			if report, err := arr.Scrub(false); err != nil || report.Mismatches != 0 {
+				t.Errorf("Scrub() = %+v, %v", report, err)
+			}
+		})
+	}
+}
+
+// TestDegradedWrites keeps writing to parity arrays with members failed, then
+// rebuilds them and checks that the data and the parity agree.
+func TestDegradedWrites(t *testing.T) {
+	tests := []struct {
+		name     string
+		level    Level
+		numDisks int
+		failed   []int
+	}{
+		{name: "RAID4 data", level: Level4, numDisks: 4, failed: []int{2}},
+		{name: "RAID4 parity", level: Level4, numDisks: 3, failed: []int{2}},
+		{name: "RAID5 data", level: Level5, numDisks: 4, failed: []int{1}},
+		{name: "RAID5 first", level: Level5, numDisks: 3, failed: []int{0}},
+		{name: "RAID6 two data", level: Level6, numDisks: 6, failed: []int{0, 3}},
+		{name: "RAID6 data and P", level: Level6, numDisks: 5, failed: []int{1, 3}},
+		{name: "RAID6 data and Q", level: Level6, numDisks: 5, failed: []int{2, 4}},
+		{name: "RAID6 P and Q", level: Level6, numDisks: 4, failed: []int{2, 3}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rng := rand.New(rand.NewSource(1))
+			disks := newMemDisks(tt.numDisks)
+			arr, err := New(tt.level, disks, 8)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := make([]byte, 512)
+			rng.Read(want)
+			arr.Write(want, 0)
+			for _, d := range tt.failed {
+				arr.Fail(d)
+			}
+			before := make([][]byte, len(disks))
+			for _, d := range tt.failed {
+				before[d] = bytes.Clone(disks[d].(*MemDisk).Bytes())
+			}
+
+			for i := 0; i < 200; i++ {
+				pos := rng.Intn(len(want))
+				data := make([]byte, rng.Intn(len(want)-pos)+1)
+				rng.Read(data)
+				if err := arr.Write(data, pos); err != nil {
+					t.Fatalf("Write(%d bytes, %d) error = %v", len(data), pos, err)
+				}
+				copy(want[pos:], data)
+				got, err := arr.Read(len(data), pos)
+				if err != nil || !bytes.Equal(got, data) {
+					t.Fatalf("Read(%d, %d) after write = %v, contents match %v", len(data), pos, err, bytes.Equal(got, data))
+				}
+			}
+			for _, d := range tt.failed {
+				if !bytes.Equal(disks[d].(*MemDisk).Bytes(), before[d]) {
+					t.Errorf("failed disk %d was written to", d)
+				}
+			}
+			got, err := arr.Read(len(want), 0)
+			if err != nil || !bytes.Equal(got, want) {
+				t.Fatalf("degraded Read() = %v, contents match %v", err, bytes.Equal(got, want))
+			}
+
+			for _, d := range tt.failed {
+				if err := arr.Replace(d, NewMemDisk(0)); err != nil {
+					t.Fatal(err)
+				}
+				if err := arr.Rebuild(d); err != nil {
+					t.Fatalf("Rebuild(%d) error = %v", d, err)
+				}
+			}
+			if report, err := arr.Scrub(false); err != nil || report.Mismatches != 0 {
+				t.Errorf("Scrub() after rebuild = %+v, %v", report, err)
+			}
+		})
+	}
+}
+
+// TestWriteDataLost checks that writes fail where a member they need is gone
+// and no redundancy is left to hold their data.
+func TestWriteDataLost(t *testing.T) {
+	tests := []struct {
+		level    Level
+		numDisks int
+		failed   []int
+		lost     bool
+	}{
+		{Level0, 3, []int{1}, true},
+		{LevelLinear, 3, []int{0}, true},
+		{Level1, 2, []int{0}, false},
+		{Level1, 2, []int{0, 1}, true},
+		{Level10, 4, []int{0, 2}, false},
+		{Level10, 4, []int{2, 3}, true},
+		{Level5, 4, []int{1}, false},
+		{Level5, 4, []int{1, 2}, true},
+		{Level6, 5, []int{0, 4}, false},
+		{Level6, 5, []int{0, 1, 4}, true},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprint(tt.level, tt.failed), func(t *testing.T) {
+			disks := make([]Disk, tt.numDisks)
+			for i := range disks {
+				disks[i] = NewMemDisk(4096)
+			}
+			arr, err := New(tt.level, disks, 64)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, d := range tt.failed {
+				arr.Fail(d)
+			}
+			err = arr.Write(make([]byte, arr.Size()), 0)
+			if lost := errors.Is(err, ErrDataLost); lost != tt.lost {
+				t.Errorf("Write() with %v failed = %v, want data lost %v", tt.failed, err, tt.lost)
+			}
+			err = arr.Discard(0, int(arr.Size()))
+			if lost := errors.Is(err, ErrDataLost); lost != tt.lost {
+				t.Errorf("Discard() with %v failed = %v, want data lost %v", tt.failed, err, tt.lost)
+			}
+		})
+	}
+}
+
+// TestDiscardFails checks that a member that fails to discard is failed, and
+// that the discard reports lost data when that member held the only copy.
+func TestDiscardFails(t *testing.T) {
+	for _, tt := range []struct {
+		level Level
+		lost  bool
+	}{
+		{Level0, true},
+		{LevelLinear, true},
+		{Level1, false},
+		{Level5, false},
+	} {
+		t.Run(tt.level.String(), func(t *testing.T) {
+			disks := []Disk{NewMemDisk(4096), NewMemDisk(4096), NewMemDisk(4096)}
+			if tt.level == Level1 {
+				disks = disks[:2]
+			}
+			faulty := &faultyDisk{Disk: disks[1]}
+			disks[1] = faulty
+			arr, err := New(tt.level, disks, 64)
+			if err != nil {
+				t.Fatal(err)
+			}
+			faulty.n = 4096
+			err = arr.Discard(0, int(arr.Size()))
+			if lost := errors.Is(err, ErrDataLost); lost != tt.lost {
+				t.Errorf("Discard() over a failing member = %v, want data lost %v", err, tt.lost)
+			}
+			if st := arr.Status().Members[1].State; st != DiskFailed {
+				t.Errorf("member that failed to discard is %v", st)
+			}
+		})
+	}
+}
+
+// TestDiscard discards partial and whole stripes and checks that they read as
+// zeros, that the rest is untouched and that the redundancy stays consistent.
+func TestDiscard(t *testing.T) {
+	tests := []struct {
+		level    Level
+		numDisks int
+	}{
+		{Level0, 3},
+		{Level1, 2},
+		{Level10, 4},
+		{Level4, 4},
+		{Level5, 4},
+		{Level6, 5},
+	}
+	for _, tt := range tests {
+		t.Run(tt.level.String(), func(t *testing.T) {
+			rng := rand.New(rand.NewSource(1))
+			disks := newMemDisks(tt.numDisks)
+			arr, err := New(tt.level, disks, 8)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := make([]byte, 512)
+			rng.Read(want)
+			arr.Write(want, 0)
+			for _, r := range [][2]int{{3, 5}, {40, 150}, {256, 256}} {
+				if err := arr.Discard(r[0], r[1]); err != nil {
+					t.Fatalf("Discard(%d, %d) error = %v", r[0], r[1], err)
+				}
+				clear(want[r[0] : r[0]+r[1]])
+			}
+			got, err := arr.Read(len(want), 0)
+			if err != nil || !bytes.Equal(got, want) {
+				t.Fatalf("Read() = %v, contents match %v", err, bytes.Equal(got, want))
+			}
+			if report, err := arr.Scrub(false); err != nil || report.Mismatches != 0 {
+				t.Errorf("Scrub() = %+v, %v", report, err)
+			}
+			for i, d := range disks {
+				if size := d.Size(); size > 512 {
+					t.Errorf("disk %d grew to %d bytes", i, size)
+				}
+			}
+		})
+	}
+}
+
+func TestFileDiskDiscard(t *testing.T) {
+	d, err := CreateFileDisk(filepath.Join(t.TempDir(), "disk.img"), 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	data := bytes.Repeat([]byte{0xAA}, 1<<20)
+	d.WriteAt(data, 0)
+	if err := d.Discard(4096, 64<<10); err != nil {
+		t.Fatalf("Discard() error = %v", err)
+	}
+	if err := d.Discard(1<<20-10, 100); err != nil {
+		t.Fatalf("Discard() past the end error = %v", err)
+	}
+	clear(data[4096 : 4096+64<<10])
+	clear(data[1<<20-10:])
+	got := make([]byte, len(data))
+	d.ReadAt(got, 0)
+	if !bytes.Equal(got, data) {
+		t.Error("contents after Discard() do not match")
+	}
+	if size := d.Size(); size != 1<<20 {
+		t.Errorf("Size() after Discard() = %d, want %d", size, 1<<20)
+	}
+}
+
+// TestLinear concatenates members of different sizes and checks that every
+// one keeps its place, also when assembled without one of them.
+func TestLinear(t *testing.T) {
+	sizes := []int64{100, 300, 50}
+	disks := make([]Disk, len(sizes))
+	for i, size := range sizes {
+		disks[i] = NewMemDisk(SuperblockSize + size)
+	}
+	arr, err := Create(LevelLinear, disks, 0)
+	if err != nil {
+		t.Fatalf("Create() error = %v", err)
+	}
+	if size := arr.Status().Size; size != 450 {
+		t.Errorf("Status().Size = %d, want 450", size)
+	}
+	data := make([]byte, 450)
+	rand.New(rand.NewSource(1)).Read(data)
+	if err := arr.Write(data, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := arr.Write([]byte{1}, 450); err == nil {
+		t.Error("Write() past the end succeeded")
+	}
+	extents, _ := arr.Map(90, 320)
+	want := []Extent{{90, 10, 0, 90, RoleData}, {100, 300, 1, 0, RoleData}, {400, 10, 2, 0, RoleData}}
+	if !slices.Equal(extents, want) {
+		t.Errorf("Map(90, 320) = %v, want %v", extents, want)
+	}
+
+	arr, err = Assemble([]Disk{disks[0], disks[2]})
+	if err != nil {
+		t.Fatalf("Assemble() error = %v", err)
+	}
+	got, err := arr.Read(50, 400)
+	if err != nil || !bytes.Equal(got, data[400:]) {
+		t.Errorf("Read() of the last member = %v, contents match %v", err, bytes.Equal(got, data[400:]))
+	}
+	if _, err := arr.Read(10, 95); !errors.Is(err, ErrDataLost) {
+		t.Errorf("Read() across the missing member error = %v, want %v", err, ErrDataLost)
+	}
+}
+
+// TestHybrid lays tiers over members of different sizes and checks that
+// every member can be lost and rebuilt without growing past its size.
+func TestHybrid(t *testing.T) {
+	sizes := []int64{100, 300, 300, 50}
+	disks := make([]Disk, len(sizes))
+	for i, size := range sizes {
+		disks[i] = NewMemDisk(size)
+	}
+	arr, err := newHybrid(disks, 16, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Tiers of 4 members up to 48, 3 up to 96 and a mirror up to 288.
+	if size := arr.Size(); size != 48*3+48*2+192 {
+		t.Errorf("Size() = %d, want %d", size, 48*3+48*2+192)
+	}
+	data := make([]byte, arr.Size())
+	rand.New(rand.NewSource(1)).Read(data)
+	if err := arr.Write(data, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := arr.Write([]byte{1}, len(data)); err == nil {
+		t.Error("Write() past the end succeeded")
+	}
+	for d := range disks {
+		arr.ClearDisk(d)
+		got, err := arr.Read(len(data), 0)
+		if err != nil || !bytes.Equal(got, data) {
+			t.Errorf("Read() without disk %d = %v, contents match %v", d, err, bytes.Equal(got, data))
+		}
+		if err := arr.Rebuild(d); err != nil {
+			t.Fatalf("Rebuild(%d) error = %v", d, err)
+		}
+	}
+	for i, d := range disks {
+		if d.Size() != sizes[i] {
+			t.Errorf("disk %d grew from %d to %d bytes", i, sizes[i], d.Size())
+		}
+	}
+	if report, err := arr.Scrub(false); err != nil || report.Mismatches != 0 {
+		t.Errorf("Scrub() = %+v, %v", report, err)
+	}
+}
+
+// TestParityDisk spreads small writes over the data chunks of many stripes.
+// RAID4 updates its parity disk for every one of them, RAID5 spreads the
+// parity as well.
+func TestParityDisk(t *testing.T) {
+	tests := []struct {
+		level Level
+		want  []int64
+	}{
+		{Level4, []int64{4, 4, 4, 12}},
+		{Level5, []int64{6, 6, 6, 6}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.level.String(), func(t *testing.T) {
+			disks := make([]Disk, 4)
+			counters := make([]*countingDisk, len(disks))
+			for i := range disks {
+				counters[i] = &countingDisk{Disk: NewMemDisk(0)}
+				disks[i] = counters[i]
+			}
+			arr, err := New(tt.level, disks, 16)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for s := 0; s < 12; s++ {
+				arr.Write([]byte{1}, s*48+s%3*16)
+			}
+			for i, c := range counters {
+				if got := c.writes.Load(); got != tt.want[i] {
+					t.Errorf("disk %d got %d writes, want %d", i, got, tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestGFMultiply(t *testing.T) {
+	// The carry-less multiplication the tables replace.
+	slow := func(a, b byte) byte {
+		var product byte
+		for i := 0; i < 8; i++ {
+			if b&1 != 0 {
+				product ^= a
+			}
+			highBit := a & 0x80
+			a <<= 1
+			if highBit != 0 {
+				a ^= 0x1D
+			}
+			b >>= 1
+		}
+		return product
+	}
+	for a := 0; a < 256; a++ {
+		for b := 0; b < 256; b++ {
+			if got, want := gfMultiply(byte(a), byte(b)), slow(byte(a), byte(b)); got != want {
+				t.Fatalf("gfMultiply(%d, %d) = %d, want %d", a, b, got, want)
+			}
+		}
+		if a > 0 && gfMultiply(byte(a), gfInverse(byte(a))) != 1 {
+			t.Fatalf("gfInverse(%d) is not an inverse", a)
+		}
+	}
+}
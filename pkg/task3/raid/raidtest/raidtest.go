@@ -0,0 +1,336 @@
+// Package raidtest checks that a RAID implementation keeps the contract of
+// raid.RAID: what was written reads back, unwritten and discarded ranges
+// read as zeros, and losing as many members as the level tolerates loses no
+// data. Run it from the tests of an implementation:
+//
+//	func TestConformance(t *testing.T) {
+//		raidtest.Run(t, raidtest.Config{New: newArray, NumDisks: 4, Tolerance: 1})
+//	}
+package raidtest
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"graid-tech-assignment/pkg/task3/raid"
+	"math/rand"
+	"testing"
+)
+
+// Config describes the implementation under test.
+type Config struct {
+	// New returns a new, empty RAID. It is called for every subtest.
+	New func() (raid.RAID, error)
+	// Size is the number of logical bytes to exercise. If it is zero, the
+	// RAID has to be a raid.Array, and its whole size is used.
+	Size int
+	// NumDisks is the number of members, which are failed with ClearDisk.
+	NumDisks int
+	// Tolerance is the number of members that can fail without losing data.
+	Tolerance int
+	// Seed seeds the random operations, so that failures can be reproduced.
+	Seed int64
+}
+
+func (c Config) newRAID(t testing.TB) (raid.RAID, int) {
+	t.Helper()
+	r, err := c.New()
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	size := c.Size
+	if size == 0 {
+		arr, ok := r.(raid.Array)
+		if !ok {
+			t.Fatal("raidtest: Config.Size is needed for a RAID that is not a raid.Array")
+		}
+		size = int(arr.Geometry().Size)
+	}
+	if size <= 0 {
+		t.Fatal("raidtest: the RAID has no capacity")
+	}
+	return r, size
+}
+
+// Run runs the whole suite as subtests of t.
+func Run(t *testing.T, c Config) {
+	t.Run("Zero", func(t *testing.T) { testZero(t, c) })
+	t.Run("Boundaries", func(t *testing.T) { testBoundaries(t, c) })
+	t.Run("Random", func(t *testing.T) { testRandom(t, c) })
+	t.Run("Discard", func(t *testing.T) { testDiscard(t, c) })
+	t.Run("NegativeRange", func(t *testing.T) { testNegativeRange(t, c) })
+	t.Run("Failures", func(t *testing.T) { testFailures(t, c) })
+	t.Run("TooManyFailures", func(t *testing.T) { testTooManyFailures(t, c) })
+}
+
+// reference is a RAID under test together with the flat buffer that says
+// what it must contain.
+type reference struct {
+	t    testing.TB
+	r    raid.RAID
+	want []byte
+}
+
+func (ref *reference) write(data []byte, pos int) {
+	ref.t.Helper()
+	if err := ref.r.Write(data, pos); err != nil {
+		ref.t.Fatalf("Write(%d bytes, %d) error = %v", len(data), pos, err)
+	}
+	copy(ref.want[pos:], data)
+}
+
+func (ref *reference) discard(pos, length int) {
+	ref.t.Helper()
+	if err := ref.r.Discard(pos, length); err != nil {
+		ref.t.Fatalf("Discard(%d, %d) error = %v", pos, length, err)
+	}
+	clear(ref.want[pos : pos+length])
+}
+
+func (ref *reference) check(length, pos int) {
+	ref.t.Helper()
+	got, err := ref.r.Read(length, pos)
+	if err != nil {
+		ref.t.Fatalf("Read(%d, %d) error = %v", length, pos, err)
+	}
+	if want := ref.want[pos : pos+length]; !bytes.Equal(got, want) {
+		ref.t.Fatalf("Read(%d, %d) differs from what was written at byte %d", length, pos, pos+firstDiff(got, want))
+	}
+}
+
+func (ref *reference) checkAll() {
+	ref.t.Helper()
+	ref.check(len(ref.want), 0)
+}
+
+func firstDiff(a, b []byte) int {
+	for i := range min(len(a), len(b)) {
+		if a[i] != b[i] {
+			return i
+		}
+	}
+	return min(len(a), len(b))
+}
+
+func randomBytes(rng *rand.Rand, n int) []byte {
+	data := make([]byte, n)
+	rng.Read(data)
+	return data
+}
+
+func testZero(t *testing.T, c Config) {
+	r, size := c.newRAID(t)
+	ref := &reference{t, r, make([]byte, size)}
+	ref.checkAll()
+	ref.write(nil, 0)
+	ref.write(nil, size/2)
+	ref.check(0, size/2)
+	ref.write(bytes.Repeat([]byte{0xFF}, size), 0)
+	ref.write(make([]byte, size/2), size/4)
+	ref.checkAll()
+}
+
+func testBoundaries(t *testing.T, c Config) {
+	r, size := c.newRAID(t)
+	rng := rand.New(rand.NewSource(c.Seed))
+	ref := &reference{t, r, make([]byte, size)}
+	// Requests around every power of two catch off-by-ones at chunk and
+	// stripe boundaries, whatever the geometry.
+	var offsets []int
+	for b := 1; b < size; b *= 2 {
+		offsets = append(offsets, b-1, b, b+1)
+	}
+	offsets = append(offsets, 0, size-1)
+	for _, pos := range offsets {
+		if pos < 0 || pos >= size {
+			continue
+		}
+		for _, n := range []int{1, 2, 7} {
+			n = min(n, size-pos)
+			ref.write(randomBytes(rng, n), pos)
+			ref.check(n, pos)
+		}
+	}
+	ref.write(randomBytes(rng, size), 0)
+	ref.checkAll()
+	ref.check(1, size-1)
+}
+
+func testRandom(t *testing.T, c Config) {
+	r, size := c.newRAID(t)
+	rng := rand.New(rand.NewSource(c.Seed))
+	ref := &reference{t, r, make([]byte, size)}
+	for i := 0; i < 300; i++ {
+		pos := rng.Intn(size)
+		n := rng.Intn(min(size-pos, 4096)) + 1
+		if rng.Intn(3) == 0 {
+			ref.check(n, pos)
+		} else {
+			ref.write(randomBytes(rng, n), pos)
+		}
+	}
+	ref.checkAll()
+}
+
+func testDiscard(t *testing.T, c Config) {
+	r, size := c.newRAID(t)
+	rng := rand.New(rand.NewSource(c.Seed))
+	ref := &reference{t, r, make([]byte, size)}
+	ref.write(randomBytes(rng, size), 0)
+	ref.discard(0, 1)
+	ref.discard(size-1, 1)
+	ref.discard(size/4, size/2)
+	ref.checkAll()
+	for i := 0; i < 50; i++ {
+		pos := rng.Intn(size)
+		n := rng.Intn(size-pos) + 1
+		if rng.Intn(2) == 0 {
+			ref.discard(pos, n)
+		} else {
+			ref.write(randomBytes(rng, n), pos)
+		}
+	}
+	ref.checkAll()
+}
+
+// testNegativeRange makes requests at negative positions and lengths. They
+// have to fail without touching the data or failing any member.
+func testNegativeRange(t *testing.T, c Config) {
+	r, size := c.newRAID(t)
+	rng := rand.New(rand.NewSource(c.Seed))
+	ref := &reference{t, r, make([]byte, size)}
+	ref.write(randomBytes(rng, size), 0)
+	for _, pos := range []int{-1, -5, -20, -size} {
+		if err := r.Write(randomBytes(rng, 3), pos); err == nil {
+			t.Errorf("Write(3 bytes, %d) succeeded", pos)
+		}
+		if _, err := r.Read(3, pos); err == nil {
+			t.Errorf("Read(3, %d) succeeded", pos)
+		}
+		if err := r.Discard(pos, 10); err == nil {
+			t.Errorf("Discard(%d, 10) succeeded", pos)
+		}
+	}
+	if _, err := r.Read(-1, 0); err == nil {
+		t.Error("Read(-1, 0) succeeded")
+	}
+	if err := r.Discard(0, -1); err == nil {
+		t.Error("Discard(0, -1) succeeded")
+	}
+	if arr, ok := r.(raid.Array); ok && arr.Status().Degraded() {
+		t.Errorf("Status() after requests at negative positions is degraded: %+v", arr.Status().Members)
+	}
+	ref.checkAll()
+}
+
+// testFailures fails every combination of as many members as the RAID
+// tolerates. The data has to stay readable and writable, and an Array has to
+// rebuild the members to a consistent state.
+func testFailures(t *testing.T, c Config) {
+	for _, failed := range combinations(c.NumDisks, c.Tolerance) {
+		t.Run(fmt.Sprint(failed), func(t *testing.T) {
+			r, size := c.newRAID(t)
+			rng := rand.New(rand.NewSource(c.Seed))
+			ref := &reference{t, r, make([]byte, size)}
+			ref.write(randomBytes(rng, size), 0)
+			for _, d := range failed {
+				r.ClearDisk(d)
+			}
+			ref.checkAll()
+			for i := 0; i < 50; i++ {
+				pos := rng.Intn(size)
+				ref.write(randomBytes(rng, rng.Intn(min(size-pos, 4096))+1), pos)
+			}
+			ref.checkAll()
+
+			arr, ok := r.(raid.Array)
+			if !ok {
+				return
+			}
+			for _, d := range failed {
+				if err := arr.Rebuild(d); err != nil {
+					t.Fatalf("Rebuild(%d) error = %v", d, err)
+				}
+			}
+			if arr.Status().Degraded() {
+				t.Errorf("Status() after rebuilding %v is still degraded", failed)
+			}
+			if report, err := arr.Scrub(false); err != nil || report.Mismatches != 0 {
+				t.Errorf("Scrub() after rebuilding %v = %+v, %v", failed, report, err)
+			}
+			ref.checkAll()
+		})
+	}
+}
+
+// testTooManyFailures fails one member more than the RAID tolerates. Reads
+// may fail, but they must not return wrong data.
+func testTooManyFailures(t *testing.T, c Config) {
+	if c.Tolerance+1 > c.NumDisks {
+		t.Skip("every member may fail")
+	}
+	r, size := c.newRAID(t)
+	rng := rand.New(rand.NewSource(c.Seed))
+	ref := &reference{t, r, make([]byte, size)}
+	ref.write(randomBytes(rng, size), 0)
+	for d := 0; d <= c.Tolerance; d++ {
+		r.ClearDisk(d)
+	}
+	got, err := r.Read(size, 0)
+	if err == nil && !bytes.Equal(got, ref.want) {
+		t.Errorf("Read() with %d members lost returned wrong data instead of an error", c.Tolerance+1)
+	}
+}
+
+// combinations returns every set of up to k of the first n members.
+func combinations(n, k int) [][]int {
+	var result [][]int
+	var pick func(start int, set []int)
+	pick = func(start int, set []int) {
+		if len(set) > 0 {
+			result = append(result, append([]int(nil), set...))
+		}
+		if len(set) == k {
+			return
+		}
+		for i := start; i < n; i++ {
+			pick(i+1, append(set, i))
+		}
+	}
+	pick(0, nil)
+	return result
+}
+
+// Fuzz runs a fuzz target that decodes its input into a sequence of writes,
+// reads, discards and member failures, never failing more members than the
+// RAID tolerates, and compares the RAID with a flat buffer after each one.
+func Fuzz(f *testing.F, c Config) {
+	f.Add([]byte{0, 0, 0, 16, 0xAA})
+	f.Add([]byte{0, 0, 5, 200, 0x55, 3, 1, 1, 0, 1, 0, 0, 0, 255, 0x11})
+	f.Add([]byte{2, 0, 8, 64, 0, 1, 0, 0, 0, 255, 0})
+	f.Fuzz(func(t *testing.T, ops []byte) {
+		r, size := c.newRAID(t)
+		ref := &reference{t, r, make([]byte, size)}
+		failed := 0
+		for len(ops) >= 5 {
+			op, pos, n, fill := ops[0]%4, int(binary.BigEndian.Uint16(ops[1:])), int(ops[3])+1, ops[4]
+			ops = ops[5:]
+			pos %= size
+			n = min(n*int(fill%8+1), size-pos)
+			switch op {
+			case 0:
+				ref.write(bytes.Repeat([]byte{fill}, n), pos)
+			case 1:
+				ref.check(n, pos)
+			case 2:
+				ref.discard(pos, n)
+			case 3:
+				if failed < c.Tolerance {
+					r.ClearDisk(pos % c.NumDisks)
+					failed++
+				}
+			}
+		}
+		ref.checkAll()
+	})
+}
@@ -0,0 +1,204 @@
+package raid
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+)
+
+type TaskKind int
+
+const (
+	TaskRebuild TaskKind = iota
+	TaskScrub
+	TaskPatrol
+)
+
+func (k TaskKind) String() string {
+	switch k {
+	case TaskRebuild:
+		return "rebuild"
+	case TaskScrub:
+		return "scrub"
+	case TaskPatrol:
+		return "patrol"
+	default:
+		return "unknown"
+	}
+}
+
+// Task is a piece of background work. Disk is the member a rebuild is for,
+// and Repair tells a scrub to repair what it finds.
+type Task struct {
+	Kind   TaskKind
+	Disk   int
+	Repair bool
+}
+
+func (t Task) String() string {
+	switch t.Kind {
+	case TaskRebuild:
+		return fmt.Sprintf("rebuild of disk %d", t.Disk)
+	case TaskScrub:
+		if t.Repair {
+			return "scrub with repair"
+		}
+	}
+	return t.Kind.String()
+}
+
+type SchedulerConfig struct {
+	// Speed throttles the tasks, see SyncSpeed.
+	Speed SyncSpeed
+	// PatrolInterval is the time between patrol reads, 0 for none.
+	PatrolInterval time.Duration
+}
+
+// Scheduler runs the background work of an array, one task at a time.
+// Rebuilds go first, as the array lacks redundancy until they are done.
+// Members that are replaced are rebuilt without being asked, and a patrol
+// read is queued at every PatrolInterval. How the tasks end is published on
+// the array's event bus.
+type Scheduler struct {
+	arr         Array
+	interval    time.Duration
+	ctx         context.Context
+	cancel      context.CancelFunc
+	unsubscribe func()
+	events      <-chan Event
+	wake        chan struct{}
+	wg          sync.WaitGroup
+
+	mu      sync.Mutex
+	queue   []Task
+	running *Task
+}
+
+// NewScheduler applies the speed limits of c to arr and starts running its
+// background work until Close.
+func NewScheduler(arr Array, c SchedulerConfig) *Scheduler {
+	s := newScheduler(arr, c)
+	s.wg.Add(2)
+	go s.watch()
+	go s.run()
+	return s
+}
+
+func newScheduler(arr Array, c SchedulerConfig) *Scheduler {
+	arr.SetSyncSpeed(c.Speed)
+	s := &Scheduler{arr: arr, interval: c.PatrolInterval, wake: make(chan struct{}, 1)}
+	s.ctx, s.cancel = context.WithCancel(context.Background())
+	s.events, s.unsubscribe = arr.Events().Subscribe(64)
+	return s
+}
+
+// Submit queues a task, unless the same task is already queued or running.
+func (s *Scheduler) Submit(t Task) {
+	if t.Kind != TaskRebuild {
+		t.Disk = 0
+	}
+	if t.Kind != TaskScrub {
+		t.Repair = false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if slices.Contains(s.queue, t) || s.running != nil && *s.running == t {
+		return
+	}
+	s.queue = append(s.queue, t)
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Pending returns the running task, if any, followed by the queued ones in
+// the order they will run.
+func (s *Scheduler) Pending() []Task {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var tasks []Task
+	if s.running != nil {
+		tasks = append(tasks, *s.running)
+	}
+	for _, t := range s.queue {
+		if t.Kind == TaskRebuild {
+			tasks = append(tasks, t)
+		}
+	}
+	for _, t := range s.queue {
+		if t.Kind != TaskRebuild {
+			tasks = append(tasks, t)
+		}
+	}
+	return tasks
+}
+
+// Close stops the running task, drops the queued ones and waits for the
+// scheduler to finish. A rebuild that is stopped picks up where it left
+// off when it is queued again.
+func (s *Scheduler) Close() {
+	s.cancel()
+	s.unsubscribe()
+	s.wg.Wait()
+}
+
+// watch queues the rebuild of every member that is replaced.
+func (s *Scheduler) watch() {
+	defer s.wg.Done()
+	for ev := range s.events {
+		if ev.Kind == EventMemberReplaced {
+			s.Submit(Task{Kind: TaskRebuild, Disk: ev.Disk})
+		}
+	}
+}
+
+func (s *Scheduler) run() {
+	defer s.wg.Done()
+	var patrol <-chan time.Time
+	if s.interval > 0 {
+		ticker := time.NewTicker(s.interval)
+		defer ticker.Stop()
+		patrol = ticker.C
+	}
+	for s.ctx.Err() == nil {
+		if t, ok := s.next(); ok {
+			s.runTask(t)
+			continue
+		}
+		select {
+		case <-s.ctx.Done():
+		case <-s.wake:
+		case <-patrol:
+			s.Submit(Task{Kind: TaskPatrol})
+		}
+	}
+}
+
+// next takes the task to run next off the queue.
+func (s *Scheduler) next() (Task, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.running = nil
+	if len(s.queue) == 0 {
+		return Task{}, false
+	}
+	j := max(slices.IndexFunc(s.queue, func(t Task) bool { return t.Kind == TaskRebuild }), 0)
+	t := s.queue[j]
+	s.queue = slices.Delete(s.queue, j, j+1)
+	s.running = &t
+	return t, true
+}
+
+func (s *Scheduler) runTask(t Task) {
+	switch t.Kind {
+	case TaskRebuild:
+		s.arr.RebuildContext(s.ctx, t.Disk)
+	case TaskScrub:
+		s.arr.ScrubContext(s.ctx, t.Repair)
+	case TaskPatrol:
+		s.arr.Patrol(s.ctx)
+	}
+}
@@ -0,0 +1,176 @@
+package raid
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// waitFor waits for an event of the given kind on ch.
+func waitFor(t *testing.T, ch <-chan Event, kind EventKind) Event {
+	t.Helper()
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case ev := <-ch:
+			if ev.Kind == kind {
+				return ev
+			}
+		case <-timeout:
+			t.Fatalf("no %s event", kind)
+		}
+	}
+}
+
+func TestSchedulerRebuildsReplaced(t *testing.T) {
+	arr, err := New(Level5, newMemDisks(3), 512)
+	if err != nil {
+		t.Fatal(err)
+	}
+	arr.Write(make([]byte, 64<<10), 0)
+	s := NewScheduler(arr, SchedulerConfig{})
+	defer s.Close()
+	ch, unsubscribe := arr.Events().Subscribe(256)
+	defer unsubscribe()
+
+	arr.Fail(2)
+	arr.Replace(2, NewMemDisk(0))
+	if ev := waitFor(t, ch, EventRebuildFinished); ev.Disk != 2 || ev.Err != nil {
+		t.Errorf("rebuild of the replaced member = %+v", ev)
+	}
+	if m := arr.Status().Members[2]; m.State != DiskActive {
+		t.Errorf("replaced member after the scheduler rebuilt it = %+v", m)
+	}
+}
+
+func TestSchedulerPatrol(t *testing.T) {
+	faulty := &faultyDisk{Disk: NewMemDisk(0), bad: 20000, n: 1}
+	arr, err := New(Level5, []Disk{NewMemDisk(0), NewMemDisk(0), faulty}, 512)
+	if err != nil {
+		t.Fatal(err)
+	}
+	faulty.n = 0
+	arr.Write(make([]byte, 64<<10), 0)
+	faulty.n = 1
+	ch, unsubscribe := arr.Events().Subscribe(256)
+	defer unsubscribe()
+	s := NewScheduler(arr, SchedulerConfig{PatrolInterval: 10 * time.Millisecond})
+	defer s.Close()
+
+	if ev := waitFor(t, ch, EventBadBlock); ev.Disk != 2 || ev.Offset != 16384 {
+		t.Errorf("bad block found by the patrol read = %+v", ev)
+	}
+	waitFor(t, ch, EventPatrolFinished)
+	if m := arr.Status().Members[2]; m.State != DiskActive || m.BadBlocks != 1 {
+		t.Errorf("member with a bad sector after a patrol read = %+v", m)
+	}
+	// Known bad blocks are skipped.
+	report, err := arr.Patrol(context.Background())
+	if err != nil || report.BadBlocks != 0 || report.Checked != 32<<10 {
+		t.Errorf("Patrol() = %+v, %v", report, err)
+	}
+}
+
+func TestSchedulerQueue(t *testing.T) {
+	arr, err := New(Level5, newMemDisks(3), 512)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := newScheduler(arr, SchedulerConfig{})
+	defer s.unsubscribe()
+	s.Submit(Task{Kind: TaskPatrol})
+	s.Submit(Task{Kind: TaskScrub, Disk: 3})
+	s.Submit(Task{Kind: TaskRebuild, Disk: 1})
+	s.Submit(Task{Kind: TaskScrub})
+	s.Submit(Task{Kind: TaskScrub, Repair: true})
+	want := []Task{{Kind: TaskRebuild, Disk: 1}, {Kind: TaskPatrol}, {Kind: TaskScrub}, {Kind: TaskScrub, Repair: true}}
+	if got := s.Pending(); !equalTasks(got, want) {
+		t.Errorf("Pending() = %v, want %v", got, want)
+	}
+	for _, w := range want {
+		if got, ok := s.next(); !ok || got != w {
+			t.Errorf("next() = %v, %v, want %v", got, ok, w)
+		}
+	}
+	if _, ok := s.next(); ok || len(s.Pending()) != 0 {
+		t.Errorf("tasks left over: %v", s.Pending())
+	}
+}
+
+func equalTasks(a, b []Task) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// syncArray returns a RAID5 array whose members hold size bytes each, with
+// disk 1 failed.
+func syncArray(t *testing.T, size int64) Array {
+	t.Helper()
+	disks := make([]Disk, 3)
+	for i := range disks {
+		disks[i] = NewMemDisk(size)
+	}
+	arr, err := New(Level5, disks, 512)
+	if err != nil {
+		t.Fatal(err)
+	}
+	arr.Fail(1)
+	return arr
+}
+
+func TestSyncSpeedMax(t *testing.T) {
+	arr := syncArray(t, 256<<10)
+	arr.SetSyncSpeed(SyncSpeed{Max: 1 << 20})
+	start := time.Now()
+	if err := arr.Rebuild(1); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < 200*time.Millisecond {
+		t.Errorf("rebuild of 256K at 1M/s took %v", elapsed)
+	}
+}
+
+// TestSyncSpeedBackoff checks that a rebuild slows down to the minimum speed
+// while foreground I/O is busy, and runs at full speed otherwise.
+func TestSyncSpeedBackoff(t *testing.T) {
+	arr := syncArray(t, 1<<20)
+	arr.SetSyncSpeed(SyncSpeed{Min: 2 << 20})
+	start := time.Now()
+	if err := arr.Rebuild(1); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed > 200*time.Millisecond {
+		t.Errorf("rebuild without foreground I/O took %v", elapsed)
+	}
+
+	arr.Fail(1)
+	ctx, cancel := context.WithCancel(context.Background())
+	started, done := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(done)
+		arr.Read(512, 0)
+		close(started)
+		for ctx.Err() == nil {
+			arr.Read(512, 0)
+		}
+	}()
+	<-started
+	start = time.Now()
+	err := arr.Rebuild(1)
+	elapsed := time.Since(start)
+	cancel()
+	<-done
+	if err != nil {
+		t.Fatal(err)
+	}
+	if elapsed < 300*time.Millisecond {
+		t.Errorf("rebuild of 1M at 2M/s under foreground I/O took %v", elapsed)
+	}
+}
@@ -0,0 +1,297 @@
+package raid
+
+import "slices"
+
+// chunk is the part of a request that falls into one stripe chunk, i.e. one
+// contiguous range of a single member.
+type chunk struct {
+	index  int // logical chunk number
+	within int // offset inside the chunk
+	pos    int // offset inside the request
+	n      int
+}
+
+// splitChunks splits the logical range [pos, pos+length) at every multiple of
+// chunkSize.
+func splitChunks(pos, length, chunkSize int) []chunk {
+	var chunks []chunk
+	for done := 0; done < length; {
+		logicalPos := pos + done
+		within := logicalPos % chunkSize
+		n := min(chunkSize-within, length-done)
+		chunks = append(chunks, chunk{logicalPos / chunkSize, within, done, n})
+		done += n
+	}
+	return chunks
+}
+
+// parityLevel is what distinguishes the parity levels from each other.
+type parityLevel interface {
+	// stripeDisks returns the members holding the data chunks and the parity
+	// chunks of stripe s, in order.
+	stripeDisks(s int) (data []int, parity []int)
+	// encode computes the parity chunks from the data chunks.
+	encode(data [][]byte, parity [][]byte)
+	// update folds delta, the change of data chunk k, into the parity.
+	update(parity [][]byte, k int, delta []byte)
+}
+
+// parityStripes implements reads and writes for arrays that keep one chunk of
+// every member of a stripe at the same offset, some of them holding parity.
+// A row of chunks, one on every member, holds rowStripes stripes. Rows
+// start at member offset base.
+type parityStripes struct {
+	m          *members
+	level      parityLevel
+	stripeSize int
+	dataDisks  int
+	rowStripes int
+	base       int64
+}
+
+// offset is where the chunks of stripe s start on their members.
+func (p *parityStripes) offset(s int) int64 {
+	return p.base + int64(s/p.rowStripes*p.stripeSize)
+}
+
+// mapRange returns the data extents of the range, each followed by the
+// parity that protects it.
+func (p *parityStripes) mapRange(pos, length int) []Extent {
+	var extents []Extent
+	for _, c := range splitChunks(pos, length, p.stripeSize) {
+		s, k := c.index/p.dataDisks, c.index%p.dataDisks
+		data, parity := p.level.stripeDisks(s)
+		off := p.offset(s) + int64(c.within)
+		extents = append(extents, Extent{pos + c.pos, c.n, data[k], off, RoleData})
+		for i, d := range parity {
+			extents = append(extents, Extent{pos + c.pos, c.n, d, off, RoleP + Role(i)})
+		}
+	}
+	return extents
+}
+
+func (p *parityStripes) read(length, pos int) ([]byte, error) {
+	result := make([]byte, length)
+	if err := p.readV([]IOVec{{pos, result}}); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// readV reads the data chunks of all requests at once.
+func (p *parityStripes) readV(vecs []IOVec) error {
+	var ios []memberIO
+	for _, v := range vecs {
+		for _, c := range splitChunks(v.Pos, len(v.Data), p.stripeSize) {
+			s, k := c.index/p.dataDisks, c.index%p.dataDisks
+			data, _ := p.level.stripeDisks(s)
+			off := p.offset(s) + int64(c.within)
+			ios = append(ios, memberIO{data[k], v.Data[c.pos : c.pos+c.n], off})
+		}
+	}
+	return p.m.readAll(ios)
+}
+
+// piece is new data for part of one stripe, starting within bytes into the
+// data of the stripe.
+type piece struct {
+	within int
+	data   []byte
+}
+
+// touched splits the pieces of a stripe at its data chunks. It returns the
+// chunks, indexed by data chunk within the stripe, and the new data of each.
+func (p *parityStripes) touched(pieces []piece) ([]chunk, [][]byte) {
+	var chunks []chunk
+	var newData [][]byte
+	for _, pc := range pieces {
+		for _, c := range splitChunks(pc.within, len(pc.data), p.stripeSize) {
+			chunks = append(chunks, c)
+			newData = append(newData, pc.data[c.pos:c.pos+c.n])
+		}
+	}
+	return chunks, newData
+}
+
+// rmw is a read-modify-write of one partial stripe.
+type rmw struct {
+	touched []chunk
+	newData [][]byte
+	old     [][]byte // old contents of the touched chunks
+	parity  [][]byte // parity over [lo, hi) of the stripe
+	lo      int
+}
+
+func (p *parityStripes) write(data []byte, pos int) error {
+	return p.writeV([]IOVec{{pos, data}})
+}
+
+// writeV updates whole stripes by computing their parity from the new data,
+// and partial stripes by read-modify-write: the change of every data chunk is
+// folded into the old parity, which is read and written once per stripe
+// however many requests touch it. All reads of a batch are issued together,
+// then all writes, so that the members work concurrently. The requests must
+// be sorted and disjoint, as coalesce leaves them.
+//
+// A partial stripe with a member out of sync is updated by reconstruct-write
+// instead: the rows of the stripe are read, missing ones reconstructed, and
+// the parity is computed afresh with the new data. Writes to members that are
+// out of sync are dropped, so their data lives on in the parity until they
+// are rebuilt.
+func (p *parityStripes) writeV(vecs []IOVec) error {
+	stripeDataSize := p.dataDisks * p.stripeSize
+	var stripes []int
+	var pieces [][]piece
+	for _, v := range vecs {
+		for _, st := range splitChunks(v.Pos, len(v.Data), stripeDataSize) {
+			pc := piece{st.within, v.Data[st.pos : st.pos+st.n]}
+			if n := len(stripes); n > 0 && stripes[n-1] == st.index {
+				pieces[n-1] = append(pieces[n-1], pc)
+				continue
+			}
+			stripes = append(stripes, st.index)
+			pieces = append(pieces, []piece{pc})
+		}
+	}
+
+	var reads, writes []memberIO
+	var partial []rmw
+	for j, s := range stripes {
+		dataDisks, parityDisks := p.level.stripeDisks(s)
+		stripeOff := p.offset(s)
+
+		if pcs := pieces[j]; len(pcs) == 1 && len(pcs[0].data) == stripeDataSize {
+			newData := pcs[0].data
+			chunks := make([][]byte, p.dataDisks)
+			for k := range chunks {
+				chunks[k] = newData[k*p.stripeSize : (k+1)*p.stripeSize]
+			}
+			parity := make([][]byte, len(parityDisks))
+			for i := range parity {
+				parity[i] = make([]byte, p.stripeSize)
+			}
+			p.level.encode(chunks, parity)
+			for k, d := range dataDisks {
+				writes = append(writes, memberIO{d, chunks[k], stripeOff})
+			}
+			for i, d := range parityDisks {
+				writes = append(writes, memberIO{d, parity[i], stripeOff})
+			}
+			continue
+		}
+
+		if p.degraded(stripeOff, dataDisks, parityDisks) {
+			w, err := p.reconstructWrite(stripeOff, dataDisks, parityDisks, pieces[j])
+			if err != nil {
+				return err
+			}
+			writes = append(writes, w...)
+			continue
+		}
+
+		var u rmw
+		u.touched, u.newData = p.touched(pieces[j])
+		lo, hi := p.stripeSize, 0
+		for _, c := range u.touched {
+			lo, hi = min(lo, c.within), max(hi, c.within+c.n)
+		}
+		u.lo = lo
+		for i, d := range parityDisks {
+			u.parity = append(u.parity, make([]byte, hi-lo))
+			reads = append(reads, memberIO{d, u.parity[i], stripeOff + int64(lo)})
+		}
+		for i, c := range u.touched {
+			old := make([]byte, c.n)
+			u.old = append(u.old, old)
+			off := stripeOff + int64(c.within)
+			reads = append(reads, memberIO{dataDisks[c.index], old, off})
+			writes = append(writes, memberIO{dataDisks[c.index], u.newData[i], off})
+		}
+		for i, d := range parityDisks {
+			writes = append(writes, memberIO{d, u.parity[i], stripeOff + int64(lo)})
+		}
+		partial = append(partial, u)
+	}
+
+	if err := p.m.readAll(reads); err != nil {
+		return err
+	}
+	for _, u := range partial {
+		for j, c := range u.touched {
+			delta := u.old[j]
+			xorInto(delta, u.newData[j])
+			window := make([][]byte, len(u.parity))
+			for i := range u.parity {
+				window[i] = u.parity[i][c.within-u.lo : c.within-u.lo+c.n]
+			}
+			p.level.update(window, c.index, delta)
+		}
+	}
+	return p.m.writeAll(writes)
+}
+
+// degraded reports whether any member of the stripe starting at member offset
+// stripeOff is out of sync.
+func (p *parityStripes) degraded(stripeOff int64, dataDisks, parityDisks []int) bool {
+	for _, d := range slices.Concat(dataDisks, parityDisks) {
+		if !p.m.inSync(d, stripeOff, p.stripeSize) {
+			return true
+		}
+	}
+	return false
+}
+
+// reconstructWrite merges the pieces of new data with the current contents
+// of a stripe and returns the writes that store them together with the
+// parity computed from scratch.
+func (p *parityStripes) reconstructWrite(stripeOff int64, dataDisks, parityDisks []int, pieces []piece) ([]memberIO, error) {
+	touched, newData := p.touched(pieces)
+	lo, hi := p.stripeSize, 0
+	for _, c := range touched {
+		lo, hi = min(lo, c.within), max(hi, c.within+c.n)
+	}
+	off := stripeOff + int64(lo)
+	rows, err := p.m.readRows(off, hi-lo)
+	if err != nil {
+		return nil, err
+	}
+	var writes []memberIO
+	for j, c := range touched {
+		row := rows[dataDisks[c.index]][c.within-lo : c.within-lo+c.n]
+		copy(row, newData[j])
+		writes = append(writes, memberIO{dataDisks[c.index], row, stripeOff + int64(c.within)})
+	}
+	data := make([][]byte, len(dataDisks))
+	for k, d := range dataDisks {
+		data[k] = rows[d]
+	}
+	parity := make([][]byte, len(parityDisks))
+	for i, d := range parityDisks {
+		parity[i] = rows[d]
+		writes = append(writes, memberIO{d, rows[d], off})
+	}
+	p.level.encode(data, parity)
+	return writes, nil
+}
+
+// discard drops whole stripes from their members: the parity of zeros is
+// zeros. Partial stripes are zeroed by a write, which keeps their parity
+// consistent.
+func (p *parityStripes) discard(pos, length int) error {
+	stripeDataSize := p.dataDisks * p.stripeSize
+	for _, st := range splitChunks(pos, length, stripeDataSize) {
+		if st.n < stripeDataSize {
+			if err := p.write(make([]byte, st.n), pos+st.pos); err != nil {
+				return err
+			}
+			continue
+		}
+		data, parity := p.level.stripeDisks(st.index)
+		for _, d := range slices.Concat(data, parity) {
+			if err := p.m.discardAt(d, p.offset(st.index), p.stripeSize); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
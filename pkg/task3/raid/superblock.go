@@ -0,0 +1,351 @@
+package raid
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"slices"
+
+	"github.com/google/uuid"
+)
+
+// Every member of an array created with Create starts with a superblock that
+// records the geometry of the array and the state of all members, so that the
+// array can be assembled again from its disks. Member data follows it.
+//
+// Layout: magic (8 bytes), payload length (uint32), CRC32 of the payload
+// (uint32), then the JSON encoded payload.
+const (
+	superblockMagic = "GRAIDSB1"
+	superblockHdr   = 16
+)
+
+// SuperblockSize is how much of every disk is taken by the superblock, on
+// top of the member data.
+const SuperblockSize = 4096
+
+var ErrNoSuperblock = errors.New("no valid superblock")
+
+type superblock struct {
+	UUID       string      `json:"uuid"`
+	Level      Level       `json:"level"`
+	StripeSize int         `json:"stripe_size"`
+	NumDisks   int         `json:"num_disks"`
+	Index      int         `json:"index"`
+	Events     uint64      `json:"events"`
+	States     []DiskState `json:"states"`
+	DataOffset int64       `json:"data_offset"`
+	DataSize   int64       `json:"data_size"`
+	// MemberSizes is the data size of every member of a linear or hybrid
+	// array, whose members differ in size. Other levels use DataSize of
+	// every member.
+	MemberSizes []int64 `json:"member_sizes,omitempty"`
+	// Declustered arrays record their geometry and the failed members whose
+	// chunks live in the spare space.
+	Declustered *DeclusteredConfig `json:"declustered,omitempty"`
+	Spared      []sparedDisk       `json:"spared,omitempty"`
+	// Reserve is the number of blocks behind the data of every member that
+	// bad blocks are remapped to. BadBlocks is the list of this member.
+	Reserve   int        `json:"reserve,omitempty"`
+	BadBlocks []badBlock `json:"bad_blocks,omitempty"`
+}
+
+// metadata is what an array needs to keep its superblocks up to date.
+type metadata struct {
+	uuid        string
+	level       Level
+	stripeSize  int
+	dataSize    int64
+	sizes       []int64 // per member, for linear and hybrid arrays
+	declustered *DeclusteredConfig
+	spared      []sparedDisk
+	reserve     int
+	events      uint64
+	raw         []Disk
+}
+
+// memberSize is the data size of member i.
+func (md *metadata) memberSize(i int) int64 {
+	if md.sizes != nil {
+		return md.sizes[i]
+	}
+	return md.dataSize
+}
+
+// attach prepares a new disk for slot i, whose bad blocks go on bad, and
+// returns the region of it that holds member data.
+func (md *metadata) attach(i int, disk Disk, bad *badList) (Disk, error) {
+	if need := md.memberSize(i) + int64(md.reserve)*badBlockSize + SuperblockSize; disk.Size() < need {
+		return nil, fmt.Errorf("disk of %d bytes is too small, need %d", disk.Size(), need)
+	}
+	md.raw[i] = disk
+	return md.section(i, disk, bad), nil
+}
+
+// section returns the region of the disk in slot i that holds member data,
+// with the blocks remapped to the reserved area redirected there.
+func (md *metadata) section(i int, disk Disk, bad *badList) Disk {
+	bad.slots = md.reserve
+	var d Disk = &sectionDisk{disk, SuperblockSize}
+	if md.reserve > 0 {
+		d = &remapDisk{d, bad, md.memberSize(i)}
+	}
+	return d
+}
+
+// write bumps the event counter and writes the superblock of every member.
+// It returns the members whose superblock could not be written, which would
+// otherwise keep a stale event count and drop out at the next assembly.
+func (md *metadata) write(m *members) []int {
+	md.events++
+	var failed []int
+	for i, disk := range md.raw {
+		sb := superblock{
+			UUID:        md.uuid,
+			Level:       md.level,
+			StripeSize:  md.stripeSize,
+			NumDisks:    len(md.raw),
+			Index:       i,
+			Events:      md.events,
+			States:      slices.Clone(m.state),
+			DataOffset:  SuperblockSize,
+			DataSize:    md.dataSize,
+			MemberSizes: md.sizes,
+			Declustered: md.declustered,
+			Spared:      md.spared,
+			Reserve:     md.reserve,
+			BadBlocks:   m.bad[i].blocks,
+		}
+		if err := writeSuperblock(disk, &sb); err != nil {
+			failed = append(failed, i)
+		}
+	}
+	return failed
+}
+
+func writeSuperblock(disk Disk, sb *superblock) error {
+	payload, err := json.Marshal(sb)
+	if err != nil {
+		return err
+	}
+	if len(payload) > SuperblockSize-superblockHdr {
+		return fmt.Errorf("superblock of %d bytes does not fit", len(payload))
+	}
+	buf := make([]byte, SuperblockSize)
+	copy(buf, superblockMagic)
+	binary.LittleEndian.PutUint32(buf[8:], uint32(len(payload)))
+	binary.LittleEndian.PutUint32(buf[12:], crc32.ChecksumIEEE(payload))
+	copy(buf[superblockHdr:], payload)
+	_, err = disk.WriteAt(buf, 0)
+	return err
+}
+
+func readSuperblock(disk Disk) (*superblock, error) {
+	buf := make([]byte, SuperblockSize)
+	if _, err := disk.ReadAt(buf, 0); err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(buf[:8], []byte(superblockMagic)) {
+		return nil, ErrNoSuperblock
+	}
+	n := binary.LittleEndian.Uint32(buf[8:])
+	if n > SuperblockSize-superblockHdr {
+		return nil, fmt.Errorf("%w: bad length %d", ErrNoSuperblock, n)
+	}
+	payload := buf[superblockHdr : superblockHdr+n]
+	if crc32.ChecksumIEEE(payload) != binary.LittleEndian.Uint32(buf[12:]) {
+		return nil, fmt.Errorf("%w: checksum mismatch", ErrNoSuperblock)
+	}
+	var sb superblock
+	if err := json.Unmarshal(payload, &sb); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrNoSuperblock, err)
+	}
+	return &sb, nil
+}
+
+// Create builds a new array on the disks and writes a superblock to each of
+// them. The smallest disk determines how much of every member is used.
+func Create(level Level, disks []Disk, stripeSize int) (Array, error) {
+	var c *DeclusteredConfig
+	if level == LevelDeclustered {
+		d := defaultDeclustered(len(disks))
+		c = &d
+	}
+	return create(level, disks, stripeSize, c)
+}
+
+// CreateDeclustered is Create for a declustered array of the given geometry.
+func CreateDeclustered(disks []Disk, stripeSize int, c DeclusteredConfig) (Array, error) {
+	return create(LevelDeclustered, disks, stripeSize, &c)
+}
+
+func create(level Level, disks []Disk, stripeSize int, c *DeclusteredConfig) (Array, error) {
+	if len(disks) == 0 {
+		return nil, errors.New("no disks")
+	}
+	dataSize := disks[0].Size()
+	for _, d := range disks {
+		dataSize = min(dataSize, d.Size())
+	}
+	dataSize = splitReserve(dataSize - SuperblockSize)
+	if stripeSize > 0 {
+		dataSize -= dataSize % int64(stripeSize)
+	}
+	reserve := reserveSlots(dataSize)
+	if dataSize <= 0 {
+		return nil, fmt.Errorf("disks must be larger than %d bytes", SuperblockSize)
+	}
+	var sizes []int64
+	if level == LevelLinear || level == LevelHybrid {
+		// These use every member whole.
+		for _, d := range disks {
+			sizes = append(sizes, d.Size()-SuperblockSize-int64(reserve)*badBlockSize)
+		}
+		dataSize = slices.Max(sizes)
+	}
+	md := &metadata{
+		uuid:        uuid.NewString(),
+		level:       level,
+		stripeSize:  stripeSize,
+		dataSize:    dataSize,
+		sizes:       sizes,
+		declustered: c,
+		reserve:     reserve,
+		raw:         slices.Clone(disks),
+	}
+	arr, err := assemble(md, make([]DiskState, len(disks)), make([][]badBlock, len(disks)))
+	if err != nil {
+		return nil, err
+	}
+	m := arr.(interface{ base() *members }).base()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.persist()
+	return arr, nil
+}
+
+// Assemble rebuilds an array from disks that carry superblocks, in any order.
+// Slots whose disk is not given are assembled as failed, and so are members
+// whose superblock is older than the newest one. The superblocks are left
+// untouched until the state of a member changes.
+func Assemble(disks []Disk) (Array, error) {
+	var newest *superblock
+	sbs := make([]*superblock, len(disks))
+	for i, d := range disks {
+		sb, err := readSuperblock(d)
+		if err != nil {
+			return nil, fmt.Errorf("disk %d: %w", i, err)
+		}
+		if newest != nil && sb.UUID != newest.UUID {
+			return nil, fmt.Errorf("disk %d belongs to array %s, not %s", i, sb.UUID, newest.UUID)
+		}
+		if newest == nil || sb.Events > newest.Events {
+			newest = sb
+		}
+		sbs[i] = sb
+	}
+	if newest == nil {
+		return nil, errors.New("no disks")
+	}
+	if len(newest.States) != newest.NumDisks {
+		return nil, fmt.Errorf("%w: %d states for %d disks", ErrNoSuperblock, len(newest.States), newest.NumDisks)
+	}
+
+	md := &metadata{
+		uuid:        newest.UUID,
+		level:       newest.Level,
+		stripeSize:  newest.StripeSize,
+		dataSize:    newest.DataSize,
+		sizes:       newest.MemberSizes,
+		declustered: newest.Declustered,
+		spared:      newest.Spared,
+		reserve:     newest.Reserve,
+		events:      newest.Events,
+		raw:         make([]Disk, newest.NumDisks),
+	}
+	states := slices.Clone(newest.States)
+	bad := make([][]badBlock, newest.NumDisks)
+	for i, sb := range sbs {
+		if sb.Index < 0 || sb.Index >= newest.NumDisks {
+			return nil, fmt.Errorf("disk %d: slot %d out of range", i, sb.Index)
+		}
+		if md.raw[sb.Index] != nil {
+			return nil, fmt.Errorf("disk %d: slot %d given twice", i, sb.Index)
+		}
+		md.raw[sb.Index] = disks[i]
+		bad[sb.Index] = sb.BadBlocks
+		if sb.Events < newest.Events && states[sb.Index] == DiskActive {
+			states[sb.Index] = DiskFailed
+		}
+	}
+	for i, d := range md.raw {
+		if d == nil {
+			md.raw[i] = missingDisk{}
+			states[i] = DiskFailed
+		}
+	}
+	return assemble(md, states, bad)
+}
+
+func assemble(md *metadata, states []DiskState, bad [][]badBlock) (Array, error) {
+	disks := make([]Disk, len(md.raw))
+	lists := make([]*badList, len(md.raw))
+	for i, d := range md.raw {
+		lists[i] = &badList{blocks: bad[i]}
+		disks[i] = md.section(i, d, lists[i])
+	}
+	arr, err := build(md.level, disks, md.stripeSize, md.sizes, md.declustered, md.spared)
+	if err != nil {
+		return nil, err
+	}
+	m := arr.(interface{ base() *members }).base()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i, s := range states {
+		// An interrupted rebuild starts over.
+		if s == DiskRebuilding {
+			s = DiskFailed
+		}
+		m.state[i] = s
+	}
+	m.bad = lists
+	m.meta = md
+	m.degraded = m.outOfSync()
+	return arr, nil
+}
+
+// build puts an array of the given level together on disks, with what the
+// levels that take more than a stripe size need.
+func build(level Level, disks []Disk, stripeSize int, sizes []int64, c *DeclusteredConfig, spared []sparedDisk) (Array, error) {
+	switch level {
+	case LevelLinear:
+		// Members that are missing or smaller than they were must not shift
+		// the ones after them.
+		return newLinear(disks, sizes)
+	case LevelHybrid:
+		return newHybrid(disks, stripeSize, sizes)
+	case LevelDeclustered:
+		if c == nil {
+			return nil, errors.New("dRAID: geometry missing")
+		}
+		r, err := newDeclustered(disks, stripeSize, *c)
+		if err != nil {
+			return nil, err
+		}
+		r.spared = slices.Clone(spared)
+		return r, nil
+	}
+	return New(level, disks, stripeSize)
+}
+
+// missingDisk stands in for a member that was not found at assembly.
+type missingDisk struct{}
+
+var errMissingDisk = errors.New("disk is missing")
+
+func (missingDisk) ReadAt(p []byte, off int64) (int, error)  { return 0, errMissingDisk }
+func (missingDisk) WriteAt(p []byte, off int64) (int, error) { return 0, errMissingDisk }
+func (missingDisk) Size() int64                              { return 0 }
@@ -0,0 +1,105 @@
+package raid
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestAssembleAfterRebuild(t *testing.T) {
+	tests := []struct {
+		name     string
+		level    Level
+		numDisks int
+		failed   []int
+	}{
+		{name: "dRAID", level: LevelDeclustered, numDisks: 7, failed: []int{3}},
+		{name: "RAID1", level: Level1, numDisks: 2, failed: []int{0}},
+		{name: "SHR", level: LevelHybrid, numDisks: 3, failed: []int{1}},
+		{name: "RAID10", level: Level10, numDisks: 4, failed: []int{1, 2}},
+		{name: "RAID4", level: Level4, numDisks: 3, failed: []int{2}},
+		{name: "RAID5", level: Level5, numDisks: 3, failed: []int{2}},
+		{name: "RAID6 data", level: Level6, numDisks: 5, failed: []int{0, 2}},
+		{name: "RAID6 parity", level: Level6, numDisks: 4, failed: []int{1, 3}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			disks := make([]Disk, tt.numDisks)
+			for i := range disks {
+				disks[i] = NewMemDisk(SuperblockSize + 1024)
+			}
+			arr, err := Create(tt.level, disks, 16)
+			if err != nil {
+				t.Fatalf("Create() error = %v", err)
+			}
+			data := bytes.Repeat([]byte("0123456789abcdef"), 12)
+			if err := arr.Write(data, 0); err != nil {
+				t.Fatalf("Write() error = %v", err)
+			}
+			for _, d := range tt.failed {
+				arr.ClearDisk(d)
+			}
+
+			// Assemble from the disks in reverse order: slots come from the superblocks.
+			reversed := make([]Disk, len(disks))
+			for i, d := range disks {
+				reversed[len(disks)-1-i] = d
+			}
+			arr, err = Assemble(reversed)
+			if err != nil {
+				t.Fatalf("Assemble() error = %v", err)
+			}
+			if !arr.Status().Degraded() {
+				t.Errorf("Status().Degraded() = false after clearing %v", tt.failed)
+			}
+			for _, d := range tt.failed {
+				if err := arr.Rebuild(d); err != nil {
+					t.Fatalf("Rebuild(%d) error = %v", d, err)
+				}
+			}
+			if report, err := arr.Scrub(false); err != nil || report.Mismatches != 0 {
+				t.Errorf("Scrub() = %+v, %v", report, err)
+			}
+
+			// Every member is valid again, so the array survives losing others.
+			arr.ClearDisk(tt.numDisks - 1 - tt.failed[0])
+			got, err := arr.Read(len(data), 0)
+			if err != nil || !bytes.Equal(got, data) {
+				t.Errorf("Read() = %q, %v, want %q", got, err, data)
+			}
+		})
+	}
+}
+
+// TestSuperblockWriteError checks that a member whose superblock cannot be
+// written is failed, on the other members' superblocks too, instead of
+// dropping out at the next assembly with nothing recorded.
+func TestSuperblockWriteError(t *testing.T) {
+	disks := make([]Disk, 4)
+	for i := range disks {
+		disks[i] = NewMemDisk(SuperblockSize + 1024)
+	}
+	faulty := &faultyDisk{Disk: disks[1]}
+	disks[1] = faulty
+	arr, err := Create(Level6, disks, 16)
+	if err != nil {
+		t.Fatal(err)
+	}
+	faulty.n = SuperblockSize
+	if err := arr.Fail(2); err != nil {
+		t.Fatal(err)
+	}
+	if st := arr.Status().Members[1].State; st != DiskFailed {
+		t.Fatalf("member 1 after a failed superblock write is %v", st)
+	}
+
+	faulty.n = 0
+	arr, err = Assemble([]Disk{disks[0], disks[3]})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, want := range []DiskState{DiskActive, DiskFailed, DiskFailed, DiskActive} {
+		if st := arr.Status().Members[i].State; st != want {
+			t.Errorf("assembled member %d is %v, want %v", i, st, want)
+		}
+	}
+}
@@ -0,0 +1,108 @@
+package raid
+
+import (
+	"context"
+	"time"
+)
+
+// SyncSpeed limits the rate of rebuilds, scrubs and patrol reads, in bytes
+// per second of each member, like md's sync_speed_min and sync_speed_max.
+// The zero value leaves them unthrottled.
+type SyncSpeed struct {
+	// Max caps the rate; 0 leaves it unlimited.
+	Max int64 `json:"max,omitempty"`
+	// Min is the rate kept up while foreground I/O is busy. Above it,
+	// background work backs off whenever foreground requests came in since
+	// its last chunk. 0 disables the backoff.
+	Min int64 `json:"min,omitempty"`
+}
+
+const (
+	// syncWindow is how long the rate of background work is averaged over,
+	// so that work held back by foreground I/O does not burst afterwards.
+	syncWindow = 3 * time.Second
+	// backoffStep is how long background work sleeps before it looks at
+	// the foreground again.
+	backoffStep = 50 * time.Millisecond
+	// idleAfter is how long foreground I/O has to stay away before
+	// background work speeds up again.
+	idleAfter = 100 * time.Millisecond
+)
+
+// SetSyncSpeed sets the limits of background work, including the work
+// already running.
+func (m *members) SetSyncSpeed(s SyncSpeed) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.speed = s
+}
+
+// throttle paces one run of background work.
+type throttle struct {
+	m     *members
+	start time.Time
+	bytes int64     // per member, since start
+	seen  int64     // m.requests at the end of the last chunk
+	busy  time.Time // when foreground I/O was last seen
+}
+
+// newThrottle is called with the lock held.
+func (m *members) newThrottle() *throttle {
+	return &throttle{m: m, start: time.Now(), seen: m.requests}
+}
+
+// begin is called with the lock held at the start of every chunk, and
+// notices the foreground requests issued since the last one.
+func (t *throttle) begin() {
+	if t.m.requests != t.seen {
+		t.busy = time.Now()
+	}
+}
+
+// done accounts for a chunk of n bytes per member. It is called with the
+// lock held, once the chunk's own I/O is issued.
+func (t *throttle) done(n int) {
+	t.bytes += int64(n)
+	t.seen = t.m.requests
+}
+
+// wait sleeps, without the lock, for as long as the limits ask, or until
+// ctx is done.
+func (t *throttle) wait(ctx context.Context) {
+	for {
+		t.m.mu.Lock()
+		speed, requests := t.m.speed, t.m.requests
+		t.m.mu.Unlock()
+		if requests != t.seen {
+			t.busy = time.Now()
+		}
+		t.seen = requests
+		busy := time.Since(t.busy) < idleAfter
+
+		elapsed := time.Since(t.start)
+		var sleep time.Duration
+		if at := atRate(t.bytes, speed.Max); at > elapsed {
+			sleep = at - elapsed
+		} else if at := atRate(t.bytes, speed.Min); busy && at > elapsed {
+			sleep = min(at-elapsed, backoffStep)
+		} else {
+			if elapsed > syncWindow {
+				t.start, t.bytes = time.Now(), 0
+			}
+			return
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(sleep):
+		}
+	}
+}
+
+// atRate is how long n bytes take at rate bytes per second, 0 for no limit.
+func atRate(n, rate int64) time.Duration {
+	if rate <= 0 {
+		return 0
+	}
+	return time.Duration(float64(n) / float64(rate) * float64(time.Second))
+}
@@ -0,0 +1,114 @@
+package raid
+
+import (
+	"slices"
+	"sort"
+)
+
+// IOVec is one request of a batch: Data is written at, or read from, Pos.
+type IOVec struct {
+	Pos  int
+	Data []byte
+}
+
+// VectorRAID is a RAID that takes a batch of scattered requests at once. The
+// parity levels compute the parity of every stripe a batch touches once,
+// instead of once per request, and issue the member I/O of the whole batch
+// together.
+type VectorRAID interface {
+	RAID
+	// ReadV fills the Data of every request.
+	ReadV(vecs []IOVec) error
+	// WriteV writes every request. Where requests overlap, the later one
+	// wins, as if they had been written one after the other.
+	WriteV(vecs []IOVec) error
+}
+
+// ReadV reads a batch of requests from r, at once if r is a VectorRAID and
+// one after the other otherwise.
+func ReadV(r RAID, vecs []IOVec) error {
+	if v, ok := r.(VectorRAID); ok {
+		return v.ReadV(vecs)
+	}
+	if err := checkVecs(vecs); err != nil {
+		return err
+	}
+	for _, v := range vecs {
+		data, err := r.Read(len(v.Data), v.Pos)
+		if err != nil {
+			return err
+		}
+		copy(v.Data, data)
+	}
+	return nil
+}
+
+// WriteV writes a batch of requests to r, at once if r is a VectorRAID.
+// Otherwise adjacent requests are merged and written one after the other.
+func WriteV(r RAID, vecs []IOVec) error {
+	if v, ok := r.(VectorRAID); ok {
+		return v.WriteV(vecs)
+	}
+	if err := checkVecs(vecs); err != nil {
+		return err
+	}
+	for _, v := range coalesce(vecs) {
+		if err := r.Write(v.Data, v.Pos); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func checkVecs(vecs []IOVec) error {
+	for _, v := range vecs {
+		if v.Pos < 0 {
+			return errNegativeRange
+		}
+	}
+	return nil
+}
+
+// coalesce merges overlapping and adjacent requests and returns them sorted
+// by position. Where requests overlap, the later one wins. Requests that
+// merge with no other keep their buffer.
+func coalesce(vecs []IOVec) []IOVec {
+	order := make([]int, 0, len(vecs))
+	for i, v := range vecs {
+		if len(v.Data) > 0 {
+			order = append(order, i)
+		}
+	}
+	slices.SortStableFunc(order, func(a, b int) int { return vecs[a].Pos - vecs[b].Pos })
+
+	var merged []IOVec
+	var ends []int
+	var single []int // the request a merged one is made of, -1 for several
+	for _, i := range order {
+		v := vecs[i]
+		if n := len(merged); n > 0 && v.Pos <= ends[n-1] {
+			ends[n-1] = max(ends[n-1], v.Pos+len(v.Data))
+			single[n-1] = -1
+			continue
+		}
+		merged = append(merged, IOVec{Pos: v.Pos})
+		ends = append(ends, v.Pos+len(v.Data))
+		single = append(single, i)
+	}
+	for j := range merged {
+		if single[j] >= 0 {
+			merged[j].Data = vecs[single[j]].Data
+		} else {
+			merged[j].Data = make([]byte, ends[j]-merged[j].Pos)
+		}
+	}
+	for _, v := range vecs {
+		if len(v.Data) == 0 {
+			continue
+		}
+		if j := sort.Search(len(merged), func(j int) bool { return ends[j] > v.Pos }); single[j] < 0 {
+			copy(merged[j].Data[v.Pos-merged[j].Pos:], v.Data)
+		}
+	}
+	return merged
+}
@@ -0,0 +1,140 @@
+package raid
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+)
+
+// TestWriteV writes batches of scattered, overlapping requests, healthy and
+// degraded, and compares the array with a flat buffer written request by
+// request.
+func TestWriteV(t *testing.T) {
+	const size = 4096
+	sized := func(n int) []Disk {
+		disks := make([]Disk, n)
+		for i := range disks {
+			disks[i] = NewMemDisk(size)
+		}
+		return disks
+	}
+	tests := []struct {
+		name   string
+		new    func() (Array, error)
+		failed int
+	}{
+		{"RAID0", func() (Array, error) { return New(Level0, sized(3), 16) }, -1},
+		{"RAID1", func() (Array, error) { return New(Level1, sized(2), 16) }, 1},
+		{"RAID4", func() (Array, error) { return New(Level4, sized(4), 16) }, 1},
+		{"RAID5", func() (Array, error) { return New(Level5, sized(4), 16) }, 2},
+		{"RAID6", func() (Array, error) { return New(Level6, sized(5), 16) }, 0},
+		{"RAID10", func() (Array, error) { return New(Level10, sized(4), 16) }, 3},
+		{"dRAID", func() (Array, error) { return New(LevelDeclustered, sized(7), 16) }, 4},
+		{"SHR", func() (Array, error) { return NewHybrid(16, 4096, 2048, 4096, 1024) }, 1},
+	}
+	for _, tt := range tests {
+		for _, degraded := range []bool{false, true} {
+			if degraded && tt.failed < 0 {
+				continue
+			}
+			name := tt.name
+			if degraded {
+				name += " degraded"
+			}
+			t.Run(name, func(t *testing.T) {
+				arr, err := tt.new()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if degraded {
+					arr.ClearDisk(tt.failed)
+				}
+				rng := rand.New(rand.NewSource(1))
+				want := make([]byte, size)
+				for range 20 {
+					vecs := make([]IOVec, 1+rng.Intn(8))
+					for i := range vecs {
+						n := 1 + rng.Intn(100)
+						vecs[i] = IOVec{rng.Intn(size - n), make([]byte, n)}
+						rng.Read(vecs[i].Data)
+					}
+					if err := WriteV(arr, vecs); err != nil {
+						t.Fatalf("WriteV() error = %v", err)
+					}
+					for _, v := range vecs {
+						copy(want[v.Pos:], v.Data)
+					}
+				}
+
+				vecs := []IOVec{{0, make([]byte, size/2)}, {size / 2, make([]byte, size/2)}, {100, make([]byte, 50)}}
+				if err := ReadV(arr, vecs); err != nil {
+					t.Fatalf("ReadV() error = %v", err)
+				}
+				for _, v := range vecs {
+					if !bytes.Equal(v.Data, want[v.Pos:v.Pos+len(v.Data)]) {
+						t.Errorf("ReadV() of %d bytes at %d does not match what was written", len(v.Data), v.Pos)
+					}
+				}
+				if degraded {
+					return
+				}
+				if report, err := arr.Scrub(false); err != nil || report.Mismatches != 0 {
+					t.Errorf("Scrub() = %+v, %v", report, err)
+				}
+			})
+		}
+	}
+}
+
+// TestWriteVParityOnce checks that a batch of small writes to one stripe
+// reads and writes its parity once.
+func TestWriteVParityOnce(t *testing.T) {
+	counters := make([]*countingDisk, 4)
+	disks := make([]Disk, len(counters))
+	for i := range disks {
+		counters[i] = &countingDisk{Disk: NewMemDisk(0)}
+		disks[i] = counters[i]
+	}
+	arr, err := New(Level5, disks, 16)
+	if err != nil {
+		t.Fatal(err)
+	}
+	arr.Write(make([]byte, 48), 0)
+	for _, c := range counters {
+		c.reads.Store(0)
+		c.writes.Store(0)
+	}
+	// Stripe 0 keeps its parity on disk 0.
+	vecs := []IOVec{{2, []byte("ab")}, {35, []byte("cd")}, {9, []byte("ef")}, {11, []byte("g")}}
+	if err := WriteV(arr, vecs); err != nil {
+		t.Fatal(err)
+	}
+	if r, w := counters[0].reads.Load(), counters[0].writes.Load(); r != 1 || w != 1 {
+		t.Errorf("parity disk got %d reads and %d writes, want 1 and 1", r, w)
+	}
+	got, err := arr.Read(48, 0)
+	want := make([]byte, 48)
+	copy(want[2:], "ab")
+	copy(want[35:], "cd")
+	copy(want[9:], "efg")
+	if err != nil || !bytes.Equal(got, want) {
+		t.Errorf("Read() = %q, %v, want %q", got, err, want)
+	}
+}
+
+func TestCoalesce(t *testing.T) {
+	a, b := []byte("aaaa"), []byte("bb")
+	got := coalesce([]IOVec{{10, a}, {0, []byte("xxx")}, {3, b}, {8, []byte("cccc")}, {20, nil}})
+	want := []IOVec{{0, []byte("xxxbb")}, {8, []byte("ccccaa")}}
+	if len(got) != len(want) {
+		t.Fatalf("coalesce() = %q, want %q", got, want)
+	}
+	for i := range want {
+		if got[i].Pos != want[i].Pos || !bytes.Equal(got[i].Data, want[i].Data) {
+			t.Errorf("coalesce()[%d] = %d %q, want %d %q", i, got[i].Pos, got[i].Data, want[i].Pos, want[i].Data)
+		}
+	}
+	if single := coalesce([]IOVec{{5, a}}); &single[0].Data[0] != &a[0] {
+		t.Error("coalesce() copied a request that merges with no other")
+	}
+}
@@ -0,0 +1,304 @@
+// Package reliability estimates how likely an array is to lose data within a
+// span of time, by Monte Carlo simulation of disk failures, repairs and
+// unrecoverable read errors.
+//
+// What the simulation knows of a configuration it learns from the raid
+// package itself: Measure builds the array on memory disks, fails members to
+// find out which combinations of failures it survives, and repairs every
+// member to see how much the repair reads from and writes to the others, and
+// how fast the code runs.
+package reliability
+
+import (
+	"errors"
+	"fmt"
+	"graid-tech-assignment/pkg/task3/raid"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Config is an array configuration to evaluate.
+type Config struct {
+	Level      raid.Level
+	Disks      int
+	StripeSize int // 0 for DefaultStripeSize
+	// Declustered is the geometry of a dRAID array, nil for the one Create
+	// picks.
+	Declustered *raid.DeclusteredConfig
+}
+
+const DefaultStripeSize = 64 << 10
+
+// maxDisks is the most members a configuration may have, as sets of members
+// are kept in a uint64.
+const maxDisks = 64
+
+func (c Config) String() string {
+	if d := c.Declustered; d != nil {
+		return fmt.Sprintf("%v %d:%d:%d x%d", c.Level, d.Data, d.Parity, d.Spares, c.Disks)
+	}
+	return fmt.Sprintf("%v x%d", c.Level, c.Disks)
+}
+
+// ParseConfig parses level:disks, e.g. "6:8" or "raid10:4", and for dRAID
+// arrays of a chosen geometry draid:disks:data:parity:spares, e.g.
+// "draid:12:8:2:1".
+func ParseConfig(s string) (Config, error) {
+	fields := strings.Split(s, ":")
+	if len(fields) < 2 {
+		return Config{}, fmt.Errorf("config %q: want level:disks", s)
+	}
+	level, err := raid.ParseLevel(fields[0])
+	if err != nil {
+		return Config{}, err
+	}
+	var nums []int
+	for _, f := range fields[1:] {
+		n, err := strconv.Atoi(f)
+		if err != nil {
+			return Config{}, fmt.Errorf("config %q: %q is not a number", s, f)
+		}
+		nums = append(nums, n)
+	}
+	c := Config{Level: level, Disks: nums[0]}
+	switch {
+	case len(nums) == 4 && level == raid.LevelDeclustered:
+		c.Declustered = &raid.DeclusteredConfig{Data: nums[1], Parity: nums[2], Spares: nums[3]}
+	case len(nums) != 1:
+		return Config{}, fmt.Errorf("config %q: want level:disks, or draid:disks:data:parity:spares", s)
+	}
+	return c, nil
+}
+
+func (c Config) stripeSize() int {
+	if c.StripeSize > 0 {
+		return c.StripeSize
+	}
+	return DefaultStripeSize
+}
+
+// create builds the array on the disks, with superblocks as raidctl does.
+func (c Config) create(disks []raid.Disk, stripeSize int) (raid.Array, error) {
+	if c.Declustered != nil {
+		return raid.CreateDeclustered(disks, stripeSize, *c.Declustered)
+	}
+	return raid.Create(c.Level, disks, stripeSize)
+}
+
+// Repair is the work of restoring one member, per byte of member data.
+type Repair struct {
+	// Read and Written are the bytes read from and written to every member.
+	Read, Written []float64
+	// Rate is how fast the raid package did it on memory disks, in bytes of
+	// member data per second: the speed of the code itself, which holds a
+	// repair back when the disks do not.
+	Rate float64
+}
+
+// Duration is how long the repair takes for disks of diskSize bytes that
+// move rate bytes per second, throttled to speed.
+func (r *Repair) Duration(diskSize, rate int64, speed raid.SyncSpeed) time.Duration {
+	secs := float64(diskSize) / r.Rate
+	if speed.Max > 0 {
+		secs = max(secs, float64(diskSize)/float64(speed.Max))
+	}
+	if rate > 0 {
+		for i := range r.Read {
+			secs = max(secs, (r.Read[i]+r.Written[i])*float64(diskSize)/float64(rate))
+		}
+	}
+	return time.Duration(secs * float64(time.Second))
+}
+
+// Model is what Measure learned of a configuration.
+type Model struct {
+	Config
+	// DataMembers is the number of members' worth of usable capacity.
+	DataMembers int
+	// Repairs are how every member is restored once it failed, nil for
+	// members whose failure alone loses data. For dRAID arrays with spare
+	// space, it is the rebuild into the spare space.
+	Repairs []*Repair
+	// Spares is how many failed members the distributed spare space of a
+	// dRAID array takes in. CopyBacks are then how the chunks of every
+	// member are copied back onto its replacement, and Direct how it is
+	// rebuilt when the spare space is used up: the reads of the rebuild
+	// into the spare space, written to the member itself.
+	Spares    int
+	CopyBacks []*Repair
+	Direct    []*Repair
+
+	survived map[uint64]bool
+}
+
+const (
+	// probeSize is the member data of the array Measure repairs.
+	probeSize = 4 << 20
+	// survivalStripe and survivalRows size the arrays that find out which
+	// failures are survived. dRAID rows shuffle the members; with enough of
+	// them, every two members share a stripe somewhere, as they do on disks
+	// of real size.
+	survivalStripe = 4096
+	survivalRows   = 256
+)
+
+// Measure learns how an array of configuration c survives failures and
+// repairs members.
+func Measure(c Config) (*Model, error) {
+	if c.Disks < 1 || c.Disks > maxDisks {
+		return nil, fmt.Errorf("%v: need 1 to %d disks", c, maxDisks)
+	}
+	m := &Model{
+		Config:   c,
+		Repairs:  make([]*Repair, c.Disks),
+		survived: make(map[uint64]bool),
+	}
+	disks := make([]*countingDisk, c.Disks)
+	raw := make([]raid.Disk, c.Disks)
+	for i := range disks {
+		disks[i] = &countingDisk{Disk: raid.NewMemDisk(raid.DiskSize(probeSize))}
+		raw[i] = disks[i]
+	}
+	arr, err := c.create(raw, c.stripeSize())
+	if err != nil {
+		return nil, fmt.Errorf("%v: %w", c, err)
+	}
+	m.DataMembers = arr.Geometry().DataMembers
+	data := float64(arr.Geometry().MemberSize)
+	if data == 0 {
+		return nil, fmt.Errorf("%v: no member data", c)
+	}
+
+	sparer, _ := arr.(interface{ Spare(int) error })
+	if d, ok := arr.(interface{ Config() raid.DeclusteredConfig }); ok {
+		dc := d.Config()
+		width := dc.Data + dc.Parity
+		m.Spares = c.Disks - (c.Disks-dc.Spares)/width*width
+	}
+	if m.Spares > 0 {
+		m.CopyBacks = make([]*Repair, c.Disks)
+		m.Direct = make([]*Repair, c.Disks)
+	}
+
+	// measure runs fn against the array and sums up its I/O.
+	measure := func(fn func() error) (*Repair, error) {
+		for _, d := range disks {
+			d.reset()
+		}
+		start := time.Now()
+		if err := fn(); err != nil {
+			return nil, err
+		}
+		r := &Repair{
+			Read:    make([]float64, c.Disks),
+			Written: make([]float64, c.Disks),
+			Rate:    data / max(time.Since(start).Seconds(), 1e-9),
+		}
+		for i, d := range disks {
+			r.Read[i] = float64(d.read.Load()) / data
+			r.Written[i] = float64(d.written.Load()) / data
+		}
+		return r, nil
+	}
+
+	for f := range c.Disks {
+		ok, err := m.survives(1 << f)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			continue
+		}
+		if err := arr.Fail(f); err != nil {
+			return nil, err
+		}
+		disks[f] = &countingDisk{Disk: raid.NewMemDisk(raid.DiskSize(probeSize))}
+		if err := arr.Replace(f, disks[f]); err != nil {
+			return nil, err
+		}
+		if m.Spares > 0 {
+			if m.Repairs[f], err = measure(func() error { return sparer.Spare(f) }); err != nil {
+				return nil, fmt.Errorf("%v: spare of disk %d: %w", c, f, err)
+			}
+			direct := *m.Repairs[f]
+			direct.Written = make([]float64, c.Disks)
+			direct.Written[f] = 1
+			m.Direct[f] = &direct
+		}
+		r, err := measure(func() error { return arr.Rebuild(f) })
+		if err != nil {
+			return nil, fmt.Errorf("%v: rebuild of disk %d: %w", c, f, err)
+		}
+		if m.Spares > 0 {
+			m.CopyBacks[f] = r
+		} else {
+			m.Repairs[f] = r
+		}
+	}
+	return m, nil
+}
+
+// Survives reports whether the array keeps all its data with the given
+// members failed.
+func (m *Model) Survives(failed ...int) (bool, error) {
+	var set uint64
+	for _, f := range failed {
+		if f < 0 || f >= m.Disks {
+			return false, fmt.Errorf("%w: %d", raid.ErrInvalidDisk, f)
+		}
+		set |= 1 << f
+	}
+	return m.survives(set)
+}
+
+// survives finds out, once for every set of members, whether the array
+// reads back whole with them failed.
+func (m *Model) survives(failed uint64) (bool, error) {
+	if ok, seen := m.survived[failed]; seen {
+		return ok, nil
+	}
+	disks := make([]raid.Disk, m.Disks)
+	for i := range disks {
+		disks[i] = raid.NewMemDisk(raid.DiskSize(survivalStripe * survivalRows))
+	}
+	arr, err := m.create(disks, survivalStripe)
+	if err != nil {
+		return false, fmt.Errorf("%v: %w", m.Config, err)
+	}
+	for i := range m.Disks {
+		if failed&(1<<i) != 0 {
+			arr.Fail(i)
+		}
+	}
+	_, err = arr.Read(int(arr.Size()), 0)
+	if err != nil && !errors.Is(err, raid.ErrDataLost) {
+		return false, fmt.Errorf("%v: %w", m.Config, err)
+	}
+	m.survived[failed] = err == nil
+	return err == nil, nil
+}
+
+// countingDisk counts the bytes read from and written to a disk.
+type countingDisk struct {
+	raid.Disk
+	read, written atomic.Int64
+}
+
+func (d *countingDisk) ReadAt(p []byte, off int64) (int, error) {
+	n, err := d.Disk.ReadAt(p, off)
+	d.read.Add(int64(n))
+	return n, err
+}
+
+func (d *countingDisk) WriteAt(p []byte, off int64) (int, error) {
+	n, err := d.Disk.WriteAt(p, off)
+	d.written.Add(int64(n))
+	return n, err
+}
+
+func (d *countingDisk) reset() {
+	d.read.Store(0)
+	d.written.Store(0)
+}
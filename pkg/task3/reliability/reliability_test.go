@@ -0,0 +1,176 @@
+package reliability
+
+import (
+	"graid-tech-assignment/pkg/task3/raid"
+	"math"
+	"testing"
+	"time"
+)
+
+func measure(t *testing.T, c Config) *Model {
+	t.Helper()
+	m, err := Measure(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+// probe is a model of c that only finds out which failures it survives,
+// without measuring the repairs.
+func probe(c Config) *Model {
+	return &Model{Config: c, survived: make(map[uint64]bool)}
+}
+
+func TestParseConfig(t *testing.T) {
+	for _, tt := range []struct {
+		in   string
+		want string
+	}{
+		{"5:4", "RAID5 x4"},
+		{"raid10:8", "RAID10 x8"},
+		{"draid:12:8:2:1", "dRAID 8:2:1 x12"},
+	} {
+		c, err := ParseConfig(tt.in)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if c.String() != tt.want {
+			t.Errorf("ParseConfig(%q) = %v, want %s", tt.in, c, tt.want)
+		}
+	}
+	for _, in := range []string{"5", "7:4", "5:x", "5:4:1", "draid:12:8"} {
+		if _, err := ParseConfig(in); err == nil {
+			t.Errorf("ParseConfig(%q) succeeded", in)
+		}
+	}
+}
+
+func TestSurvives(t *testing.T) {
+	for _, tt := range []struct {
+		c      Config
+		failed []int
+		want   bool
+	}{
+		{Config{Level: raid.Level0, Disks: 3}, []int{1}, false},
+		{Config{Level: raid.Level5, Disks: 4}, []int{2}, true},
+		{Config{Level: raid.Level5, Disks: 4}, []int{0, 3}, false},
+		{Config{Level: raid.Level6, Disks: 5}, []int{0, 3}, true},
+		{Config{Level: raid.Level6, Disks: 5}, []int{0, 1, 3}, false},
+		{Config{Level: raid.Level10, Disks: 4}, []int{0, 2}, true},
+		{Config{Level: raid.Level10, Disks: 4}, []int{0, 1}, false},
+		{Config{Level: raid.LevelDeclustered, Disks: 7}, []int{2, 5}, false},
+		{Config{Level: raid.LevelDeclustered, Disks: 12, Declustered: &raid.DeclusteredConfig{Data: 8, Parity: 2, Spares: 1}}, []int{2, 5}, true},
+	} {
+		ok, err := probe(tt.c).Survives(tt.failed...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ok != tt.want {
+			t.Errorf("%v survives %v = %v, want %v", tt.c, tt.failed, ok, tt.want)
+		}
+	}
+}
+
+func TestMeasure(t *testing.T) {
+	m := measure(t, Config{Level: raid.Level5, Disks: 4})
+	r := m.Repairs[1]
+	// Superblock updates write a little to every member.
+	if m.DataMembers != 3 || m.Spares != 0 || r.Written[1] < 1 || r.Written[0] > 0.01 || r.Read[0] != 1 || r.Read[1] != 0 || r.Rate <= 0 {
+		t.Errorf("Measure(RAID5) = %d data members, %d spares, repair %+v", m.DataMembers, m.Spares, r)
+	}
+
+	// A dRAID array rebuilds a member into the spare space on all the
+	// others.
+	d := measure(t, Config{Level: raid.LevelDeclustered, Disks: 12, Declustered: &raid.DeclusteredConfig{Data: 4, Parity: 1, Spares: 2}})
+	r = d.Repairs[0]
+	if d.Spares != 2 || r.Written[0] > 0.01 || d.CopyBacks[0].Written[0] == 0 || d.Direct[0].Written[0] != 1 {
+		t.Fatalf("Measure(dRAID) = %d spares, spare %+v, copy back %+v", d.Spares, r, d.CopyBacks[0])
+	}
+	for i, w := range r.Written[1:] {
+		if w <= 0 || w >= 0.5 {
+			t.Errorf("spare rebuild wrote %.2f of a member to disk %d", w, i+1)
+		}
+	}
+	if got := m.Repairs[1].Duration(1<<30, 0, raid.SyncSpeed{Max: 1 << 20}); got < 1024*time.Second {
+		t.Errorf("rebuild at 1M/s of 1G takes %v", got)
+	}
+}
+
+var params = Params{
+	DiskSize:     4 << 40,
+	AFR:          0.05,
+	URE:          1e-14,
+	DiskRate:     100 << 20,
+	ReplaceDelay: 72 * time.Hour,
+	Horizon:      5 * Year,
+	Trials:       2000,
+	Seed:         1,
+}
+
+// TestSimulateRAID0 checks the simulation against the formula for an array
+// that loses data on its first failure.
+func TestSimulateRAID0(t *testing.T) {
+	p := params
+	p.Horizon = Year
+	res, err := Simulate(measure(t, Config{Level: raid.Level0, Disks: 4}), p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := 1 - math.Pow(1-p.AFR, 4)
+	if res.Low > want || res.High < want || res.FailureLosses != res.Losses {
+		t.Errorf("Simulate(RAID0) = %+v, want probability %.4f", res, want)
+	}
+	if res.Capacity != 4*p.DiskSize {
+		t.Errorf("Simulate(RAID0) capacity = %d", res.Capacity)
+	}
+}
+
+func TestSimulate(t *testing.T) {
+	run := func(c Config, p Params) Result {
+		res, err := Simulate(measure(t, c), p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Logf("%v: %+v", c, res)
+		return res
+	}
+	raid5 := run(Config{Level: raid.Level5, Disks: 4}, params)
+	raid6 := run(Config{Level: raid.Level6, Disks: 4}, params)
+	if raid5.URELosses == 0 || raid5.FailureLosses == 0 {
+		t.Errorf("RAID5 lost data %d times to failures, %d to read errors", raid5.FailureLosses, raid5.URELosses)
+	}
+	if raid6.High >= raid5.Low {
+		t.Errorf("RAID6 probability %.4f, not below RAID5 %.4f", raid6.Probability, raid5.Probability)
+	}
+	if want := params.AFR * 4 * 5; math.Abs(raid6.Failures-want) > 0.1*want {
+		t.Errorf("RAID6 had %.2f failures per trial, want about %.2f", raid6.Failures, want)
+	}
+
+	// Without read errors, a dRAID array loses data less often than RAID5
+	// on as many disks, as it rebuilds into its spare space right away
+	// instead of waiting for the replacement. Disks that fail often make
+	// the losses common enough to tell apart in few trials.
+	p := params
+	p.URE = 0
+	p.AFR = 0.2
+	raid5 = run(Config{Level: raid.Level5, Disks: 6}, p)
+	draid := run(Config{Level: raid.LevelDeclustered, Disks: 6, Declustered: &raid.DeclusteredConfig{Data: 4, Parity: 1, Spares: 1}}, p)
+	if draid.High >= raid5.Low || draid.URELosses != 0 {
+		t.Errorf("dRAID probability %.4f, not below RAID5 %.4f", draid.Probability, raid5.Probability)
+	}
+}
+
+func TestSimulateParams(t *testing.T) {
+	m := measure(t, Config{Level: raid.Level1, Disks: 2})
+	for _, p := range []Params{
+		{AFR: 0.01, Horizon: Year, Trials: 1},
+		{DiskSize: 1, AFR: 1, Horizon: Year, Trials: 1},
+		{DiskSize: 1, AFR: 0.01, Trials: 1},
+		{DiskSize: 1, AFR: 0.01, Horizon: Year},
+	} {
+		if _, err := Simulate(m, p); err == nil {
+			t.Errorf("Simulate(%+v) succeeded", p)
+		}
+	}
+}
@@ -0,0 +1,323 @@
+package reliability
+
+import (
+	"errors"
+	"fmt"
+	"graid-tech-assignment/pkg/task3/raid"
+	"math"
+	"math/bits"
+	"math/rand"
+	"slices"
+	"time"
+)
+
+// Year is the year failure rates are given per.
+const Year = time.Duration(365.25 * 24 * float64(time.Hour))
+
+// Params describe the disks and how they are looked after.
+type Params struct {
+	// DiskSize is the member data of every disk, in bytes.
+	DiskSize int64
+	// AFR is the annualized failure rate of a disk, e.g. 0.02 for 2%.
+	// Failures are independent and their rate is constant.
+	AFR float64
+	// URE is the rate of unrecoverable read errors per bit read, e.g. 1e-15.
+	// An error loses data when a repair reads it off a member whose data
+	// has no redundancy left.
+	URE float64
+	// DiskRate is the throughput of one disk in bytes per second. Repairs
+	// take as long as their busiest member needs for its share of the I/O,
+	// or as the code needs, whichever is longer. 0 leaves only the code.
+	DiskRate int64
+	// ReplaceDelay is how long a failed disk waits to be replaced before
+	// its rebuild can start. dRAID arrays rebuild into their spare space
+	// meanwhile.
+	ReplaceDelay time.Duration
+	// Speed throttles repairs. Only Max slows them, as nothing else keeps
+	// the disks busy in the simulation.
+	Speed raid.SyncSpeed
+	// Horizon is the span of time each trial covers.
+	Horizon time.Duration
+	Trials  int
+	Seed    int64
+}
+
+// Result sums up the trials of a simulation.
+type Result struct {
+	Trials int
+	// Losses counts the trials that lost data: FailureLosses to more failed
+	// members than the array survives, URELosses to unrecoverable read
+	// errors during a repair.
+	Losses, FailureLosses, URELosses int
+	// Probability is the share of trials that lost data within the horizon,
+	// and Low and High bound it with 95% confidence.
+	Probability, Low, High float64
+	// MeanTimeToLoss is when, on average, the trials that lost data lost it.
+	MeanTimeToLoss time.Duration
+	// Failures is the mean number of disk failures per trial.
+	Failures float64
+	// RepairTime is how long restoring a failed member takes on average,
+	// the window in which the array has less redundancy.
+	RepairTime time.Duration
+	// Capacity is the usable capacity, in bytes.
+	Capacity int64
+}
+
+// cause is why a trial lost data.
+type cause int
+
+const (
+	noLoss cause = iota
+	failureLoss
+	ureLoss
+)
+
+// Simulate runs the trials against the configuration m was measured from.
+//
+// Repairs run one at a time, in the order their members become ready, as a
+// raid.Scheduler runs them. A member is ready as soon as it fails if the
+// spare space of a dRAID array takes it in, and once it is replaced
+// otherwise. A spared member holds on to its spare space until it is
+// replaced and copied back.
+func Simulate(m *Model, p Params) (Result, error) {
+	switch {
+	case p.DiskSize <= 0:
+		return Result{}, errors.New("disk size must be positive")
+	case p.AFR <= 0 || p.AFR >= 1:
+		return Result{}, errors.New("AFR must be between 0 and 1")
+	case p.URE < 0:
+		return Result{}, errors.New("URE rate must not be negative")
+	case p.Horizon <= 0:
+		return Result{}, errors.New("horizon must be positive")
+	case p.Trials <= 0:
+		return Result{}, errors.New("trials must be positive")
+	}
+	s := &sim{
+		m:    m,
+		p:    p,
+		rng:  rand.New(rand.NewSource(p.Seed)),
+		rate: -math.Log1p(-p.AFR) / Year.Seconds(),
+	}
+	res := Result{Trials: p.Trials, Capacity: p.DiskSize * int64(m.DataMembers)}
+	s.repair = make([]time.Duration, m.Disks)
+	s.direct = make([]time.Duration, m.Disks)
+	s.copyBack = make([]time.Duration, m.Disks)
+	var repaired int
+	for f, r := range m.Repairs {
+		if r == nil {
+			continue
+		}
+		s.repair[f] = r.Duration(p.DiskSize, p.DiskRate, p.Speed)
+		res.RepairTime += s.repair[f]
+		repaired++
+		if m.Spares > 0 {
+			s.direct[f] = m.Direct[f].Duration(p.DiskSize, p.DiskRate, p.Speed)
+			s.copyBack[f] = m.CopyBacks[f].Duration(p.DiskSize, p.DiskRate, p.Speed)
+		}
+	}
+	if repaired > 0 {
+		res.RepairTime /= time.Duration(repaired)
+	}
+
+	var lostAt float64 // seconds, which do not overflow summed up
+	for range p.Trials {
+		at, c, err := s.trial()
+		if err != nil {
+			return res, err
+		}
+		switch c {
+		case failureLoss:
+			res.FailureLosses++
+		case ureLoss:
+			res.URELosses++
+		}
+		if c != noLoss {
+			res.Losses++
+			lostAt += at.Seconds()
+		}
+	}
+	res.Failures = float64(s.failures) / float64(p.Trials)
+	if res.Losses > 0 {
+		res.MeanTimeToLoss = time.Duration(lostAt / float64(res.Losses) * float64(time.Second))
+	}
+	res.Probability = float64(res.Losses) / float64(p.Trials)
+	res.Low, res.High = wilson(res.Losses, p.Trials)
+	return res, nil
+}
+
+// job is the repair of a failed member.
+type job struct {
+	disk  int
+	ready time.Duration
+	spare bool // into the spare space
+}
+
+// release is when a spared member gives its spare space back.
+type release struct {
+	disk int
+	at   time.Duration
+}
+
+type sim struct {
+	m    *Model
+	p    Params
+	rng  *rand.Rand
+	rate float64 // failures per second of one disk
+
+	// The durations of the repairs of every member: into the spare space
+	// or, without one, the rebuild; and for dRAID arrays with spare space,
+	// the rebuild without it and the copy back.
+	repair, direct, copyBack []time.Duration
+
+	failures int
+}
+
+// trial runs the array until it loses data or the horizon is reached.
+func (s *sim) trial() (time.Duration, cause, error) {
+	var (
+		now      time.Duration
+		failed   uint64 // members whose data is not restored
+		down     uint64 // failed members, and spared ones not yet back
+		queue    []job
+		running  *job
+		doneAt   time.Duration
+		releases []release
+		spares   = s.m.Spares
+	)
+	for {
+		const (
+			none = iota
+			failure
+			start
+			done
+			give
+		)
+		next, event := s.p.Horizon, none
+		if up := s.m.Disks - bits.OnesCount64(down); up > 0 {
+			wait := s.rng.ExpFloat64() / (s.rate * float64(up))
+			if wait < (next - now).Seconds() {
+				next, event = now+time.Duration(wait*float64(time.Second)), failure
+			}
+		}
+		if running != nil {
+			if doneAt < next {
+				next, event = doneAt, done
+			}
+		} else if len(queue) > 0 {
+			if at := max(queue[0].ready, now); at < next {
+				next, event = at, start
+			}
+		}
+		for _, r := range releases {
+			if r.at < next {
+				next, event = r.at, give
+			}
+		}
+		if event == none {
+			return 0, noLoss, nil
+		}
+		now = next
+
+		switch event {
+		case failure:
+			s.failures++
+			f := s.pickUp(down)
+			failed |= 1 << f
+			down |= 1 << f
+			ok, err := s.m.survives(failed)
+			if err != nil || !ok {
+				return now, failureLoss, err
+			}
+			j := job{disk: f, ready: now + s.p.ReplaceDelay}
+			if spares > 0 {
+				j.ready, j.spare = now, true
+				spares--
+			}
+			i := slices.IndexFunc(queue, func(q job) bool { return q.ready > j.ready })
+			if i < 0 {
+				i = len(queue)
+			}
+			queue = slices.Insert(queue, i, j)
+		case start:
+			j := queue[0]
+			queue = queue[1:]
+			lost, err := s.readError(j.disk, failed)
+			if err != nil || lost {
+				return now, ureLoss, err
+			}
+			running, doneAt = &j, now+s.duration(j)
+		case done:
+			f := running.disk
+			failed &^= 1 << f
+			if running.spare {
+				releases = append(releases, release{f, now + s.p.ReplaceDelay + s.copyBack[f]})
+			} else {
+				down &^= 1 << f
+			}
+			running = nil
+		case give:
+			i := slices.IndexFunc(releases, func(r release) bool { return r.at == now })
+			down &^= 1 << releases[i].disk
+			releases = slices.Delete(releases, i, i+1)
+			spares++
+		}
+	}
+}
+
+// pickUp picks one of the members that are up at random.
+func (s *sim) pickUp(down uint64) int {
+	n := s.rng.Intn(s.m.Disks - bits.OnesCount64(down))
+	for f := range s.m.Disks {
+		if down&(1<<f) != 0 {
+			continue
+		}
+		if n == 0 {
+			return f
+		}
+		n--
+	}
+	panic(fmt.Sprintf("reliability: no member up in %b", down))
+}
+
+func (s *sim) duration(j job) time.Duration {
+	if s.m.Spares > 0 && !j.spare {
+		return s.direct[j.disk]
+	}
+	return s.repair[j.disk]
+}
+
+// readError reports whether the repair of member f hits an unrecoverable
+// read error on a member whose data has no redundancy left, with the members
+// in failed not restored.
+func (s *sim) readError(f int, failed uint64) (bool, error) {
+	if s.p.URE == 0 {
+		return false, nil
+	}
+	r := s.m.Repairs[f]
+	for i, share := range r.Read {
+		if share == 0 || failed&(1<<i) != 0 {
+			continue
+		}
+		ok, err := s.m.survives(failed | 1<<i)
+		if err != nil {
+			return false, err
+		}
+		if ok {
+			continue
+		}
+		bitsRead := share * float64(s.p.DiskSize) * 8
+		if s.rng.Float64() < -math.Expm1(-bitsRead*s.p.URE) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// wilson is the 95% Wilson score interval of k successes in n trials.
+func wilson(k, n int) (float64, float64) {
+	const z = 1.96
+	p, fn := float64(k)/float64(n), float64(n)
+	center := (p + z*z/(2*fn)) / (1 + z*z/fn)
+	half := z / (1 + z*z/fn) * math.Sqrt(p*(1-p)/fn+z*z/(4*fn*fn))
+	return max(center-half, 0), min(center+half, 1)
+}
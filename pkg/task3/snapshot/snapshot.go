@@ -0,0 +1,297 @@
+// Package snapshot takes point-in-time copies of a RAID.
+//
+// Writes to the origin first save the chunks they overwrite into the
+// exception store of every snapshot that still shares them, so a snapshot
+// costs nothing until the origin changes, and rolling back only copies the
+// chunks that changed since.
+package snapshot
+
+import (
+	"errors"
+	"graid-tech-assignment/pkg/task3/raid"
+	"slices"
+	"sync"
+)
+
+var ErrReleased = errors.New("snapshot has been released")
+
+var errNegativeRange = errors.New("snapshot: negative position or length")
+
+// Origin wraps the RAID that snapshots are taken of. All writes to the RAID
+// have to go through the Origin, or the snapshots see them.
+type Origin struct {
+	mu        sync.Mutex
+	dev       raid.RAID
+	chunkSize int
+	snapshots []*Snapshot
+}
+
+// Snapshot is a RAID holding the contents of its origin at the time it was
+// taken. It can be written to without affecting the origin.
+type Snapshot struct {
+	origin *Origin
+	// store holds the chunks that differ from the origin, one per slot.
+	store      raid.Disk
+	exceptions map[int]exception
+	next       int64
+	released   bool
+}
+
+// exception is a chunk of a snapshot that lives in its store. Only the first
+// n bytes of the slot are valid; the rest of the chunk reads as zeros.
+type exception struct {
+	slot int64
+	n    int
+}
+
+// NewOrigin wraps dev. chunkSize is the unit in which the origin's contents
+// are copied to the snapshots.
+func NewOrigin(dev raid.RAID, chunkSize int) (*Origin, error) {
+	if chunkSize <= 0 {
+		return nil, errors.New("snapshot: chunk size must be positive")
+	}
+	return &Origin{dev: dev, chunkSize: chunkSize}, nil
+}
+
+// Snapshot takes a snapshot of the origin's current contents. Chunks are
+// copied into store as the origin or the snapshot is written.
+func (o *Origin) Snapshot(store raid.Disk) *Snapshot {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	s := &Snapshot{origin: o, store: store, exceptions: make(map[int]exception)}
+	o.snapshots = append(o.snapshots, s)
+	return s
+}
+
+// Rollback makes the origin's contents those of s again. Only the chunks
+// that changed since s was taken are copied. s stays usable and holds the
+// same contents afterwards, so the origin can be rolled back to it again.
+func (o *Origin) Rollback(s *Snapshot) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if s.released {
+		return ErrReleased
+	}
+	chunks := make([]int, 0, len(s.exceptions))
+	for c := range s.exceptions {
+		chunks = append(chunks, c)
+	}
+	slices.Sort(chunks)
+	for _, c := range chunks {
+		pos, n := o.chunkRange(c)
+		data, err := s.chunk(c)
+		if err != nil {
+			return err
+		}
+		if err := o.preserve(c, s); err != nil {
+			return err
+		}
+		if err := o.dev.Write(data[:n], pos); err != nil {
+			return err
+		}
+	}
+	clear(s.exceptions)
+	s.next = 0
+	return nil
+}
+
+// Release stops maintaining s. The origin no longer copies chunks for it and
+// it can no longer be used.
+func (o *Origin) Release(s *Snapshot) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.snapshots = slices.DeleteFunc(o.snapshots, func(other *Snapshot) bool {
+		return other == s
+	})
+	s.released = true
+}
+
+func (o *Origin) Read(length int, pos int) ([]byte, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.dev.Read(length, pos)
+}
+
+func (o *Origin) Write(data []byte, pos int) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	first, last := o.chunks(pos, len(data))
+	for c := first; c <= last; c++ {
+		if err := o.preserve(c, nil); err != nil {
+			return err
+		}
+	}
+	return o.dev.Write(data, pos)
+}
+
+func (o *Origin) Discard(pos, length int) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	first, last := o.chunks(pos, length)
+	for c := first; c <= last; c++ {
+		if err := o.preserve(c, nil); err != nil {
+			return err
+		}
+	}
+	return o.dev.Discard(pos, length)
+}
+
+// ClearDisk is passed on: the redundancy of the RAID hides it from the
+// snapshots.
+func (o *Origin) ClearDisk(diskIndex int) {
+	o.dev.ClearDisk(diskIndex)
+}
+
+// Flush flushes the RAID if it supports it.
+func (o *Origin) Flush() error {
+	if f, ok := o.dev.(interface{ Flush() error }); ok {
+		return f.Flush()
+	}
+	return nil
+}
+
+// chunks returns the first and the last chunk that [pos, pos+length)
+// touches. An empty range has first > last.
+func (o *Origin) chunks(pos, length int) (int, int) {
+	if length <= 0 {
+		return 0, -1
+	}
+	return pos / o.chunkSize, (pos + length - 1) / o.chunkSize
+}
+
+// chunkRange returns the position of chunk c and how much of it lies within
+// the RAID, when the RAID knows its size.
+func (o *Origin) chunkRange(c int) (int, int) {
+	pos, n := c*o.chunkSize, o.chunkSize
+	if sized, ok := o.dev.(interface{ Status() raid.Status }); ok {
+		n = int(max(min(int64(n), sized.Status().Size-int64(pos)), 0))
+	}
+	return pos, n
+}
+
+// preserve copies chunk c of the origin to every snapshot but except that
+// still shares it.
+func (o *Origin) preserve(c int, except *Snapshot) error {
+	var old []byte
+	for _, s := range o.snapshots {
+		if _, ok := s.exceptions[c]; ok || s == except {
+			continue
+		}
+		if old == nil {
+			pos, n := o.chunkRange(c)
+			var err error
+			if old, err = o.dev.Read(n, pos); err != nil {
+				return err
+			}
+		}
+		if err := s.save(c, old); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// save stores data as the contents of chunk c in a new slot.
+func (s *Snapshot) save(c int, data []byte) error {
+	slot := s.next
+	if _, err := s.store.WriteAt(data, slot); err != nil {
+		return err
+	}
+	s.next += int64(s.origin.chunkSize)
+	s.exceptions[c] = exception{slot, len(data)}
+	return nil
+}
+
+// chunk returns the contents of chunk c from the store.
+func (s *Snapshot) chunk(c int) ([]byte, error) {
+	e := s.exceptions[c]
+	data := make([]byte, s.origin.chunkSize)
+	if _, err := s.store.ReadAt(data[:e.n], e.slot); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// Read reads the origin and replaces the chunks that changed since the
+// snapshot was taken by their saved contents.
+func (s *Snapshot) Read(length int, pos int) ([]byte, error) {
+	if pos < 0 || length < 0 {
+		return nil, errNegativeRange
+	}
+	o := s.origin
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if s.released {
+		return nil, ErrReleased
+	}
+	result, err := o.dev.Read(length, pos)
+	if err != nil {
+		return nil, err
+	}
+	first, last := o.chunks(pos, length)
+	for c := first; c <= last; c++ {
+		if _, ok := s.exceptions[c]; !ok {
+			continue
+		}
+		data, err := s.chunk(c)
+		if err != nil {
+			return nil, err
+		}
+		start := c * o.chunkSize
+		lo, hi := max(pos, start), min(pos+length, start+o.chunkSize)
+		copy(result[lo-pos:hi-pos], data[lo-start:hi-start])
+	}
+	return result, nil
+}
+
+func (s *Snapshot) Write(data []byte, pos int) error {
+	if pos < 0 {
+		return errNegativeRange
+	}
+	o := s.origin
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if s.released {
+		return ErrReleased
+	}
+	first, last := o.chunks(pos, len(data))
+	for c := first; c <= last; c++ {
+		e, ok := s.exceptions[c]
+		if !ok {
+			start, n := o.chunkRange(c)
+			old, err := o.dev.Read(n, start)
+			if err != nil {
+				return err
+			}
+			if err := s.save(c, old); err != nil {
+				return err
+			}
+			e = s.exceptions[c]
+		}
+		start := c * o.chunkSize
+		lo, hi := max(pos, start), min(pos+len(data), start+o.chunkSize)
+		if _, err := s.store.WriteAt(data[lo-pos:hi-pos], e.slot+int64(lo-start)); err != nil {
+			return err
+		}
+		if e.n < hi-start {
+			// The gap between the old end and the new data must read as zeros.
+			if _, err := s.store.WriteAt(make([]byte, max(lo-start-e.n, 0)), e.slot+int64(e.n)); err != nil {
+				return err
+			}
+			e.n = hi - start
+			s.exceptions[c] = e
+		}
+	}
+	return nil
+}
+
+// Discard zeroes the range in the snapshot; the origin is not affected.
+func (s *Snapshot) Discard(pos, length int) error {
+	if pos < 0 || length < 0 {
+		return errNegativeRange
+	}
+	return s.Write(make([]byte, length), pos)
+}
+
+// ClearDisk does nothing: a snapshot has no members of its own.
+func (s *Snapshot) ClearDisk(diskIndex int) {}
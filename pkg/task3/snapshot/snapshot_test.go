@@ -0,0 +1,167 @@
+package snapshot
+
+import (
+	"bytes"
+	"errors"
+	"graid-tech-assignment/pkg/task3/raid"
+	"graid-tech-assignment/pkg/task3/raid/raidtest"
+	"math/rand"
+	"testing"
+)
+
+func newOrigin(t *testing.T, size int) (*Origin, []byte) {
+	t.Helper()
+	arr, err := raid.New(raid.Level5, []raid.Disk{raid.NewMemDisk(0), raid.NewMemDisk(0), raid.NewMemDisk(0)}, 16)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := make([]byte, size)
+	rand.New(rand.NewSource(1)).Read(data)
+	if err := arr.Write(data, 0); err != nil {
+		t.Fatal(err)
+	}
+	o, err := NewOrigin(arr, 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return o, data
+}
+
+func check(t *testing.T, name string, r raid.RAID, want []byte) {
+	t.Helper()
+	got, err := r.Read(len(want), 0)
+	if err != nil || !bytes.Equal(got, want) {
+		t.Errorf("%s: Read() = %v, contents match %v", name, err, bytes.Equal(got, want))
+	}
+}
+
+func TestSnapshot(t *testing.T) {
+	o, data := newOrigin(t, 1024)
+	s1 := o.Snapshot(raid.NewMemDisk(0))
+
+	o.Write(bytes.Repeat([]byte{1}, 100), 30)
+	origin := bytes.Clone(data)
+	copy(origin[30:], bytes.Repeat([]byte{1}, 100))
+	s2 := o.Snapshot(raid.NewMemDisk(0))
+	o.Discard(512, 256)
+	clear(origin[512:768])
+	o.Write([]byte("origin"), 100)
+	copy(origin[100:], "origin")
+
+	check(t, "origin", o, origin)
+	check(t, "first snapshot", s1, data)
+	want2 := bytes.Clone(data)
+	copy(want2[30:], bytes.Repeat([]byte{1}, 100))
+	check(t, "second snapshot", s2, want2)
+
+	// Writing a snapshot affects neither the origin nor other snapshots.
+	s2.Write([]byte("snapshot"), 60)
+	copy(want2[60:], "snapshot")
+	check(t, "written snapshot", s2, want2)
+	check(t, "origin after snapshot write", o, origin)
+	check(t, "first snapshot after snapshot write", s1, data)
+
+	if err := o.Rollback(s2); err != nil {
+		t.Fatalf("Rollback() error = %v", err)
+	}
+	check(t, "origin after rollback", o, want2)
+	check(t, "rolled back snapshot", s2, want2)
+	check(t, "first snapshot after rollback", s1, data)
+
+	// The snapshot keeps its contents, so the origin can be rolled back again.
+	o.Write(bytes.Repeat([]byte{2}, 1024), 0)
+	if err := o.Rollback(s2); err != nil {
+		t.Fatalf("second Rollback() error = %v", err)
+	}
+	check(t, "origin after second rollback", o, want2)
+
+	o.Release(s1)
+	if _, err := s1.Read(1, 0); !errors.Is(err, ErrReleased) {
+		t.Errorf("Read() of released snapshot error = %v, want %v", err, ErrReleased)
+	}
+	if err := o.Rollback(s1); !errors.Is(err, ErrReleased) {
+		t.Errorf("Rollback() to released snapshot error = %v, want %v", err, ErrReleased)
+	}
+}
+
+// TestRandomWrites interleaves writes to the origin and a snapshot and rolls
+// back repeatedly, comparing everything with flat buffers.
+func TestRandomWrites(t *testing.T) {
+	o, data := newOrigin(t, 2048)
+	rng := rand.New(rand.NewSource(2))
+	s := o.Snapshot(raid.NewMemDisk(0))
+	origin, snap := bytes.Clone(data), bytes.Clone(data)
+	for i := 0; i < 300; i++ {
+		pos := rng.Intn(len(data))
+		buf := make([]byte, rng.Intn(min(len(data)-pos, 200))+1)
+		rng.Read(buf)
+		switch rng.Intn(10) {
+		case 0:
+			if err := o.Rollback(s); err != nil {
+				t.Fatal(err)
+			}
+			copy(origin, snap)
+		case 1, 2, 3:
+			if err := s.Write(buf, pos); err != nil {
+				t.Fatal(err)
+			}
+			copy(snap[pos:], buf)
+		default:
+			if err := o.Write(buf, pos); err != nil {
+				t.Fatal(err)
+			}
+			copy(origin[pos:], buf)
+		}
+	}
+	check(t, "origin", o, origin)
+	check(t, "snapshot", s, snap)
+}
+
+// TestOriginConformance runs the suite against an origin with a snapshot
+// taken of it, so that every write goes through the copy-on-write path.
+func TestOriginConformance(t *testing.T) {
+	raidtest.Run(t, raidtest.Config{
+		New: func() (raid.RAID, error) {
+			disks := make([]raid.Disk, 4)
+			for i := range disks {
+				disks[i] = raid.NewMemDisk(4096)
+			}
+			arr, err := raid.New(raid.Level5, disks, 64)
+			if err != nil {
+				return nil, err
+			}
+			o, err := NewOrigin(arr, 256)
+			if err != nil {
+				return nil, err
+			}
+			o.Snapshot(raid.NewMemDisk(0))
+			return o, nil
+		},
+		Size:      3 * 4096,
+		NumDisks:  4,
+		Tolerance: 1,
+	})
+}
+
+// TestSnapshotConformance runs the suite against a snapshot, whose writes
+// all go to its exception store.
+func TestSnapshotConformance(t *testing.T) {
+	raidtest.Run(t, raidtest.Config{
+		New: func() (raid.RAID, error) {
+			disks := make([]raid.Disk, 4)
+			for i := range disks {
+				disks[i] = raid.NewMemDisk(4096)
+			}
+			arr, err := raid.New(raid.Level5, disks, 64)
+			if err != nil {
+				return nil, err
+			}
+			o, err := NewOrigin(arr, 256)
+			if err != nil {
+				return nil, err
+			}
+			return o.Snapshot(raid.NewMemDisk(0)), nil
+		},
+		Size: 3 * 4096,
+	})
+}
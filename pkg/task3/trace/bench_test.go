@@ -0,0 +1,117 @@
+package trace
+
+import (
+	"flag"
+	"graid-tech-assignment/pkg/task3/raid"
+	"math/rand"
+	"os"
+	"testing"
+)
+
+var traceFile = flag.String("trace", "", "trace for BenchmarkReplay to replay instead of the made-up workloads")
+
+// workloads are made-up traces with the shape of common workloads.
+var workloads = []struct {
+	name string
+	gen  func(rng *rand.Rand, span int) Record
+}{
+	// A database: small random reads and writes, mostly reads.
+	{"oltp", func(rng *rand.Rand, span int) Record {
+		op := OpRead
+		if rng.Intn(10) < 3 {
+			op = OpWrite
+		}
+		return Record{Op: op, Pos: rng.Intn(span/4096) * 4096, Length: 4096}
+	}},
+	// A file server: larger reads and writes of whole files, and deletes.
+	{"fileserver", func(rng *rand.Rand, span int) Record {
+		n := (1 + rng.Intn(32)) * 4096
+		rec := Record{Op: OpRead, Pos: rng.Intn((span-n)/4096) * 4096, Length: n}
+		switch rng.Intn(10) {
+		case 0:
+			rec.Op = OpDiscard
+		case 1, 2, 3:
+			rec.Op = OpWrite
+		}
+		return rec
+	}},
+	// Backups: long sequential writes.
+	{"backup", func() func(rng *rand.Rand, span int) Record {
+		pos := 0
+		return func(rng *rand.Rand, span int) Record {
+			rec := Record{Op: OpWrite, Pos: pos, Length: 256 << 10}
+			pos = (pos + rec.Length) % span
+			return rec
+		}
+	}()},
+}
+
+const benchSpan = 16 << 20
+
+var benchLevels = []struct {
+	level    raid.Level
+	numDisks int
+}{
+	{raid.Level10, 4},
+	{raid.Level5, 4},
+	{raid.Level6, 6},
+	{raid.LevelDeclustered, 7},
+}
+
+// BenchmarkReplay replays workloads against every level. With -trace, it
+// replays a recorded trace instead, such as one taken by raidctl nbd -trace.
+func BenchmarkReplay(b *testing.B) {
+	type named struct {
+		name string
+		tr   *Trace
+	}
+	var traces []named
+	if *traceFile != "" {
+		f, err := os.Open(*traceFile)
+		if err != nil {
+			b.Fatal(err)
+		}
+		tr, err := Load(f)
+		f.Close()
+		if err != nil {
+			b.Fatal(err)
+		}
+		traces = append(traces, named{"trace", tr})
+	} else {
+		for _, w := range workloads {
+			rng := rand.New(rand.NewSource(1))
+			tr := &Trace{}
+			for range 1000 {
+				tr.Records = append(tr.Records, w.gen(rng, benchSpan))
+			}
+			traces = append(traces, named{w.name, tr})
+		}
+	}
+	for _, t := range traces {
+		tr := t.tr
+		var bytes int64
+		for _, rec := range tr.Records {
+			bytes += int64(rec.Length)
+		}
+		for _, l := range benchLevels {
+			b.Run(t.name+"/"+l.level.String(), func(b *testing.B) {
+				disks := make([]raid.Disk, l.numDisks)
+				for i := range disks {
+					disks[i] = raid.NewMemDisk(0)
+				}
+				arr, err := raid.New(l.level, disks, 64<<10)
+				if err != nil {
+					b.Fatal(err)
+				}
+				arr.Write(make([]byte, max(tr.Extent(), benchSpan)), 0)
+				b.SetBytes(bytes)
+				b.ResetTimer()
+				for range b.N {
+					if _, err := Replay(tr, arr, ReplayOptions{}); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		}
+	}
+}
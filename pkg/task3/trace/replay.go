@@ -0,0 +1,128 @@
+package trace
+
+import (
+	"encoding/binary"
+	"graid-tech-assignment/pkg/task3/raid"
+	"time"
+)
+
+// ReplayOptions are how a trace is replayed.
+type ReplayOptions struct {
+	// Timed keeps the pace of the recording: no call is made earlier,
+	// from the start of the replay, than it was recorded. Otherwise every
+	// call is made as soon as the one before returns.
+	Timed bool
+	// Digest computes the digest of the final contents.
+	Digest bool
+}
+
+// Stats sums up the calls of one kind.
+type Stats struct {
+	Calls int
+	Bytes int64
+	// Recorded and Replayed are the time the calls took when they were
+	// recorded and when they were replayed.
+	Recorded time.Duration
+	Replayed time.Duration
+}
+
+// Result is the outcome of a replay.
+type Result struct {
+	Stats map[Op]*Stats
+	// Elapsed is how long the replay took, and Recorded how long the
+	// recorded calls did, from the first to the end of the last.
+	Elapsed  time.Duration
+	Recorded time.Duration
+	// ReadMismatches counts the reads that returned other data than they
+	// did when recorded. Reads are only compared when the trace holds the
+	// data of every write and the hashes of the reads.
+	ReadMismatches int
+	// ErrorMismatches counts the calls that failed when recorded but not
+	// when replayed, or the other way around.
+	ErrorMismatches int
+	// Contents is the digest of the contents up to the extent of the trace
+	// after the replay. RecordedContents is the digest the recording ended
+	// with, if the trace holds the data of every write; otherwise writes
+	// are replayed with made-up data, and only replays can be compared.
+	Contents         string
+	RecordedContents string
+}
+
+// Replay makes the calls of t against dev, one after the other. dev should
+// start out as the recorded RAID did, usually empty, for the reads and the
+// contents to match.
+func Replay(t *Trace, dev raid.RAID, opts ReplayOptions) (Result, error) {
+	res := Result{Stats: make(map[Op]*Stats)}
+	compare := t.Data && t.Hash
+	start := time.Now()
+	for i, rec := range t.Records {
+		if opts.Timed {
+			if wait := rec.At - time.Since(start); wait > 0 {
+				time.Sleep(wait)
+			}
+		}
+		callStart := time.Now()
+		var err error
+		var hash string
+		switch rec.Op {
+		case OpRead:
+			var data []byte
+			data, err = dev.Read(rec.Length, rec.Pos)
+			if err == nil && compare && rec.Hash != "" {
+				hash = digest(data)
+			}
+		case OpWrite:
+			data := rec.Data
+			if !t.Data {
+				data = madeUp(i, rec.Length)
+			}
+			err = dev.Write(data, rec.Pos)
+		case OpDiscard:
+			err = dev.Discard(rec.Pos, rec.Length)
+		case OpClearDisk:
+			dev.ClearDisk(rec.Disk)
+		}
+		took := time.Since(callStart)
+
+		s := res.Stats[rec.Op]
+		if s == nil {
+			s = &Stats{}
+			res.Stats[rec.Op] = s
+		}
+		s.Calls++
+		s.Bytes += int64(rec.Length)
+		s.Recorded += rec.Took
+		s.Replayed += took
+		res.Recorded = max(res.Recorded, rec.At+rec.Took)
+		if (err != nil) != (rec.Err != "") {
+			res.ErrorMismatches++
+		}
+		if hash != "" && hash != rec.Hash {
+			res.ReadMismatches++
+		}
+	}
+	res.Elapsed = time.Since(start)
+
+	if compare && t.End != nil {
+		res.RecordedContents = t.End.Hash
+	}
+	if opts.Digest {
+		var err error
+		if res.Contents, err = Digest(dev, t.Extent()); err != nil {
+			return res, err
+		}
+	}
+	return res, nil
+}
+
+// madeUp returns the data replayed for write i of a trace that does not
+// hold its data: the index of the write, repeated. It is the same for every
+// replay, and cheap enough not to skew the timing.
+func madeUp(i, n int) []byte {
+	data := make([]byte, max(n, 8))
+	binary.LittleEndian.PutUint64(data, uint64(i)+1)
+	for filled := 8; filled < n; filled *= 2 {
+		copy(data[filled:], data[:filled])
+	}
+	return data[:n]
+}
@@ -0,0 +1,302 @@
+// Package trace records the calls made to a RAID and replays them against
+// another one, so that a workload can be reproduced on any level or
+// configuration and the outcome compared.
+//
+// A trace is a stream of JSON lines: a header with the options it was
+// recorded with, one record per call, and, once the recorder is closed, a
+// record with a digest of the final contents.
+package trace
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"graid-tech-assignment/pkg/task3/raid"
+	"io"
+	"sync"
+	"time"
+)
+
+// Op is the kind of a call.
+type Op int
+
+const (
+	OpRead Op = iota
+	OpWrite
+	OpDiscard
+	OpClearDisk
+	// OpEnd closes a trace. Length is the extent of the calls, and Hash the
+	// digest of the contents up to it.
+	OpEnd
+)
+
+var opNames = []string{"read", "write", "discard", "clear-disk", "end"}
+
+func (o Op) String() string {
+	if o < 0 || int(o) >= len(opNames) {
+		return "unknown"
+	}
+	return opNames[o]
+}
+
+func (o Op) MarshalText() ([]byte, error) {
+	return []byte(o.String()), nil
+}
+
+func (o *Op) UnmarshalText(text []byte) error {
+	for i, name := range opNames {
+		if name == string(text) {
+			*o = Op(i)
+			return nil
+		}
+	}
+	return fmt.Errorf("trace: unknown op %q", text)
+}
+
+// Options are what a trace records besides the calls themselves.
+type Options struct {
+	// Hash records a digest of the data of every read and write, and of the
+	// final contents.
+	Hash bool `json:"hash,omitempty"`
+	// Data records the data of every write, which lets a replay write the
+	// same contents. Without it, writes are replayed with made-up data.
+	Data bool `json:"data,omitempty"`
+}
+
+// Record is one call.
+type Record struct {
+	Op     Op  `json:"op"`
+	Pos    int `json:"pos,omitempty"`
+	Length int `json:"length,omitempty"`
+	Disk   int `json:"disk,omitempty"`
+	// At is when the call was made, from the start of the trace, and Took
+	// how long it took.
+	At   time.Duration `json:"at"`
+	Took time.Duration `json:"took,omitempty"`
+	Hash string        `json:"hash,omitempty"`
+	Data []byte        `json:"data,omitempty"`
+	Err  string        `json:"err,omitempty"`
+}
+
+type header struct {
+	Version int       `json:"version"`
+	Start   time.Time `json:"start"`
+	Options
+}
+
+const version = 1
+
+// Trace is a trace read back.
+type Trace struct {
+	Options
+	Start   time.Time
+	Records []Record
+	// End is the closing record, nil if the recorder was not closed.
+	End *Record
+}
+
+// Recorder is a RAID that passes every call on to another one and records
+// it. Calls may be made concurrently; they are recorded in the order they
+// complete.
+type Recorder struct {
+	dev   raid.RAID
+	opts  Options
+	start time.Time
+
+	mu     sync.Mutex
+	w      *bufio.Writer
+	enc    *json.Encoder
+	extent int
+	err    error // the first error writing the trace
+}
+
+// NewRecorder records the calls made to dev to w.
+func NewRecorder(dev raid.RAID, w io.Writer, opts Options) (*Recorder, error) {
+	r := &Recorder{dev: dev, opts: opts, start: time.Now(), w: bufio.NewWriter(w)}
+	r.enc = json.NewEncoder(r.w)
+	if err := r.enc.Encode(header{version, r.start, opts}); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *Recorder) Read(length int, pos int) ([]byte, error) {
+	start := time.Now()
+	data, err := r.dev.Read(length, pos)
+	rec := Record{Op: OpRead, Pos: pos, Length: length}
+	if r.opts.Hash && err == nil {
+		rec.Hash = digest(data)
+	}
+	r.add(rec, start, err)
+	return data, err
+}
+
+func (r *Recorder) Write(data []byte, pos int) error {
+	start := time.Now()
+	err := r.dev.Write(data, pos)
+	rec := Record{Op: OpWrite, Pos: pos, Length: len(data)}
+	if r.opts.Hash {
+		rec.Hash = digest(data)
+	}
+	if r.opts.Data {
+		rec.Data = data
+	}
+	r.add(rec, start, err)
+	return err
+}
+
+func (r *Recorder) Discard(pos, length int) error {
+	start := time.Now()
+	err := r.dev.Discard(pos, length)
+	r.add(Record{Op: OpDiscard, Pos: pos, Length: length}, start, err)
+	return err
+}
+
+func (r *Recorder) ClearDisk(diskIndex int) {
+	start := time.Now()
+	r.dev.ClearDisk(diskIndex)
+	r.add(Record{Op: OpClearDisk, Disk: diskIndex}, start, nil)
+}
+
+// Flush flushes dev, if it can be, and what has been recorded so far.
+func (r *Recorder) Flush() error {
+	if f, ok := r.dev.(interface{ Flush() error }); ok {
+		if err := f.Flush(); err != nil {
+			return err
+		}
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.err == nil {
+		r.err = r.w.Flush()
+	}
+	return r.err
+}
+
+// Close ends the trace with a digest of the contents of dev up to the
+// extent of the calls, if hashes are recorded, and flushes it. It does not
+// close dev. If the digest cannot be computed, the calls recorded so far are
+// still flushed, and the trace is left without an end.
+func (r *Recorder) Close() error {
+	r.mu.Lock()
+	end := Record{Op: OpEnd, Length: r.extent, At: time.Since(r.start)}
+	r.mu.Unlock()
+	if size, ok := r.dev.(interface{ Size() int64 }); ok {
+		end.Length = int(min(int64(end.Length), size.Size()))
+	}
+	var digestErr error
+	if r.opts.Hash {
+		end.Hash, digestErr = Digest(r.dev, end.Length)
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.err == nil && digestErr == nil {
+		r.err = r.enc.Encode(end)
+	}
+	if r.err == nil {
+		r.err = r.w.Flush()
+	}
+	if r.err != nil {
+		return r.err
+	}
+	return digestErr
+}
+
+func (r *Recorder) add(rec Record, start time.Time, err error) {
+	rec.At, rec.Took = start.Sub(r.start), time.Since(start)
+	if err != nil {
+		rec.Err = err.Error()
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	// Failed calls may lie past the end of dev, where Close could not
+	// digest it.
+	if rec.Op != OpClearDisk && err == nil {
+		r.extent = max(r.extent, rec.Pos+rec.Length)
+	}
+	if r.err == nil {
+		r.err = r.enc.Encode(rec)
+	}
+}
+
+// Load reads a trace.
+func Load(rd io.Reader) (*Trace, error) {
+	dec := json.NewDecoder(bufio.NewReader(rd))
+	var h header
+	if err := dec.Decode(&h); err != nil {
+		return nil, fmt.Errorf("trace: reading header: %w", err)
+	}
+	if h.Version != version {
+		return nil, fmt.Errorf("trace: unsupported version %d", h.Version)
+	}
+	t := &Trace{Options: h.Options, Start: h.Start}
+	for {
+		var rec Record
+		err := dec.Decode(&rec)
+		if errors.Is(err, io.EOF) {
+			return t, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("trace: record %d: %w", len(t.Records), err)
+		}
+		if err := rec.check(); err != nil {
+			return nil, fmt.Errorf("trace: record %d: %w", len(t.Records), err)
+		}
+		if rec.Op == OpEnd {
+			t.End = &rec
+			return t, nil
+		}
+		t.Records = append(t.Records, rec)
+	}
+}
+
+// check rejects records that cannot be replayed.
+func (rec *Record) check() error {
+	switch {
+	case rec.Pos < 0 || rec.Length < 0:
+		return fmt.Errorf("negative range [%d, +%d)", rec.Pos, rec.Length)
+	case rec.Disk < 0:
+		return fmt.Errorf("negative disk %d", rec.Disk)
+	case rec.Data != nil && len(rec.Data) != rec.Length:
+		return fmt.Errorf("%d bytes of data for a write of %d", len(rec.Data), rec.Length)
+	}
+	return nil
+}
+
+// Extent is the end of the furthest range the calls touch.
+func (t *Trace) Extent() int {
+	if t.End != nil {
+		return t.End.Length
+	}
+	extent := 0
+	for _, rec := range t.Records {
+		if rec.Op != OpClearDisk {
+			extent = max(extent, rec.Pos+rec.Length)
+		}
+	}
+	return extent
+}
+
+func digest(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// digestChunk is how much Digest reads at a time.
+const digestChunk = 1 << 20
+
+// Digest returns the SHA-256 of the first n bytes of dev, as hex.
+func Digest(dev raid.RAID, n int) (string, error) {
+	h := sha256.New()
+	for pos := 0; pos < n; pos += digestChunk {
+		data, err := dev.Read(min(digestChunk, n-pos), pos)
+		if err != nil {
+			return "", err
+		}
+		h.Write(data)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
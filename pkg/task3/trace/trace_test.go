@@ -0,0 +1,213 @@
+package trace
+
+import (
+	"bytes"
+	"errors"
+	"graid-tech-assignment/pkg/task3/raid"
+	"math/rand"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newArray(t testing.TB, level raid.Level, n int) raid.Array {
+	t.Helper()
+	disks := make([]raid.Disk, n)
+	for i := range disks {
+		disks[i] = raid.NewMemDisk(0)
+	}
+	arr, err := raid.New(level, disks, 512)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return arr
+}
+
+// record runs a random workload against a RAID5 array through a recorder and
+// returns the trace.
+func record(t *testing.T, opts Options) *Trace {
+	t.Helper()
+	var buf bytes.Buffer
+	rec, err := NewRecorder(newArray(t, raid.Level5, 3), &buf, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rng := rand.New(rand.NewSource(1))
+	for i := range 200 {
+		pos, n := rng.Intn(60000), 1+rng.Intn(4000)
+		switch {
+		case i == 100:
+			rec.ClearDisk(1)
+		case i%10 == 0:
+			rec.Discard(pos, n)
+		case i%3 == 0:
+			data := make([]byte, n)
+			rng.Read(data)
+			rec.Write(data, pos)
+		default:
+			rec.Read(n, pos)
+		}
+	}
+	if err := rec.Close(); err != nil {
+		t.Fatal(err)
+	}
+	tr, err := Load(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tr
+}
+
+// TestRecordReplay replays a recording against other levels and checks that
+// they read and end up with the same data.
+func TestRecordReplay(t *testing.T) {
+	tr := record(t, Options{Hash: true, Data: true})
+	if len(tr.Records) != 200 || tr.End == nil || tr.End.Hash == "" {
+		t.Fatalf("Load() = %d records, end %+v", len(tr.Records), tr.End)
+	}
+	for _, tt := range []struct {
+		level raid.Level
+		n     int
+	}{{raid.Level5, 3}, {raid.Level6, 5}, {raid.Level10, 4}, {raid.Level4, 4}} {
+		t.Run(tt.level.String(), func(t *testing.T) {
+			res, err := Replay(tr, newArray(t, tt.level, tt.n), ReplayOptions{Digest: true})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if res.ReadMismatches != 0 || res.ErrorMismatches != 0 {
+				t.Errorf("Replay() = %d read and %d error mismatches", res.ReadMismatches, res.ErrorMismatches)
+			}
+			if res.Contents != res.RecordedContents {
+				t.Errorf("Replay() contents %s, recorded %s", res.Contents, res.RecordedContents)
+			}
+			if s := res.Stats[OpRead]; s == nil || s.Calls != 120 || s.Replayed <= 0 {
+				t.Errorf("Replay() read stats = %+v", s)
+			}
+			if s := res.Stats[OpClearDisk]; s == nil || s.Calls != 1 {
+				t.Errorf("Replay() clear-disk stats = %+v", s)
+			}
+		})
+	}
+}
+
+func TestReplayMismatch(t *testing.T) {
+	tr := record(t, Options{Hash: true, Data: true})
+	arr := newArray(t, raid.Level5, 3)
+	junk := make([]byte, 64<<10)
+	rand.New(rand.NewSource(2)).Read(junk)
+	arr.Write(junk, 0)
+	res, err := Replay(tr, arr, ReplayOptions{Digest: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.ReadMismatches == 0 || res.Contents == res.RecordedContents {
+		t.Errorf("Replay() onto other contents = %d read mismatches, contents match %v",
+			res.ReadMismatches, res.Contents == res.RecordedContents)
+	}
+}
+
+// TestReplayMadeUp checks that replays of a trace without data write the
+// same made-up data every time.
+func TestReplayMadeUp(t *testing.T) {
+	tr := record(t, Options{Hash: true})
+	a, err := Replay(tr, newArray(t, raid.Level5, 4), ReplayOptions{Digest: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := Replay(tr, newArray(t, raid.Level6, 4), ReplayOptions{Digest: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.Contents != b.Contents || a.RecordedContents != "" || a.ReadMismatches != 0 {
+		t.Errorf("replays of a trace without data = %+v and %+v", a, b)
+	}
+}
+
+func TestReplayTimed(t *testing.T) {
+	tr := &Trace{Records: []Record{
+		{Op: OpWrite, Length: 10},
+		{Op: OpRead, Length: 10, At: 50 * time.Millisecond},
+		{Op: OpRead, Length: 10, At: 100 * time.Millisecond, Took: time.Millisecond},
+	}}
+	res, err := Replay(tr, newArray(t, raid.Level1, 2), ReplayOptions{Timed: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Elapsed < 100*time.Millisecond || res.Recorded != 101*time.Millisecond {
+		t.Errorf("timed Replay() took %v of %v recorded", res.Elapsed, res.Recorded)
+	}
+}
+
+func TestLoad(t *testing.T) {
+	if _, err := Load(strings.NewReader(`{"version":2}`)); err == nil {
+		t.Error("Load() of a newer version succeeded")
+	}
+	tr, err := Load(strings.NewReader(`{"version":1,"hash":true}
+{"op":"write","pos":10,"length":5,"at":0}
+{"op":"clear-disk","disk":2,"at":1}
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tr.Records) != 2 || tr.Records[1].Op != OpClearDisk || tr.End != nil || tr.Extent() != 15 || !tr.Hash {
+		t.Errorf("Load() = %+v", tr)
+	}
+	if _, err := Load(strings.NewReader(`{"version":1}
+{"op":"seek"}`)); err == nil {
+		t.Error("Load() of an unknown op succeeded")
+	}
+}
+
+// sized is a RAID of a fixed size, which fails calls past its end.
+type sized struct {
+	raid.RAID
+	size int
+}
+
+func (s sized) Size() int64 { return int64(s.size) }
+
+func (s sized) Read(length, pos int) ([]byte, error) {
+	if pos+length > s.size {
+		return nil, errors.New("read past the end")
+	}
+	return s.RAID.Read(length, pos)
+}
+
+// TestCloseAfterFailedRead checks that a read past the end of the device
+// neither widens the extent nor loses the trace when Close digests it.
+func TestCloseAfterFailedRead(t *testing.T) {
+	var buf bytes.Buffer
+	rec, err := NewRecorder(sized{newArray(t, raid.Level5, 3), 4096}, &buf, Options{Hash: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := rec.Write(make([]byte, 100), 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := rec.Read(100, 1<<20); err == nil {
+		t.Fatal("Read() past the end succeeded")
+	}
+	if err := rec.Close(); err != nil {
+		t.Fatal(err)
+	}
+	tr, err := Load(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tr.Records) != 2 || tr.End == nil || tr.Extent() != 100 {
+		t.Errorf("Load() = %+v", tr)
+	}
+}
+
+func TestLoadBadRecord(t *testing.T) {
+	for _, rec := range []string{
+		`{"op":"write","pos":10,"length":-1}`,
+		`{"op":"read","pos":-10,"length":5}`,
+		`{"op":"clear-disk","disk":-1}`,
+		`{"op":"write","length":5,"data":"AAA="}`,
+	} {
+		if _, err := Load(strings.NewReader(`{"version":1}` + "\n" + rec)); err == nil {
+			t.Errorf("Load() of %s succeeded", rec)
+		}
+	}
+}
@@ -0,0 +1,138 @@
+package volume
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"graid-tech-assignment/pkg/task3/raid"
+	"hash/crc32"
+)
+
+// The metadata of a group lives at the start of the device in two copies,
+// written alternately so that a torn write leaves the previous one intact.
+// The valid copy with the highest sequence number wins.
+//
+// Layout of a copy: magic (8 bytes), payload length (uint32), CRC32 of the
+// payload (uint32), then the JSON encoded payload.
+const (
+	metadataMagic = "GRAIDVG1"
+	metadataHdr   = 16
+	copySize      = MetadataSize / 2
+)
+
+// MetadataSize is how much of the device the metadata takes up. Extents
+// follow it.
+const MetadataSize = 128 << 10
+
+var ErrNoMetadata = errors.New("no valid volume group metadata")
+
+type metadata struct {
+	UUID       string           `json:"uuid"`
+	Seq        uint64           `json:"seq"`
+	ExtentSize int              `json:"extent_size"`
+	Extents    int              `json:"extents"`
+	Volumes    []volumeMetadata `json:"volumes"`
+}
+
+type volumeMetadata struct {
+	Name     string    `json:"name"`
+	Size     int64     `json:"size"`
+	Thin     bool      `json:"thin,omitempty"`
+	Segments []segment `json:"segments,omitempty"`
+}
+
+// segment maps Count logical extents from Logical on to the physical extents
+// from Physical on, as LVM does. Thin volumes have no segments for what was
+// never written.
+type segment struct {
+	Logical  int `json:"logical"`
+	Physical int `json:"physical"`
+	Count    int `json:"count"`
+}
+
+// segments compresses an extent map into runs of contiguous extents.
+func segments(extents []int) []segment {
+	var segs []segment
+	for l, p := range extents {
+		if p < 0 {
+			continue
+		}
+		if n := len(segs); n > 0 {
+			last := &segs[n-1]
+			if last.Logical+last.Count == l && last.Physical+last.Count == p {
+				last.Count++
+				continue
+			}
+		}
+		segs = append(segs, segment{Logical: l, Physical: p, Count: 1})
+	}
+	return segs
+}
+
+func writeMetadata(dev raid.RAID, md *metadata) error {
+	payload, err := json.Marshal(md)
+	if err != nil {
+		return err
+	}
+	if len(payload) > copySize-metadataHdr {
+		return fmt.Errorf("metadata of %d bytes does not fit", len(payload))
+	}
+	buf := make([]byte, metadataHdr+len(payload))
+	copy(buf, metadataMagic)
+	binary.LittleEndian.PutUint32(buf[8:], uint32(len(payload)))
+	binary.LittleEndian.PutUint32(buf[12:], crc32.ChecksumIEEE(payload))
+	copy(buf[metadataHdr:], payload)
+	return dev.Write(buf, int(md.Seq%2)*copySize)
+}
+
+func readMetadata(dev raid.RAID) (*metadata, error) {
+	var newest *metadata
+	var invalid error
+	for c := 0; c < 2; c++ {
+		md, err := readCopy(dev, c)
+		if errors.Is(err, ErrNoMetadata) {
+			if invalid == nil {
+				invalid = err
+			}
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if newest == nil || md.Seq > newest.Seq {
+			newest = md
+		}
+	}
+	if newest == nil {
+		return nil, invalid
+	}
+	return newest, nil
+}
+
+func readCopy(dev raid.RAID, c int) (*metadata, error) {
+	buf, err := dev.Read(copySize, c*copySize)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(buf[:8], []byte(metadataMagic)) {
+		return nil, ErrNoMetadata
+	}
+	n := binary.LittleEndian.Uint32(buf[8:])
+	if n > copySize-metadataHdr {
+		return nil, fmt.Errorf("%w: bad length %d", ErrNoMetadata, n)
+	}
+	payload := buf[metadataHdr : metadataHdr+n]
+	if crc32.ChecksumIEEE(payload) != binary.LittleEndian.Uint32(buf[12:]) {
+		return nil, fmt.Errorf("%w: checksum mismatch", ErrNoMetadata)
+	}
+	var md metadata
+	if err := json.Unmarshal(payload, &md); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrNoMetadata, err)
+	}
+	if md.ExtentSize <= 0 || md.Extents < 0 {
+		return nil, fmt.Errorf("%w: bad extents", ErrNoMetadata)
+	}
+	return &md, nil
+}
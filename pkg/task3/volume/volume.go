@@ -0,0 +1,694 @@
+// Package volume carves a RAID into named logical volumes, the way LVM
+// carves up its physical volumes. The device is divided into extents of a
+// fixed size, and every volume is a list of extents that need not be
+// contiguous, so volumes can be created, grown, shrunk and removed in any
+// order.
+//
+// A thick volume gets all its extents when it is created or grown. A thin
+// volume gets an extent only when it is first written, so the volumes of a
+// group may add up to more than the device holds; writes fail with ErrNoSpace
+// once the extents run out. Discarding whole extents of a thin volume returns
+// them to the group.
+//
+// Every volume is a raid.RAID, an io.ReaderAt and an io.WriterAt of its own,
+// so it can be served or snapshotted independently.
+package volume
+
+import (
+	"errors"
+	"fmt"
+	"graid-tech-assignment/pkg/task3/raid"
+	"io"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/google/uuid"
+)
+
+var (
+	ErrExists     = errors.New("volume already exists")
+	ErrNotFound   = errors.New("no such volume")
+	ErrNoSpace    = errors.New("not enough free extents")
+	ErrOutOfRange = errors.New("range exceeds the volume")
+	ErrRemoved    = errors.New("volume was removed")
+)
+
+const DefaultExtentSize = 1 << 20
+
+// maxExtents bounds the extents of a volume, and so the memory its extent
+// map takes, however thin it is.
+const maxExtents = 1 << 22
+
+// Options configure a new group.
+type Options struct {
+	// ExtentSize is the unit of allocation, DefaultExtentSize by default.
+	// Stripe-sized multiples keep the writes of a volume to whole stripes.
+	ExtentSize int
+}
+
+// Group is a device divided into volumes. The lock of the group guards the
+// extent maps; it is not held while volumes read or write the device.
+type Group struct {
+	mu      sync.Mutex
+	dev     raid.RAID
+	md      metadata
+	used    []bool
+	free    int
+	volumes map[string]*Volume
+}
+
+// Volume is a logical volume of a group.
+type Volume struct {
+	// ioLock is held shared by reads and writes, and exclusively while
+	// extents are taken away from the volume, so that no extent is given to
+	// another volume while a read or write of this one is still using it.
+	// It is taken before the lock of the group.
+	ioLock sync.RWMutex
+
+	g    *Group
+	name string
+	size int64
+	thin bool
+	// extents holds the physical extent of every logical extent, or -1 for
+	// the extents of a thin volume that were never written.
+	extents []int
+	removed bool
+}
+
+// Info describes a volume.
+type Info struct {
+	Name string
+	Size int64
+	Thin bool
+	// Allocated is the number of bytes of extents the volume holds.
+	Allocated int64
+}
+
+// Format writes an empty group to dev, which has to report its size with a
+// Size or a Status method. Whatever dev held before is lost.
+func Format(dev raid.RAID, opts *Options) (*Group, error) {
+	extentSize := DefaultExtentSize
+	if opts != nil && opts.ExtentSize != 0 {
+		extentSize = opts.ExtentSize
+	}
+	if extentSize <= 0 {
+		return nil, fmt.Errorf("volume: invalid extent size %d", extentSize)
+	}
+	size, err := deviceSize(dev)
+	if err != nil {
+		return nil, err
+	}
+	extents := int((size - MetadataSize) / int64(extentSize))
+	if extents <= 0 {
+		return nil, fmt.Errorf("volume: device of %d bytes has no room for an extent of %d bytes", size, extentSize)
+	}
+	// Free extents always read as zeros, so new volumes do. Discarding the
+	// metadata area also drops an older group's second metadata copy.
+	if err := dev.Discard(0, MetadataSize+extents*extentSize); err != nil {
+		return nil, err
+	}
+	g := &Group{
+		dev:     dev,
+		md:      metadata{UUID: uuid.NewString(), ExtentSize: extentSize, Extents: extents},
+		used:    make([]bool, extents),
+		free:    extents,
+		volumes: make(map[string]*Volume),
+	}
+	if err := g.save(); err != nil {
+		return nil, err
+	}
+	return g, nil
+}
+
+// Open loads the group on dev.
+func Open(dev raid.RAID) (*Group, error) {
+	md, err := readMetadata(dev)
+	if err != nil {
+		return nil, err
+	}
+	size, err := deviceSize(dev)
+	if err != nil {
+		return nil, err
+	}
+	if int64(md.Extents) > (size-MetadataSize)/int64(md.ExtentSize) {
+		return nil, fmt.Errorf("%w: %d extents of %d bytes do not fit on a device of %d bytes", ErrNoMetadata, md.Extents, md.ExtentSize, size)
+	}
+	g := &Group{
+		dev:     dev,
+		md:      *md,
+		used:    make([]bool, md.Extents),
+		free:    md.Extents,
+		volumes: make(map[string]*Volume),
+	}
+	for _, vm := range md.Volumes {
+		if err := checkName(vm.Name); err != nil || g.checkSize(vm.Size) != nil {
+			return nil, fmt.Errorf("%w: bad volume %q", ErrNoMetadata, vm.Name)
+		}
+		if g.volumes[vm.Name] != nil {
+			return nil, fmt.Errorf("%w: volume %q given twice", ErrNoMetadata, vm.Name)
+		}
+		v := &Volume{g: g, name: vm.Name, size: vm.Size, thin: vm.Thin, extents: unallocated(g.extentCount(vm.Size))}
+		for _, s := range vm.Segments {
+			for i := range s.Count {
+				l, p := s.Logical+i, s.Physical+i
+				if l < 0 || l >= len(v.extents) || v.extents[l] >= 0 || p < 0 || p >= md.Extents || g.used[p] {
+					return nil, fmt.Errorf("%w: bad extent %d of volume %q", ErrNoMetadata, l, vm.Name)
+				}
+				v.extents[l] = p
+				g.used[p] = true
+				g.free--
+			}
+		}
+		g.volumes[vm.Name] = v
+	}
+	return g, nil
+}
+
+func deviceSize(dev raid.RAID) (int64, error) {
+	switch d := dev.(type) {
+	case interface{ Size() int64 }:
+		return d.Size(), nil
+	case interface{ Status() raid.Status }:
+		return d.Status().Size, nil
+	}
+	return 0, errors.New("volume: the size of the device is unknown")
+}
+
+// checkName accepts the names LVM does, which are safe in paths and URLs.
+func checkName(name string) error {
+	if name == "" || len(name) > 128 || name == "." || name == ".." || name[0] == '-' {
+		return fmt.Errorf("invalid volume name %q", name)
+	}
+	for _, c := range name {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case c == '_', c == '.', c == '+', c == '-':
+		default:
+			return fmt.Errorf("invalid volume name %q", name)
+		}
+	}
+	return nil
+}
+
+func unallocated(n int) []int {
+	extents := make([]int, n)
+	for i := range extents {
+		extents[i] = -1
+	}
+	return extents
+}
+
+// checkSize rejects volume sizes that are negative or need more than
+// maxExtents extents.
+func (g *Group) checkSize(size int64) error {
+	if size < 0 || size/int64(g.md.ExtentSize) >= maxExtents {
+		return fmt.Errorf("invalid volume size %d", size)
+	}
+	return nil
+}
+
+func (g *Group) extentCount(size int64) int {
+	return int((size + int64(g.md.ExtentSize) - 1) / int64(g.md.ExtentSize))
+}
+
+// UUID identifies the group.
+func (g *Group) UUID() string {
+	return g.md.UUID
+}
+
+// ExtentSize is the unit of allocation.
+func (g *Group) ExtentSize() int {
+	return g.md.ExtentSize
+}
+
+// Extents returns the number of extents of the group and how many of them
+// are free.
+func (g *Group) Extents() (total, free int) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.md.Extents, g.free
+}
+
+// Create adds a volume of size bytes. A thick volume gets all its extents
+// now, a thin one as it is written.
+func (g *Group) Create(name string, size int64, thin bool) (*Volume, error) {
+	if err := checkName(name); err != nil {
+		return nil, err
+	}
+	if err := g.checkSize(size); err != nil {
+		return nil, err
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.volumes[name] != nil {
+		return nil, fmt.Errorf("%w: %s", ErrExists, name)
+	}
+	v := &Volume{g: g, name: name, size: size, thin: thin, extents: unallocated(g.extentCount(size))}
+	if !thin {
+		if err := g.allocate(v, 0, len(v.extents)); err != nil {
+			return nil, err
+		}
+	}
+	g.volumes[name] = v
+	if err := g.save(); err != nil {
+		delete(g.volumes, name)
+		g.release(v, 0, len(v.extents))
+		return nil, err
+	}
+	return v, nil
+}
+
+// Volume returns the volume called name.
+func (g *Group) Volume(name string) (*Volume, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	v := g.volumes[name]
+	if v == nil {
+		return nil, fmt.Errorf("%w: %s", ErrNotFound, name)
+	}
+	return v, nil
+}
+
+// Volumes describes all volumes, sorted by name.
+func (g *Group) Volumes() []Info {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	infos := make([]Info, 0, len(g.volumes))
+	for _, v := range g.volumes {
+		infos = append(infos, v.info())
+	}
+	slices.SortFunc(infos, func(a, b Info) int { return strings.Compare(a.Name, b.Name) })
+	return infos
+}
+
+// Remove deletes a volume and returns its extents to the group. Handles to
+// it fail with ErrRemoved from then on.
+func (g *Group) Remove(name string) error {
+	v, err := g.Volume(name)
+	if err != nil {
+		return err
+	}
+	v.ioLock.Lock()
+	defer v.ioLock.Unlock()
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.volumes[name] != v {
+		return fmt.Errorf("%w: %s", ErrNotFound, name)
+	}
+	if err := g.discardExtents(v, 0, len(v.extents)); err != nil {
+		return err
+	}
+	delete(g.volumes, name)
+	if err := g.save(); err != nil {
+		g.volumes[name] = v
+		return err
+	}
+	g.release(v, 0, len(v.extents))
+	v.removed = true
+	return nil
+}
+
+// save writes the metadata to the copy that does not hold the current
+// version.
+func (g *Group) save() error {
+	g.md.Volumes = g.md.Volumes[:0]
+	for _, v := range g.volumes {
+		g.md.Volumes = append(g.md.Volumes, volumeMetadata{Name: v.name, Size: v.size, Thin: v.thin, Segments: segments(v.extents)})
+	}
+	slices.SortFunc(g.md.Volumes, func(a, b volumeMetadata) int { return strings.Compare(a.Name, b.Name) })
+	g.md.Seq++
+	if err := writeMetadata(g.dev, &g.md); err != nil {
+		g.md.Seq--
+		return err
+	}
+	return nil
+}
+
+// allocate gives the unallocated extents of v in [first, last) the lowest
+// free physical extents. It allocates all of them or none.
+func (g *Group) allocate(v *Volume, first, last int) error {
+	need := 0
+	for l := first; l < last; l++ {
+		if v.extents[l] < 0 {
+			need++
+		}
+	}
+	if need > g.free {
+		return fmt.Errorf("%w: need %d, %d free", ErrNoSpace, need, g.free)
+	}
+	p := 0
+	for l := first; l < last; l++ {
+		if v.extents[l] >= 0 {
+			continue
+		}
+		for g.used[p] {
+			p++
+		}
+		v.extents[l] = p
+		g.used[p] = true
+		g.free--
+	}
+	return nil
+}
+
+// release returns the extents of v in [first, last) to the group.
+func (g *Group) release(v *Volume, first, last int) {
+	for l := first; l < last; l++ {
+		if p := v.extents[l]; p >= 0 {
+			g.used[p] = false
+			g.free++
+			v.extents[l] = -1
+		}
+	}
+}
+
+// restore gives v back the extents in prev, starting at logical extent
+// first, after they were released.
+func (g *Group) restore(v *Volume, first int, prev []int) {
+	for i, p := range prev {
+		if p >= 0 && v.extents[first+i] < 0 {
+			v.extents[first+i] = p
+			g.used[p] = true
+			g.free--
+		}
+	}
+}
+
+// discardExtents discards the extents of v in [first, last), so that they
+// read as zeros once they are free.
+func (g *Group) discardExtents(v *Volume, first, last int) error {
+	for l := first; l < last; l++ {
+		if p := v.extents[l]; p >= 0 {
+			if err := g.dev.Discard(g.offset(p), g.md.ExtentSize); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// offset is where physical extent p starts on the device.
+func (g *Group) offset(p int) int {
+	return MetadataSize + p*g.md.ExtentSize
+}
+
+// Name returns the name of the volume.
+func (v *Volume) Name() string {
+	return v.name
+}
+
+// Size returns the size of the volume in bytes.
+func (v *Volume) Size() int64 {
+	v.g.mu.Lock()
+	defer v.g.mu.Unlock()
+	return v.size
+}
+
+// Info describes the volume.
+func (v *Volume) Info() Info {
+	v.g.mu.Lock()
+	defer v.g.mu.Unlock()
+	return v.info()
+}
+
+func (v *Volume) info() Info {
+	allocated := 0
+	for _, p := range v.extents {
+		if p >= 0 {
+			allocated++
+		}
+	}
+	return Info{Name: v.name, Size: v.size, Thin: v.thin, Allocated: int64(allocated) * int64(v.g.md.ExtentSize)}
+}
+
+// Resize grows or shrinks the volume. Growing a thick volume allocates the
+// new extents; shrinking frees the extents past the new end and loses what
+// they held.
+func (v *Volume) Resize(size int64) error {
+	g := v.g
+	if err := g.checkSize(size); err != nil {
+		return err
+	}
+	v.ioLock.Lock()
+	defer v.ioLock.Unlock()
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if v.removed {
+		return ErrRemoved
+	}
+	old, oldSize := v.extents, v.size
+	n := g.extentCount(size)
+	if n > len(old) {
+		v.extents = append(slices.Clone(old), unallocated(n-len(old))...)
+		if !v.thin {
+			if err := g.allocate(v, len(old), n); err != nil {
+				v.extents = old
+				return err
+			}
+		}
+		v.size = size
+		if err := g.save(); err != nil {
+			g.release(v, len(old), n)
+			v.extents, v.size = old, oldSize
+			return err
+		}
+		return nil
+	}
+
+	// What lies past the new end has to read as zeros if the volume grows
+	// again.
+	if err := g.discardExtents(v, n, len(old)); err != nil {
+		return err
+	}
+	if tail := int(size % int64(g.md.ExtentSize)); tail > 0 && size < oldSize && old[n-1] >= 0 {
+		if err := g.dev.Discard(g.offset(old[n-1])+tail, g.md.ExtentSize-tail); err != nil {
+			return err
+		}
+	}
+	prev := slices.Clone(old)
+	g.release(v, n, len(old))
+	v.extents, v.size = old[:n], size
+	if err := g.save(); err != nil {
+		v.extents, v.size = old, oldSize
+		g.restore(v, 0, prev)
+		return err
+	}
+	return nil
+}
+
+// piece is a part of a request that lies in one run of physically
+// contiguous extents, or of unallocated extents if phys is -1.
+type piece struct {
+	off  int // in the request
+	phys int // on the device
+	n    int
+}
+
+// pieces splits [pos, pos+length) of the volume into pieces.
+func (v *Volume) pieces(pos, length int) []piece {
+	es := v.g.md.ExtentSize
+	var ps []piece
+	for off := 0; off < length; {
+		l, within := (pos+off)/es, (pos+off)%es
+		n := min(es-within, length-off)
+		phys := -1
+		if p := v.extents[l]; p >= 0 {
+			phys = v.g.offset(p) + within
+		}
+		if k := len(ps); k > 0 {
+			last := &ps[k-1]
+			if (last.phys < 0 && phys < 0) || (last.phys >= 0 && last.phys+last.n == phys) {
+				last.n += n
+				off += n
+				continue
+			}
+		}
+		ps = append(ps, piece{off: off, phys: phys, n: n})
+		off += n
+	}
+	return ps
+}
+
+func (v *Volume) check(pos, length int) error {
+	if v.removed {
+		return ErrRemoved
+	}
+	if pos < 0 || length < 0 {
+		return errors.New("negative position or length")
+	}
+	if int64(pos)+int64(length) > v.size {
+		return fmt.Errorf("%w: %d bytes at %d, volume %s has %d", ErrOutOfRange, length, pos, v.name, v.size)
+	}
+	return nil
+}
+
+func (v *Volume) Read(length int, pos int) ([]byte, error) {
+	v.ioLock.RLock()
+	defer v.ioLock.RUnlock()
+	v.g.mu.Lock()
+	if err := v.check(pos, length); err != nil {
+		v.g.mu.Unlock()
+		return nil, err
+	}
+	ps := v.pieces(pos, length)
+	v.g.mu.Unlock()
+
+	buf := make([]byte, length)
+	for _, p := range ps {
+		if p.phys < 0 {
+			continue
+		}
+		data, err := v.g.dev.Read(p.n, p.phys)
+		if err != nil {
+			return nil, err
+		}
+		copy(buf[p.off:], data)
+	}
+	return buf, nil
+}
+
+// Write allocates the extents of a thin volume that the write touches for
+// the first time.
+func (v *Volume) Write(data []byte, pos int) error {
+	v.ioLock.RLock()
+	defer v.ioLock.RUnlock()
+	ps, err := v.mapWrite(pos, len(data))
+	if err != nil {
+		return err
+	}
+	g := v.g
+	for _, p := range ps {
+		if err := g.dev.Write(data[p.off:p.off+p.n], p.phys); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// mapWrite allocates the extents a write touches, if the volume is thin, and
+// returns where its pieces go.
+func (v *Volume) mapWrite(pos, length int) ([]piece, error) {
+	g := v.g
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if err := v.check(pos, length); err != nil {
+		return nil, err
+	}
+	if length == 0 {
+		return nil, nil
+	}
+	if v.thin {
+		es := g.md.ExtentSize
+		first, last := pos/es, (pos+length-1)/es+1
+		old := slices.Clone(v.extents[first:last])
+		if err := g.allocate(v, first, last); err != nil {
+			return nil, err
+		}
+		if !slices.Equal(old, v.extents[first:last]) {
+			if err := g.save(); err != nil {
+				for i, p := range old {
+					if p < 0 {
+						g.release(v, first+i, first+i+1)
+					}
+				}
+				return nil, err
+			}
+		}
+	}
+	return v.pieces(pos, length), nil
+}
+
+// Discard discards the range on the device. The extents of a thin volume
+// that it covers entirely go back to the group.
+func (v *Volume) Discard(pos, length int) error {
+	v.ioLock.Lock()
+	defer v.ioLock.Unlock()
+	g := v.g
+	g.mu.Lock()
+	if err := v.check(pos, length); err != nil {
+		g.mu.Unlock()
+		return err
+	}
+	ps := v.pieces(pos, length)
+	g.mu.Unlock()
+
+	for _, p := range ps {
+		if p.phys < 0 {
+			continue
+		}
+		if err := g.dev.Discard(p.phys, p.n); err != nil {
+			return err
+		}
+	}
+	if !v.thin || length == 0 {
+		return nil
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	es := g.md.ExtentSize
+	first := (pos + es - 1) / es
+	last := (pos + length) / es
+	if int64(pos+length) == v.size {
+		// The partial extent at the end of the volume is covered as well.
+		last = len(v.extents)
+	}
+	if first >= last {
+		return nil
+	}
+	prev := slices.Clone(v.extents[first:last])
+	g.release(v, first, last)
+	if slices.Equal(prev, v.extents[first:last]) {
+		return nil
+	}
+	if err := g.save(); err != nil {
+		g.restore(v, first, prev)
+		return err
+	}
+	return nil
+}
+
+// ReadAt reads from the volume. Reading past its end returns io.EOF.
+func (v *Volume) ReadAt(p []byte, off int64) (int, error) {
+	size := v.Size()
+	if off < 0 {
+		return 0, errors.New("negative offset")
+	}
+	if off >= size {
+		return 0, io.EOF
+	}
+	n := int(min(int64(len(p)), size-off))
+	data, err := v.Read(n, int(off))
+	if err != nil {
+		return 0, err
+	}
+	copy(p, data)
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// WriteAt writes to the volume. Writes past its end fail with ErrOutOfRange.
+func (v *Volume) WriteAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New("negative offset")
+	}
+	if err := v.Write(p, int(off)); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// ClearDisk clears a member of the device below.
+func (v *Volume) ClearDisk(diskIndex int) {
+	v.g.dev.ClearDisk(diskIndex)
+}
+
+// Flush flushes the device below if it supports it.
+func (v *Volume) Flush() error {
+	if f, ok := v.g.dev.(interface{ Flush() error }); ok {
+		return f.Flush()
+	}
+	return nil
+}
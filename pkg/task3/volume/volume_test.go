@@ -0,0 +1,291 @@
+package volume
+
+import (
+	"bytes"
+	"errors"
+	"graid-tech-assignment/pkg/task3/raid"
+	"graid-tech-assignment/pkg/task3/raid/raidtest"
+	"io"
+	"testing"
+	"time"
+)
+
+const extentSize = 4096
+
+// newArray returns a RAID5 with room for 24 extents after the metadata.
+func newArray(t testing.TB) raid.Array {
+	t.Helper()
+	disks := make([]raid.Disk, 5)
+	for i := range disks {
+		disks[i] = raid.NewMemDisk((MetadataSize + 24*extentSize) / 4)
+	}
+	arr, err := raid.New(raid.Level5, disks, 512)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return arr
+}
+
+func newGroup(t testing.TB) (*Group, raid.Array) {
+	t.Helper()
+	arr := newArray(t)
+	g, err := Format(arr, &Options{ExtentSize: extentSize})
+	if err != nil {
+		t.Fatalf("Format() error = %v", err)
+	}
+	return g, arr
+}
+
+func checkFree(t *testing.T, g *Group, want int) {
+	t.Helper()
+	if _, free := g.Extents(); free != want {
+		t.Errorf("Extents() free = %d, want %d", free, want)
+	}
+}
+
+func TestGroup(t *testing.T) {
+	g, arr := newGroup(t)
+	checkFree(t, g, 24)
+
+	thick, err := g.Create("thick", 5*extentSize+100, false)
+	if err != nil {
+		t.Fatalf("Create(thick) error = %v", err)
+	}
+	checkFree(t, g, 18)
+	thin, err := g.Create("thin", 100*extentSize, true)
+	if err != nil {
+		t.Fatalf("Create(thin) error = %v", err)
+	}
+	checkFree(t, g, 18)
+	if _, err := g.Create("thick", 1, true); !errors.Is(err, ErrExists) {
+		t.Errorf("Create() of an existing name error = %v, want %v", err, ErrExists)
+	}
+	if _, err := g.Create("a/b", 1, true); err == nil {
+		t.Error("Create() accepted a name with a slash")
+	}
+	if _, err := g.Create("huge", 19*extentSize, false); !errors.Is(err, ErrNoSpace) {
+		t.Errorf("Create() of a volume larger than the free space error = %v, want %v", err, ErrNoSpace)
+	}
+
+	// A write to a thin volume allocates only the extents it touches.
+	data := bytes.Repeat([]byte("thin"), extentSize/2)
+	if err := thin.Write(data, 50*extentSize-100); err != nil {
+		t.Fatal(err)
+	}
+	checkFree(t, g, 15)
+	if err := thick.Write([]byte("thick"), 5*extentSize); err != nil {
+		t.Fatal(err)
+	}
+	if err := thick.Write([]byte("x"), 5*extentSize+100); !errors.Is(err, ErrOutOfRange) {
+		t.Errorf("Write() past the end error = %v, want %v", err, ErrOutOfRange)
+	}
+
+	// Everything survives reopening the group.
+	g, err = Open(arr)
+	if err != nil {
+		t.Fatalf("Open() error = %v", err)
+	}
+	checkFree(t, g, 15)
+	if got := g.Volumes(); len(got) != 2 || got[0] != (Info{"thick", 5*extentSize + 100, false, 6 * extentSize}) || got[1] != (Info{"thin", 100 * extentSize, true, 3 * extentSize}) {
+		t.Errorf("Volumes() = %+v", got)
+	}
+	thin, _ = g.Volume("thin")
+	got, err := thin.Read(len(data)+200, 50*extentSize-200)
+	if err != nil || !bytes.Equal(got[100:len(got)-100], data) || !bytes.Equal(got[:100], make([]byte, 100)) {
+		t.Errorf("Read() of the thin volume = %v, contents match %v", err, bytes.Equal(got[100:len(got)-100], data))
+	}
+
+	// Discarding the whole middle extent returns it.
+	if err := thin.Discard(50*extentSize, extentSize); err != nil {
+		t.Fatal(err)
+	}
+	checkFree(t, g, 16)
+
+	// Shrinking drops the tail, which reads as zeros after growing again.
+	thick, _ = g.Volume("thick")
+	if err := thick.Resize(extentSize + 10); err != nil {
+		t.Fatal(err)
+	}
+	checkFree(t, g, 20)
+	if err := thick.Resize(6 * extentSize); err != nil {
+		t.Fatal(err)
+	}
+	checkFree(t, g, 16)
+	if got, err := thick.Read(6*extentSize-10, 10); err != nil || !bytes.Equal(got, make([]byte, len(got))) {
+		t.Errorf("Read() after shrinking and growing = %v, zeros %v", err, bytes.Equal(got, make([]byte, len(got))))
+	}
+
+	// Removed volumes give their extents back, which then read as zeros.
+	if err := g.Remove("thin"); err != nil {
+		t.Fatal(err)
+	}
+	checkFree(t, g, 18)
+	if _, err := thin.Read(1, 0); !errors.Is(err, ErrRemoved) {
+		t.Errorf("Read() of a removed volume error = %v, want %v", err, ErrRemoved)
+	}
+	if _, err := g.Volume("thin"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Volume() of a removed volume error = %v, want %v", err, ErrNotFound)
+	}
+	all, err := g.Create("all", 18*extentSize, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := all.Read(18*extentSize, 0); err != nil || !bytes.Equal(got, make([]byte, len(got))) {
+		t.Errorf("Read() of a volume on reused extents = %v, zeros %v", err, bytes.Equal(got, make([]byte, len(got))))
+	}
+
+	// Thin volumes may promise more than there is.
+	over, _ := g.Create("over", 10*extentSize, true)
+	if err := over.Write([]byte{1}, 0); !errors.Is(err, ErrNoSpace) {
+		t.Errorf("Write() to a thin volume of a full group error = %v, want %v", err, ErrNoSpace)
+	}
+}
+
+func TestReaderAt(t *testing.T) {
+	g, _ := newGroup(t)
+	v, _ := g.Create("v", 1000, true)
+	if n, err := v.WriteAt([]byte("hello"), 995); n != 5 || err != nil {
+		t.Errorf("WriteAt() = %d, %v", n, err)
+	}
+	if _, err := v.WriteAt([]byte("hello"), 996); !errors.Is(err, ErrOutOfRange) {
+		t.Errorf("WriteAt() past the end error = %v, want %v", err, ErrOutOfRange)
+	}
+	buf := make([]byte, 10)
+	if n, err := v.ReadAt(buf, 995); n != 5 || err != io.EOF || string(buf[:5]) != "hello" {
+		t.Errorf("ReadAt() = %d, %v, %q", n, err, buf[:n])
+	}
+}
+
+func TestMetadataCopies(t *testing.T) {
+	g, arr := newGroup(t)
+	g.Create("a", extentSize, false)
+	g.Create("b", extentSize, false)
+	// Tearing the newest copy falls back to the one before.
+	if err := arr.Write([]byte("garbage"), int(g.md.Seq%2)*copySize+metadataHdr); err != nil {
+		t.Fatal(err)
+	}
+	g, err := Open(arr)
+	if err != nil {
+		t.Fatalf("Open() error = %v", err)
+	}
+	if got := g.Volumes(); len(got) != 1 || got[0].Name != "a" {
+		t.Errorf("Volumes() after tearing the newest copy = %+v", got)
+	}
+	if _, err := Open(newArray(t)); !errors.Is(err, ErrNoMetadata) {
+		t.Errorf("Open() of an unformatted array error = %v, want %v", err, ErrNoMetadata)
+	}
+
+	// Valid metadata of a group larger than the device is rejected.
+	g.md.Extents = 25
+	if err := g.save(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Open(arr); !errors.Is(err, ErrNoMetadata) {
+		t.Errorf("Open() of a group past the end of the device error = %v, want %v", err, ErrNoMetadata)
+	}
+}
+
+func TestHugeVolume(t *testing.T) {
+	g, _ := newGroup(t)
+	if _, err := g.Create("huge", 1<<62, true); err == nil {
+		t.Error("Create() of a thin volume of 4 EiB succeeded")
+	}
+	v, err := g.Create("v", extentSize, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := v.Resize(maxExtents * extentSize); err == nil {
+		t.Errorf("Resize() to %d extents succeeded", maxExtents)
+	}
+}
+
+// stallDev stalls writes at stall until release is closed.
+type stallDev struct {
+	raid.Array
+	stall   int
+	stalled chan struct{}
+	release chan struct{}
+}
+
+func (d *stallDev) Write(data []byte, pos int) error {
+	if pos == d.stall {
+		close(d.stalled)
+		<-d.release
+	}
+	return d.Array.Write(data, pos)
+}
+
+// TestConcurrentVolumes checks that the I/O of one volume does not wait for
+// that of another.
+func TestConcurrentVolumes(t *testing.T) {
+	dev := &stallDev{Array: newArray(t), stall: -1, stalled: make(chan struct{}), release: make(chan struct{})}
+	g, err := Format(dev, &Options{ExtentSize: extentSize})
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, _ := g.Create("a", extentSize, false)
+	b, _ := g.Create("b", extentSize, false)
+	dev.stall = g.offset(a.extents[0])
+	go a.Write([]byte("a"), 0)
+	<-dev.stalled
+
+	done := make(chan error)
+	go func() {
+		if err := b.Write([]byte("b"), 0); err != nil {
+			done <- err
+			return
+		}
+		_, err := b.Read(1, 0)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Error(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("I/O of volume b waited for a write to volume a")
+	}
+	close(dev.release)
+}
+
+func TestConformance(t *testing.T) {
+	for _, thin := range []bool{false, true} {
+		name := "thick"
+		if thin {
+			name = "thin"
+		}
+		t.Run(name, func(t *testing.T) {
+			raidtest.Run(t, raidtest.Config{
+				New: func() (raid.RAID, error) {
+					g, err := Format(newArray(t), &Options{ExtentSize: extentSize})
+					if err != nil {
+						return nil, err
+					}
+					// Freeing every other extent of a neighbour scatters the
+					// extents of the volume.
+					other, err := g.Create("other", 8*extentSize, true)
+					if err != nil {
+						return nil, err
+					}
+					if err := other.Write(make([]byte, 8*extentSize), 0); err != nil {
+						return nil, err
+					}
+					for i := 1; i < 8; i += 2 {
+						if err := other.Discard(i*extentSize, extentSize); err != nil {
+							return nil, err
+						}
+					}
+					v, err := g.Create("v", 10*extentSize-100, thin)
+					if err != nil {
+						return nil, err
+					}
+					return v, nil
+				},
+				Size:      10*extentSize - 100,
+				NumDisks:  5,
+				Tolerance: 1,
+			})
+		})
+	}
+}
@@ -0,0 +1,1158 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"graid-tech-assignment/pkg/task3/crypt"
+	"graid-tech-assignment/pkg/task3/httpapi"
+	"graid-tech-assignment/pkg/task3/layout"
+	"graid-tech-assignment/pkg/task3/nbd"
+	"graid-tech-assignment/pkg/task3/raid"
+	"graid-tech-assignment/pkg/task3/reliability"
+	"graid-tech-assignment/pkg/task3/trace"
+	"graid-tech-assignment/pkg/task3/volume"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const usage = `Usage: raidctl <command> [flags] <image>...
+
+Commands:
+  create   -level L -stripe N -size S[,S...] [-draid D:P:S] <image>...
+                                                create member images and the array on them
+  assemble <image>...                           assemble the array and show its members
+  status   <image>...                           show the array and member states
+  write    [-offset N] [-in file] <image>...    write a file (default stdin) into the array
+  read     [-offset N] [-length N] [-out file] <image>...
+                                                read from the array to a file (default stdout)
+  discard  -offset N -length N <image>...        discard a range, releasing its space
+  map      [-offset N] [-length N] <image>...     show where a logical range lives on the members
+  layout   [-stripes N] [-format ascii|json|svg] <image>...
+  layout   -level L -disks N [-stripe N] [-fail N,...] [-stripes N] [-format F]
+                                                draw the stripe map of an array, or of an
+                                                example array that is not backed by images
+  export   [-out file] <image>...               write the array, members and all, to one
+                                                image file (default stdout)
+  import   [-in file] <image>...                create member images from an image file
+                                                (default stdin) and show the array
+  encrypt  -keyfile F <image>...                 format the array as an encrypted volume,
+                                                unlocked by the key file
+  lv       create -name N -size S [-thin] [-extent N] | list | resize -name N -size S |
+           remove -name N  [-keyfile F] <image>...
+                                                manage logical volumes on the array (or on its
+                                                encrypted volume); create sets up the volume
+                                                group if there is none
+  fail     -disk N <image>...                   mark a member failed
+  replace  -disk N -new image <image>...        swap a failed member for a new image
+  rebuild  -disk N [-spare] [background flags] <image>...
+                                                rebuild a member from the others, or only into
+                                                the distributed spare space of a dRAID array
+  scrub    [-repair] [background flags] <image>...
+                                                check (and repair) the redundancy
+  patrol   [background flags] <image>...        read the members to find unreadable blocks
+  nbd      [-listen addr] [-name export] [-readonly] [-cache N [-writethrough]]
+           [-keyfile F] [-volume N] [-patrol D [-min-speed S] [-max-speed S]]
+           [-trace F [-trace-data]] <image>...
+                                                serve the array over NBD until interrupted,
+                                                optionally caching N stripes; with -keyfile
+                                                the decrypted contents of an encrypted volume,
+                                                with -volume one logical volume; with -patrol
+                                                a patrol read runs every D; with -trace the
+                                                calls of the clients are recorded to F
+  reliability [-disk-size S] [-afr P] [-ure R] [-disk-rate S] [-replace D]
+           [-max-speed S] [-years N] [-trials N] <level:disks>...
+                                                estimate the probability of data loss of
+                                                configurations, e.g. 5:8, 6:8 or
+                                                draid:12:8:2:1, by simulating failures,
+                                                rebuilds and unrecoverable read errors
+  replay   -trace F [-timed] <image>...         make the calls of a trace against the array,
+                                                which it writes to, and compare the outcome
+                                                with the recording
+  http     [-listen addr] [-dir dir] [-name name] [<image>...]
+                                                serve the HTTP management API; new member
+                                                images are created in dir
+
+Sizes accept K, M and G suffixes.
+
+Background flags: [-timeout D] [-events] [-min-speed S] [-max-speed S]
+Rebuilds, scrubs and patrol reads stop when interrupted or after the timeout
+and report how far they got. A stopped rebuild starts over the next time. With
+-events they print member failures, progress and mismatches to stderr as they
+happen. They run at up to -max-speed bytes per second per member, and back off
+to -min-speed while foreground I/O is busy.`
+
+func main() {
+	log.SetFlags(0)
+	if len(os.Args) < 2 {
+		fmt.Fprintln(os.Stderr, usage)
+		os.Exit(2)
+	}
+	command, args := os.Args[1], os.Args[2:]
+
+	var err error
+	switch command {
+	case "create":
+		err = create(args)
+	case "assemble", "status":
+		err = status(command, args)
+	case "write":
+		err = write(args)
+	case "read":
+		err = read(args)
+	case "discard":
+		err = discard(args)
+	case "map":
+		err = mapRange(args)
+	case "layout":
+		err = drawLayout(args)
+	case "export":
+		err = exportImage(args)
+	case "import":
+		err = importImage(args)
+	case "encrypt":
+		err = encrypt(args)
+	case "lv":
+		err = logicalVolumes(args)
+	case "fail":
+		err = fail(args)
+	case "replace":
+		err = replace(args)
+	case "rebuild":
+		err = rebuild(args)
+	case "scrub":
+		err = scrub(args)
+	case "patrol":
+		err = patrol(args)
+	case "replay":
+		err = replay(args)
+	case "reliability":
+		err = simulateReliability(args)
+	case "nbd":
+		err = serveNBD(args)
+	case "http":
+		err = serveHTTP(args)
+	case "help", "-h", "--help":
+		fmt.Println(usage)
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command %q\n\n%s\n", command, usage)
+		os.Exit(2)
+	}
+	if err != nil {
+		log.Fatalf("raidctl %s: %v", command, err)
+	}
+}
+
+func create(args []string) error {
+	fs := flag.NewFlagSet("create", flag.ExitOnError)
+	levelFlag := fs.String("level", "5", "RAID level: linear, 0, 1, 4, 5, 6, 10, draid or shr")
+	stripe := fs.Int("stripe", 64*1024, "stripe size in bytes")
+	sizeFlag := fs.String("size", "64M", "size of every member image, or a comma-separated size per image")
+	draid := fs.String("draid", "", "data:parity:spares of a dRAID array (default chosen from the number of images)")
+	fs.Parse(args)
+
+	level, err := raid.ParseLevel(*levelFlag)
+	if err != nil {
+		return err
+	}
+	var sizes []int64
+	for _, f := range strings.Split(*sizeFlag, ",") {
+		size, err := parseSize(f)
+		if err != nil {
+			return err
+		}
+		sizes = append(sizes, size)
+	}
+	if len(sizes) > 1 && len(sizes) != fs.NArg() {
+		return fmt.Errorf("%d sizes for %d images", len(sizes), fs.NArg())
+	}
+	var disks []raid.Disk
+	for i, path := range fs.Args() {
+		size := sizes[0]
+		if len(sizes) > 1 {
+			size = sizes[i]
+		}
+		disk, err := raid.CreateFileDisk(path, size)
+		if err != nil {
+			return err
+		}
+		defer disk.Close()
+		disks = append(disks, disk)
+	}
+	var arr raid.Array
+	if *draid != "" {
+		var c raid.DeclusteredConfig
+		if _, err := fmt.Sscanf(*draid, "%d:%d:%d", &c.Data, &c.Parity, &c.Spares); err != nil {
+			return fmt.Errorf("bad -draid %q: %v", *draid, err)
+		}
+		arr, err = raid.CreateDeclustered(disks, *stripe, c)
+	} else {
+		arr, err = raid.Create(level, disks, *stripe)
+	}
+	if err != nil {
+		return err
+	}
+	printStatus(arr.Status())
+	return nil
+}
+
+func status(command string, args []string) error {
+	fs := flag.NewFlagSet(command, flag.ExitOnError)
+	fs.Parse(args)
+	arr, closeDisks, err := open(fs.Args())
+	if err != nil {
+		return err
+	}
+	defer closeDisks()
+	printStatus(arr.Status())
+	return nil
+}
+
+func write(args []string) error {
+	fs := flag.NewFlagSet("write", flag.ExitOnError)
+	offset := fs.Int("offset", 0, "array offset to write at")
+	in := fs.String("in", "", "file to write (default stdin)")
+	fs.Parse(args)
+
+	arr, closeDisks, err := open(fs.Args())
+	if err != nil {
+		return err
+	}
+	defer closeDisks()
+
+	r := io.Reader(os.Stdin)
+	if *in != "" {
+		f, err := os.Open(*in)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		r = f
+	}
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	if end := int64(*offset + len(data)); end > arr.Status().Size {
+		return fmt.Errorf("write of %d bytes at %d exceeds the array size %d", len(data), *offset, arr.Status().Size)
+	}
+	if err := arr.Write(data, *offset); err != nil {
+		return err
+	}
+	log.Printf("wrote %d bytes at offset %d", len(data), *offset)
+	return nil
+}
+
+func read(args []string) error {
+	fs := flag.NewFlagSet("read", flag.ExitOnError)
+	offset := fs.Int("offset", 0, "array offset to read from")
+	length := fs.Int("length", -1, "number of bytes to read (default up to the end of the array)")
+	out := fs.String("out", "", "file to write to (default stdout)")
+	fs.Parse(args)
+
+	arr, closeDisks, err := open(fs.Args())
+	if err != nil {
+		return err
+	}
+	defer closeDisks()
+
+	size := arr.Status().Size
+	if *length < 0 {
+		*length = int(max(size-int64(*offset), 0))
+	}
+	if end := int64(*offset + *length); end > size {
+		return fmt.Errorf("read of %d bytes at %d exceeds the array size %d", *length, *offset, size)
+	}
+	data, err := arr.Read(*length, *offset)
+	if err != nil {
+		return err
+	}
+
+	w := io.Writer(os.Stdout)
+	if *out != "" {
+		f, err := os.Create(*out)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+	_, err = w.Write(data)
+	return err
+}
+
+func exportImage(args []string) error {
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	out := fs.String("out", "", "image file to write (default stdout)")
+	fs.Parse(args)
+
+	arr, closeDisks, err := open(fs.Args())
+	if err != nil {
+		return err
+	}
+	defer closeDisks()
+	if *out == "" {
+		return raid.Export(os.Stdout, arr)
+	}
+	f, err := os.Create(*out)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := raid.Export(f, arr); err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+func importImage(args []string) error {
+	fs := flag.NewFlagSet("import", flag.ExitOnError)
+	in := fs.String("in", "", "image file to read (default stdin)")
+	fs.Parse(args)
+
+	r := io.Reader(os.Stdin)
+	if *in != "" {
+		f, err := os.Open(*in)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		r = f
+	}
+	var files []*raid.FileDisk
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	arr, err := raid.Import(r, func(i int, size int64) (raid.Disk, error) {
+		if i >= fs.NArg() {
+			return nil, fmt.Errorf("the image holds more than %d disks", fs.NArg())
+		}
+		f, err := raid.CreateFileDisk(fs.Arg(i), size)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, f)
+		return f, nil
+	})
+	if err != nil {
+		return err
+	}
+	if len(files) != fs.NArg() {
+		return fmt.Errorf("the image holds %d disks, not %d", len(files), fs.NArg())
+	}
+	printStatus(arr.Status())
+	return nil
+}
+
+func discard(args []string) error {
+	fs := flag.NewFlagSet("discard", flag.ExitOnError)
+	offset := fs.Int("offset", 0, "array offset to discard from")
+	length := fs.Int("length", 0, "number of bytes to discard")
+	fs.Parse(args)
+
+	arr, closeDisks, err := open(fs.Args())
+	if err != nil {
+		return err
+	}
+	defer closeDisks()
+	if size := arr.Status().Size; int64(*offset+*length) > size {
+		return fmt.Errorf("discard of %d bytes at %d exceeds the array size %d", *length, *offset, size)
+	}
+	if err := arr.Discard(*offset, *length); err != nil {
+		return err
+	}
+	return arr.Flush()
+}
+
+func mapRange(args []string) error {
+	fs := flag.NewFlagSet("map", flag.ExitOnError)
+	offset := fs.Int("offset", 0, "array offset of the range")
+	length := fs.Int("length", -1, "length of the range (default one full stripe)")
+	fs.Parse(args)
+
+	arr, closeDisks, err := open(fs.Args())
+	if err != nil {
+		return err
+	}
+	defer closeDisks()
+
+	g := arr.Geometry()
+	if *length < 0 {
+		*length = max(g.StripeWidth, 1)
+	}
+	extents, err := arr.Map(*offset, *length)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Level:  %s, %d disks, %d data\n", g.Level, g.NumDisks, g.DataMembers)
+	if g.StripeWidth > 0 {
+		fmt.Printf("Stripe: %d per member, %d per stripe\n", g.StripeSize, g.StripeWidth)
+	}
+	if g.Level == raid.LevelLinear || g.Level == raid.LevelHybrid {
+		var sizes []string
+		for _, m := range arr.Status().Members {
+			sizes = append(sizes, fmt.Sprint(m.Size))
+		}
+		fmt.Printf("Data:   at %d on every member, %s bytes\n", g.DataOffset, strings.Join(sizes, ", "))
+	} else {
+		fmt.Printf("Data:   at %d on every member, %d bytes each\n", g.DataOffset, g.MemberSize)
+	}
+	fmt.Printf("%12s %8s  %-4s %-6s %12s\n", "logical", "length", "disk", "role", "offset")
+	for _, e := range extents {
+		fmt.Printf("%12d %8d  %-4d %-6s %12d\n", e.Pos, e.Length, e.Member, e.Role, e.Offset)
+	}
+	return nil
+}
+
+func drawLayout(args []string) error {
+	fs := flag.NewFlagSet("layout", flag.ExitOnError)
+	stripes := fs.Int("stripes", 8, "number of stripes to draw")
+	format := fs.String("format", "ascii", "output format: ascii, json or svg")
+	levelFlag := fs.String("level", "", "RAID level of an example array to draw instead of images")
+	numDisks := fs.Int("disks", 4, "number of disks of the example array")
+	stripe := fs.Int("stripe", 64*1024, "stripe size of the example array")
+	failFlag := fs.String("fail", "", "comma-separated members of the example array to fail")
+	fs.Parse(args)
+
+	var arr raid.Array
+	if *levelFlag != "" {
+		level, err := raid.ParseLevel(*levelFlag)
+		if err != nil {
+			return err
+		}
+		disks := make([]raid.Disk, *numDisks)
+		for i := range disks {
+			disks[i] = raid.NewMemDisk(0)
+		}
+		if arr, err = raid.New(level, disks, *stripe); err != nil {
+			return err
+		}
+		for _, f := range strings.FieldsFunc(*failFlag, func(r rune) bool { return r == ',' }) {
+			disk, err := strconv.Atoi(f)
+			if err != nil {
+				return fmt.Errorf("invalid disk %q", f)
+			}
+			if err := arr.Fail(disk); err != nil {
+				return err
+			}
+		}
+	} else {
+		var closeDisks func()
+		var err error
+		if arr, closeDisks, err = open(fs.Args()); err != nil {
+			return err
+		}
+		defer closeDisks()
+	}
+
+	l, err := layout.Build(arr, *stripes)
+	if err != nil {
+		return err
+	}
+	return l.Render(os.Stdout, *format)
+}
+
+func encrypt(args []string) error {
+	fs := flag.NewFlagSet("encrypt", flag.ExitOnError)
+	keyFile := fs.String("keyfile", "", "file whose contents are the key")
+	fs.Parse(args)
+
+	if *keyFile == "" {
+		return fmt.Errorf("encrypt needs -keyfile")
+	}
+	key, err := crypt.ReadKeyFile(*keyFile)
+	if err != nil {
+		return err
+	}
+	arr, closeDisks, err := open(fs.Args())
+	if err != nil {
+		return err
+	}
+	defer closeDisks()
+	v, err := crypt.Format(arr, key, nil)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("encrypted volume %s, %d bytes\n", v.UUID(), v.Size())
+	return arr.Flush()
+}
+
+func logicalVolumes(args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("lv needs one of create, list, resize and remove")
+	}
+	op := args[0]
+	fs := flag.NewFlagSet("lv "+op, flag.ExitOnError)
+	name := fs.String("name", "", "volume name")
+	sizeFlag := fs.String("size", "", "volume size")
+	thin := fs.Bool("thin", false, "allocate extents on first write")
+	extent := fs.Int("extent", volume.DefaultExtentSize, "extent size in bytes of a new volume group")
+	keyFile := fs.String("keyfile", "", "use the encrypted volume on the array, unlocked by this key file")
+	fs.Parse(args[1:])
+
+	var size int64
+	switch op {
+	case "create", "resize":
+		var err error
+		if size, err = parseSize(*sizeFlag); err != nil {
+			return err
+		}
+		fallthrough
+	case "remove":
+		if *name == "" {
+			return fmt.Errorf("lv %s needs -name", op)
+		}
+	case "list":
+	default:
+		return fmt.Errorf("unknown lv command %q", op)
+	}
+
+	arr, closeDisks, err := open(fs.Args())
+	if err != nil {
+		return err
+	}
+	defer closeDisks()
+	dev, _, err := unlock(arr, *keyFile)
+	if err != nil {
+		return err
+	}
+	g, err := volume.Open(dev)
+	if errors.Is(err, volume.ErrNoMetadata) && op == "create" {
+		g, err = volume.Format(dev, &volume.Options{ExtentSize: *extent})
+	}
+	if err != nil {
+		return err
+	}
+
+	switch op {
+	case "create":
+		_, err = g.Create(*name, size, *thin)
+	case "resize":
+		var v *volume.Volume
+		if v, err = g.Volume(*name); err == nil {
+			err = v.Resize(size)
+		}
+	case "remove":
+		err = g.Remove(*name)
+	case "list":
+		total, free := g.Extents()
+		fmt.Printf("extents: %d of %d bytes, %d free\n", total, g.ExtentSize(), free)
+		for _, info := range g.Volumes() {
+			kind := "thick"
+			if info.Thin {
+				kind = "thin"
+			}
+			fmt.Printf("  %-20s %-5s %12d bytes, %12d allocated\n", info.Name, kind, info.Size, info.Allocated)
+		}
+	}
+	if err != nil {
+		return err
+	}
+	return arr.Flush()
+}
+
+func fail(args []string) error {
+	fs := flag.NewFlagSet("fail", flag.ExitOnError)
+	disk := fs.Int("disk", -1, "index of the member to fail")
+	fs.Parse(args)
+
+	arr, closeDisks, err := open(fs.Args())
+	if err != nil {
+		return err
+	}
+	defer closeDisks()
+	if err := arr.Fail(*disk); err != nil {
+		return err
+	}
+	printStatus(arr.Status())
+	return nil
+}
+
+func replace(args []string) error {
+	fs := flag.NewFlagSet("replace", flag.ExitOnError)
+	disk := fs.Int("disk", -1, "index of the member to replace")
+	newPath := fs.String("new", "", "image of the new member, created if it does not exist")
+	fs.Parse(args)
+	if *newPath == "" {
+		return fmt.Errorf("-new is required")
+	}
+
+	arr, closeDisks, err := open(fs.Args())
+	if err != nil {
+		return err
+	}
+	defer closeDisks()
+
+	newDisk, err := raid.OpenFileDisk(*newPath)
+	if os.IsNotExist(err) {
+		// New images get the size of the existing ones.
+		var fi os.FileInfo
+		if fi, err = os.Stat(fs.Arg(0)); err == nil {
+			newDisk, err = raid.CreateFileDisk(*newPath, fi.Size())
+		}
+	}
+	if err != nil {
+		return err
+	}
+	defer newDisk.Close()
+	if err := arr.Replace(*disk, newDisk); err != nil {
+		return err
+	}
+	printStatus(arr.Status())
+	return nil
+}
+
+func rebuild(args []string) error {
+	fs := flag.NewFlagSet("rebuild", flag.ExitOnError)
+	disk := fs.Int("disk", -1, "index of the member to rebuild")
+	spare := fs.Bool("spare", false, "rebuild into the distributed spare space of a dRAID array only")
+	bg := addBackgroundFlags(fs)
+	fs.Parse(args)
+
+	arr, closeDisks, err := open(fs.Args())
+	if err != nil {
+		return err
+	}
+	defer closeDisks()
+	ctx, stop, err := bg.start(arr)
+	if err != nil {
+		return err
+	}
+	defer stop()
+	if *spare {
+		d, ok := arr.(*raid.Declustered)
+		if !ok {
+			return fmt.Errorf("%s arrays have no distributed spare space", arr.Level())
+		}
+		err = d.SpareContext(ctx, *disk)
+	} else {
+		err = arr.RebuildContext(ctx, *disk)
+	}
+	stop()
+	var progress *raid.ProgressError
+	if errors.As(err, &progress) {
+		printStatus(arr.Status())
+	}
+	if err != nil {
+		return err
+	}
+	printStatus(arr.Status())
+	return nil
+}
+
+// logEvents prints the events of arr to stderr until the returned function
+// is called.
+func logEvents(arr raid.Array) func() {
+	ch, unsubscribe := arr.Events().Subscribe(64)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for ev := range ch {
+			line := ev.Kind.String()
+			if ev.Disk >= 0 {
+				line += fmt.Sprintf(" disk %d", ev.Disk)
+			}
+			switch ev.Kind {
+			case raid.EventRebuildProgress:
+				line += fmt.Sprintf(": %d%%", ev.Done*100/ev.Total)
+			case raid.EventScrubMismatch:
+				line += fmt.Sprintf(": %d at offset %d", ev.Mismatches, ev.Offset)
+			case raid.EventBadBlock:
+				line += fmt.Sprintf(" at offset %d, remapped %v", ev.Offset, ev.Remapped)
+			}
+			if ev.Err != nil {
+				line += fmt.Sprintf(": %v", ev.Err)
+			}
+			fmt.Fprintln(os.Stderr, line)
+		}
+	}()
+	return func() {
+		unsubscribe()
+		<-done
+	}
+}
+
+// speedFlags are the speed limits of background work.
+type speedFlags struct {
+	minSpeed *string
+	maxSpeed *string
+}
+
+func addSpeedFlags(fs *flag.FlagSet) speedFlags {
+	return speedFlags{
+		minSpeed: fs.String("min-speed", "0", "bytes per second per member to keep up under foreground I/O"),
+		maxSpeed: fs.String("max-speed", "0", "bytes per second per member at most, 0 for no limit"),
+	}
+}
+
+func (f speedFlags) speed() (raid.SyncSpeed, error) {
+	var s raid.SyncSpeed
+	var err error
+	if s.Min, err = parseSize(*f.minSpeed); err != nil {
+		return s, err
+	}
+	s.Max, err = parseSize(*f.maxSpeed)
+	return s, err
+}
+
+// backgroundFlags are the flags of the commands that run background work.
+type backgroundFlags struct {
+	speedFlags
+	timeout *time.Duration
+	events  *bool
+}
+
+func addBackgroundFlags(fs *flag.FlagSet) *backgroundFlags {
+	return &backgroundFlags{
+		speedFlags: addSpeedFlags(fs),
+		timeout:    fs.Duration("timeout", 0, "stop after this long, 0 for no limit"),
+		events:     fs.Bool("events", false, "print array events as they happen"),
+	}
+}
+
+// start applies the speed limits to arr and starts printing its events if
+// asked. It returns the context to run the work in, and a function that
+// stops both, to call once the work is done.
+func (b *backgroundFlags) start(arr raid.Array) (context.Context, func(), error) {
+	speed, err := b.speed()
+	if err != nil {
+		return nil, nil, err
+	}
+	arr.SetSyncSpeed(speed)
+	stopEvents := func() {}
+	if *b.events {
+		stopEvents = logEvents(arr)
+	}
+	ctx, cancel := interruptible(*b.timeout)
+	return ctx, func() {
+		stopEvents()
+		cancel()
+	}, nil
+}
+
+// interruptible returns a context that is done on SIGINT or SIGTERM, or once
+// timeout has passed if it is positive.
+func interruptible(timeout time.Duration) (context.Context, context.CancelFunc) {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	if timeout <= 0 {
+		return ctx, stop
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	return ctx, func() {
+		cancel()
+		stop()
+	}
+}
+
+func scrub(args []string) error {
+	fs := flag.NewFlagSet("scrub", flag.ExitOnError)
+	repair := fs.Bool("repair", false, "rewrite inconsistent redundancy")
+	bg := addBackgroundFlags(fs)
+	fs.Parse(args)
+
+	arr, closeDisks, err := open(fs.Args())
+	if err != nil {
+		return err
+	}
+	defer closeDisks()
+	ctx, stop, err := bg.start(arr)
+	if err != nil {
+		return err
+	}
+	defer stop()
+	report, err := arr.ScrubContext(ctx, *repair)
+	stop()
+	var progress *raid.ProgressError
+	if err == nil || errors.As(err, &progress) {
+		fmt.Printf("checked %d bytes per member, %d mismatches, %d repaired\n",
+			report.Checked, report.Mismatches, report.Repaired)
+	}
+	return err
+}
+
+func patrol(args []string) error {
+	fs := flag.NewFlagSet("patrol", flag.ExitOnError)
+	bg := addBackgroundFlags(fs)
+	fs.Parse(args)
+
+	arr, closeDisks, err := open(fs.Args())
+	if err != nil {
+		return err
+	}
+	defer closeDisks()
+	ctx, stop, err := bg.start(arr)
+	if err != nil {
+		return err
+	}
+	defer stop()
+	report, err := arr.Patrol(ctx)
+	stop()
+	var progress *raid.ProgressError
+	if err == nil || errors.As(err, &progress) {
+		fmt.Printf("read %d bytes per member, %d new bad blocks\n", report.Checked, report.BadBlocks)
+	}
+	return err
+}
+
+func replay(args []string) error {
+	fs := flag.NewFlagSet("replay", flag.ExitOnError)
+	traceFile := fs.String("trace", "", "trace file to replay")
+	timed := fs.Bool("timed", false, "keep the pace of the recording")
+	fs.Parse(args)
+
+	f, err := os.Open(*traceFile)
+	if err != nil {
+		return err
+	}
+	tr, err := trace.Load(f)
+	f.Close()
+	if err != nil {
+		return err
+	}
+	arr, closeDisks, err := open(fs.Args())
+	if err != nil {
+		return err
+	}
+	defer closeDisks()
+	res, err := trace.Replay(tr, arr, trace.ReplayOptions{Timed: *timed, Digest: true})
+	if err != nil {
+		return err
+	}
+	if err := arr.Flush(); err != nil {
+		return err
+	}
+
+	fmt.Printf("%d calls in %v, recorded in %v\n", len(tr.Records), res.Elapsed.Round(time.Microsecond), res.Recorded.Round(time.Microsecond))
+	for op := trace.OpRead; op < trace.OpEnd; op++ {
+		if s := res.Stats[op]; s != nil {
+			fmt.Printf("  %-10s %6d calls %12d bytes  %12v recorded  %12v replayed\n",
+				op, s.Calls, s.Bytes, s.Recorded.Round(time.Microsecond), s.Replayed.Round(time.Microsecond))
+		}
+	}
+	fmt.Printf("contents: sha256 %s\n", res.Contents)
+	if res.ReadMismatches > 0 || res.ErrorMismatches > 0 {
+		return fmt.Errorf("%d reads returned other data and %d calls failed differently than recorded",
+			res.ReadMismatches, res.ErrorMismatches)
+	}
+	if res.RecordedContents != "" && res.Contents != res.RecordedContents {
+		return fmt.Errorf("contents differ from the recording, sha256 %s", res.RecordedContents)
+	}
+	return nil
+}
+
+func simulateReliability(args []string) error {
+	fs := flag.NewFlagSet("reliability", flag.ExitOnError)
+	diskSize := fs.String("disk-size", "4T", "size of every disk")
+	afr := fs.Float64("afr", 2, "annualized failure rate of a disk, in percent")
+	ure := fs.Float64("ure", 1e-15, "unrecoverable read errors per bit read")
+	diskRate := fs.String("disk-rate", "150M", "throughput of a disk per second, 0 for as fast as the code runs")
+	replaceDelay := fs.Duration("replace", 24*time.Hour, "how long a failed disk waits to be replaced")
+	maxSpeed := fs.String("max-speed", "0", "rebuild speed limit per member and second, 0 for none")
+	years := fs.Float64("years", 5, "time span to estimate the probability of data loss over")
+	trials := fs.Int("trials", 100000, "number of simulated arrays")
+	seed := fs.Int64("seed", 1, "seed of the simulation")
+	stripe := fs.Int("stripe", reliability.DefaultStripeSize, "stripe size of the arrays")
+	fs.Parse(args)
+	if fs.NArg() == 0 {
+		return errors.New("no configurations given")
+	}
+
+	p := reliability.Params{
+		AFR:          *afr / 100,
+		URE:          *ure,
+		ReplaceDelay: *replaceDelay,
+		Horizon:      time.Duration(*years * float64(reliability.Year)),
+		Trials:       *trials,
+		Seed:         *seed,
+	}
+	var err error
+	if p.DiskSize, err = parseSize(*diskSize); err != nil {
+		return err
+	}
+	if p.DiskRate, err = parseSize(*diskRate); err != nil {
+		return err
+	}
+	if p.Speed.Max, err = parseSize(*maxSpeed); err != nil {
+		return err
+	}
+
+	fmt.Printf("%-18s %9s %10s %9s %19s %9s %9s %11s\n",
+		"config", "capacity", "repair", "loss", "95% interval", "failures", "read err", "mean loss")
+	for _, arg := range fs.Args() {
+		c, err := reliability.ParseConfig(arg)
+		if err != nil {
+			return err
+		}
+		c.StripeSize = *stripe
+		m, err := reliability.Measure(c)
+		if err != nil {
+			return err
+		}
+		res, err := reliability.Simulate(m, p)
+		if err != nil {
+			return err
+		}
+		meanLoss := "-"
+		if res.Losses > 0 {
+			meanLoss = fmt.Sprintf("%.2fy", res.MeanTimeToLoss.Hours()/reliability.Year.Hours())
+		}
+		fmt.Printf("%-18s %9s %10s %8.4f%% %8.4f%% - %7.4f%% %9d %9d %11s\n",
+			c, formatSize(res.Capacity), res.RepairTime.Round(time.Minute),
+			100*res.Probability, 100*res.Low, 100*res.High, res.FailureLosses, res.URELosses, meanLoss)
+	}
+	return nil
+}
+
+func serveNBD(args []string) error {
+	fs := flag.NewFlagSet("nbd", flag.ExitOnError)
+	listen := fs.String("listen", "127.0.0.1:10809", "TCP address, or unix:<path> for a Unix socket")
+	name := fs.String("name", "raid", "export name")
+	readOnly := fs.Bool("readonly", false, "refuse writes and trims")
+	cacheSize := fs.Int("cache", 0, "number of stripes to cache, 0 for none")
+	writeThrough := fs.Bool("writethrough", false, "write to the members before acknowledging writes")
+	keyFile := fs.String("keyfile", "", "serve the encrypted volume on the array, unlocked by this key file")
+	volumeName := fs.String("volume", "", "serve this logical volume")
+	patrolEvery := fs.Duration("patrol", 0, "run a patrol read this often while serving, 0 for never")
+	speedLimits := addSpeedFlags(fs)
+	traceFile := fs.String("trace", "", "record the calls of the clients to this trace file")
+	traceData := fs.Bool("trace-data", false, "record the data written along with the calls")
+	fs.Parse(args)
+
+	arr, closeDisks, err := open(fs.Args())
+	if err != nil {
+		return err
+	}
+	defer closeDisks()
+	if *patrolEvery > 0 {
+		speed, err := speedLimits.speed()
+		if err != nil {
+			return err
+		}
+		sched := raid.NewScheduler(arr, raid.SchedulerConfig{Speed: speed, PatrolInterval: *patrolEvery})
+		defer sched.Close()
+	}
+	if *cacheSize > 0 {
+		mode := raid.WriteBack
+		if *writeThrough {
+			mode = raid.WriteThrough
+		}
+		if arr, err = raid.NewStripeCache(arr, *cacheSize, mode); err != nil {
+			return err
+		}
+	}
+
+	network, addr := "tcp", *listen
+	if path, ok := strings.CutPrefix(*listen, "unix:"); ok {
+		network, addr = "unix", path
+	}
+	dev, size, err := unlock(arr, *keyFile)
+	if err != nil {
+		return err
+	}
+	if *volumeName != "" {
+		g, err := volume.Open(dev)
+		if err != nil {
+			return err
+		}
+		v, err := g.Volume(*volumeName)
+		if err != nil {
+			return err
+		}
+		dev, size = v, v.Size()
+	}
+	if *traceFile != "" {
+		f, err := os.Create(*traceFile)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		rec, err := trace.NewRecorder(dev, f, trace.Options{Hash: true, Data: *traceData})
+		if err != nil {
+			return err
+		}
+		defer rec.Close()
+		dev = rec
+	}
+	export := &nbd.Export{Name: *name, Device: dev, Size: size, ReadOnly: *readOnly}
+	l, err := net.Listen(network, addr)
+	if err != nil {
+		return err
+	}
+	srv := nbd.NewServer(export)
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-sig
+		srv.Close()
+	}()
+	log.Printf("serving %s (%d bytes) as %q on %s %s", arr.Level(), export.Size, *name, network, addr)
+	if err := srv.Serve(l); err != nil {
+		return err
+	}
+	return arr.Flush()
+}
+
+func serveHTTP(args []string) error {
+	fs := flag.NewFlagSet("http", flag.ExitOnError)
+	listen := fs.String("listen", "127.0.0.1:8080", "address to listen on")
+	dir := fs.String("dir", ".", "directory for the images of new members")
+	name := fs.String("name", "raid", "name of the array given on the command line")
+	maxDisks := fs.Int("max-disks", httpapi.DefaultLimits.Disks, "most members of a new array")
+	maxDiskSize := fs.String("max-disk-size", "1G", "largest member of a new array")
+	maxArrays := fs.Int("max-arrays", httpapi.DefaultLimits.Arrays, "most arrays served")
+	maxTotalSize := fs.String("max-total-size", "4G", "most space the members of new arrays take together")
+	fs.Parse(args)
+
+	srv := httpapi.NewServer(func(array string, index int, size int64) (raid.Disk, error) {
+		path := filepath.Join(*dir, fmt.Sprintf("%s-%d-%d.img", array, index, time.Now().UnixNano()))
+		return raid.CreateFileDisk(path, size)
+	})
+	srv.Limits.Disks = *maxDisks
+	srv.Limits.Arrays = *maxArrays
+	var err error
+	if srv.Limits.DiskSize, err = parseSize(*maxDiskSize); err != nil {
+		return err
+	}
+	if srv.Limits.TotalSize, err = parseSize(*maxTotalSize); err != nil {
+		return err
+	}
+	if fs.NArg() > 0 {
+		arr, closeDisks, err := open(fs.Args())
+		if err != nil {
+			return err
+		}
+		defer closeDisks()
+		srv.Add(*name, arr)
+	}
+	hs := &http.Server{Addr: *listen, Handler: srv}
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-sig
+		hs.Shutdown(context.Background())
+	}()
+	log.Printf("serving the HTTP API on %s", *listen)
+	if err := hs.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	// Stop the rebuilds before their disks are closed.
+	srv.Close()
+	return nil
+}
+
+// unlock returns the encrypted volume on arr and its size if keyFile is
+// given, and arr itself otherwise.
+func unlock(arr raid.Array, keyFile string) (raid.RAID, int64, error) {
+	if keyFile == "" {
+		return arr, arr.Status().Size, nil
+	}
+	key, err := crypt.ReadKeyFile(keyFile)
+	if err != nil {
+		return nil, 0, err
+	}
+	v, err := crypt.Open(arr, key)
+	if err != nil {
+		return nil, 0, err
+	}
+	return v, v.Size(), nil
+}
+
+// open assembles the array from its member images.
+func open(paths []string) (raid.Array, func(), error) {
+	if len(paths) == 0 {
+		return nil, nil, fmt.Errorf("no member images given")
+	}
+	var files []*raid.FileDisk
+	closeDisks := func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}
+	disks := make([]raid.Disk, 0, len(paths))
+	for _, path := range paths {
+		f, err := raid.OpenFileDisk(path)
+		if err != nil {
+			closeDisks()
+			return nil, nil, err
+		}
+		files = append(files, f)
+		disks = append(disks, f)
+	}
+	arr, err := raid.Assemble(disks)
+	if err != nil {
+		closeDisks()
+		return nil, nil, err
+	}
+	return arr, closeDisks, nil
+}
+
+func printStatus(s raid.Status) {
+	fmt.Printf("UUID:   %s\n", s.UUID)
+	fmt.Printf("Level:  %s\n", s.Level)
+	if s.Level != raid.Level1 && s.Level != raid.LevelLinear {
+		fmt.Printf("Stripe: %d\n", s.StripeSize)
+	}
+	fmt.Printf("Size:   %d\n", s.Size)
+	state := "clean"
+	if s.Degraded() {
+		state = "degraded"
+	}
+	fmt.Printf("State:  %s\n", state)
+	for _, m := range s.Members {
+		line := fmt.Sprintf("  disk %d  %-10s %s", m.Index, m.State, m.Name)
+		if m.State == raid.DiskRebuilding && m.Size > 0 {
+			line += fmt.Sprintf("  (%d%%)", min(m.Recovered*100/m.Size, 100))
+		}
+		if m.BadBlocks > 0 {
+			line += fmt.Sprintf("  %d bad blocks, %d remapped", m.BadBlocks, m.Remapped)
+		}
+		fmt.Println(line)
+	}
+}
+
+func parseSize(s string) (int64, error) {
+	mult := int64(1)
+	switch {
+	case strings.HasSuffix(s, "K"):
+		mult = 1 << 10
+	case strings.HasSuffix(s, "M"):
+		mult = 1 << 20
+	case strings.HasSuffix(s, "G"):
+		mult = 1 << 30
+	case strings.HasSuffix(s, "T"):
+		mult = 1 << 40
+	}
+	if mult > 1 {
+		s = s[:len(s)-1]
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return n * mult, nil
+}
+
+// formatSize is the inverse of parseSize, rounded to one decimal.
+func formatSize(n int64) string {
+	for _, unit := range []struct {
+		suffix string
+		size   int64
+	}{{"T", 1 << 40}, {"G", 1 << 30}, {"M", 1 << 20}, {"K", 1 << 10}} {
+		if n >= unit.size {
+			return fmt.Sprintf("%.1f%s", float64(n)/float64(unit.size), unit.suffix)
+		}
+	}
+	return strconv.FormatInt(n, 10)
+}